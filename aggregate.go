@@ -0,0 +1,163 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// Process and measurement noise of the rssi Kalman filter, dBm squared
+	KALMAN_PROCESS_NOISE     = 0.125
+	KALMAN_MEASUREMENT_NOISE = 4.0
+	// Filters of beacons not seen for this many windows start over
+	AGGREGATE_KALMAN_WINDOWS = 10
+)
+
+// rssiKalman is a one dimensional Kalman filter of the rssi of a beacon
+type rssiKalman struct {
+	estimate float64
+	variance float64
+	// Windows since the beacon was last seen
+	idle int
+}
+
+// update adds a measurement and returns the new estimate
+func (k *rssiKalman) update(rssi float64) float64 {
+	if k.variance == 0 {
+		k.estimate, k.variance = rssi, KALMAN_MEASUREMENT_NOISE
+		return k.estimate
+	}
+	k.variance += KALMAN_PROCESS_NOISE
+	gain := k.variance / (k.variance + KALMAN_MEASUREMENT_NOISE)
+	k.estimate += gain * (rssi - k.estimate)
+	k.variance *= 1 - gain
+	return k.estimate
+}
+
+// aggregateRecord is the aggregate of a beacon over one window
+type aggregateRecord struct {
+	BeaconData
+	BeaconAggregate
+}
+
+// aggregateRecords summarises the records of each beacon from brs over
+// every window, with the rssi Kalman filtered if kalman is set. Records
+// with telemetry are also passed on to tlms as it isn't aggregated.
+func aggregateRecords(brs <-chan BeaconRecord, aggs chan<- aggregateRecord,
+	tlms chan<- BeaconRecord, window time.Duration, kalman bool) {
+	ticker := time.NewTicker(window)
+	start := time.Now()
+	samples := make(map[BeaconData][]int16)
+	txpowers := make(map[BeaconData]int8)
+	filters := make(map[BeaconData]*rssiKalman)
+	for {
+		select {
+		case br := <-brs:
+			if br.Telemetry != nil {
+				tlms <- br
+			}
+			samples[br.BeaconData] = append(samples[br.BeaconData], br.Rssi)
+			if br.TxPower != 0 {
+				txpowers[br.BeaconData] = br.TxPower
+			}
+			if kalman {
+				filter, ok := filters[br.BeaconData]
+				if !ok {
+					filter = new(rssiKalman)
+					filters[br.BeaconData] = filter
+				}
+				filter.update(float64(br.Rssi))
+				filter.idle = 0
+			}
+		case now := <-ticker.C:
+			for b, rssis := range samples {
+				agg := summariseRssi(rssis)
+				agg.Start, agg.Window = start, now.Sub(start)
+				agg.TxPower = txpowers[b]
+				if filter, ok := filters[b]; ok {
+					agg.Filtered, agg.Kalman = true, filter.estimate
+				}
+				aggs <- aggregateRecord{b, agg}
+			}
+			for b, filter := range filters {
+				if _, ok := samples[b]; !ok {
+					if filter.idle++; filter.idle >= AGGREGATE_KALMAN_WINDOWS {
+						delete(filters, b)
+					}
+				}
+			}
+			samples = make(map[BeaconData][]int16)
+			txpowers = make(map[BeaconData]int8)
+			start = now
+		}
+	}
+}
+
+// summariseRssi returns the statistics of rssis, it must not be empty
+func summariseRssi(rssis []int16) BeaconAggregate {
+	sorted := make([]int, len(rssis))
+	sum := 0
+	for i, r := range rssis {
+		sorted[i] = int(r)
+		sum += int(r)
+	}
+	sort.Ints(sorted)
+	n := len(sorted)
+	median := float64(sorted[n/2])
+	if n%2 == 0 {
+		median = float64(sorted[n/2-1]+sorted[n/2]) / 2
+	}
+	return BeaconAggregate{
+		Count:  uint32(n),
+		Min:    int16(sorted[0]),
+		Max:    int16(sorted[n-1]),
+		Mean:   float64(sum) / float64(n),
+		Median: median,
+	}
+}
+
+// Rssi returns the filtered rssi of the window if there is one, otherwise
+// the mean
+func (a *BeaconAggregate) Rssi() float64 {
+	if a.Filtered {
+		return a.Kalman
+	}
+	return a.Mean
+}
+
+// Time returns the middle of the window
+func (a *BeaconAggregate) Time() time.Time {
+	return a.Start.Add(a.Window / 2)
+}
+
+// aggregatesToLogs replaces the aggregates of the packet with a log per
+// window for version 1 servers
+func aggregatesToLogs(datapacket *BeaconLogPacket) {
+	for _, a := range datapacket.Aggregates {
+		datapacket.Logs = append(datapacket.Logs, BeaconLog{
+			Datetime:    a.Time(),
+			Rssi:        int16(math.Round(a.Rssi())),
+			BeaconIndex: a.BeaconIndex,
+			TxPower:     a.TxPower,
+		})
+	}
+	datapacket.Aggregates = nil
+	datapacket.Ext &^= EXT_AGGREGATE
+}
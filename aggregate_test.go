@@ -0,0 +1,82 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSummariseRssi(t *testing.T) {
+	agg := summariseRssi([]int16{-70, -60, -80, -66})
+	if agg.Count != 4 || agg.Min != -80 || agg.Max != -60 || agg.Mean != -69 || agg.Median != -68 {
+		t.Fatalf("Aggregate was %+v", agg)
+	}
+	if agg = summariseRssi([]int16{-50}); agg.Median != -50 || agg.Mean != -50 {
+		t.Fatalf("Aggregate was %+v", agg)
+	}
+
+	var k rssiKalman
+	for i := 0; i < 200; i++ {
+		// Alternating noise around -65
+		k.update(-65 + float64(4*(i%2)-2))
+	}
+	if math.Abs(k.estimate+65) > 1 {
+		t.Fatalf("Kalman estimate %f is far from -65", k.estimate)
+	}
+}
+
+func TestAggregatePacket(t *testing.T) {
+	start := time.Unix(1500000000, 123000)
+	blp := BeaconLogPacket{
+		Flags:   2,
+		Ext:     EXT_AGGREGATE | EXT_TX_POWER,
+		Beacons: []BeaconData{{Major: 1}, {Major: 2, Type: BEACON_EDDYSTONE_UID}},
+		Aggregates: []BeaconAggregate{
+			{Start: start, Window: time.Second, BeaconIndex: 1, Count: 10, Min: -90,
+				Max: -60, Mean: -71.25, Median: -70.5, TxPower: -59},
+			{Start: start.Add(time.Second), Window: time.Second, BeaconIndex: 0,
+				Count: 3, Min: -70, Max: -68, Mean: -69, Median: -69, Filtered: true,
+				Kalman: -68.5},
+		},
+	}
+	bin, err := blp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tar BeaconLogPacket
+	if err = tar.UnmarshalBinary(bin); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tar.Aggregates, blp.Aggregates) {
+		t.Fatalf("Aggregates were %+v", tar.Aggregates)
+	}
+
+	// Version 1 servers get a log per window
+	aggregatesToLogs(&tar)
+	tar.Flags = 1
+	if _, err = tar.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tar.Logs) != 2 || tar.Logs[0].Rssi != -71 || tar.Logs[1].Rssi != -69 ||
+		tar.Logs[0].TxPower != -59 ||
+		!tar.Logs[1].Datetime.Equal(start.Add(1500*time.Millisecond)) {
+		t.Fatalf("Logs were %+v", tar.Logs)
+	}
+}
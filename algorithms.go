@@ -0,0 +1,118 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// metricsserv builds cause problems with other binaries due to inclusion
+// of packages that require python3
+// +build metrics
+
+package beaconpi
+
+import (
+	"github.com/pkg/errors"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// AlgorithmParameter is a tunable of a localization algorithm, the
+// algorithm finds its value in FilteredMapLocationRequest.Parameters
+type AlgorithmParameter struct {
+	Name        string
+	Description string
+	Default     float64
+	Min         float64
+	Max         float64
+	// Integer parameters must be whole numbers
+	Integer bool
+}
+
+// LocalizationAlgorithm is an algorithm registered for map tracking
+type LocalizationAlgorithm struct {
+	Name        string
+	Description string
+	Parameters  []AlgorithmParameter
+	run         filterFunction
+}
+
+// localizationAlgorithms are the registered algorithms by name, they are
+// registered by init functions so it is not locked
+var localizationAlgorithms = make(map[string]*LocalizationAlgorithm)
+
+// registerAlgorithm makes run available for map tracking as name, it
+// panics if name is taken
+func registerAlgorithm(name, description string, run filterFunction,
+	params ...AlgorithmParameter) {
+	if _, ok := localizationAlgorithms[name]; ok {
+		panic("Localization algorithm registered twice: " + name)
+	}
+	localizationAlgorithms[name] = &LocalizationAlgorithm{
+		Name:        name,
+		Description: description,
+		Parameters:  params,
+		run:         run,
+	}
+}
+
+// localizationAlgorithm returns the algorithm called name, nil if there is
+// none
+func localizationAlgorithm(name string) *LocalizationAlgorithm {
+	return localizationAlgorithms[name]
+}
+
+// resolveParameters returns the parameters of the algorithm with those not
+// given set to their defaults, an error is returned for unknown or
+// invalid parameters
+func (a *LocalizationAlgorithm) resolveParameters(given map[string]float64) (map[string]float64, error) {
+	res := make(map[string]float64, len(a.Parameters))
+	for _, p := range a.Parameters {
+		v, ok := given[p.Name]
+		if !ok {
+			res[p.Name] = p.Default
+			continue
+		}
+		if v < p.Min || v > p.Max || math.IsNaN(v) {
+			return nil, errors.Errorf("Parameter %s of %s must be between %g and %g",
+				p.Name, a.Name, p.Min, p.Max)
+		}
+		if p.Integer && v != math.Trunc(v) {
+			return nil, errors.Errorf("Parameter %s of %s must be a whole number",
+				p.Name, a.Name)
+		}
+		res[p.Name] = v
+	}
+	for name := range given {
+		if _, ok := res[name]; !ok {
+			return nil, errors.Errorf("Algorithm %s has no parameter %s", a.Name, name)
+		}
+	}
+	return res, nil
+}
+
+// allAlgorithms returns the registered algorithms and their parameters
+func allAlgorithms() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		algos := make([]*LocalizationAlgorithm, 0, len(localizationAlgorithms))
+		for _, a := range localizationAlgorithms {
+			algos = append(algos, a)
+		}
+		sort.Slice(algos, func(i, j int) bool {
+			return algos[i].Name < algos[j].Name
+		})
+		jsonResponse(w, map[string]interface{}{
+			"Algorithms": algos,
+		})
+	})
+}
@@ -0,0 +1,116 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// metricsserv builds cause problems with other binaries due to inclusion
+// of packages that require python3
+// +build metrics
+
+package beaconpi
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResolveParameters(t *testing.T) {
+	algo := &LocalizationAlgorithm{
+		Name: "test",
+		Parameters: []AlgorithmParameter{
+			{Name: "Count", Default: 10, Min: 1, Max: 100, Integer: true},
+			{Name: "Scale", Default: 0.5, Min: -1, Max: 1},
+		},
+	}
+	for _, c := range []struct {
+		given map[string]float64
+		want  map[string]float64
+	}{
+		{nil, map[string]float64{"Count": 10, "Scale": 0.5}},
+		{map[string]float64{"Count": 1}, map[string]float64{"Count": 1, "Scale": 0.5}},
+		{map[string]float64{"Count": 100, "Scale": -1}, map[string]float64{"Count": 100, "Scale": -1}},
+		{map[string]float64{"Scale": 0.25}, map[string]float64{"Count": 10, "Scale": 0.25}},
+	} {
+		got, err := algo.resolveParameters(c.given)
+		if err != nil {
+			t.Errorf("%v failed: %s", c.given, err)
+			continue
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%v resolved to %v", c.given, got)
+		}
+		for name, v := range c.want {
+			if got[name] != v {
+				t.Errorf("%v resolved to %v", c.given, got)
+			}
+		}
+	}
+	for _, given := range []map[string]float64{
+		{"Count": 0},
+		{"Count": 101},
+		{"Count": 2.5},
+		{"Count": math.NaN()},
+		{"Scale": math.NaN()},
+		{"Scale": math.Inf(1)},
+		{"Scale": -1.5},
+		{"Unknown": 1},
+		{"count": 10},
+	} {
+		if got, err := algo.resolveParameters(given); err == nil {
+			t.Errorf("%v resolved to %v", given, got)
+		}
+	}
+}
+
+func TestLocalizationAlgorithm(t *testing.T) {
+	for _, name := range []string{"", "unknown", "Trilateration"} {
+		if a := localizationAlgorithm(name); a != nil {
+			t.Errorf("Algorithm %q was found", name)
+		}
+	}
+	a := localizationAlgorithm("trilateration")
+	if a == nil || a.run == nil {
+		t.Fatal("Trilateration is not registered")
+	}
+	// Algorithms without parameters take none
+	if _, err := a.resolveParameters(map[string]float64{"Particles": 100}); err == nil {
+		t.Error("Parameter of another algorithm was accepted")
+	}
+}
+
+func TestFilteredMapLocationInvalid(t *testing.T) {
+	// The database can't be opened so requests that get that far fail with 500
+	handler := filteredMapLocation(MetricsParameters{DriverName: "none"})
+	for body, want := range map[string]int{
+		`{"MapID": 1, "Algorithm": "unknown"}`:                                    400,
+		`{"MapID": 1}`:                                                            400,
+		`{"MapID": 1, "Algorithm": "trilateration", "Parameters": {"Height": 1}}`: 400,
+		`{"MapID": 1, "Algorithm": "particle-filter-velocity",
+			"Parameters": {"Particles": 10.5}}`: 400,
+		`{"MapID": 1, "Algorithm": "particle-filter-velocity",
+			"Parameters": {"Particles": NaN}}`: 400,
+		`{"MapID": 1, "Algorithm": "trilateration"}`: 500,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/history/maptracking",
+			strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s was answered with %d expected %d", body, rec.Code, want)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"context"
+	"database/sql"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	// Channel notified by the trigger on ibeacons, see mig_0006.sql. Each
+	// change is also recorded in ibeacons_changes, see mig_0010.sql. Site
+	// assignments and discovery mode notify it too, see mig_0011.sql and
+	// mig_0012.sql
+	BEACONS_CHANGED_CHANNEL = "ibeacons_changed"
+	LISTENER_MIN_RECONNECT  = 10 * time.Second
+	LISTENER_MAX_RECONNECT  = time.Minute
+	LISTENER_PING           = 90 * time.Second
+)
+
+// beaconCache maps beacons to their id in ibeacons. The whole table is
+// loaded on the first lookup and dropped whenever ibeacons changes.
+type beaconCache struct {
+	sync.RWMutex
+	// nil until loaded
+	set *beaconSet
+	// Diffs to the version of set by the version they start from
+	diffs map[uint64]*BeaconDiff
+}
+
+// beaconSet is ibeacons and the sites of beacons and edges at a version
+type beaconSet struct {
+	ids map[BeaconData]int
+	// The newest row of ibeacons_changes
+	version uint64
+	// Sites by beacon id and edge uuid, beacons and edges without sites
+	// are not in them
+	beaconSites map[int][]int
+	edgeSites   map[Uuid][]int
+	// Edges in discovery mode
+	discovery map[Uuid]bool
+}
+
+// watches returns if the edge should be sent the beacon with id, that is
+// either has no sites or they share one
+func (s *beaconSet) watches(edge Uuid, id int) bool {
+	esites, bsites := s.edgeSites[edge], s.beaconSites[id]
+	if len(esites) == 0 || len(bsites) == 0 {
+		return true
+	}
+	for _, e := range esites {
+		for _, b := range bsites {
+			if e == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forEdge returns the beacons the edge should watch
+func (s *beaconSet) forEdge(edge Uuid) []BeaconData {
+	rval := make([]BeaconData, 0, len(s.ids))
+	for b, id := range s.ids {
+		if s.watches(edge, id) {
+			rval = append(rval, b)
+		}
+	}
+	return rval
+}
+
+// beacons is the cache used by the beacon server
+var beacons = new(beaconCache)
+
+// lookup returns the id of each beacon, unknown beacons are 0
+func (c *beaconCache) lookup(bs []BeaconData, db *sql.DB) ([]int, error) {
+	set, err := c.get(db)
+	if err != nil {
+		return nil, err
+	}
+	rval := make([]int, len(bs))
+	for i, b := range bs {
+		rval[i] = set.ids[b]
+	}
+	return rval, nil
+}
+
+// get returns the cached beacon set, loading it if needed
+func (c *beaconCache) get(db *sql.DB) (*beaconSet, error) {
+	c.RLock()
+	set := c.set
+	c.RUnlock()
+	if set != nil {
+		return set, nil
+	}
+	return c.load(db)
+}
+
+// load reads ibeacons and the sites into the cache
+func (c *beaconCache) load(db *sql.DB) (*beaconSet, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.set != nil {
+		return c.set, nil
+	}
+	// The version has to match the rows read
+	tx, err := db.BeginTx(context.Background(),
+		&sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to begin reading beacon ids")
+	}
+	defer tx.Rollback()
+	set := &beaconSet{
+		ids:         make(map[BeaconData]int),
+		beaconSites: make(map[int][]int),
+		edgeSites:   make(map[Uuid][]int),
+		discovery:   make(map[Uuid]bool),
+	}
+	err = tx.QueryRow(`select coalesce(max(id), 0) from ibeacons_changes`).Scan(&set.version)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query beacon set version")
+	}
+	rows, err := tx.Query(`
+		select id, uuid, major, minor, beacontype
+		from ibeacons`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query beacon ids")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var uuid string
+		var b BeaconData
+		if err = rows.Scan(&id, &uuid, &b.Major, &b.Minor, &b.Type); err != nil {
+			return nil, errors.Wrap(err, "Failed while scanning beacon ids")
+		}
+		if b.Uuid, err = UuidFromString(uuid); err != nil {
+			return nil, errors.Wrap(err, "Invalid uuid in ibeacons")
+		}
+		set.ids[b] = id
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed while reading beacon ids")
+	}
+	rows.Close()
+
+	rows, err = tx.Query(`select beaconid, siteid from beacon_sites`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query beacon sites")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, site int
+		if err = rows.Scan(&id, &site); err != nil {
+			return nil, errors.Wrap(err, "Failed while scanning beacon sites")
+		}
+		set.beaconSites[id] = append(set.beaconSites[id], site)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed while reading beacon sites")
+	}
+	rows.Close()
+
+	rows, err = tx.Query(`
+		select e.uuid, s.siteid
+		from edge_sites as s join edge_node as e on e.id = s.edgenodeid`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query edge sites")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uuid string
+		var site int
+		if err = rows.Scan(&uuid, &site); err != nil {
+			return nil, errors.Wrap(err, "Failed while scanning edge sites")
+		}
+		edge, err := UuidFromString(uuid)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid uuid in edge_node")
+		}
+		set.edgeSites[edge] = append(set.edgeSites[edge], site)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed while reading edge sites")
+	}
+	rows, err = tx.Query(`select uuid from edge_node where discovery`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query edges in discovery")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uuid string
+		if err = rows.Scan(&uuid); err != nil {
+			return nil, errors.Wrap(err, "Failed while scanning edges in discovery")
+		}
+		edge, err := UuidFromString(uuid)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid uuid in edge_node")
+		}
+		set.discovery[edge] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed while reading edges in discovery")
+	}
+	log.Debugf("Loaded %d beacon ids at version %d", len(set.ids), set.version)
+	c.set = set
+	c.diffs = make(map[uint64]*BeaconDiff)
+	return set, nil
+}
+
+// diff returns the changes to the beacons watched by edge since version
+// from, nil if from is the current version. Clients that are too far
+// behind or ahead, such as after the table was truncated or the sites
+// changed, get their whole set.
+func (c *beaconCache) diff(edge Uuid, from uint64, db *sql.DB) (*BeaconDiff, error) {
+	set, err := c.get(db)
+	if err != nil {
+		return nil, err
+	}
+	if from == set.version {
+		return nil, nil
+	}
+	c.RLock()
+	d, ok := c.diffs[from]
+	c.RUnlock()
+	if !ok || d.Version != set.version {
+		d = &BeaconDiff{From: from, Version: set.version}
+		d.Full = from == 0 || from > set.version
+		if !d.Full {
+			if d.Full, err = c.loadDiff(d, db); err != nil {
+				return nil, err
+			}
+		}
+		c.Lock()
+		// Only cache diffs to the version still cached
+		if c.set == set {
+			c.diffs[from] = d
+		}
+		c.Unlock()
+	}
+
+	// Cached diffs are of every beacon, removing ones the edge does not
+	// have is harmless
+	rval := &BeaconDiff{From: d.From, Version: d.Version, Full: d.Full, Removed: d.Removed}
+	if d.Full {
+		rval.Added = set.forEdge(edge)
+		return rval, nil
+	}
+	for _, b := range d.Added {
+		if set.watches(edge, set.ids[b]) {
+			rval.Added = append(rval.Added, b)
+		}
+	}
+	return rval, nil
+}
+
+// loadDiff reads the changes from d.From to d.Version into d, full is true
+// if they are not all recorded
+func (c *beaconCache) loadDiff(d *BeaconDiff, db *sql.DB) (full bool, err error) {
+	err = db.QueryRow(`
+		select coalesce(min(id), 1) > $1 + 1 or
+			exists (select 1 from ibeacons_changes
+				where id > $1 and id <= $2 and added is null)
+		from ibeacons_changes`, d.From, d.Version).Scan(&full)
+	if err != nil || full {
+		return full, errors.Wrap(err, "Failed to check beacon changes")
+	}
+	// The last change of each beacon is its state at d.Version
+	rows, err := db.Query(`
+		select distinct on (uuid, major, minor, beacontype)
+			uuid, major, minor, beacontype, added
+		from ibeacons_changes
+		where id > $1 and id <= $2
+		order by uuid, major, minor, beacontype, id desc`, d.From, d.Version)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to query beacon changes")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uuid string
+		var b BeaconData
+		var added bool
+		if err = rows.Scan(&uuid, &b.Major, &b.Minor, &b.Type, &added); err != nil {
+			return false, errors.Wrap(err, "Failed while scanning beacon changes")
+		}
+		if b.Uuid, err = UuidFromString(uuid); err != nil {
+			return false, errors.Wrap(err, "Invalid uuid in ibeacons_changes")
+		}
+		if added {
+			d.Added = append(d.Added, b)
+		} else {
+			d.Removed = append(d.Removed, b)
+		}
+	}
+	return false, errors.Wrap(rows.Err(), "Failed while reading beacon changes")
+}
+
+// invalidate drops the cache so the next lookup reloads it
+func (c *beaconCache) invalidate() {
+	c.Lock()
+	c.set = nil
+	c.diffs = nil
+	c.Unlock()
+}
+
+// listen invalidates the cache when ibeacons changes, changes missed
+// while the listener reconnects also invalidate it
+func (c *beaconCache) listen(drivername, dsn string) {
+	listener := pq.NewListener(dsn, LISTENER_MIN_RECONNECT, LISTENER_MAX_RECONNECT,
+		func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Warnf("Beacon change listener: %s", err)
+			}
+			if ev == pq.ListenerEventReconnected {
+				c.invalidate()
+			}
+		})
+	if err := listener.Listen(BEACONS_CHANGED_CHANNEL); err != nil {
+		log.Errorf("Failed to listen for beacon changes: %s", err)
+	}
+	for {
+		select {
+		case _ = <-listener.Notify:
+			log.Debug("Beacons changed, invalidating cache")
+			c.invalidate()
+		case _ = <-time.After(LISTENER_PING):
+			go listener.Ping()
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"testing"
+)
+
+func TestBeaconSetWatches(t *testing.T) {
+	north, south := Uuid{1}, Uuid{2}
+	everywhere := Uuid{3}
+	set := &beaconSet{
+		ids: map[BeaconData]int{
+			{Major: 1}: 1,
+			{Major: 2}: 2,
+			{Major: 3}: 3,
+		},
+		// Beacon 3 has no site so every edge watches it
+		beaconSites: map[int][]int{1: {10}, 2: {20, 30}},
+		edgeSites:   map[Uuid][]int{north: {10}, south: {30}},
+	}
+	cases := []struct {
+		edge Uuid
+		want map[int]bool
+	}{
+		{north, map[int]bool{1: true, 2: false, 3: true}},
+		{south, map[int]bool{1: false, 2: true, 3: true}},
+		{everywhere, map[int]bool{1: true, 2: true, 3: true}},
+	}
+	for _, c := range cases {
+		for id, want := range c.want {
+			if got := set.watches(c.edge, id); got != want {
+				t.Errorf("Edge %s beacon %d watched %v", c.edge, id, got)
+			}
+		}
+		if n := len(set.forEdge(c.edge)); n != len(set.ids)-1 && c.edge != everywhere {
+			t.Errorf("Edge %s watches %d beacons", c.edge, n)
+		}
+	}
+}
@@ -22,58 +22,287 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"github.com/pkg/errors"
+	"io"
 	"log"
+	"os"
 	"os/exec"
 	"time"
 )
 
+const (
+	// HCI packet type indicators, the first byte of every packet read from
+	// a raw HCI socket
+	HCI_COMMAND_PKT = 0x01
+	HCI_EVENT_PKT   = 0x04
+
+	// HCI events that are of interest to the scanner
+	EVT_CMD_COMPLETE = 0x0E
+	EVT_CMD_STATUS   = 0x0F
+	EVT_LE_META      = 0x3E
+	// LE Meta subevent for advertising reports
+	EVT_LE_ADVERTISING_REPORT = 0x02
+
+	// Delay before a failed scanner is reopened
+	SCANNER_RETRY = 5 * time.Second
+)
+
+// bleAdvertisement is a single LE Advertising Report decoded from an HCI
+// event
+type bleAdvertisement struct {
+	EventType   uint8
+	AddressType uint8
+	// Address of the advertiser as it was sent by the controller, which is
+	// little endian
+	Address [6]byte
+	// Data holds the advertising data (AD) structures
+	Data []byte
+	Rssi int8
+}
+
+// bleScanner is a source of raw HCI event packets. Each packet starts with
+// the HCI packet type indicator exactly as it is read from a raw HCI socket
+type bleScanner interface {
+	// Scan blocks while sending packets to events, it returns nil once the
+	// source is exhausted or an error if it failed
+	Scan(events chan<- []byte) error
+	// Close stops the scanner and releases its resources
+	Close() error
+}
+
 // produceBLEAdv is run on the edge node to produce ble advertisements
-// that are detected by the device and pass them through in binary to bleadv
-func produceBLEAdv(bleadv chan *bytes.Buffer) {
+// that are detected by the device and pass them through decoded to bleadv.
+// The error from the scanner is returned once it stops.
+func produceBLEAdv(scanner bleScanner, bleadv chan *bleAdvertisement) error {
+	events := make(chan []byte, 128)
+	done := make(chan error, 1)
+	go func() {
+		done <- scanner.Scan(events)
+		close(events)
+	}()
+
+	for pkt := range events {
+		advs, err := decodeLEAdvertisingReports(pkt)
+		if err != nil {
+			log.Printf("Failed to decode HCI event: %s", err)
+			continue
+		}
+		for _, adv := range advs {
+			bleadv <- adv
+		}
+	}
+	return <-done
+}
+
+// decodeLEAdvertisingReports returns the advertisements contained in pkt,
+// packets that are not LE Advertising Report events return no
+// advertisements and no error
+func decodeLEAdvertisingReports(pkt []byte) ([]*bleAdvertisement, error) {
+	if len(pkt) < 3 || pkt[0] != HCI_EVENT_PKT || pkt[1] != EVT_LE_META {
+		return nil, nil
+	}
+	plen := int(pkt[2])
+	if len(pkt) < 3+plen {
+		return nil, errors.Errorf("Event is %d bytes but claims %d bytes of parameters",
+			len(pkt), plen)
+	}
+	params := pkt[3 : 3+plen]
+	if len(params) < 2 || params[0] != EVT_LE_ADVERTISING_REPORT {
+		return nil, nil
+	}
+
+	nreports := int(params[1])
+	advs := make([]*bleAdvertisement, 0, nreports)
+	p := 2
+	for i := 0; i < nreports; i++ {
+		// Event type, address type, address and data length
+		if len(params) < p+9 {
+			return nil, errors.New("Advertising report header truncated")
+		}
+		adv := new(bleAdvertisement)
+		adv.EventType = params[p]
+		adv.AddressType = params[p+1]
+		copy(adv.Address[:], params[p+2:p+8])
+		dlen := int(params[p+8])
+		p += 9
+		// Data and the trailing RSSI
+		if len(params) < p+dlen+1 {
+			return nil, errors.New("Advertising report data truncated")
+		}
+		adv.Data = make([]byte, dlen)
+		copy(adv.Data, params[p:p+dlen])
+		adv.Rssi = int8(params[p+dlen])
+		p += dlen + 1
+		advs = append(advs, adv)
+	}
+	return advs, nil
+}
+
+// hcidumpScanner is the legacy backend which uses hcitool to enable
+// scanning and parses the hex output of hcidump
+type hcidumpScanner struct {
+	hcitool *exec.Cmd
+	hcidump *exec.Cmd
+}
+
+func newHcidumpScanner() (bleScanner, error) {
+	return &hcidumpScanner{}, nil
+}
+
+// Scan implements bleScanner
+func (s *hcidumpScanner) Scan(events chan<- []byte) error {
 	log.Println("Starting hcitool for BLE")
-	hcitool := exec.Command("hcitool", "lescan", "--duplicates")
-	if err := hcitool.Start(); err != nil {
-		log.Printf("Error starting hcitool: %s", err)
-		return
+	s.hcitool = exec.Command("hcitool", "lescan", "--duplicates")
+	if err := s.hcitool.Start(); err != nil {
+		return errors.Wrap(err, "Error starting hcitool")
 	}
 	log.Println("Starting hcidump")
-	hcidump := exec.Command("hcidump", "--raw")
-	read, err := hcidump.StdoutPipe()
-	if err := hcidump.Start(); err != nil {
-		log.Printf("Error starting hcidump: %s", err)
-		return
-	}
-	log.Println("hcidump started")
+	s.hcidump = exec.Command("hcidump", "--raw")
+	read, err := s.hcidump.StdoutPipe()
 	if err != nil {
-		log.Printf("Error connecting to stdout: %s", err)
+		return errors.Wrap(err, "Error connecting to stdout")
 	}
+	if err := s.hcidump.Start(); err != nil {
+		return errors.Wrap(err, "Error starting hcidump")
+	}
+	log.Println("hcidump started")
 	scan := bufio.NewScanner(read)
 	scan.Split(bufio.ScanWords)
 
-	var buffer *bytes.Buffer = new(bytes.Buffer)
-
 	// Skip header
 	for scan.Scan() {
 		if scan.Text() == ">" {
 			break
 		}
 	}
-	// Main section
+	// Main section, ">" starts packets from the controller and "<" starts
+	// packets to it which we ignore
+	buffer := new(bytes.Buffer)
+	incoming := true
 	for scan.Scan() {
 		token := scan.Text()
-		if token == ">" && buffer.Len() != 0 {
-			bleadv <- buffer
+		if token == ">" || token == "<" {
+			if incoming && buffer.Len() != 0 {
+				events <- buffer.Bytes()
+			}
 			buffer = new(bytes.Buffer)
+			incoming = token == ">"
 			continue
 		}
 		decodedb, err := hex.DecodeString(token)
 		if err != nil {
-			log.Println("This shouldn't happen")
+			log.Printf("Unexpected token from hcidump: %s", token)
 			continue
 		}
 		// Will panic if fails
 		_, _ = buffer.Write(decodedb)
 	}
+	if err := scan.Err(); err != nil {
+		return errors.Wrap(err, "Failed reading from hcidump")
+	}
+	return errors.New("hcidump exited")
+}
+
+// Close implements bleScanner
+func (s *hcidumpScanner) Close() error {
+	for _, cmd := range []*exec.Cmd{s.hcidump, s.hcitool} {
+		if cmd != nil && cmd.Process != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	}
+	return nil
+}
+
+const (
+	// btsnoop datalink types that can be replayed
+	BTSNOOP_H4      = 1002
+	BTSNOOP_MONITOR = 2001
+	// Opcode of an event packet in the btsnoop monitor datalink
+	BTSNOOP_MONITOR_EVENT = 3
+)
+
+// replayScanner reads HCI packets that were captured to a btsnoop file, as
+// written by "btmon -w" or "hcidump --btsnoop -w"
+type replayScanner struct {
+	r    io.Reader
+	file *os.File
+}
+
+func newReplayScanner(fname string) (bleScanner, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open replay file")
+	}
+	return &replayScanner{r: bufio.NewReader(f), file: f}, nil
+}
+
+// Scan implements bleScanner
+func (s *replayScanner) Scan(events chan<- []byte) error {
+	var header struct {
+		Magic    [8]byte
+		Version  uint32
+		Datalink uint32
+	}
+	if err := binary.Read(s.r, binary.BigEndian, &header); err != nil {
+		return errors.Wrap(err, "Failed to read btsnoop header")
+	}
+	if string(header.Magic[:]) != "btsnoop\x00" {
+		return errors.New("Replay file is not in btsnoop format")
+	}
+	if header.Datalink != BTSNOOP_H4 && header.Datalink != BTSNOOP_MONITOR {
+		return errors.Errorf("Unsupported btsnoop datalink %d", header.Datalink)
+	}
+
+	for {
+		var record struct {
+			OrigLen   uint32
+			InclLen   uint32
+			Flags     uint32
+			Drops     uint32
+			Timestamp int64
+		}
+		if err := binary.Read(s.r, binary.BigEndian, &record); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "Failed to read btsnoop record")
+		}
+		data := make([]byte, record.InclLen)
+		if _, err := io.ReadFull(s.r, data); err != nil {
+			return errors.Wrap(err, "Failed to read btsnoop record data")
+		}
+		if header.Datalink == BTSNOOP_MONITOR {
+			// Monitor records carry the packet type in the opcode instead of
+			// the data
+			if record.Flags&0xFFFF != BTSNOOP_MONITOR_EVENT {
+				continue
+			}
+			data = append([]byte{HCI_EVENT_PKT}, data...)
+		}
+		events <- data
+	}
+}
+
+// Close implements bleScanner
+func (s *replayScanner) Close() error {
+	return s.file.Close()
+}
+
+// scannerBackend returns a constructor of the bleScanner for the given
+// backend name
+func scannerBackend(backend string, device int, replayfile string) (func() (bleScanner, error), error) {
+	switch backend {
+	case "hci":
+		return func() (bleScanner, error) { return newHCISocketScanner(device) }, nil
+	case "hcitool":
+		return newHcidumpScanner, nil
+	case "replay":
+		if replayfile == "" {
+			return nil, errors.New("Replay backend requires a replay file")
+		}
+		return func() (bleScanner, error) { return newReplayScanner(replayfile) }, nil
+	}
+	return nil, fmt.Errorf("Unknown BLE backend \"%s\"", backend)
 }
 
 // BeaconRecord represents a complete Beacon record including ID data
@@ -82,12 +311,19 @@ type BeaconRecord struct {
 	BeaconData
 	Datetime time.Time
 	Rssi     int16
+	// TxPower is the advertised rssi at 1m, 0 if the frame has none
+	TxPower int8
+	// Telemetry is set for records that came from Eddystone-TLM frames
+	Telemetry *EddystoneTelemetry
 }
 
 // IBeaconListener is public provider for BeaconRecords
 func IBeaconListener(validbeacons []BeaconData, brs chan BeaconRecord) {
 	client := clientinfo{
 		nodes: make(map[string]struct{}),
+		newScanner: func() (bleScanner, error) {
+			return newHCISocketScanner(0)
+		},
 	}
 	for _, v := range validbeacons {
 		uid := v.String()
@@ -96,57 +332,60 @@ func IBeaconListener(validbeacons []BeaconData, brs chan BeaconRecord) {
 	processIBeacons(&client, brs)
 }
 
-// processIBeacons returns a stream of BeaconRecords given the collection of
-// valid beacons given from client
-func processIBeacons(client *clientinfo, brs chan BeaconRecord) {
-	bleadv := make(chan *bytes.Buffer, 128)
-	go produceBLEAdv(bleadv)
-
+// runScanner keeps a scanner from client producing advertisements on
+// bleadv, scanners that fail are reopened. bleadv is closed once a
+// scanner is exhausted.
+func runScanner(client *clientinfo, bleadv chan *bleAdvertisement) {
+	defer close(bleadv)
 	for {
-		bytesb := <-bleadv
-		buffer := bytesb.Bytes()
-		index := bytes.Index(buffer, []byte{0x4C, 0x00, 0x02})
-		if index == -1 {
+		scanner, err := client.newScanner()
+		if err != nil {
+			log.Printf("Failed to open BLE scanner: %s", err)
+			time.Sleep(SCANNER_RETRY)
 			continue
 		}
-		buffer = buffer[index+4:] // There is one byte we wanna skip
-		if len(buffer) < 22 {
-			log.Println("Buffer was not long enough for", buffer)
-			continue
+		err = produceBLEAdv(scanner, bleadv)
+		scanner.Close()
+		if err == nil {
+			log.Println("BLE scanner exhausted")
+			return
 		}
-		var beaconRecord BeaconRecord
-		copy(beaconRecord.Uuid[:], buffer[:16])
-		buffer = buffer[16:]
-		reader := bytes.NewReader(buffer)
-		if err := binary.Read(reader, binary.BigEndian, &beaconRecord.Major); err != nil {
-			log.Printf("Failed to parse major: %s", err)
-			continue
-		}
-		if err := binary.Read(reader, binary.BigEndian, &beaconRecord.Minor); err != nil {
-			log.Printf("Failed to parse Minor: %s", err)
+		log.Printf("BLE scanner failed, restarting: %s", err)
+		time.Sleep(SCANNER_RETRY)
+	}
+}
+
+// processIBeacons returns a stream of BeaconRecords given the collection of
+// valid beacons given from client, advertisements are matched against each
+// of the decoders of the client
+func processIBeacons(client *clientinfo, brs chan BeaconRecord) {
+	bleadv := make(chan *bleAdvertisement, 128)
+	go runScanner(client, bleadv)
+	state := newAdvDecoderState(client.decoders)
+
+	for adv := range bleadv {
+		beaconRecord, ok := state.decode(adv)
+		if !ok {
 			continue
 		}
 
+		// The RSSI comes from the report rather than the advertising data
+		beaconRecord.Rssi = int16(adv.Rssi)
+		beaconRecord.Datetime = time.Now()
+
 		{
 			client.Lock()
-			uid := fmt.Sprintf("%s,%d,%d", beaconRecord.Uuid.String(), beaconRecord.Major, beaconRecord.Minor)
+			uid := beaconRecord.BeaconData.String()
 			if _, ok := client.nodes[uid]; !ok {
+				if client.discovery != nil {
+					client.discovery.record(&beaconRecord)
+				}
 				client.Unlock()
 				continue
 			}
 			client.Unlock()
 		}
 
-		var rssi int8
-		// NOTE: we throw away the 21st bit, which is the send power
-		binary.Read(reader, binary.BigEndian, &rssi)
-		// Read the real RSSI
-		if err := binary.Read(reader, binary.BigEndian, &rssi); err != nil {
-			log.Printf("Failed to parse Rssi: %s", err)
-			continue
-		}
-		beaconRecord.Rssi = int16(rssi)
-		beaconRecord.Datetime = time.Now()
 		brs <- beaconRecord
 	}
 }
@@ -0,0 +1,104 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// iBeacon advertising report as printed by hcidump --raw
+var testIBeaconEvent = []byte{0x04, 0x3E, 0x2A, 0x02, 0x01, 0x00, 0x00, 0x10,
+	0x32, 0x54, 0x76, 0x98, 0xBA, 0x1E, 0x02, 0x01, 0x06, 0x1A, 0xFF, 0x4C,
+	0x00, 0x02, 0x15, 0x95, 0x66, 0xc7, 0x4d, 0x10, 0x03, 0x7c, 0x4d, 0x7b,
+	0xbb, 0x04, 0x07, 0xd1, 0xe2, 0xc6, 0x49, 0x00, 0x06, 0x00, 0x19, 0xC5,
+	0xB8}
+
+func TestDecodeLEAdvertisingReports(t *testing.T) {
+	advs, err := decodeLEAdvertisingReports(testIBeaconEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(advs) != 1 {
+		t.Fatalf("Expected 1 advertisement got %d", len(advs))
+	}
+	if advs[0].Rssi != -72 {
+		t.Fatalf("Rssi was %d", advs[0].Rssi)
+	}
+	if !bytes.Equal(advs[0].Address[:], []byte{0x10, 0x32, 0x54, 0x76, 0x98, 0xBA}) {
+		t.Fatalf("Address was %x", advs[0].Address)
+	}
+	if len(advs[0].Data) != 30 {
+		t.Fatalf("Data was %d bytes", len(advs[0].Data))
+	}
+
+	// Non advertising events are ignored
+	advs, err = decodeLEAdvertisingReports([]byte{0x04, 0x0E, 0x04, 0x01, 0x0B, 0x20, 0x00})
+	if err != nil || len(advs) != 0 {
+		t.Fatalf("Command complete was decoded %v %s", advs, err)
+	}
+	if _, err = decodeLEAdvertisingReports(testIBeaconEvent[:20]); err == nil {
+		t.Fatal("Truncated event did not fail")
+	}
+}
+
+// writeBtsnoop writes packets to a btsnoop file using the H4 datalink
+func writeBtsnoop(t *testing.T, packets ...[]byte) string {
+	f, err := ioutil.TempFile("", "beaconpi-btsnoop-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write([]byte("btsnoop\x00"))
+	binary.Write(f, binary.BigEndian, []uint32{1, BTSNOOP_H4})
+	for _, p := range packets {
+		binary.Write(f, binary.BigEndian, []uint32{uint32(len(p)), uint32(len(p)), 1, 0})
+		binary.Write(f, binary.BigEndian, int64(0))
+		f.Write(p)
+	}
+	return f.Name()
+}
+
+func TestReplayScanner(t *testing.T) {
+	fname := writeBtsnoop(t, []byte{0x01, 0x0C, 0x20, 0x02, 0x01, 0x00},
+		testIBeaconEvent)
+	defer os.Remove(fname)
+
+	scanner, err := scannerBackend("replay", 0, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := clientinfo{
+		nodes:      map[string]struct{}{"9566c74d-1003-7c4d-7bbb-0407d1e2c649,6,25": struct{}{}},
+		newScanner: scanner,
+	}
+	brs := make(chan BeaconRecord, 1)
+	go processIBeacons(&client, brs)
+
+	select {
+	case br := <-brs:
+		if br.Major != 6 || br.Minor != 25 || br.Rssi != -72 {
+			t.Fatalf("Unexpected record %#v", br)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for replayed beacon")
+	}
+}
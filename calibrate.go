@@ -0,0 +1,80 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"math"
+	"net/http"
+)
+
+const (
+	// Largest floor plan that can be uploaded in bytes
+	MAP_IMAGE_MAX = 20 << 20
+
+	MAP_IMAGE_PNG  = "image/png"
+	MAP_IMAGE_JPEG = "image/jpeg"
+	MAP_IMAGE_SVG  = "image/svg+xml"
+)
+
+// mapImageType returns the MIME type of a floor plan, an error is returned
+// if it is not a PNG, JPEG or SVG
+func mapImageType(data []byte) (string, error) {
+	switch t := http.DetectContentType(data); t {
+	case MAP_IMAGE_PNG, MAP_IMAGE_JPEG:
+		return t, nil
+	}
+	// SVG is sniffed as XML or text, look for its root element
+	head := data
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	if bytes.Contains(head, []byte("<svg")) {
+		return MAP_IMAGE_SVG, nil
+	}
+	return "", errors.New("Floor plans must be PNG, JPEG or SVG")
+}
+
+// calibrateAxis fits pixel = bias + scale * world by least squares for one
+// axis of reference points, rms is the root mean square error in pixels
+func calibrateAxis(pixel, world []float64) (bias, scale, rms float64, err error) {
+	if len(pixel) != len(world) || len(pixel) < 2 {
+		return 0, 0, 0, errors.New("Calibration needs two or more reference points")
+	}
+	n := float64(len(pixel))
+	var mp, mw float64
+	for i := range pixel {
+		mp += pixel[i] / n
+		mw += world[i] / n
+	}
+	var cov, varw float64
+	for i := range pixel {
+		cov += (world[i] - mw) * (pixel[i] - mp)
+		varw += (world[i] - mw) * (world[i] - mw)
+	}
+	if varw == 0 {
+		return 0, 0, 0, errors.New("Reference points must be at different world coordinates")
+	}
+	scale = cov / varw
+	bias = mp - scale*mw
+	for i := range pixel {
+		r := pixel[i] - bias - scale*world[i]
+		rms += r * r / n
+	}
+	return bias, scale, math.Sqrt(rms), nil
+}
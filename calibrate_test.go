@@ -0,0 +1,62 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMapImageType(t *testing.T) {
+	for _, c := range []struct {
+		data string
+		mime string
+	}{
+		{"\x89PNG\x0d\x0a\x1a\x0a\x00\x00\x00\x0dIHDR", MAP_IMAGE_PNG},
+		{"\xff\xd8\xff\xe0\x00\x10JFIF\x00", MAP_IMAGE_JPEG},
+		{`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"></svg>`, MAP_IMAGE_SVG},
+		{"<svg width=\"10\" height=\"10\"></svg>", MAP_IMAGE_SVG},
+	} {
+		if mime, err := mapImageType([]byte(c.data)); err != nil || mime != c.mime {
+			t.Errorf("%q was %s expected %s: %v", c.data, mime, c.mime, err)
+		}
+	}
+	if _, err := mapImageType([]byte("GIF89a")); err == nil {
+		t.Error("GIF was accepted")
+	}
+}
+
+func TestCalibrateAxis(t *testing.T) {
+	// 50 pixels a metre with the origin at pixel 120, the y axis flipped
+	bias, scale, rms, err := calibrateAxis([]float64{120, 370, 620}, []float64{0, 5, 10})
+	if err != nil || bias != 120 || scale != 50 || rms != 0 {
+		t.Fatalf("Got bias %f scale %f rms %f: %v", bias, scale, rms, err)
+	}
+	bias, scale, rms, err = calibrateAxis([]float64{800, 302}, []float64{0, 10})
+	if err != nil || bias != 800 || math.Abs(scale+49.8) > 1e-9 {
+		t.Fatalf("Flipped axis got bias %f scale %f: %v", bias, scale, err)
+	}
+	if _, _, rms, _ = calibrateAxis([]float64{0, 52, 98}, []float64{0, 1, 2}); rms <= 0 {
+		t.Fatal("Inexact points had no error")
+	}
+	if _, _, _, err = calibrateAxis([]float64{0, 10}, []float64{3, 3}); err == nil {
+		t.Fatal("Points at one world coordinate were calibrated")
+	}
+	if _, _, _, err = calibrateAxis([]float64{0}, []float64{3}); err == nil {
+		t.Fatal("One point was calibrated")
+	}
+}
@@ -18,15 +18,16 @@ package beaconpi
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"io"
-	"os/exec"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
@@ -40,6 +41,15 @@ const (
 	BACKOFF_MAX            = 30 * time.Second
 	BACKOFF_MIN            = 50 * time.Millisecond
 	BACKOFF_MULTIPLIER     = 2
+	DIAL_TIMEOUT           = 5 * time.Second
+	// Packets waiting for the sender before the collector blocks
+	PENDING_PACKETS = 256
+	// Attempts at replaying a spooled packet the server fails on
+	SPOOL_MAX_ATTEMPTS   = 5
+	SPOOL_STATS_INTERVAL = time.Minute
+	// Version 2 clients that exchanged nothing with the server for this
+	// long send the version of their beacon set to pick up changes
+	BEACON_SYNC_IDLE = 5 * time.Second
 )
 
 // Encapsulates all client data
@@ -47,14 +57,47 @@ type clientinfo struct {
 	sync.Mutex
 
 	tlsconf *tls.Config
-	// Key to nothing, key is "UUID,major,minor"
+	// Key to nothing, key is BeaconData.String()
 	nodes map[string]struct{}
-	host  string
-	uuid  Uuid
+	// Version of nodes given by the server, 0 until it sent the set
+	beaconVersion uint64
+	// Last time a packet was answered by the server
+	lastExchange time.Time
+	// Beacons not in nodes that were seen, nil unless discovery is on
+	discovery discoveryReport
+	// Window to aggregate sightings of each beacon over, 0 sends every one
+	aggregateWindow time.Duration
+	aggregateKalman bool
+	host            string
+	uuid            Uuid
 	// Time to re request beacons from server
 	timeoutBeaconRefresh time.Duration
 	// Time to force the beacons sightings to the server
 	timeoutBeacon time.Duration
+	// Opens the source of BLE advertisements
+	newScanner func() (bleScanner, error)
+	// Decoders tried on each advertisement, nil uses all of them
+	decoders []advDecoder
+	// Highest protocol version to use and the version agreed with the
+	// server on the current connection
+	maxVersion uint8
+	version    uint8
+	// Compress version 2 packets
+	compress bool
+	// Public key updates from the server must be signed with
+	updateKey ed25519.PublicKey
+	// Executables the server may run directly with the raw operation
+	allowRaw map[string]struct{}
+	// Ids of control commands that are running
+	running map[int]struct{}
+	// Output and results of control commands to send
+	control chan *BeaconLogPacket
+	// Set once the server asked the client to exit
+	exiting  bool
+	exitCode int
+	// Packets waiting to be sent to the server
+	spool       packetSpool
+	spoolMaxAge time.Duration
 }
 
 // Main entry point for the client app that is run on the edge devices
@@ -70,6 +113,19 @@ func StartClient() {
 		timeoutBeaconRefresh int
 		timeoutBeacon        int
 		logDebug             bool
+		bleBackend           string
+		bleDevice            int
+		bleReplayFile        string
+		decoderNames         string
+		spoolDir             string
+		spoolMaxSize         int64
+		spoolMaxAge          time.Duration
+		protocolVersion      int
+		compress             bool
+		updateKeyFile        string
+		allowRaw             string
+		aggregateWindow      time.Duration
+		aggregateKalman      bool
 	)
 
 	flag.StringVar(&servcertfile, "serv-cert-file", "", "Has trusted keys")
@@ -78,9 +134,22 @@ func StartClient() {
 	flag.StringVar(&clientuuid, "client-uuid", "", "Uuid for this node, no dashes")
 	flag.StringVar(&servhost, "serv-host", "localhost", "")
 	flag.StringVar(&servport, "serv-port", DEFAULT_PORT, "")
-	flag.IntVar(&timeoutBeaconRefresh, "timeout-beacon-refresh", TIMEOUT_BEACON_REFRESH, "timeout for beacon data rerequest from server to keep freshness")
+	flag.IntVar(&timeoutBeaconRefresh, "timeout-beacon-refresh", TIMEOUT_BEACON_REFRESH, "timeout for beacon data rerequest from server to keep freshness, version 2 servers send changes as they happen")
 	flag.IntVar(&timeoutBeacon, "timeout-beacon", TIMEOUT_BEACON, "timeout for beacon sightings before pushing to the server")
 	flag.BoolVar(&logDebug, "debug", false, "enable more logging")
+	flag.StringVar(&bleBackend, "ble-backend", "hci", "source of BLE advertisements: hci, hcitool or replay")
+	flag.IntVar(&bleDevice, "ble-device", 0, "HCI device number used by the hci backend, 0 is hci0")
+	flag.StringVar(&bleReplayFile, "ble-replay-file", "", "btsnoop capture read by the replay backend")
+	flag.StringVar(&decoderNames, "decoders", "", "comma separated advertisement decoders to use, empty for all of ibeacon, altbeacon, eddystone-uid, eddystone-url, eddystone-tlm")
+	flag.StringVar(&spoolDir, "spool-dir", "", "directory to keep packets in while the server is unreachable, empty keeps them in memory")
+	flag.Int64Var(&spoolMaxSize, "spool-max-size", SPOOL_MAX_SIZE, "bytes of packets to keep before dropping the oldest")
+	flag.DurationVar(&spoolMaxAge, "spool-max-age", SPOOL_MAX_AGE, "age after which spooled packets are dropped")
+	flag.IntVar(&protocolVersion, "protocol-version", CURRENT_VERSION, "highest protocol version to use, 1 for servers that do not support version 2")
+	flag.BoolVar(&compress, "compress", false, "compress packets with deflate when using protocol version 2")
+	flag.StringVar(&updateKeyFile, "update-key", "", "file with the base64 ed25519 public key updates are verified with, updates are refused without it")
+	flag.StringVar(&allowRaw, "allow-raw", "", "comma separated executables the server may run with the raw control operation, none by default")
+	flag.DurationVar(&aggregateWindow, "aggregate-window", 0, "send the mean, median, min, max and count of the rssi of each beacon over this window instead of every sighting, 0 sends every sighting")
+	flag.BoolVar(&aggregateKalman, "aggregate-kalman", false, "also send the Kalman filtered rssi of aggregated beacons")
 	flag.Parse()
 
 	certpool := LoadFileToCert(servcertfile)
@@ -98,12 +167,61 @@ func StartClient() {
 		Certificates: []tls.Certificate{clientcert},
 	}
 
+	scanner, err := scannerBackend(bleBackend, bleDevice, bleReplayFile)
+	if err != nil {
+		log.Fatal("Invalid BLE backend: ", err)
+	}
+
+	decoders, err := decodersByName(decoderNames)
+	if err != nil {
+		log.Fatal("Invalid decoders: ", err)
+	}
+
+	if protocolVersion < 1 || protocolVersion > CURRENT_VERSION {
+		log.Fatalf("Protocol version must be between 1 and %d", CURRENT_VERSION)
+	}
+	if aggregateWindow != 0 && aggregateWindow < time.Millisecond {
+		log.Fatal("Aggregate window must be at least a millisecond")
+	}
+
+	spool, err := openSpool(spoolDir, spoolMaxSize, spoolMaxAge)
+	if err != nil {
+		log.Fatal("Failed to open spool: ", err)
+	}
+	if n := spool.Len(); n > 0 {
+		log.Infof("Replaying %d spooled packets", n)
+	}
+
+	var updateKey ed25519.PublicKey
+	if updateKeyFile != "" {
+		if updateKey, err = loadUpdateKey(updateKeyFile); err != nil {
+			log.Fatal("Failed to load update key: ", err)
+		}
+	}
+
 	client := clientinfo{
 		tlsconf:              conf,
 		host:                 servhost + ":" + servport,
 		nodes:                make(map[string]struct{}),
 		timeoutBeaconRefresh: time.Millisecond * time.Duration(timeoutBeaconRefresh),
 		timeoutBeacon:        time.Millisecond * time.Duration(timeoutBeacon),
+		newScanner:           scanner,
+		decoders:             decoders,
+		spool:                spool,
+		spoolMaxAge:          spoolMaxAge,
+		maxVersion:           uint8(protocolVersion),
+		compress:             compress,
+		updateKey:            updateKey,
+		allowRaw:             make(map[string]struct{}),
+		running:              make(map[int]struct{}),
+		control:              make(chan *BeaconLogPacket, PENDING_PACKETS),
+		aggregateWindow:      aggregateWindow,
+		aggregateKalman:      aggregateKalman,
+	}
+	for _, name := range strings.Split(allowRaw, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			client.allowRaw[name] = struct{}{}
+		}
 	}
 
 	uuiddec, err := hex.DecodeString(clientuuid)
@@ -118,126 +236,325 @@ func StartClient() {
 	clientLoop(&client)
 }
 
-// clientLoop is the hot loop for the beacons it handles communicating with
-// the remote server and creating packets to send over the channel
+// Errors returned when the server answered a packet
+var (
+	// The server will never accept the packet, it must not be resent
+	errPacketRejected = errors.New("Server rejected packet")
+	// The server failed to store the packet, it can be resent later
+	errServerFailure = errors.New("Server failed to handle packet")
+)
+
+// clientLoop is the hot loop for the beacons it collects sightings into
+// packets and hands them to clientSender
 func clientLoop(client *clientinfo) {
-	timeruuid := time.NewTicker(client.timeoutBeaconRefresh)
 	timerbeacon := time.NewTicker(client.timeoutBeacon)
 	brs := make(chan BeaconRecord, 256)
 	go processIBeacons(client, brs)
-	first := true
+	// Aggregates of the records are sent instead of them
+	var aggs chan aggregateRecord
+	var tlms chan BeaconRecord
+	if client.aggregateWindow > 0 {
+		aggs = make(chan aggregateRecord, 256)
+		tlms = make(chan BeaconRecord, 256)
+		go aggregateRecords(brs, aggs, tlms, client.aggregateWindow, client.aggregateKalman)
+		brs = nil
+	}
+	pending := make(chan *BeaconLogPacket, PENDING_PACKETS)
+	go clientSender(client, pending)
 
-	var conn *tls.Conn
+	datapacket := newDataPacket(client)
+	maxbeacons, maxlogs := packetLimits(client.maxVersion)
 
+	// Map from uuid,major,minor to offset
+	currentbeacons := make(map[string]int)
+	beaconIndex := func(b BeaconData) uint16 {
+		beaconstr := b.String()
+		i, ok := currentbeacons[beaconstr]
+		if !ok {
+			datapacket.Beacons = append(datapacket.Beacons, b)
+			i = len(datapacket.Beacons) - 1
+			currentbeacons[beaconstr] = i
+		}
+		return uint16(i)
+	}
+	addTelemetry := func(br BeaconRecord) {
+		// Packets of version 1 can't carry it
+		if client.maxVersion < 2 {
+			return
+		}
+		datapacket.Ext |= EXT_TELEMETRY
+		datapacket.Telemetry = append(datapacket.Telemetry, BeaconTelemetry{
+			Datetime:           br.Datetime,
+			BeaconIndex:        beaconIndex(br.BeaconData),
+			EddystoneTelemetry: *br.Telemetry})
+	}
+
+	log.Println("Start loop")
+	for {
+		select {
+		case tempbr := <-brs:
+			// Block gets Beacons from beacon log producer
+			if tempbr.Telemetry != nil {
+				addTelemetry(tempbr)
+			}
+			datapacket.Logs = append(datapacket.Logs, BeaconLog{
+				Datetime:    tempbr.Datetime,
+				Rssi:        tempbr.Rssi,
+				BeaconIndex: beaconIndex(tempbr.BeaconData),
+				TxPower:     tempbr.TxPower})
+		case agg := <-aggs:
+			agg.BeaconIndex = beaconIndex(agg.BeaconData)
+			datapacket.Ext |= EXT_AGGREGATE
+			datapacket.Aggregates = append(datapacket.Aggregates, agg.BeaconAggregate)
+		case tlm := <-tlms:
+			addTelemetry(tlm)
+		case _ = <-timerbeacon.C:
+			if len(datapacket.Logs) == 0 && len(datapacket.Aggregates) == 0 &&
+				len(datapacket.Telemetry) == 0 {
+				continue
+			}
+			// Send and reset
+			pending <- datapacket
+			currentbeacons = make(map[string]int)
+			datapacket = newDataPacket(client)
+		}
+		if len(datapacket.Logs) == maxlogs || len(datapacket.Beacons) == maxbeacons ||
+			len(datapacket.Aggregates) == MAX_AGGREGATES_V2 ||
+			len(datapacket.Telemetry) == MAX_TELEMETRY_V2 {
+			log.Println("Sending data to server due to full queue")
+			pending <- datapacket
+			currentbeacons = make(map[string]int)
+			datapacket = newDataPacket(client)
+		}
+	}
+}
+
+// newDataPacket returns an empty packet of logs for this client
+func newDataPacket(client *clientinfo) *BeaconLogPacket {
 	datapacket := new(BeaconLogPacket)
 	copy(datapacket.Uuid[:], client.uuid[:])
-	datapacket.Flags = CURRENT_VERSION
+	datapacket.Flags = client.maxVersion
+	return datapacket
+}
 
-	// Map from uuid,major,minor to offset
-	currentbeacons := make(map[string]int)
+// clientSender handles communicating with the remote server. Packets are
+// sent as they arrive while connected, otherwise they are written to the
+// spool and replayed in order once a connection is made.
+func clientSender(client *clientinfo, pending <-chan *BeaconLogPacket) {
+	// Version 1 servers can only send the whole beacon set when asked
+	timeruuid := time.NewTicker(client.timeoutBeaconRefresh)
+	timersync := time.NewTicker(BEACON_SYNC_IDLE)
+	timerdiscovery := time.NewTicker(DISCOVERY_INTERVAL)
+	timerstats := time.NewTicker(SPOOL_STATS_INTERVAL)
+	// Always ready, used to replay the spool between new packets
+	replayReady := make(chan time.Time)
+	close(replayReady)
 
+	var conn *tls.Conn
 	var backoff time.Duration = BACKOFF_MIN
-	log.Println("Start loop")
+	var nextDial time.Time
+	// Failed attempts at sending the oldest spooled packet
+	var attempts int
+	var laststats spoolStats
+	needBeacons := true
+
 	for {
 		var err error
-		for conn == nil {
-			log.Infof("Creating new connection: host: %s", client.host)
-			conn, err = tls.Dial("tcp", client.host, client.tlsconf)
-			if err != nil {
+		if client.exiting {
+			exitClient(client, conn, pending)
+		}
+		if conn == nil && !time.Now().Before(nextDial) {
+			if conn, err = dialServer(client); err != nil {
+				log.Printf("Failed to open socket, abandoning: %s", err)
 				log.Info("Back off ", backoff)
-				time.Sleep(backoff)
+				nextDial = time.Now().Add(backoff)
 				backoff *= BACKOFF_MULTIPLIER
 				if backoff > BACKOFF_MAX {
 					backoff = BACKOFF_MAX
 				}
-				log.Printf("Failed to open socket, abandoning: %s", err)
-				continue
-			}
-			backoff = BACKOFF_MIN
-			vbuff := bytes.NewBuffer([]byte{byte(CURRENT_VERSION)})
-			_, err = io.CopyN(conn, vbuff, 1)
-			if err != nil {
-				log.Printf("Failed to write current version to remote %s", err)
-				conn.Close()
-				conn = nil
-				return
-			}
-			vbuff.Reset()
-			_, err = io.CopyN(vbuff, conn, 1)
-			if err != nil {
-				log.Print("Failed to get server version")
-				conn.Close()
-				conn = nil
-				return
-			}
-			if uint8(vbuff.Bytes()[0]) != CURRENT_VERSION {
-				log.Println("Server failed to answer with same version")
-				conn.Close()
-				conn = nil
-				return
+			} else {
+				backoff = BACKOFF_MIN
+				needBeacons = true
 			}
 		}
 
-		if first {
+		if conn != nil && needBeacons {
 			log.Println("Init request beacons")
-			first = false
 			if err = requestBeacons(client, conn); err != nil {
 				log.Printf("Error occured, connection killed %s", err)
 				conn = nil
 				continue
 			}
+			needBeacons = false
+		}
+
+		var replay <-chan time.Time
+		var redial <-chan time.Time
+		if conn != nil && client.spool.Len() > 0 {
+			replay = replayReady
+		} else if conn == nil {
+			redial = time.After(time.Until(nextDial))
 		}
 
 		select {
-		case tempbr := <-brs:
-			// Block gets Beacons from beacon log producer
-			beaconstr := tempbr.BeaconData.String()
-			var i int
-			var ok bool
-			if i, ok = currentbeacons[beaconstr]; !ok {
-				datapacket.Beacons = append(datapacket.Beacons, tempbr.BeaconData)
-				i = len(datapacket.Beacons) - 1
-				currentbeacons[beaconstr] = i
+		case datapacket := <-client.control:
+			if conn != nil {
+				if err = sendData(client, conn, datapacket); err == nil {
+					continue
+				}
+				log.Printf("Error occured sending control, connection killed %s", err)
+				conn = nil
+				if errors.Cause(err) == errPacketRejected {
+					continue
+				}
 			}
-			datapacket.Logs = append(datapacket.Logs, BeaconLog{
-				Datetime:    tempbr.Datetime,
-				Rssi:        tempbr.Rssi,
-				BeaconIndex: uint16(i)})
-		case _ = <-timeruuid.C:
-			if err = requestBeacons(client, conn); err != nil {
+			if err = spoolPacket(client, datapacket); err != nil {
+				log.Errorf("Failed to spool control packet, dropping it: %s", err)
+			}
+		case datapacket := <-pending:
+			// Anything already spooled has to be sent first
+			if conn != nil && client.spool.Len() == 0 {
+				err = sendData(client, conn, datapacket)
+				if err == nil {
+					continue
+				}
 				log.Printf("Error occured, connection killed %s", err)
 				conn = nil
+				if errors.Cause(err) == errPacketRejected {
+					log.Warn("Dropping packet rejected by the server")
+					continue
+				}
 			}
-		case _ = <-timerbeacon.C:
-			if len(datapacket.Logs) == 0 {
+			if err = spoolPacket(client, datapacket); err != nil {
+				log.Errorf("Failed to spool packet, dropping it: %s", err)
+			}
+		case _ = <-replay:
+			if err = replaySpooled(client, conn); err == nil {
+				attempts = 0
 				continue
 			}
-			// Send and reset
-			if err = sendData(client, conn, datapacket); err != nil {
-				log.Printf("Error occured, connection killed %s", err)
-				conn = nil
+			log.Printf("Error occured replaying spool, connection killed %s", err)
+			conn = nil
+			attempts = spoolReplayFailed(client.spool, err, attempts)
+		case _ = <-redial:
+		case _ = <-timeruuid.C:
+			if conn != nil && client.version < 2 {
+				if err = requestBeacons(client, conn); err != nil {
+					log.Printf("Error occured, connection killed %s", err)
+					conn = nil
+				}
 			}
-			// Reset data
-			currentbeacons = make(map[string]int)
-			datapacket = new(BeaconLogPacket)
-			datapacket.Flags = CURRENT_VERSION
-			copy(datapacket.Uuid[:], client.uuid[:])
-
-		}
-		if len(datapacket.Beacons) == MAX_LOGS {
-			log.Println("Sending data to server due to full queue")
-			if err = sendData(client, conn, datapacket); err != nil {
-				log.Printf("Error occured, connection killed %s", err)
-				conn = nil
+		case _ = <-timersync.C:
+			if conn != nil && client.version >= 2 &&
+				time.Since(client.lastExchange) >= BEACON_SYNC_IDLE {
+				if err = requestBeacons(client, conn); err != nil {
+					log.Printf("Error occured, connection killed %s", err)
+					conn = nil
+				}
+			}
+		case _ = <-timerdiscovery.C:
+			if conn == nil || client.version < 2 {
+				continue
+			}
+			// Reports are not spooled, the beacons will be seen again
+			datapacket, err := takeDiscovery(client)
+			if err != nil {
+				log.Warn(err)
+			} else if datapacket != nil {
+				if err = sendData(client, conn, datapacket); err != nil {
+					log.Printf("Error occured sending discovery, connection killed %s", err)
+					conn = nil
+				}
+			}
+		case _ = <-timerstats.C:
+			if stats := client.spool.Stats(); stats != laststats {
+				log.Infof("Spool: %s", stats)
+				laststats = stats
 			}
-			// Reset data
-			currentbeacons = make(map[string]int)
-			datapacket = new(BeaconLogPacket)
-			copy(datapacket.Uuid[:], client.uuid[:])
-			datapacket.Flags = CURRENT_VERSION
 		}
 	}
+}
+
+// dialServer opens a connection to the server and agrees on the version,
+// the server answers with the lower of its version and ours
+func dialServer(client *clientinfo) (*tls.Conn, error) {
+	log.Infof("Creating new connection: host: %s", client.host)
+	dialer := &net.Dialer{Timeout: DIAL_TIMEOUT}
+	conn, err := tls.DialWithDialer(dialer, "tcp", client.host, client.tlsconf)
+	if err != nil {
+		return nil, err
+	}
+	vbuff := bytes.NewBuffer([]byte{client.maxVersion})
+	_, err = io.CopyN(conn, vbuff, 1)
+	if err != nil {
+		return nil, handleFatalError(conn, "Failed to write current version to remote", err)
+	}
+	vbuff.Reset()
+	_, err = io.CopyN(vbuff, conn, 1)
+	if err != nil {
+		return nil, handleFatalError(conn, "Failed to get server version", err)
+	}
+	version := uint8(vbuff.Bytes()[0])
+	if version < 1 || version > client.maxVersion {
+		return nil, handleFatalError(conn,
+			fmt.Sprintf("Server answered with unsupported version %d", version), nil)
+	}
+	log.Infof("Using protocol version %d", version)
+	client.version = version
+	return conn, nil
+}
+
+// spoolPacket writes a packet that could not be sent to the spool
+func spoolPacket(client *clientinfo, datapacket *BeaconLogPacket) error {
+	bytespacket, err := datapacket.MarshalBinary()
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal binary")
+	}
+	return client.spool.Append(bytespacket)
+}
 
+// replaySpooled sends the oldest spooled packet, it is removed from the
+// spool once the server acknowledged it
+func replaySpooled(client *clientinfo, conn *tls.Conn) error {
+	bytespacket, spooled, err := client.spool.Peek()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return handleFatalError(conn, "Failed to read spool", err)
+	}
+	if time.Since(spooled) > client.spoolMaxAge {
+		return client.spool.Drop(false)
+	}
+	var datapacket BeaconLogPacket
+	if err = datapacket.UnmarshalBinary(bytespacket); err != nil {
+		log.Warnf("Dropping spooled packet that failed to unmarshal: %s", err)
+		return client.spool.Drop(true)
+	}
+	if err = sendData(client, conn, &datapacket); err != nil {
+		return err
+	}
+	return client.spool.Ack()
+}
+
+// spoolReplayFailed handles an error replaying the oldest spooled packet
+// and returns the attempts at it so far. Packets the server rejects are
+// dropped and those it fails on are dropped after SPOOL_MAX_ATTEMPTS,
+// connection errors are retried until the packet is too old as the server
+// never saw it.
+func spoolReplayFailed(spool packetSpool, err error, attempts int) int {
+	switch errors.Cause(err) {
+	case errPacketRejected:
+		log.Warn("Dropping spooled packet rejected by the server")
+	case errServerFailure:
+		if attempts++; attempts < SPOOL_MAX_ATTEMPTS {
+			return attempts
+		}
+		log.Warnf("Dropping spooled packet after %d attempts", attempts)
+	default:
+		return attempts
+	}
+	spool.Drop(true)
+	return 0
 }
 
 // handleFatalError returns and error (if available, err == nil just makes
@@ -286,36 +603,92 @@ func readFromRemoteOrClose(conn *tls.Conn, buff *bytes.Buffer) error {
 // sendData sends the current datapacket over the connection handling errors
 // and responses
 func sendData(client *clientinfo, conn *tls.Conn, datapacket *BeaconLogPacket) error {
+	setPacketVersion(client, datapacket)
+	if client.version < 2 && len(datapacket.Aggregates) > 0 {
+		aggregatesToLogs(datapacket)
+	}
+	if client.version < 2 {
+		// Version 1 has no telemetry, the frames were still sent as logs
+		datapacket.Telemetry = nil
+	}
+	if parts := datapacket.Split(client.version); len(parts) > 1 {
+		// Packets collected for a newer version than the server supports
+		for _, part := range parts {
+			if err := sendData(client, conn, part); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if datapacket.Flags&(REQUEST_CONTROL_LOG|REQUEST_CONTROL_COMPLETE) == 0 &&
+		datapacket.Ext&EXT_DISCOVERY == 0 {
+		datapacket.SetSentTime(time.Now())
+	}
+	brp, err := exchangePacket(conn, datapacket)
+	if err != nil {
+		return err
+	}
+	client.lastExchange = time.Now()
+	if datapacket.Flags&REQUEST_CONTROL_COMPLETE != 0 {
+		// The server won't send the command again once it has the result
+		id, _ := strconv.Atoi(strings.SplitN(datapacket.ControlData, "\n", 2)[0])
+		client.Lock()
+		delete(client.running, id)
+		client.Unlock()
+	}
+	return handleResponse(client, conn, brp)
+}
+
+// exchangePacket sends a packet and returns the response of the server
+func exchangePacket(conn *tls.Conn, datapacket *BeaconLogPacket) (*BeaconResponsePacket, error) {
 	bytespacket, err := datapacket.MarshalBinary()
 	if err != nil {
-		return handleFatalError(conn, "Failed to marshal binary", err)
+		return nil, handleFatalError(conn, "Failed to marshal binary", err)
 	}
 	buff := bytes.NewBuffer(bytespacket)
 	err = writeLengthLE32(conn, buff)
 	if err != nil {
-		return handleFatalError(conn, "Failed to write length", err)
+		return nil, handleFatalError(conn, "Failed to write length", err)
 	}
 
 	_, err = buff.WriteTo(conn)
 	if err != nil {
-		return handleFatalError(conn, "Failed to write to socket", err)
+		return nil, handleFatalError(conn, "Failed to write to socket", err)
 	}
 	//conn.CloseWrite()
 	buff.Reset()
 
 	err = readFromRemoteOrClose(conn, buff)
 	if err != nil {
-		return errors.Wrap(err, "Failed to read response to sendData")
+		return nil, errors.Wrap(err, "Failed to read response to sendData")
 	}
+	return parseResponse(conn, buff)
+}
 
-	return readUpdates(client, conn, buff)
+// setPacketVersion marks the packet with the version of the connection
+func setPacketVersion(client *clientinfo, datapacket *BeaconLogPacket) {
+	datapacket.Flags = datapacket.Flags&^VERSION_MASK | client.version
+	datapacket.Ext &^= EXT_DEFLATE | EXT_BEACON_VERSION | EXT_TX_POWER
+	if client.compress && client.version >= 2 {
+		datapacket.Ext |= EXT_DEFLATE
+	}
+	if client.version >= 2 && datapacket.hasTxPower() {
+		datapacket.Ext |= EXT_TX_POWER
+	}
+	// Every packet acknowledges the beacon set so changes come with the
+	// response
+	if client.version >= 2 {
+		datapacket.Ext |= EXT_BEACON_VERSION
+		datapacket.BeaconVersion = client.beaconVersion
+	}
 }
 
-// requestBeacons sends a request for the registered beacons from the server
+// requestBeacons sends a request for the registered beacons from the server,
+// version 2 servers answer with the changes since the set the client holds
 func requestBeacons(client *clientinfo, conn *tls.Conn) error {
 	var blp BeaconLogPacket
-	blp.Flags = CURRENT_VERSION
-	blp.Flags |= REQUEST_BEACON_UPDATES
+	blp.Flags = REQUEST_BEACON_UPDATES
+	setPacketVersion(client, &blp)
 	copy(blp.Uuid[:], client.uuid[:])
 	buffer, err := blp.MarshalBinary()
 	if err != nil {
@@ -340,16 +713,42 @@ func requestBeacons(client *clientinfo, conn *tls.Conn) error {
 	if err != nil {
 		return handleFatalError(conn, "Failed to read response to sendData", err)
 	}
+	client.lastExchange = time.Now()
 
 	return readUpdates(client, conn, reader)
 }
 
 // For any handling of client responses
 func readUpdates(client *clientinfo, conn *tls.Conn, buff *bytes.Buffer) error {
+	brp, err := parseResponse(conn, buff)
+	if err != nil {
+		return err
+	}
+	return handleResponse(client, conn, brp)
+}
+
+// parseResponse decodes a response, returning an error if the server
+// responded with one
+func parseResponse(conn *tls.Conn, buff *bytes.Buffer) (*BeaconResponsePacket, error) {
 	var brp BeaconResponsePacket
 	if err := brp.UnmarshalBinary(buff.Bytes()); err != nil {
-		return handleFatalError(conn, "Failed to Unmarshal response packet", err)
+		return nil, handleFatalError(conn, "Failed to Unmarshal response packet", err)
+	}
+	// The server closes the connection after either of these
+	if brp.Flags&RESPONSE_INVALID != 0 {
+		return nil, handleFatalError(conn, "Server responded with an error", errPacketRejected)
+	} else if brp.Flags&RESPONSE_INTERNAL_FAILURE != 0 {
+		return nil, handleFatalError(conn, "Server responded with an error", errServerFailure)
 	}
+	return &brp, nil
+}
+
+// handleResponse acts on the flags of a successful response
+func handleResponse(client *clientinfo, conn *tls.Conn, brp *BeaconResponsePacket) error {
+	if brp.Flags&RESPONSE_BEACON_DIFF != 0 && brp.Diff != nil {
+		applyBeaconDiff(client, brp.Diff)
+	}
+	setDiscovery(client, brp.Flags&RESPONSE_DISCOVERY != 0)
 	if brp.Flags&RESPONSE_BEACON_UPDATES != 0 {
 		splitnl := strings.Split(brp.Data, "\n")
 		client.Lock()
@@ -360,46 +759,94 @@ func readUpdates(client *clientinfo, conn *tls.Conn, buff *bytes.Buffer) error {
 		}
 		log.Printf("New beacon list: \n%#v", client.nodes)
 		log.Println("Completed parsing response from server")
+		return nil
 	} else if brp.Flags&RESPONSE_SYSTEM != 0 {
-		return handleSystem(client, conn, &brp)
+		if err := handleSystem(client, conn, brp); err != nil {
+			return err
+		}
 	}
-	return nil
+	return handleAction(client, conn, brp)
+}
+
+// applyBeaconDiff updates the beacon set of the client. Diffs from another
+// version than the one held are ignored, the server sends the right one
+// in answer to the next packet.
+func applyBeaconDiff(client *clientinfo, diff *BeaconDiff) {
+	client.Lock()
+	defer client.Unlock()
+	if !diff.Full && diff.From != client.beaconVersion {
+		log.Warnf("Ignoring beacon diff from version %d, we have %d", diff.From,
+			client.beaconVersion)
+		return
+	}
+	if diff.Full {
+		client.nodes = make(map[string]struct{})
+	}
+	for _, b := range diff.Added {
+		client.nodes[b.String()] = struct{}{}
+	}
+	for _, b := range diff.Removed {
+		delete(client.nodes, b.String())
+	}
+	client.beaconVersion = diff.Version
+	log.Infof("Beacon set at version %d, %d added %d removed, %d beacons",
+		diff.Version, len(diff.Added), len(diff.Removed), len(client.nodes))
 }
 
 // handleSystem processes any response from the server that
-// contains RESPONSE_SYSTEM flag
+// contains RESPONSE_SYSTEM flag, the command runs in the background and
+// its output and result are sent by clientSender
 func handleSystem(client *clientinfo, conn *tls.Conn, brp *BeaconResponsePacket) error {
 	cd := strings.SplitN(brp.Data, "\n", 2)
 	if len(cd) != 2 {
 		return handleFatalError(conn, "Sent control is invalid", nil)
 	}
-	_, err := strconv.Atoi(cd[0])
+	id, err := strconv.Atoi(cd[0])
 	if err != nil {
 		return handleFatalError(conn, "Sent control is invalid not integer", nil)
 	}
-	command := cd[1]
-	var cmd []string
-	if err = json.Unmarshal([]byte(command), &cmd); err != nil {
-		return handleFatalError(conn, "Sent control: Failed to unmarshal: ", err)
-	}
-	var com *exec.Cmd
-	if len(cmd) == 1 {
-		com = exec.Command(cmd[0])
-	} else if len(cmd) > 1 {
-		com = exec.Command(cmd[0], cmd[1:]...)
-	}
-	output, err := com.CombinedOutput()
-	log.Println("Combined output:", output)
-	outputstr := cd[0] + "\n" + string(output)
-	end := len(outputstr)
-	if end > MAX_CTRL {
-		end = MAX_CTRL
-	}
-	outputstr = outputstr[:end]
+	// The server sends the command until it is completed
+	client.Lock()
+	if _, ok := client.running[id]; ok {
+		client.Unlock()
+		return nil
+	}
+	client.running[id] = struct{}{}
+	client.Unlock()
+
+	maxctrl := MAX_CTRL
+	if client.version >= 2 {
+		maxctrl = MAX_CTRL_V2
+	}
+	go runControl(client, cd[0], cd[1], maxctrl)
+	return nil
+}
+
+// runControl runs a command from the server streaming its output as it
+// runs and then sending its result
+func runControl(client *clientinfo, id, command string, maxctrl int) {
+	var result controlResult
+	cmd, err := parseControlCommand(command)
+	if err != nil {
+		// Completing it stops the server sending it again
+		result = controlResult{Exit: -1, Error: "Invalid command: " + err.Error()}
+	} else {
+		log.Infof("Running control %s %s %v", id, cmd.Op, cmd.Args)
+		progress := newProgressWriter(id, client.uuid, client.control)
+		result = runControlCommand(cmd, client.allowRaw, (maxctrl-CONTROL_RESULT_OVERHEAD)/2,
+			progress)
+		progress.Close()
+	}
+	log.Infof("Control %s %s exited %d after %.1fs %s", id, result.Op, result.Exit,
+		result.Duration, result.Error)
+	resultjson, err := marshalControlResult(id, result, maxctrl)
+	if err != nil {
+		log.Errorf("Failed to marshal control result %s", err)
+		return
+	}
 	var datapacket BeaconLogPacket
-	datapacket.Flags = CURRENT_VERSION
-	datapacket.Flags |= REQUEST_CONTROL_COMPLETE
+	datapacket.Flags = REQUEST_CONTROL_COMPLETE
 	copy(datapacket.Uuid[:], client.uuid[:])
-	datapacket.ControlData = outputstr
-	return sendData(client, conn, &datapacket)
+	datapacket.ControlData = id + "\n" + string(resultjson)
+	client.control <- &datapacket
 }
@@ -25,6 +25,5 @@ import (
 func main() {
 	config := beaconpi.GetFlags()
 	log.Printf("Config: %#v", config)
-	beaconpi.StartServer(config.X509cert, config.X509key,
-			config.Drivername, config.DSN, nil)
+	beaconpi.StartServerConfig(config, nil)
 }
@@ -15,6 +15,10 @@ func getflags() (out beaconpi.MetricsParameters) {
 		"Required: The database datasource name, may be multiple tokes")
 	flag.StringVar(&out.Port, "port", "", "Required: Port for serving http")
 	flag.StringVar(&out.AllowedOrigin, "allowed-origin", "http://localhost:3000", "Origin, including http(s) for valid domains that may access the resource, * is invalid for our application.")
+	flag.StringVar(&out.DistanceMode, "distance-mode", "",
+		"Reference rssi at 1m for distances on maps that don't set one, the bias of the edge, txpower of the beacon or both. Defaults to bias")
+	flag.BoolVar(&out.NoTracker, "no-tracker", false,
+		"Don't locate the beacons of tracking sessions in the background")
 	cfgfile := flag.String("config", "", "Required for SMTP use")
 	flag.Parse()
 
@@ -0,0 +1,85 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// signupdate creates the ed25519 keys used to verify beaconclient updates
+// and signs binaries with their version and platform before they are
+// uploaded to /control/uploadupdate
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+func main() {
+	var genkey, keyfile, in, out, version, platform string
+	flag.StringVar(&genkey, "genkey", "", "write a new key pair to this path and path.pub")
+	flag.StringVar(&keyfile, "key", "", "base64 private key to sign with")
+	flag.StringVar(&in, "in", "", "binary to sign")
+	flag.StringVar(&out, "out", "", "file for the base64 signature, default is in.sig")
+	flag.StringVar(&version, "version", "", "version the binary is uploaded as")
+	flag.StringVar(&platform, "platform", "", "GOOS/GOARCH the binary is built for, for example linux/arm")
+	flag.Parse()
+
+	if genkey != "" {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = ioutil.WriteFile(genkey, []byte(base64.StdEncoding.EncodeToString(priv)), 0600); err != nil {
+			log.Fatal(err)
+		}
+		if err = ioutil.WriteFile(genkey+".pub", []byte(base64.StdEncoding.EncodeToString(pub)), 0644); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if keyfile == "" || in == "" || version == "" || platform == "" {
+		flag.Usage()
+		log.Fatal("-key, -in, -version and -platform are required to sign")
+	}
+	if strings.Contains(version, "\n") || strings.Count(platform, "/") != 1 {
+		log.Fatal("-version can't have newlines and -platform must be GOOS/GOARCH")
+	}
+	if out == "" {
+		out = in + ".sig"
+	}
+	b, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	priv, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(priv) != ed25519.PrivateKeySize {
+		log.Fatal("Private key is invalid")
+	}
+	binary, err := ioutil.ReadFile(in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Edges verify "version\nplatform\n" followed by the binary, see
+	// updateSignedMessage of beaconpi
+	msg := append([]byte(version+"\n"+platform+"\n"), binary...)
+	sig := ed25519.Sign(ed25519.PrivateKey(priv), msg)
+	if err = ioutil.WriteFile(out, []byte(base64.StdEncoding.EncodeToString(sig)), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
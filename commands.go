@@ -0,0 +1,337 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CONTROL_TIMEOUT_DEFAULT = 60 * time.Second
+	CONTROL_TIMEOUT_MAX     = time.Hour
+	// Room left in the control data for the id and the rest of the result
+	CONTROL_RESULT_OVERHEAD = 4096
+	// Op of commands that run Args directly, Args[0] must be allowed
+	CONTROL_OP_RAW = "raw"
+	// Output of running commands is sent in chunks of at most this size
+	// at this interval, up to CONTROL_PROGRESS_MAX bytes per command
+	CONTROL_PROGRESS_CHUNK    = 4096
+	CONTROL_PROGRESS_INTERVAL = time.Second
+	CONTROL_PROGRESS_MAX      = 1 << 20
+)
+
+// controlCommand is the data of a RESPONSE_SYSTEM after the id. Legacy
+// servers send a JSON argv which is treated as a raw command.
+type controlCommand struct {
+	Op   string
+	Args []string
+	// Seconds, zero uses the default of the operation
+	Timeout int
+}
+
+// controlResult is sent back with REQUEST_CONTROL_COMPLETE after the id
+type controlResult struct {
+	Op string
+	// Exit status of the last command that ran, -1 if it did not finish
+	Exit int
+	// Seconds
+	Duration float64
+	Stdout   string
+	Stderr   string
+	// Set if the command could not be run or timed out
+	Error string `json:",omitempty"`
+}
+
+// marshalControlResult encodes result to fit in maxctrl bytes of control
+// data after id. Escaping can grow the output past the limit so the output
+// is cut down until it fits, then the error and then the op.
+func marshalControlResult(id string, result controlResult, maxctrl int) ([]byte, error) {
+	for {
+		resultjson, err := json.Marshal(result)
+		if err != nil || len(id)+1+len(resultjson) <= maxctrl {
+			return resultjson, err
+		}
+		switch {
+		case result.Stdout != "" || result.Stderr != "":
+			result.Stdout = result.Stdout[:len(result.Stdout)/2]
+			result.Stderr = result.Stderr[:len(result.Stderr)/2]
+		case result.Error != "":
+			result.Error = result.Error[:len(result.Error)/2]
+		case result.Op != "":
+			result.Op = result.Op[:len(result.Op)/2]
+		default:
+			return nil, errors.New("Control result does not fit in the control data")
+		}
+	}
+}
+
+// controlOp is a named operation the client knows how to run
+type controlOp struct {
+	// Commands run in order, a failure stops the rest unless keepGoing
+	commands  func(args []string) ([][]string, error)
+	timeout   time.Duration
+	keepGoing bool
+}
+
+// controlOps are the operations servers can ask for by name. Privileged
+// ones use sudo -n so they fail instead of prompting if sudoers does not
+// allow them.
+var controlOps = map[string]controlOp{
+	"restart-bluetooth": {
+		commands: fixedCommands([]string{"sudo", "-n", "systemctl", "restart", "bluetooth"}),
+		timeout:  30 * time.Second,
+	},
+	"report-disk": {
+		commands: func(args []string) ([][]string, error) {
+			return [][]string{append([]string{"df", "-P"}, args...)}, nil
+		},
+		timeout: 10 * time.Second,
+	},
+	"rotate-logs": {
+		commands: fixedCommands([]string{"sudo", "-n", "logrotate", "-f", "/etc/logrotate.conf"}),
+		timeout:  60 * time.Second,
+	},
+	"collect-diagnostics": {
+		commands: fixedCommands(
+			[]string{"uname", "-a"},
+			[]string{"uptime"},
+			[]string{"free", "-m"},
+			[]string{"df", "-P"},
+			[]string{"hciconfig", "-a"},
+			[]string{"vcgencmd", "measure_temp"},
+		),
+		timeout:   60 * time.Second,
+		keepGoing: true,
+	},
+}
+
+// fixedCommands returns commands for an operation which takes no args
+func fixedCommands(commands ...[]string) func([]string) ([][]string, error) {
+	return func(args []string) ([][]string, error) {
+		if len(args) != 0 {
+			return nil, errors.New("Operation takes no arguments")
+		}
+		return commands, nil
+	}
+}
+
+// parseControlCommand decodes the command sent by the server
+func parseControlCommand(data string) (controlCommand, error) {
+	var cmd controlCommand
+	trimmed := strings.TrimSpace(data)
+	if strings.HasPrefix(trimmed, "[") {
+		cmd.Op = CONTROL_OP_RAW
+		err := json.Unmarshal([]byte(trimmed), &cmd.Args)
+		return cmd, err
+	}
+	err := json.Unmarshal([]byte(trimmed), &cmd)
+	return cmd, err
+}
+
+// runControlCommand runs cmd if it is a known operation or an allowed raw
+// command, output beyond limit bytes per stream is truncated. Output of
+// both streams is also written to progress if it is not nil.
+func runControlCommand(cmd controlCommand, allowRaw map[string]struct{}, limit int,
+	progress io.Writer) controlResult {
+	result := controlResult{Op: cmd.Op, Exit: -1}
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start).Seconds()
+	}()
+
+	var commands [][]string
+	var timeout time.Duration
+	var keepGoing bool
+	if cmd.Op == CONTROL_OP_RAW {
+		if len(cmd.Args) == 0 {
+			result.Error = "Raw command is empty"
+			return result
+		}
+		if _, ok := allowRaw[cmd.Args[0]]; !ok {
+			result.Error = fmt.Sprintf("Raw command %s is not allowed", cmd.Args[0])
+			return result
+		}
+		commands = [][]string{cmd.Args}
+		timeout = CONTROL_TIMEOUT_DEFAULT
+	} else {
+		op, ok := controlOps[cmd.Op]
+		if !ok {
+			result.Error = fmt.Sprintf("Unknown operation %s", cmd.Op)
+			return result
+		}
+		var err error
+		if commands, err = op.commands(cmd.Args); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		timeout, keepGoing = op.timeout, op.keepGoing
+	}
+	if cmd.Timeout > 0 {
+		timeout = time.Duration(cmd.Timeout) * time.Second
+	}
+	if timeout > CONTROL_TIMEOUT_MAX {
+		timeout = CONTROL_TIMEOUT_MAX
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	stdout := &limitedBuffer{limit: limit}
+	stderr := &limitedBuffer{limit: limit}
+	var outw, errw io.Writer = stdout, stderr
+	if progress != nil {
+		outw, errw = io.MultiWriter(stdout, progress), io.MultiWriter(stderr, progress)
+	}
+	for _, argv := range commands {
+		if len(commands) > 1 {
+			fmt.Fprintf(outw, "$ %s\n", strings.Join(argv, " "))
+		}
+		c := exec.CommandContext(ctx, argv[0], argv[1:]...)
+		c.Stdout, c.Stderr = outw, errw
+		// Children holding the output open must not outlive the timeout
+		c.WaitDelay = time.Second
+		err := c.Run()
+		result.Exit = -1
+		if c.ProcessState != nil {
+			result.Exit = c.ProcessState.ExitCode()
+		}
+		if ctx.Err() != nil {
+			result.Error = fmt.Sprintf("Timed out after %s", timeout)
+			break
+		}
+		if err != nil && result.Exit == -1 {
+			fmt.Fprintf(errw, "%s: %s\n", argv[0], err)
+		}
+		if err != nil && !keepGoing {
+			break
+		}
+	}
+	result.Stdout, result.Stderr = stdout.String(), stderr.String()
+	return result
+}
+
+// limitedBuffer keeps the first limit bytes written to it
+type limitedBuffer struct {
+	// Not embedded so io.Copy can't bypass Write with ReadFrom
+	buff      bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buff.Len(); room < len(p) {
+		if room > 0 {
+			b.buff.Write(p[:room])
+		}
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buff.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buff.String() + "\n[truncated]"
+	}
+	return b.buff.String()
+}
+
+// progressWriter collects the output of a running command and sends it
+// in chunks as REQUEST_CONTROL_LOG packets tagged with the control id
+type progressWriter struct {
+	sync.Mutex
+	id      string
+	uuid    Uuid
+	buff    bytes.Buffer
+	sent    int
+	packets chan<- *BeaconLogPacket
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func newProgressWriter(id string, uuid Uuid, packets chan<- *BeaconLogPacket) *progressWriter {
+	p := &progressWriter{
+		id:      id,
+		uuid:    uuid,
+		packets: packets,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	if room := CONTROL_PROGRESS_MAX - p.sent - p.buff.Len(); room < len(b) {
+		if room > 0 {
+			p.buff.Write(b[:room])
+		}
+		return len(b), nil
+	}
+	return p.buff.Write(b)
+}
+
+// run sends the output collected every interval
+func (p *progressWriter) run() {
+	defer close(p.stopped)
+	ticker := time.NewTicker(CONTROL_PROGRESS_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case _ = <-ticker.C:
+			p.flush()
+		case _ = <-p.done:
+			p.flush()
+			return
+		}
+	}
+}
+
+func (p *progressWriter) flush() {
+	for {
+		p.Lock()
+		// Copied while locked, Next returns the memory of the buffer
+		chunk := string(p.buff.Next(CONTROL_PROGRESS_CHUNK))
+		p.sent += len(chunk)
+		p.Unlock()
+		if len(chunk) == 0 {
+			return
+		}
+		var datapacket BeaconLogPacket
+		datapacket.Flags = REQUEST_CONTROL_LOG
+		datapacket.Uuid = p.uuid
+		datapacket.ControlData = p.id + "\n" + chunk
+		p.packets <- &datapacket
+	}
+}
+
+// Close sends the remaining output
+func (p *progressWriter) Close() error {
+	close(p.done)
+	<-p.stopped
+	return nil
+}
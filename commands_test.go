@@ -0,0 +1,141 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRunControlCommand(t *testing.T) {
+	allow := map[string]struct{}{"sh": struct{}{}, "sleep": struct{}{}}
+
+	cmd, err := parseControlCommand(`["sh", "-c", "echo out; echo err >&2; exit 3"]`)
+	if err != nil || cmd.Op != CONTROL_OP_RAW {
+		t.Fatalf("Legacy argv parsed as %#v, %v", cmd, err)
+	}
+	res := runControlCommand(cmd, allow, 1024, nil)
+	if res.Exit != 3 || res.Stdout != "out\n" || res.Stderr != "err\n" || res.Error != "" {
+		t.Errorf("Unexpected result %#v", res)
+	}
+
+	res = runControlCommand(controlCommand{Op: CONTROL_OP_RAW, Args: []string{"rm", "-rf", "/"}}, allow, 1024, nil)
+	if res.Error == "" || res.Exit != -1 {
+		t.Errorf("Raw command not in the allow list ran %#v", res)
+	}
+
+	res = runControlCommand(controlCommand{Op: "format-disk"}, allow, 1024, nil)
+	if !strings.Contains(res.Error, "Unknown operation") {
+		t.Errorf("Unknown operation ran %#v", res)
+	}
+
+	cmd, _ = parseControlCommand(`{"Op": "raw", "Args": ["sleep", "10"], "Timeout": 1}`)
+	res = runControlCommand(cmd, allow, 1024, nil)
+	if !strings.Contains(res.Error, "Timed out") || res.Duration > 5 {
+		t.Errorf("Command was not timed out %#v", res)
+	}
+
+	cmd, _ = parseControlCommand(`["sh", "-c", "yes | head -c 100000"]`)
+	res = runControlCommand(cmd, allow, 1024, nil)
+	if len(res.Stdout) > 1024+len("\n[truncated]") || !strings.HasSuffix(res.Stdout, "[truncated]") {
+		t.Errorf("Output was not truncated, %d bytes", len(res.Stdout))
+	}
+}
+
+func TestControlProgress(t *testing.T) {
+	allow := map[string]struct{}{"sh": struct{}{}}
+	packets := make(chan *BeaconLogPacket, 16)
+	progress := newProgressWriter("7", Uuid{}, packets)
+	cmd := controlCommand{Op: CONTROL_OP_RAW, Args: []string{"sh", "-c", "echo a; echo b >&2"}}
+	res := runControlCommand(cmd, allow, 1024, progress)
+	progress.Close()
+	close(packets)
+	if res.Stdout != "a\n" || res.Stderr != "b\n" {
+		t.Fatalf("Unexpected result %#v", res)
+	}
+	var output string
+	for p := range packets {
+		if p.Flags != REQUEST_CONTROL_LOG || !strings.HasPrefix(p.ControlData, "7\n") {
+			t.Fatalf("Unexpected progress packet %#v", p)
+		}
+		output += strings.TrimPrefix(p.ControlData, "7\n")
+	}
+	if len(output) != 4 || !strings.Contains(output, "a\n") || !strings.Contains(output, "b\n") {
+		t.Fatalf("Progress output was %q", output)
+	}
+}
+
+func TestControlProgressConcurrent(t *testing.T) {
+	packets := make(chan *BeaconLogPacket, 1024)
+	progress := newProgressWriter("7", Uuid{}, packets)
+	var want strings.Builder
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20000; i++ {
+			line := fmt.Sprintf("%05d\n", i)
+			want.WriteString(line)
+			progress.Write([]byte(line))
+		}
+	}()
+	// Chunks are sent while the command is still writing
+	for running := true; running; {
+		select {
+		case _ = <-done:
+			running = false
+		default:
+			progress.flush()
+		}
+	}
+	progress.Close()
+	close(packets)
+	var output strings.Builder
+	for p := range packets {
+		output.WriteString(strings.TrimPrefix(p.ControlData, "7\n"))
+	}
+	if output.String() != want.String() {
+		t.Fatalf("Progress output of %d bytes differs from the %d written",
+			output.Len(), want.Len())
+	}
+}
+
+func TestMarshalControlResult(t *testing.T) {
+	long := strings.Repeat("<\"x", 5000)
+	for _, res := range []controlResult{
+		{Op: "raw", Stdout: long, Stderr: long},
+		{Op: CONTROL_OP_RAW, Exit: -1, Error: "Raw command " + long + " is not allowed"},
+		{Op: long, Exit: -1, Error: "Unknown operation " + long},
+	} {
+		data, err := marshalControlResult("12", res, 1024)
+		if err != nil || 3+len(data) > 1024 {
+			t.Fatalf("Result was %d bytes: %v", len(data), err)
+		}
+		var back controlResult
+		if err = json.Unmarshal(data, &back); err != nil || back.Exit != res.Exit {
+			t.Fatalf("Result was %s: %v", data, err)
+		}
+	}
+	short := controlResult{Op: "report-disk", Stdout: "ok"}
+	if data, _ := marshalControlResult("12", short, 1024); !strings.Contains(string(data), `"Stdout":"ok"`) {
+		t.Errorf("Result that fits was changed %s", data)
+	}
+	if _, err := marshalControlResult(strings.Repeat("1", 1024), short, 1024); err == nil {
+		t.Error("Result longer than the control data was accepted")
+	}
+}
@@ -0,0 +1,566 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// metricsserv builds cause problems with other binaries due to inclusion
+// of packages that require python3
+// +build metrics
+
+package beaconpi
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/json"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	CONTROL_TAIL_POLL = 500 * time.Millisecond
+	CONTROL_TAIL_MAX  = 30 * time.Minute
+
+	CONTROL_LIST_DEFAULT = 100
+	CONTROL_LIST_MAX     = 1000
+)
+
+// Platforms of updates are GOOS/GOARCH as reported by the edges
+var updatePlatformRe = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9]+$`)
+
+// edgeAction marks edges with an action the beacon server sends on the
+// next packet from each of them
+func edgeAction() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Edges []int
+			// One of none, restart, shutdown or update
+			Action string
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in EdgeAction %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		action := -1
+		for k, v := range actionNames {
+			if v == input.Action {
+				action = k
+			}
+		}
+		if action < 0 || len(input.Edges) == 0 {
+			log.Infof("Invalid edge action \"%s\" for %v", input.Action, input.Edges)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		res, err := db.Exec(`update edge_node set pending_action = $1
+				where id = any($2::int[])`, action, pq.Array(input.Edges))
+		if err != nil {
+			log.Infof("Failed operation on DB %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		n, _ := res.RowsAffected()
+		jsonResponse(w, map[string]interface{}{
+			"Success": true,
+			"Edges":   n,
+		})
+	})
+}
+
+// uploadUpdate stores a signed client binary sent to edges told to update,
+// the signature covers the version, platform and binary as signed by
+// signupdate
+func uploadUpdate() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Version string
+			// GOOS/GOARCH of the binary, for example linux/arm
+			Platform string
+			// Base64 encoded by encoding/json
+			Binary    []byte
+			Signature []byte
+		}{}
+		dec := json.NewDecoder(req.Body)
+		err := dec.Decode(&input)
+		if err != nil {
+			log.Infof("Failed to decode json request in UploadUpdate %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		err = validateLen(nil, input.Version, "Version", 1)
+		err = validateLen(err, input.Platform, "Platform", 3)
+		if err == nil && (strings.Contains(input.Version, "\n") ||
+			!updatePlatformRe.MatchString(input.Platform)) {
+			err = errors.New("Version can't have newlines and Platform must be GOOS/GOARCH")
+		}
+		if err != nil || len(input.Binary) == 0 ||
+			len(input.Signature) != ed25519.SignatureSize {
+			log.Infof("Failed validation %v", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		var id int
+		err = db.QueryRow(`insert into edge_updates
+				(version, platform, data, signature) values ($1, $2, $3, $4)
+				returning id`, input.Version, input.Platform, input.Binary,
+			input.Signature).Scan(&id)
+		if err != nil {
+			log.Errorf("Failed to insert update %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Success": true,
+			"Id":      id,
+		})
+	})
+}
+
+// tailControl streams the control_log entries of a command as newline
+// delimited JSON as they arrive, it ends once the command has completed
+func tailControl() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Control int
+			// Only entries with a higher id are sent
+			After int
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in TailControl %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+
+		var completed bool
+		err = db.QueryRow(`select completed from control_commands where id = $1`,
+			input.Control).Scan(&completed)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Invalid Request", 400)
+			return
+		} else if err != nil {
+			log.Errorf("Failed to query control %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+
+		type entry struct {
+			Id       int
+			Datetime string
+			Data     string
+			// Set on the result of the command
+			Exit *int `json:",omitempty"`
+			Done bool
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		enc := json.NewEncoder(w)
+		after := input.After
+		deadline := time.Now().Add(CONTROL_TAIL_MAX)
+		// Legacy results have no exit status, the command being completed
+		// before the last poll means its result was already read
+		wascompleted := false
+		for {
+			rows, err := db.Query(`
+				select id, datetime, data, exit_status
+				from control_log
+				where controlid = $1 and id > $2
+				order by id`, input.Control, after)
+			if err != nil {
+				log.Errorf("Failed to query control log %s", err)
+				return
+			}
+			done := false
+			for rows.Next() {
+				var e entry
+				var datetime time.Time
+				var data sql.NullString
+				var exit sql.NullInt64
+				if err = rows.Scan(&e.Id, &datetime, &data, &exit); err != nil {
+					log.Errorf("Failed to scan control log %s", err)
+					rows.Close()
+					return
+				}
+				e.Datetime = datetime.Format(time.RFC3339Nano)
+				e.Data = data.String
+				if exit.Valid {
+					code := int(exit.Int64)
+					e.Exit = &code
+					e.Done = true
+					done = true
+				}
+				after = e.Id
+				if err = enc.Encode(e); err != nil {
+					rows.Close()
+					return
+				}
+			}
+			rows.Close()
+			if flusher != nil {
+				flusher.Flush()
+			}
+			if done || wascompleted || time.Now().After(deadline) {
+				return
+			}
+			wascompleted = completed
+			select {
+			case _ = <-req.Context().Done():
+				return
+			case _ = <-time.After(CONTROL_TAIL_POLL):
+			}
+			if err = db.QueryRow(`select completed from control_commands where id = $1`,
+				input.Control).Scan(&completed); err != nil {
+				log.Errorf("Failed to query control %s", err)
+				return
+			}
+		}
+	})
+}
+
+// enqueueControl queues a command for the given edges, or all enabled edges
+// when All is set
+func enqueueControl() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Edges   []int
+			All     bool
+			Command controlCommand
+			// RFC3339, the command is not sent after this time
+			Expires *time.Time
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in EnqueueControl %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if err := validateControlCommand(input.Command); err != nil ||
+			(len(input.Edges) == 0 && !input.All) {
+			log.Infof("Invalid control command %v for %v: %v", input.Command,
+				input.Edges, err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		data, err := json.Marshal(input.Command)
+		if err != nil {
+			log.Errorf("Failed to encode control command %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		rows, err := db.Query(`
+			insert into control_commands (edgenodeid, data, expires_at)
+			select id, $1, $2
+			from edge_node
+			where ($3 and enabled) or id = any($4::int[])
+			order by id
+			returning id, edgenodeid`, string(data), input.Expires, input.All,
+			pq.Array(input.Edges))
+		if err != nil {
+			log.Infof("Failed operation on DB %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		defer rows.Close()
+		type queued struct {
+			Id   int
+			Edge int
+		}
+		commands := []queued{}
+		for rows.Next() {
+			var q queued
+			if err = rows.Scan(&q.Id, &q.Edge); err != nil {
+				log.Errorf("Failed to scan queued control %s", err)
+				http.Error(w, "Server failure", 500)
+				return
+			}
+			commands = append(commands, q)
+		}
+		if err = rows.Err(); err != nil {
+			log.Errorf("Failed to queue control %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Success":  true,
+			"Commands": commands,
+		})
+	})
+}
+
+// validateControlCommand checks the command is one an edge can run
+func validateControlCommand(cmd controlCommand) error {
+	if cmd.Timeout < 0 || time.Duration(cmd.Timeout)*time.Second > CONTROL_TIMEOUT_MAX {
+		return errors.New("Timeout out of range")
+	}
+	if cmd.Op == CONTROL_OP_RAW {
+		if len(cmd.Args) == 0 {
+			return errors.New("Raw command has no arguments")
+		}
+		return nil
+	}
+	op, ok := controlOps[cmd.Op]
+	if !ok {
+		return errors.Errorf("Unknown operation \"%s\"", cmd.Op)
+	}
+	_, err := op.commands(cmd.Args)
+	return err
+}
+
+// listControl lists commands with their status and the result reported by
+// the edge, newest first
+func listControl() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			// Empty for every edge
+			Edges []int
+			// Empty for every status
+			Status []string
+			// Defaults to CONTROL_LIST_DEFAULT
+			Limit int
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in ListControl %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if input.Limit <= 0 || input.Limit > CONTROL_LIST_MAX {
+			input.Limit = CONTROL_LIST_DEFAULT
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		if err = dbExpireControls(0, db); err != nil {
+			log.Errorf("Failed to expire controls %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		rows, err := db.Query(`
+			select c.id, c.edgenodeid, c.data, c.status, c.datetime, c.sent_at,
+				c.completed_at, c.cancelled_at, c.expires_at,
+				l.exit_status, l.duration, coalesce(l.stdout, l.data), l.stderr
+			from control_commands as c
+			left join lateral (
+				select exit_status, duration, stdout, stderr, data
+				from control_log
+				where controlid = c.id
+				order by (exit_status is not null) desc, id desc
+				limit 1
+			) as l on c.completed
+			where (coalesce(cardinality($1::int[]), 0) = 0 or c.edgenodeid = any($1::int[]))
+				and (coalesce(cardinality($2::text[]), 0) = 0 or c.status = any($2::text[]))
+			order by c.datetime desc, c.id desc
+			limit $3`, pq.Array(input.Edges), pq.Array(input.Status), input.Limit)
+		if err != nil {
+			log.Infof("Failed operation on DB %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		defer rows.Close()
+		type command struct {
+			Id      int
+			Edge    int
+			Data    string
+			Status  string
+			Created time.Time
+			// Null until the status is reached
+			Sent, Completed, Cancelled *time.Time
+			Expires                    *time.Time
+			// Result reported by the edge once completed
+			Exit     *int64
+			Duration *float64
+			Stdout   *string
+			Stderr   *string
+		}
+		commands := []command{}
+		for rows.Next() {
+			var c command
+			var data sql.NullString
+			var sent, completed, cancelled, expires sql.NullTime
+			var exit sql.NullInt64
+			var duration sql.NullFloat64
+			var stdout, stderr sql.NullString
+			err = rows.Scan(&c.Id, &c.Edge, &data, &c.Status, &c.Created, &sent,
+				&completed, &cancelled, &expires, &exit, &duration, &stdout, &stderr)
+			if err != nil {
+				log.Errorf("Failed to scan control %s", err)
+				http.Error(w, "Server failure", 500)
+				return
+			}
+			c.Data = data.String
+			c.Sent = nullTime(sent)
+			c.Completed = nullTime(completed)
+			c.Cancelled = nullTime(cancelled)
+			c.Expires = nullTime(expires)
+			if exit.Valid {
+				c.Exit = &exit.Int64
+			}
+			if duration.Valid {
+				c.Duration = &duration.Float64
+			}
+			if stdout.Valid {
+				c.Stdout = &stdout.String
+			}
+			if stderr.Valid {
+				c.Stderr = &stderr.String
+			}
+			commands = append(commands, c)
+		}
+		if err = rows.Err(); err != nil {
+			log.Errorf("Failed to list controls %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Success":  true,
+			"Commands": commands,
+		})
+	})
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// cancelControl cancels commands that have not been sent yet, commands
+// already on the edge run to completion
+func cancelControl() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Ids []int
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil || len(input.Ids) == 0 {
+			log.Infof("Failed to decode json request in CancelControl %v", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		ids, err := dbCancelControls(input.Ids, db)
+		if err != nil {
+			log.Errorf("Failed to cancel controls %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Success":   true,
+			"Cancelled": ids,
+		})
+	})
+}
+
+// expireControl sets or clears when pending commands expire
+func expireControl() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Ids []int
+			// RFC3339, null to never expire
+			Expires *time.Time
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil || len(input.Ids) == 0 {
+			log.Infof("Failed to decode json request in ExpireControl %v", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		ids, err := updateControls(db, `
+			update control_commands
+			set expires_at = $2
+			where id = any($1::int[]) and status = $3
+			returning id`, pq.Array(input.Ids), input.Expires, CONTROL_STATUS_PENDING)
+		if err != nil {
+			log.Errorf("Failed to set control expiry %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		if err = dbExpireControls(0, db); err != nil {
+			log.Errorf("Failed to expire controls %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Success": true,
+			"Updated": ids,
+		})
+	})
+}
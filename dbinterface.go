@@ -19,8 +19,9 @@ package beaconpi
 import (
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"math"
@@ -41,9 +42,10 @@ func (dbh *dbHandler) openDB() (*sql.DB, error) {
 }
 
 // dbAddLogsForBeacons given a packet and edge add the logs for the packet
-// into the database
-func dbAddLogsForBeacons(pack *BeaconLogPacket, edgeid int, db *sql.DB) error {
-	if len(pack.Logs) == 0 {
+// into the database through writer. Aggregates are inserted into
+// beacon_log_agg and also written as a log for the middle of their window.
+func dbAddLogsForBeacons(pack *BeaconLogPacket, edgeid int, db *sql.DB, writer *logWriter) error {
+	if len(pack.Logs) == 0 && len(pack.Aggregates) == 0 && len(pack.Telemetry) == 0 {
 		return nil
 	}
 
@@ -52,20 +54,29 @@ func dbAddLogsForBeacons(pack *BeaconLogPacket, edgeid int, db *sql.DB) error {
 		return err
 	}
 
-	data := make([]struct {
-		Datetime time.Time
-		Rssi     int
-		Beaconid int
-	}, len(pack.Logs))
+	data := make([]beaconLogRow, 0, len(pack.Logs)+len(pack.Aggregates))
 
 	// Line is gaurunteed by guard at top
-	firstlog := pack.Logs[0]
-	log.Debug("Time on beacon recieved ", firstlog)
+	var firsttime time.Time
+	if len(pack.Logs) > 0 {
+		firsttime = pack.Logs[0].Datetime
+	} else if len(pack.Aggregates) > 0 {
+		firsttime = pack.Aggregates[0].Start
+	} else {
+		firsttime = pack.Telemetry[0].Datetime
+	}
+	log.Debug("Time on beacon recieved ", firsttime)
 
-	// Check if the packet is old, we should probably drop it if it is really old
+	// Check the clock of the client, logs replayed from its spool are old
+	// so the time the packet was sent is used when the client provides it
 	maxtimediff := 5.0
 	maxtimedifferr := 30.0
-	diff := firstlog.Datetime.Sub(time.Now()).Seconds()
+	senttime, ok := pack.SentTime()
+	if !ok {
+		senttime = firsttime
+	}
+	skew := time.Since(senttime)
+	diff := -skew.Seconds()
 
 	if math.Abs(diff) > maxtimedifferr {
 		errorstr := fmt.Sprintf("Time between server and client is greater than %f, (%f)", maxtimediff, diff)
@@ -80,47 +91,182 @@ func dbAddLogsForBeacons(pack *BeaconLogPacket, edgeid int, db *sql.DB) error {
 		dbInsertError(ERROR_DESYNC, ERROR_WARN, errorstr, edgeid, "2 minutes", db)
 	}
 
-	for i, logv := range pack.Logs {
-		data[i].Datetime = logv.Datetime
-		data[i].Rssi = int(logv.Rssi)
-		// TODO(mae) additional error logging here for ids that don't exist
-		data[i].Beaconid = beaconids[logv.BeaconIndex]
+	for _, logv := range pack.Logs {
+		if int(logv.BeaconIndex) >= len(beaconids) {
+			return errors.New("Log references a beacon not in the packet")
+		}
+		beaconid := beaconids[logv.BeaconIndex]
+		if beaconid == 0 {
+			continue
+		}
+		data = append(data, beaconLogRow{
+			Datetime: logv.Datetime,
+			Rssi:     int(logv.Rssi),
+			TxPower:  logv.TxPower,
+			Edgeid:   edgeid,
+			Beaconid: beaconid,
+		})
+	}
+	aggs := make([]beaconAggregateRow, 0, len(pack.Aggregates))
+	for _, a := range pack.Aggregates {
+		if int(a.BeaconIndex) >= len(beaconids) {
+			return errors.New("Aggregate references a beacon not in the packet")
+		}
+		beaconid := beaconids[a.BeaconIndex]
+		if beaconid == 0 {
+			continue
+		}
+		aggs = append(aggs, beaconAggregateRow{a, beaconid, edgeid})
+	}
+	tlms := make([]beaconTelemetryRow, 0, len(pack.Telemetry))
+	for _, tlm := range pack.Telemetry {
+		if int(tlm.BeaconIndex) >= len(beaconids) {
+			return errors.New("Telemetry references a beacon not in the packet")
+		}
+		beaconid := beaconids[tlm.BeaconIndex]
+		if beaconid == 0 {
+			continue
+		}
+		tlms = append(tlms, beaconTelemetryRow{tlm, beaconid, edgeid})
+	}
+	for i, b := range pack.Beacons {
+		if beaconids[i] == 0 {
+			errorstr := fmt.Sprintf("Logs for unknown beacon %s were dropped", b.String())
+			log.Info(errorstr)
+			dbInsertError(ERROR_UNKNOWN_BEACON, ERROR_WARN, errorstr, edgeid, "2 minutes", db)
+		}
+	}
+	if err = writer.Write(data, aggs, tlms, skew); err != nil {
+		return errors.Wrap(err, "Failed to insert into DB")
+	}
+	log.Debugf("Completed inserting %d records, %d aggregates and %d telemetry frames",
+		len(data), len(aggs), len(tlms))
+	return nil
+}
+
+// beaconAggregateRow is an aggregate of the beacon with id in ibeacons
+// seen by the edge with id in edge_node
+type beaconAggregateRow struct {
+	BeaconAggregate
+	Beaconid int
+	Edgeid   int
+}
+
+// logRow is the row of beacon_log standing for the aggregate
+func (a *beaconAggregateRow) logRow() beaconLogRow {
+	return beaconLogRow{
+		Datetime: a.Time(),
+		Rssi:     int(math.Round(a.Rssi())),
+		TxPower:  a.TxPower,
+		Edgeid:   a.Edgeid,
+		Beaconid: a.Beaconid,
+	}
+}
+
+// nullTxPower returns the tx power to insert, unknown tx power is null
+func nullTxPower(txpower int8) *int {
+	if txpower == 0 {
+		return nil
+	}
+	p := int(txpower)
+	return &p
+}
+
+// dbInsertAggregates inserts aggregates into beacon_log_agg within tx and
+// returns the beacon_log rows of those inserted, windows that were already
+// inserted by a replayed packet are skipped along with their rows
+func dbInsertAggregates(tx *sql.Tx, aggs []beaconAggregateRow) ([]beaconLogRow, error) {
+	if len(aggs) == 0 {
+		return nil, nil
 	}
-	for _, row := range data {
-		rows, err := db.Query(`
-			insert into beacon_log
-			(datetime, beaconid, edgenodeid, rssi)
-			VALUES
-			($1, $2, $3, $4)
-		`, row.Datetime.UTC(), row.Beaconid, edgeid, row.Rssi)
+	stmt, err := tx.Prepare(`
+		insert into beacon_log_agg
+		(datetime, window_ms, beaconid, edgenodeid, count, rssi_mean,
+			rssi_median, rssi_min, rssi_max, rssi_kalman, txpower) values
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		on conflict do nothing`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to prepare aggregate insert")
+	}
+	defer stmt.Close()
+	rows := make([]beaconLogRow, 0, len(aggs))
+	for i := range aggs {
+		a := &aggs[i]
+		var kalman *float64
+		if a.Filtered {
+			kalman = &a.Kalman
+		}
+		res, err := stmt.Exec(a.Start.UTC(), int64(a.Window/time.Millisecond), a.Beaconid,
+			a.Edgeid, a.Count, a.Mean, a.Median, a.Min, a.Max, kalman,
+			nullTxPower(a.TxPower))
 		if err != nil {
-			return errors.New("Failed to insert into DB: " + err.Error())
+			return nil, errors.Wrap(err, "Failed to insert aggregate")
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			rows = append(rows, a.logRow())
 		}
-		rows.Close()
 	}
-	if len(data) != 0 {
-		log.Debugf("Completed inserting %d records", len(data))
+	return rows, nil
+}
+
+// beaconTelemetryRow is a telemetry frame of the beacon with id in ibeacons
+// seen by the edge with id in edge_node
+type beaconTelemetryRow struct {
+	BeaconTelemetry
+	Beaconid int
+	Edgeid   int
+}
+
+// dbInsertTelemetry inserts telemetry frames into beacon_telemetry within
+// tx, frames already inserted by a replayed packet are skipped
+func dbInsertTelemetry(tx *sql.Tx, tlms []beaconTelemetryRow) error {
+	if len(tlms) == 0 {
+		return nil
+	}
+	stmt, err := tx.Prepare(`
+		insert into beacon_telemetry
+		(datetime, beaconid, edgenodeid, battery_mv, temperature, adv_count,
+			uptime_ms) values
+		($1, $2, $3, $4, $5, $6, $7)
+		on conflict do nothing`)
+	if err != nil {
+		return errors.Wrap(err, "Failed to prepare telemetry insert")
+	}
+	defer stmt.Close()
+	for i := range tlms {
+		t := &tlms[i]
+		// Beacons without a battery or thermometer send 0 and NaN
+		var battery *int
+		if t.Battery != 0 {
+			mv := int(t.Battery)
+			battery = &mv
+		}
+		var temp *float64
+		if !math.IsNaN(t.Temperature) {
+			temp = &t.Temperature
+		}
+		if _, err = stmt.Exec(t.Datetime.UTC(), t.Beaconid, t.Edgeid, battery, temp,
+			int64(t.AdvCount), int64(t.Uptime/time.Millisecond)); err != nil {
+			return errors.Wrap(err, "Failed to insert telemetry")
+		}
 	}
 	return nil
 }
 
 // dbGetIDForBeacons converts the ID references in the request to integer
-// ids in the DB
+// ids in the DB, beacons that are not registered are 0
 func dbGetIDForBeacons(pack *BeaconLogPacket, db *sql.DB) ([]int, error) {
-	//TODO(mae) optimize this
-	rval := make([]int, len(pack.Beacons))
-	for i, b := range pack.Beacons {
-		var tempid int
-		err := db.QueryRow(`
-			select id
-			from ibeacons
-			where uuid = $1`, b.Uuid.String()).Scan(&tempid)
-		if err != nil {
-			return []int{}, errors.New("Failed while scanning beacon ids: " + err.Error())
-		}
-		rval[i] = tempid
+	return beacons.lookup(pack.Beacons, db)
+}
+
+// dbGetBeaconsForEdge returns the beacons the edge should watch, those that
+// share a site with it
+func dbGetBeaconsForEdge(edge Uuid, db *sql.DB) ([]BeaconData, error) {
+	set, err := beacons.get(db)
+	if err != nil {
+		return nil, err
 	}
-	return rval, nil
+	return set.forEdge(edge), nil
 }
 
 // dbGetBeacons returns all Beacons in the database
@@ -128,7 +274,7 @@ func dbGetBeacons(db *sql.DB) ([]BeaconData, error) {
 	rval := make([]BeaconData, 0, 8)
 
 	rows, err := db.Query(`
-		select uuid, major, minor
+		select uuid, major, minor, beacontype
 		from ibeacons
 	`)
 	if err != nil {
@@ -137,11 +283,12 @@ func dbGetBeacons(db *sql.DB) ([]BeaconData, error) {
 	defer rows.Close()
 	for rows.Next() {
 		var (
-			uuid  string
-			major uint16
-			minor uint16
+			uuid       string
+			major      uint16
+			minor      uint16
+			beacontype uint8
 		)
-		if err := rows.Scan(&uuid, &major, &minor); err != nil {
+		if err := rows.Scan(&uuid, &major, &minor, &beacontype); err != nil {
 			return rval, errors.New("Failed while scanning ibeacons: " + err.Error())
 		}
 		uuid = strings.Replace(uuid, "-", "", -1)
@@ -149,20 +296,60 @@ func dbGetBeacons(db *sql.DB) ([]BeaconData, error) {
 		if err != nil {
 			return rval, errors.New("Failed while decoding hex: " + err.Error())
 		}
-		bdtemp := BeaconData{Major: major, Minor: minor}
+		bdtemp := BeaconData{Major: major, Minor: minor, Type: beacontype}
 		copy(bdtemp.Uuid[:], hexb[:16])
 		rval = append(rval, bdtemp)
 	}
 	return rval, nil
 }
 
+// dbAddDiscovered records the beacons seen by an edge in discovery mode,
+// registered beacons are skipped
+func dbAddDiscovered(edgeid int, bs []BeaconData, seen []discoveredBeacon, db *sql.DB) error {
+	ids, err := beacons.lookup(bs, db)
+	if err != nil {
+		return err
+	}
+	for i, b := range bs {
+		if ids[i] != 0 {
+			continue
+		}
+		_, err = db.Exec(`
+			insert into discovered_beacons as d
+			(uuid, major, minor, beacontype, edgenodeid, first_seen, last_seen,
+				best_rssi, count) values
+			($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			on conflict (uuid, major, minor, beacontype, edgenodeid) do update set
+				first_seen = least(d.first_seen, excluded.first_seen),
+				last_seen = greatest(d.last_seen, excluded.last_seen),
+				best_rssi = greatest(d.best_rssi, excluded.best_rssi),
+				count = d.count + excluded.count
+		`, b.Uuid.String(), b.Major, b.Minor, b.Type, edgeid, seen[i].First,
+			seen[i].Last, seen[i].Rssi, seen[i].Count)
+		if err != nil {
+			return errors.Wrap(err, "Failed to insert discovered beacon")
+		}
+	}
+	return nil
+}
+
 // dbInsertControlLog accepts a packet containing a Control Log from the edge
-// in the DB with ID edgenodeid and inserts the log
+// in the DB with ID edgenodeid and inserts the log. Output of a running
+// command is prefixed by its id and a newline.
 func dbInsertControlLog(edgenodeid int, packet *BeaconLogPacket, db *sql.DB) error {
+	data := packet.ControlData
+	var controlid *int
+	if pdata := strings.SplitN(data, "\n", 2); len(pdata) == 2 {
+		if id, err := strconv.Atoi(pdata[0]); err == nil {
+			controlid, data = &id, pdata[1]
+		}
+	}
+	// Commands for other edges are not linked
 	rows, err := db.Query(`
-		insert into control_log (edgenodeid, data)
-		values ($1, $2)
-	`, edgenodeid, packet.ControlData)
+		insert into control_log (edgenodeid, controlid, data)
+		values ($1, (select id from control_commands
+			where id = $2 and edgenodeid = $1), $3)
+	`, edgenodeid, controlid, sanitizeText(data))
 	if err != nil {
 		return errors.New("Failed to insert control log: " + err.Error())
 	}
@@ -170,6 +357,25 @@ func dbInsertControlLog(edgenodeid int, packet *BeaconLogPacket, db *sql.DB) err
 	return nil
 }
 
+// sanitizeText makes command output safe to store as postgres text
+func sanitizeText(s string) string {
+	return strings.Replace(strings.ToValidUTF8(s, "\uFFFD"), "\x00", "", -1)
+}
+
+// Values of control_commands.status
+const (
+	CONTROL_STATUS_PENDING   = "pending"
+	CONTROL_STATUS_SENT      = "sent"
+	CONTROL_STATUS_COMPLETED = "completed"
+	CONTROL_STATUS_FAILED    = "failed"
+	CONTROL_STATUS_EXPIRED   = "expired"
+	CONTROL_STATUS_CANCELLED = "cancelled"
+)
+
+// CONTROL_RESEND_AFTER is how long a sent command may go without a result
+// before it is sent again, longer than any command may run
+const CONTROL_RESEND_AFTER = CONTROL_TIMEOUT_MAX + 5*time.Minute
+
 func dbCompleteControl(packet *BeaconLogPacket, db *sql.DB) error {
 	edgeid, err := dbCheckUuid(packet.Uuid, db)
 	if err != nil {
@@ -183,42 +389,118 @@ func dbCompleteControl(packet *BeaconLogPacket, db *sql.DB) error {
 	if err != nil {
 		return errors.New("Failed to update control because: " + err.Error())
 	}
-	rows, err := db.Query(`
-		update control_commands
-		set COMPLETED = TRUE
-		where edgenodeid = $1 and id = $2
-	`, edgeid, controlid)
+	// Clients before structured commands send the combined output
+	var result controlResult
+	var rows *sql.Rows
+	status := CONTROL_STATUS_COMPLETED
+	if err = json.Unmarshal([]byte(pdata[1]), &result); err != nil {
+		rows, err = db.Query(`
+			insert into control_log 
+			(edgenodeid, controlid, data) VALUES
+			($1, $2, $3)
+		`, edgeid, controlid, sanitizeText(pdata[1]))
+	} else {
+		if result.Exit != 0 || result.Error != "" {
+			status = CONTROL_STATUS_FAILED
+		}
+		data := result.Stdout + result.Stderr
+		if result.Error != "" {
+			data += result.Error
+		}
+		rows, err = db.Query(`
+			insert into control_log 
+			(edgenodeid, controlid, data, op, exit_status, duration, stdout, stderr) VALUES
+			($1, $2, $3, $4, $5, $6, $7, $8)
+		`, edgeid, controlid, sanitizeText(data), result.Op, result.Exit,
+			result.Duration, sanitizeText(result.Stdout), sanitizeText(result.Stderr))
+	}
 	if err != nil {
 		return errors.New("Failed to update control because: " + err.Error())
 	}
 	rows.Close()
-	rows, err = db.Query(`
-		insert into control_log 
-		(edgenodeid, controlid, data) VALUES
-		($1, $2, $3)
-	`, edgeid, controlid, pdata[1])
+	// Cancelled commands that already ran still record how they went
+	_, err = db.Exec(`
+		update control_commands
+		set completed = TRUE, status = $3, completed_at = current_timestamp
+		where edgenodeid = $1 and id = $2
+	`, edgeid, controlid, status)
 	if err != nil {
 		return errors.New("Failed to update control because: " + err.Error())
 	}
-	rows.Close()
 	return nil
 }
 
-// dbGetControl sets that the Control Message was completed
+// dbExpireControls marks commands past their expiry as expired if they are
+// pending or would be sent again, edgeid of 0 expires them for every edge
+func dbExpireControls(edgeid int, db *sql.DB) error {
+	_, err := db.Exec(`
+		update control_commands
+		set status = $2
+		where (status = $3
+				or (status = $4 and sent_at < current_timestamp - $5 * interval '1 second'))
+			and expires_at < current_timestamp
+			and ($1 = 0 or edgenodeid = $1)
+	`, edgeid, CONTROL_STATUS_EXPIRED, CONTROL_STATUS_PENDING, CONTROL_STATUS_SENT,
+		CONTROL_RESEND_AFTER.Seconds())
+	return err
+}
+
+// dbCancelControls cancels the commands of ids that are still pending and
+// returns the ids of those cancelled
+func dbCancelControls(ids []int, db *sql.DB) ([]int, error) {
+	return updateControls(db, `
+		update control_commands
+		set status = $2, cancelled_at = current_timestamp
+		where id = any($1::int[]) and status = $3
+		returning id`, pq.Array(ids), CONTROL_STATUS_CANCELLED,
+		CONTROL_STATUS_PENDING)
+}
+
+// updateControls runs an update returning the ids of the changed commands
+func updateControls(db *sql.DB, query string, args ...interface{}) ([]int, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// dbGetControl returns the oldest command for the edge that has not been sent
+// and marks it sent. Commands that were sent but never completed, such as
+// when the edge restarted, are sent again after CONTROL_RESEND_AFTER
 func dbGetControl(packet *BeaconLogPacket, db *sql.DB) (string, error) {
 	edgeid, err := dbCheckUuid(packet.Uuid, db)
 	if err != nil {
 		return "", errors.New("Failed to get control because: " + err.Error())
 	}
+	if err = dbExpireControls(edgeid, db); err != nil {
+		return "", errors.New("Failed to get control because: " + err.Error())
+	}
 	var data string
 	var id int
 	err = db.QueryRow(`
-		select id, data
-		from control_commands
-		where edgenodeid = $1 and completed = FALSE
-		order by datetime
-		limit 1
-	`, edgeid).Scan(&id, &data)
+		update control_commands
+		set status = $3, sent_at = current_timestamp
+		where id = (
+			select id
+			from control_commands
+			where edgenodeid = $1 and (status = $4
+				or (status = $3 and sent_at < current_timestamp - $2 * interval '1 second'))
+			order by datetime
+			limit 1
+			for update skip locked)
+		returning id, data
+	`, edgeid, CONTROL_RESEND_AFTER.Seconds(), CONTROL_STATUS_SENT,
+		CONTROL_STATUS_PENDING).Scan(&id, &data)
 
 	if err != nil {
 		return "", errors.New("Failed to get control because: " + err.Error())
@@ -249,6 +531,80 @@ func dbCheckUuid(uuid Uuid, db *sql.DB) (int, error) {
 	return edgeid, nil
 }
 
+// Values of edge_node.pending_action
+const (
+	ACTION_NONE = iota
+	ACTION_RESTART
+	ACTION_SHUTDOWN
+	ACTION_UPDATE
+)
+
+// actionNames are the names of actions used by the metrics server
+var actionNames = map[int]string{
+	ACTION_NONE:     "none",
+	ACTION_RESTART:  "restart",
+	ACTION_SHUTDOWN: "shutdown",
+	ACTION_UPDATE:   "update",
+}
+
+// actionResponses maps pending actions to the response flag sent
+var actionResponses = map[int]uint16{
+	ACTION_RESTART:  RESPONSE_RESTART,
+	ACTION_SHUTDOWN: RESPONSE_SHUTDOWN,
+	ACTION_UPDATE:   RESPONSE_UPDATE,
+}
+
+// dbTakePendingAction returns the action waiting for the edge and clears
+// it so it is only sent once
+func dbTakePendingAction(edgeid int, db *sql.DB) (int, error) {
+	var action int
+	err := db.QueryRow(`
+		with old as (
+			select id, pending_action from edge_node where id = $1 for update
+		)
+		update edge_node as e set pending_action = 0
+		from old
+		where e.id = old.id and old.pending_action <> 0
+		returning old.pending_action
+	`, edgeid).Scan(&action)
+	if err == sql.ErrNoRows {
+		return ACTION_NONE, nil
+	} else if err != nil {
+		return ACTION_NONE, errors.Wrap(err, "Failed to get pending action")
+	}
+	return action, nil
+}
+
+// dbGetUpdate returns the newest update for platform formatted as the
+// data of a RESPONSE_UPDATE, version and platform each followed by a
+// newline, the 64 byte signature and the binary
+func dbGetUpdate(platform string, db *sql.DB) (string, string, error) {
+	var version string
+	var data, signature []byte
+	err := db.QueryRow(`
+		select version, data, signature
+		from edge_updates
+		where platform = $1
+		order by datetime desc
+		limit 1
+	`, platform).Scan(&version, &data, &signature)
+	if err != nil {
+		return "", "", err
+	}
+	return version, version + "\n" + platform + "\n" + string(signature) + string(data), nil
+}
+
+// dbInsertServerControlLog records an action taken by the server for edge
+func dbInsertServerControlLog(edgenodeid int, data string, db *sql.DB) {
+	_, err := db.Exec(`
+		insert into control_log (edgenodeid, data)
+		values ($1, $2)
+	`, edgenodeid, "server: "+data)
+	if err != nil {
+		log.Warnf("Failed to insert control log \"%s\": %s", data, err)
+	}
+}
+
 const (
 	ERROR_TRACE = 0
 	ERROR_DEBUG = 1
@@ -261,6 +617,7 @@ const (
 const (
 	ERROR_NULL = iota
 	ERROR_DESYNC
+	ERROR_UNKNOWN_BEACON
 )
 
 //
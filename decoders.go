@@ -0,0 +1,336 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	// Beacon types, iBeacon is 0 so that protocol version 1 packets which
+	// carry no type decode as iBeacons
+	BEACON_IBEACON       = 0
+	BEACON_EDDYSTONE_UID = 1
+	BEACON_EDDYSTONE_URL = 2
+	BEACON_ALTBEACON     = 3
+	BEACON_TYPE_MAX      = BEACON_ALTBEACON
+
+	// Advertising data structure types
+	AD_SERVICE_DATA_16 = 0x16
+	AD_MANUFACTURER    = 0xFF
+
+	// Eddystone frame types
+	EDDYSTONE_UID = 0x00
+	EDDYSTONE_URL = 0x10
+	EDDYSTONE_TLM = 0x20
+	// Loss in dBm between the 0m power of Eddystone frames and 1m
+	EDDYSTONE_LOSS_1M = 41
+
+	// Kinds of frames returned by an advDecoder
+	ADV_FRAME_NONE      = 0
+	ADV_FRAME_IDENTITY  = 1
+	ADV_FRAME_TELEMETRY = 2
+
+	// Most addresses remembered for matching telemetry to identities
+	MAX_ADV_IDENTITIES = 4096
+)
+
+// BeaconTypeName returns the name used for a beacon type in the API
+func BeaconTypeName(t uint8) string {
+	switch t {
+	case BEACON_IBEACON:
+		return "ibeacon"
+	case BEACON_EDDYSTONE_UID:
+		return "eddystone-uid"
+	case BEACON_EDDYSTONE_URL:
+		return "eddystone-url"
+	case BEACON_ALTBEACON:
+		return "altbeacon"
+	}
+	return "unknown"
+}
+
+// EddystoneTelemetry is the unencrypted Eddystone-TLM payload
+type EddystoneTelemetry struct {
+	// Battery voltage in mV, 0 if not supported
+	Battery uint16
+	// Temperature in degrees Celcius, NaN if not supported
+	Temperature float64
+	// Advertisements sent since boot
+	AdvCount uint32
+	Uptime   time.Duration
+}
+
+// adStructure is a single AD structure from advertising data
+type adStructure struct {
+	Type byte
+	Data []byte
+}
+
+// parseADStructures splits advertising data into its AD structures, a
+// malformed structure ends the parsing
+func parseADStructures(data []byte) []adStructure {
+	var ads []adStructure
+	for len(data) > 1 {
+		l := int(data[0])
+		if l == 0 || l+1 > len(data) {
+			break
+		}
+		ads = append(ads, adStructure{Type: data[1], Data: data[2 : l+1]})
+		data = data[l+1:]
+	}
+	return ads
+}
+
+// advDecoder attempts to decode a beacon from the AD structures of an
+// advertisement. Identity frames fill in rec.BeaconData, telemetry frames
+// fill only the telemetry of rec. The kind of frame is returned.
+type advDecoder func(ads []adStructure, rec *BeaconRecord) int
+
+type namedDecoder struct {
+	name    string
+	decoder advDecoder
+}
+
+// advDecoders is the registry of decoders in the order they are tried
+var advDecoders []namedDecoder
+
+// registerAdvDecoder adds a decoder to the registry under name
+func registerAdvDecoder(name string, d advDecoder) {
+	advDecoders = append(advDecoders, namedDecoder{name, d})
+}
+
+// decodersByName returns the registered decoders for the comma separated
+// names, an empty string returns all decoders
+func decodersByName(names string) ([]advDecoder, error) {
+	var res []advDecoder
+	if names == "" {
+		for _, d := range advDecoders {
+			res = append(res, d.decoder)
+		}
+		return res, nil
+	}
+	for _, n := range strings.Split(names, ",") {
+		found := false
+		for _, d := range advDecoders {
+			if d.name == strings.TrimSpace(n) {
+				res = append(res, d.decoder)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("Unknown decoder \"%s\"", n)
+		}
+	}
+	return res, nil
+}
+
+func init() {
+	registerAdvDecoder("ibeacon", decodeIBeacon)
+	registerAdvDecoder("altbeacon", decodeAltBeacon)
+	registerAdvDecoder("eddystone-uid", decodeEddystoneUID)
+	registerAdvDecoder("eddystone-url", decodeEddystoneURL)
+	registerAdvDecoder("eddystone-tlm", decodeEddystoneTLM)
+}
+
+// advDecoderState remembers the identities seen from each address so
+// telemetry frames which carry no identity can be attributed
+type advDecoderState struct {
+	decoders   []advDecoder
+	identities map[[6]byte]BeaconData
+}
+
+func newAdvDecoderState(decoders []advDecoder) *advDecoderState {
+	if decoders == nil {
+		decoders, _ = decodersByName("")
+	}
+	return &advDecoderState{
+		decoders:   decoders,
+		identities: make(map[[6]byte]BeaconData),
+	}
+}
+
+// decode returns the BeaconRecord for the advertisement, false is returned
+// if no decoder recognised it
+func (s *advDecoderState) decode(adv *bleAdvertisement) (BeaconRecord, bool) {
+	ads := parseADStructures(adv.Data)
+	for _, d := range s.decoders {
+		var rec BeaconRecord
+		switch d(ads, &rec) {
+		case ADV_FRAME_IDENTITY:
+			if _, ok := s.identities[adv.Address]; !ok &&
+				len(s.identities) >= MAX_ADV_IDENTITIES {
+				s.identities = make(map[[6]byte]BeaconData)
+			}
+			s.identities[adv.Address] = rec.BeaconData
+			return rec, true
+		case ADV_FRAME_TELEMETRY:
+			id, ok := s.identities[adv.Address]
+			if !ok {
+				return rec, false
+			}
+			rec.BeaconData = id
+			return rec, true
+		}
+	}
+	return BeaconRecord{}, false
+}
+
+// findAD returns the data of the first AD structure of type t that starts
+// with prefix
+func findAD(ads []adStructure, t byte, prefix []byte) []byte {
+	for _, ad := range ads {
+		if ad.Type == t && bytes.HasPrefix(ad.Data, prefix) {
+			return ad.Data
+		}
+	}
+	return nil
+}
+
+// decodeIBeacon decodes Apple iBeacon frames
+func decodeIBeacon(ads []adStructure, rec *BeaconRecord) int {
+	data := findAD(ads, AD_MANUFACTURER, []byte{0x4C, 0x00, 0x02, 0x15})
+	if len(data) < 25 {
+		return ADV_FRAME_NONE
+	}
+	rec.Type = BEACON_IBEACON
+	copy(rec.Uuid[:], data[4:20])
+	rec.Major = binary.BigEndian.Uint16(data[20:22])
+	rec.Minor = binary.BigEndian.Uint16(data[22:24])
+	// The 25th byte is the measured power, the rssi at 1m
+	rec.TxPower = int8(data[24])
+	return ADV_FRAME_IDENTITY
+}
+
+// decodeAltBeacon decodes AltBeacon frames, the 20 byte beacon id is split
+// into a 16 byte id and two 16 bit ids like an iBeacon
+func decodeAltBeacon(ads []adStructure, rec *BeaconRecord) int {
+	for _, ad := range ads {
+		if ad.Type != AD_MANUFACTURER || len(ad.Data) < 26 ||
+			ad.Data[2] != 0xBE || ad.Data[3] != 0xAC {
+			continue
+		}
+		rec.Type = BEACON_ALTBEACON
+		copy(rec.Uuid[:], ad.Data[4:20])
+		rec.Major = binary.BigEndian.Uint16(ad.Data[20:22])
+		rec.Minor = binary.BigEndian.Uint16(ad.Data[22:24])
+		// The reference rssi at 1m follows the id
+		rec.TxPower = int8(ad.Data[24])
+		return ADV_FRAME_IDENTITY
+	}
+	return ADV_FRAME_NONE
+}
+
+// eddystoneFrame returns the Eddystone service data for the frame type,
+// starting at the frame type
+func eddystoneFrame(ads []adStructure, frame byte) []byte {
+	data := findAD(ads, AD_SERVICE_DATA_16, []byte{0xAA, 0xFE, frame})
+	if data == nil {
+		return nil
+	}
+	return data[2:]
+}
+
+// decodeEddystoneUID decodes Eddystone-UID frames, the namespace and
+// instance make up the 16 byte id
+func decodeEddystoneUID(ads []adStructure, rec *BeaconRecord) int {
+	data := eddystoneFrame(ads, EDDYSTONE_UID)
+	if len(data) < 18 {
+		return ADV_FRAME_NONE
+	}
+	rec.Type = BEACON_EDDYSTONE_UID
+	copy(rec.Uuid[:], data[2:18])
+	rec.TxPower = eddystoneTxPower(data[1])
+	return ADV_FRAME_IDENTITY
+}
+
+// eddystoneTxPower converts the calibrated power at 0m of Eddystone frames
+// to the rssi at 1m other frames advertise, the spec gives 41dBm of loss
+// over the first metre
+func eddystoneTxPower(power byte) int8 {
+	p := int(int8(power)) - EDDYSTONE_LOSS_1M
+	if p < math.MinInt8 {
+		p = math.MinInt8
+	}
+	return int8(p)
+}
+
+var eddystoneSchemes = []string{"http://www.", "https://www.", "http://", "https://"}
+var eddystoneExpansions = []string{".com/", ".org/", ".edu/", ".net/", ".info/",
+	".biz/", ".gov/", ".com", ".org", ".edu", ".net", ".info", ".biz", ".gov"}
+
+// decodeEddystoneURL decodes Eddystone-URL frames, the id of the beacon is
+// derived from the URL with EddystoneURLUuid
+func decodeEddystoneURL(ads []adStructure, rec *BeaconRecord) int {
+	data := eddystoneFrame(ads, EDDYSTONE_URL)
+	if len(data) < 3 || int(data[2]) >= len(eddystoneSchemes) {
+		return ADV_FRAME_NONE
+	}
+	url := eddystoneSchemes[data[2]]
+	for _, c := range data[3:] {
+		if int(c) < len(eddystoneExpansions) {
+			url += eddystoneExpansions[c]
+		} else if c > 0x20 && c < 0x7F {
+			url += string(c)
+		} else {
+			return ADV_FRAME_NONE
+		}
+	}
+	rec.Type = BEACON_EDDYSTONE_URL
+	rec.Uuid = EddystoneURLUuid(url)
+	rec.TxPower = eddystoneTxPower(data[1])
+	return ADV_FRAME_IDENTITY
+}
+
+// decodeEddystoneTLM decodes unencrypted Eddystone-TLM frames
+func decodeEddystoneTLM(ads []adStructure, rec *BeaconRecord) int {
+	data := eddystoneFrame(ads, EDDYSTONE_TLM)
+	// Version 0 is the only unencrypted version
+	if len(data) < 14 || data[1] != 0 {
+		return ADV_FRAME_NONE
+	}
+	t := new(EddystoneTelemetry)
+	t.Battery = binary.BigEndian.Uint16(data[2:4])
+	// Temperature is signed 8.8 fixed point, 0x8000 if unsupported
+	temp := int16(binary.BigEndian.Uint16(data[4:6]))
+	if uint16(temp) == 0x8000 {
+		t.Temperature = math.NaN()
+	} else {
+		t.Temperature = float64(temp) / 256
+	}
+	t.AdvCount = binary.BigEndian.Uint32(data[6:10])
+	// Uptime is in units of 0.1 seconds
+	t.Uptime = time.Duration(binary.BigEndian.Uint32(data[10:14])) * 100 * time.Millisecond
+	rec.Telemetry = t
+	return ADV_FRAME_TELEMETRY
+}
+
+// EddystoneURLUuid returns the id used for an Eddystone-URL beacon that
+// advertises url, it is the first 16 bytes of the SHA-1 of the url
+func EddystoneURLUuid(url string) Uuid {
+	var u Uuid
+	sum := sha1.Sum([]byte(url))
+	copy(u[:], sum[:16])
+	return u
+}
@@ -0,0 +1,123 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// testAdv wraps AD structures in an advertisement from address
+func testAdv(address byte, ads ...[]byte) *bleAdvertisement {
+	adv := &bleAdvertisement{Address: [6]byte{address}, Rssi: -60}
+	for _, ad := range ads {
+		adv.Data = append(adv.Data, byte(len(ad)))
+		adv.Data = append(adv.Data, ad...)
+	}
+	return adv
+}
+
+var testFlagsAD = []byte{0x01, 0x06}
+
+func TestDecodeIBeacon(t *testing.T) {
+	state := newAdvDecoderState(nil)
+	rec, ok := state.decode(testAdv(1, testFlagsAD, []byte{0xFF, 0x4C, 0x00,
+		0x02, 0x15, 0x95, 0x66, 0xc7, 0x4d, 0x10, 0x03, 0x7c, 0x4d, 0x7b, 0xbb,
+		0x04, 0x07, 0xd1, 0xe2, 0xc6, 0x49, 0x00, 0x06, 0x00, 0x19, 0xC5}))
+	if !ok {
+		t.Fatal("iBeacon not decoded")
+	}
+	if rec.String() != "9566c74d-1003-7c4d-7bbb-0407d1e2c649,6,25" {
+		t.Fatalf("Unexpected identity %s", rec.String())
+	}
+	if rec.TxPower != -59 {
+		t.Fatalf("Unexpected tx power %d", rec.TxPower)
+	}
+}
+
+func TestDecodeAltBeacon(t *testing.T) {
+	state := newAdvDecoderState(nil)
+	rec, ok := state.decode(testAdv(1, []byte{0xFF, 0x18, 0x01, 0xBE, 0xAC,
+		0x95, 0x66, 0xc7, 0x4d, 0x10, 0x03, 0x7c, 0x4d, 0x7b, 0xbb, 0x04, 0x07,
+		0xd1, 0xe2, 0xc6, 0x49, 0x00, 0x01, 0x00, 0x02, 0xC5, 0x00}))
+	if !ok {
+		t.Fatal("AltBeacon not decoded")
+	}
+	if rec.Type != BEACON_ALTBEACON || rec.Major != 1 || rec.Minor != 2 {
+		t.Fatalf("Unexpected identity %s", rec.String())
+	}
+	if rec.TxPower != -59 {
+		t.Fatalf("Unexpected tx power %d", rec.TxPower)
+	}
+}
+
+func TestDecodeEddystone(t *testing.T) {
+	state := newAdvDecoderState(nil)
+	uidframe := []byte{0x16, 0xAA, 0xFE, 0x00, 0xEB, 0x01, 0x02, 0x03, 0x04,
+		0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10,
+		0x00, 0x00}
+	tlmframe := []byte{0x16, 0xAA, 0xFE, 0x20, 0x00, 0x0B, 0xB8, 0x17, 0x80,
+		0x00, 0x00, 0x00, 0x64, 0x00, 0x00, 0x00, 0x0A}
+
+	// Telemetry before the identity is known is dropped
+	if _, ok := state.decode(testAdv(2, tlmframe)); ok {
+		t.Fatal("Telemetry decoded without identity")
+	}
+	rec, ok := state.decode(testAdv(2, uidframe))
+	if !ok || rec.Type != BEACON_EDDYSTONE_UID {
+		t.Fatal("Eddystone-UID not decoded")
+	}
+	if rec.TxPower != -62 {
+		t.Fatalf("Unexpected tx power %d", rec.TxPower)
+	}
+	if rec.Uuid.String() != "01020304-0506-0708-090a-0b0c0d0e0f10" {
+		t.Fatalf("Unexpected identity %s", rec.String())
+	}
+
+	rec, ok = state.decode(testAdv(2, tlmframe))
+	if !ok || rec.Telemetry == nil {
+		t.Fatal("Eddystone-TLM not decoded")
+	}
+	if rec.Type != BEACON_EDDYSTONE_UID || rec.Uuid.String() != "01020304-0506-0708-090a-0b0c0d0e0f10" {
+		t.Fatalf("Telemetry attributed to %s", rec.String())
+	}
+	tlm := rec.Telemetry
+	if tlm.Battery != 3000 || math.Abs(tlm.Temperature-23.5) > 1e-9 ||
+		tlm.AdvCount != 100 || tlm.Uptime != time.Second {
+		t.Fatalf("Unexpected telemetry %+v", *tlm)
+	}
+
+	rec, ok = state.decode(testAdv(3, []byte{0x16, 0xAA, 0xFE, 0x10, 0xEB,
+		0x03, 'c', 'o', '6', '0', 0x07}))
+	if !ok || rec.Type != BEACON_EDDYSTONE_URL {
+		t.Fatal("Eddystone-URL not decoded")
+	}
+	if rec.Uuid != EddystoneURLUuid("https://co60.com") {
+		t.Fatalf("Unexpected identity %s", rec.String())
+	}
+}
+
+func TestDecodersByName(t *testing.T) {
+	d, err := decodersByName("ibeacon, eddystone-uid")
+	if err != nil || len(d) != 2 {
+		t.Fatalf("Failed to select decoders %s", err)
+	}
+	if _, err = decodersByName("ibeacon,nope"); err == nil {
+		t.Fatal("Unknown decoder was accepted")
+	}
+}
@@ -0,0 +1,113 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	// Discovered beacons are reported at this interval
+	DISCOVERY_INTERVAL = 30 * time.Second
+	// Beacons kept per report, more are dropped until the next one
+	DISCOVERY_MAX = 1024
+)
+
+// discoveredBeacon is what an edge reports of a beacon it does not watch
+type discoveredBeacon struct {
+	First time.Time
+	Last  time.Time
+	// Best rssi seen
+	Rssi  int16
+	Count int64
+}
+
+// discoveryReport collects the beacons an edge does not watch while the
+// server has discovery on for it
+type discoveryReport map[BeaconData]*discoveredBeacon
+
+// record adds an advertisement of a beacon that is not watched
+func (d discoveryReport) record(br *BeaconRecord) {
+	seen, ok := d[br.BeaconData]
+	if !ok {
+		if len(d) >= DISCOVERY_MAX {
+			return
+		}
+		seen = &discoveredBeacon{First: br.Datetime, Rssi: br.Rssi}
+		d[br.BeaconData] = seen
+	}
+	seen.Last = br.Datetime
+	if br.Rssi > seen.Rssi {
+		seen.Rssi = br.Rssi
+	}
+	seen.Count++
+}
+
+// setDiscovery turns discovery on or off as the server asks
+func setDiscovery(client *clientinfo, on bool) {
+	client.Lock()
+	defer client.Unlock()
+	if on && client.discovery == nil {
+		log.Info("Discovery of unregistered beacons on")
+		client.discovery = make(discoveryReport)
+	} else if !on && client.discovery != nil {
+		log.Info("Discovery of unregistered beacons off")
+		client.discovery = nil
+	}
+}
+
+// takeDiscovery returns a packet reporting the beacons discovered since the
+// last report, nil if there are none
+func takeDiscovery(client *clientinfo) (*BeaconLogPacket, error) {
+	client.Lock()
+	report := client.discovery
+	if len(report) == 0 {
+		client.Unlock()
+		return nil, nil
+	}
+	client.discovery = make(discoveryReport)
+	client.Unlock()
+
+	datapacket := newDataPacket(client)
+	datapacket.Ext |= EXT_DISCOVERY
+	seen := make([]*discoveredBeacon, 0, len(report))
+	for b, d := range report {
+		datapacket.Beacons = append(datapacket.Beacons, b)
+		seen = append(seen, d)
+	}
+	data, err := json.Marshal(seen)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to encode discovered beacons")
+	}
+	datapacket.ControlData = string(data)
+	return datapacket, nil
+}
+
+// parseDiscovery returns what was seen of each beacon in a discovery packet
+func parseDiscovery(pack *BeaconLogPacket) ([]discoveredBeacon, error) {
+	var seen []discoveredBeacon
+	if err := json.Unmarshal([]byte(pack.ControlData), &seen); err != nil {
+		return nil, errors.Wrap(err, "Invalid discovery report")
+	}
+	if len(seen) != len(pack.Beacons) {
+		return nil, errors.New("Discovery report does not match the beacons")
+	}
+	return seen, nil
+}
@@ -0,0 +1,65 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiscoveryReport(t *testing.T) {
+	client := &clientinfo{maxVersion: 2, uuid: Uuid{9}}
+	unknown := BeaconData{Uuid: Uuid{1}, Major: 3, Type: BEACON_ALTBEACON}
+	now := time.Now()
+	setDiscovery(client, true)
+	for i, rssi := range []int16{-80, -62, -75} {
+		client.discovery.record(&BeaconRecord{BeaconData: unknown, Rssi: rssi,
+			Datetime: now.Add(time.Duration(i) * time.Second)})
+	}
+
+	datapacket, err := takeDiscovery(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datapacket.Flags |= 2
+	bin, err := datapacket.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tar BeaconLogPacket
+	if err = tar.UnmarshalBinary(bin); err != nil {
+		t.Fatal(err)
+	}
+	seen, err := parseDiscovery(&tar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 1 || tar.Beacons[0] != unknown {
+		t.Fatalf("Report was %v %v", tar.Beacons, seen)
+	}
+	if seen[0].Count != 3 || seen[0].Rssi != -62 || !seen[0].Last.Equal(now.Add(2*time.Second)) {
+		t.Fatalf("Report was %+v", seen[0])
+	}
+
+	if datapacket, _ = takeDiscovery(client); datapacket != nil {
+		t.Fatal("Reported beacons twice")
+	}
+	setDiscovery(client, false)
+	if client.discovery != nil {
+		t.Fatal("Discovery still on")
+	}
+}
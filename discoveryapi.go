@@ -0,0 +1,203 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// metricsserv builds cause problems with other binaries due to inclusion
+// of packages that require python3
+// +build metrics
+
+package beaconpi
+
+import (
+	"encoding/json"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// edgeDiscovery turns discovery of unregistered beacons on or off for edges
+func edgeDiscovery() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Edges   []int
+			Enabled bool
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil || len(input.Edges) == 0 {
+			log.Infof("Failed to decode json request in EdgeDiscovery %v", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		res, err := db.Exec(`update edge_node set discovery = $1
+				where id = any($2::int[])`, input.Enabled, pq.Array(input.Edges))
+		if err != nil {
+			log.Infof("Failed operation on DB %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		n, _ := res.RowsAffected()
+		jsonResponse(w, map[string]interface{}{
+			"Success": true,
+			"Edges":   n,
+		})
+	})
+}
+
+// getDiscovered lists beacons seen by edges in discovery mode that are not
+// registered, the edges that saw them are ordered by best rssi
+func getDiscovered() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+
+		rows, err := db.Query(`
+			select d.uuid, d.major, d.minor, d.beacontype, min(d.first_seen),
+				max(d.last_seen), max(d.best_rssi), sum(d.count),
+				array_agg(d.edgenodeid order by d.best_rssi desc)
+			from discovered_beacons as d
+			where not exists (select 1 from ibeacons as b
+				where (b.uuid, b.major, b.minor, b.beacontype) =
+					(d.uuid, d.major, d.minor, d.beacontype))
+			group by d.uuid, d.major, d.minor, d.beacontype
+			order by max(d.last_seen) desc`)
+		if err != nil {
+			log.Errorf("Failed while quering discovered beacons %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer rows.Close()
+		type discovered struct {
+			Uuid       string
+			Major      int
+			Minor      int
+			BeaconType int
+			TypeName   string
+			FirstSeen  time.Time
+			LastSeen   time.Time
+			BestRssi   int
+			Count      int64
+			Edges      []int64
+		}
+		outdata := []discovered{}
+		for rows.Next() {
+			var d discovered
+			if err = rows.Scan(&d.Uuid, &d.Major, &d.Minor, &d.BeaconType,
+				&d.FirstSeen, &d.LastSeen, &d.BestRssi, &d.Count,
+				(*pq.Int64Array)(&d.Edges)); err != nil {
+				log.Errorf("Failed to scan discovered beacons %s", err)
+				http.Error(w, "Server failure", 500)
+				return
+			}
+			d.TypeName = BeaconTypeName(uint8(d.BeaconType))
+			outdata = append(outdata, d)
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Beacons": outdata,
+		})
+	})
+}
+
+// promoteBeacon registers a discovered beacon, optionally assigning it to
+// sites, and forgets that it was discovered
+func promoteBeacon() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Uuid       string
+			Major      int
+			Minor      int
+			BeaconType int
+			Label      string
+			Sites      []int
+		}{}
+		dec := json.NewDecoder(req.Body)
+		err := dec.Decode(&input)
+		if err != nil {
+			log.Infof("Failed to decode json request in PromoteBeacon %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		err = validateLen(nil, input.Label, "Label", 1)
+		err = validateLen(err, input.Uuid, "Uuid", 32)
+		if err == nil && (input.BeaconType < 0 || input.BeaconType > BEACON_TYPE_MAX) {
+			err = errors.Errorf("BeaconType %d is unknown", input.BeaconType)
+		}
+		if err != nil {
+			log.Infof("Failed validation %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		tx, err := db.Begin()
+		if err != nil {
+			log.Errorf("Failed to begin transaction %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer tx.Rollback()
+		var id int
+		err = tx.QueryRow(`insert into ibeacons
+				(label, uuid, major, minor, beacontype) values
+				($1, $2, $3, $4, $5) returning id`, input.Label, input.Uuid,
+			input.Major, input.Minor, input.BeaconType).Scan(&id)
+		if err == nil && len(input.Sites) > 0 {
+			_, err = tx.Exec(`insert into beacon_sites (beaconid, siteid)
+					select $1, unnest($2::int[])`, id, pq.Array(input.Sites))
+		}
+		if err == nil {
+			_, err = tx.Exec(`delete from discovered_beacons
+					where (uuid, major, minor, beacontype) = ($1, $2, $3, $4)`,
+				input.Uuid, input.Major, input.Minor, input.BeaconType)
+		}
+		if err != nil {
+			log.Infof("Failed operation on DB %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if err = tx.Commit(); err != nil {
+			log.Errorf("Failed to commit promoted beacon %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Success": true,
+			"Id":      id,
+		})
+	})
+}
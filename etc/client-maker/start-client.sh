@@ -13,5 +13,6 @@ else
         exit 1
 fi
 
-"$GOPATH/bin/beaconclient" -client-cert-file "${CLIENT_CERT}" -client-key-file "${CLIENT_KEY}" -client-uuid "${CLIENT_UUID}" -serv-cert-file "${SERVER_CERT}" -serv-host "${SERVER}" -serv-port "${PORT}"
+# exec so the exit code reaches the supervisor, 75 asks for a restart
+exec "$GOPATH/bin/beaconclient" ${UPDATE_KEY:+-update-key "${UPDATE_KEY}"} -client-cert-file "${CLIENT_CERT}" -client-key-file "${CLIENT_KEY}" -client-uuid "${CLIENT_UUID}" -serv-cert-file "${SERVER_CERT}" -serv-host "${SERVER}" -serv-port "${PORT}"
 
@@ -0,0 +1,6 @@
+alter table ibeacons add column beacontype integer not null default 0;
+comment on column ibeacons.beacontype is '0: iBeacon, 1: Eddystone-UID, 2: Eddystone-URL, 3: AltBeacon';
+comment on column ibeacons.uuid is 'iBeacon UUID, Eddystone namespace and instance, AltBeacon first 16 bytes of id or the first 16 bytes of the SHA-1 of an Eddystone URL';
+
+alter table ibeacons add column url text;
+comment on column ibeacons.url is 'URL advertised by Eddystone-URL beacons';
@@ -0,0 +1,25 @@
+-- Beacons are identified by uuid, major, minor and type. Logs recorded
+-- against duplicates are moved to the oldest row before they are removed.
+create temporary table ibeacons_duplicates as
+  select id, min(id) over (partition by uuid, major, minor, beacontype) as keep
+  from ibeacons;
+update beacon_log as l set beaconid = d.keep
+  from ibeacons_duplicates as d
+  where l.beaconid = d.id and d.id <> d.keep;
+delete from ibeacons as b
+  using ibeacons_duplicates as d
+  where b.id = d.id and d.id <> d.keep;
+drop table ibeacons_duplicates;
+
+create unique index ibeacons_identity on ibeacons (uuid, major, minor, beacontype);
+
+-- The beacon server caches ibeacons and listens for this notification
+create or replace function notify_ibeacons_changed() returns trigger as $$
+  BEGIN
+    perform pg_notify('ibeacons_changed', '');
+    return null;
+  END; $$ language plpgsql;
+
+create trigger ibeacons_changed
+  after insert or update or delete or truncate on ibeacons
+  for each statement execute procedure notify_ibeacons_changed();
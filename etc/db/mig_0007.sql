@@ -0,0 +1,15 @@
+alter table edge_node add column pending_action integer not null default 0;
+comment on column edge_node.pending_action is '0: None, 1: Restart, 2: Shutdown, 3: Update, sent to the edge on its next packet';
+
+create table edge_updates (
+  id serial primary key,
+  datetime timestamp with time zone not null default current_timestamp,
+  version text not null,
+  platform text not null,
+  data bytea not null,
+  signature bytea not null
+);
+create index edge_updates_platform on edge_updates(platform);
+
+comment on column edge_updates.platform is 'GOOS/GOARCH the binary is built for, for example linux/arm';
+comment on column edge_updates.signature is 'ed25519 signature of data, verified by the edge before installing';
@@ -0,0 +1,10 @@
+alter table control_log add column op text;
+alter table control_log add column exit_status integer;
+alter table control_log add column duration double precision;
+alter table control_log add column stdout text;
+alter table control_log add column stderr text;
+
+comment on column control_log.op is 'Named operation of the command, raw for an allowed argv';
+comment on column control_log.exit_status is 'Exit status of the command, -1 if it did not finish';
+comment on column control_log.duration is 'Seconds the command ran for';
+comment on column control_log.data is 'Combined output, kept for clients that do not separate stdout and stderr';
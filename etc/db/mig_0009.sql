@@ -0,0 +1,16 @@
+alter table control_commands add column status text not null default 'pending'
+  check (status in ('pending', 'sent', 'completed', 'failed', 'expired', 'cancelled'));
+alter table control_commands add column sent_at timestamp with time zone;
+alter table control_commands add column completed_at timestamp with time zone;
+alter table control_commands add column cancelled_at timestamp with time zone;
+alter table control_commands add column expires_at timestamp with time zone;
+
+update control_commands set status = 'completed', completed_at = datetime
+  where completed = TRUE;
+
+create index control_commands_status on control_commands(edgenodeid, datetime)
+  where status in ('pending', 'sent');
+
+comment on column control_commands.status is 'pending until sent to the edge, then completed or failed once it reports the result';
+comment on column control_commands.expires_at is 'Pending commands are not sent after this time and become expired';
+comment on column control_commands.completed is 'Set with the completed and failed status, kept for older tools';
@@ -0,0 +1,39 @@
+-- Every change to the beacon set, the id of the newest row is the version
+-- of the set that edges acknowledge. Rows without an identity reset it.
+create table ibeacons_changes (
+  id bigserial primary key,
+  datetime timestamp with time zone not null default current_timestamp,
+  uuid uuid,
+  major integer,
+  minor integer,
+  beacontype integer,
+  added boolean
+);
+
+insert into ibeacons_changes (uuid, major, minor, beacontype, added)
+  select uuid, major, minor, beacontype, TRUE from ibeacons order by id;
+
+create or replace function record_ibeacons_change() returns trigger as $$
+  BEGIN
+    if TG_OP = 'TRUNCATE' then
+      insert into ibeacons_changes (added) values (null);
+      return null;
+    end if;
+    if TG_OP in ('UPDATE', 'DELETE') then
+      insert into ibeacons_changes (uuid, major, minor, beacontype, added)
+        values (OLD.uuid, OLD.major, OLD.minor, OLD.beacontype, FALSE);
+    end if;
+    if TG_OP in ('UPDATE', 'INSERT') then
+      insert into ibeacons_changes (uuid, major, minor, beacontype, added)
+        values (NEW.uuid, NEW.major, NEW.minor, NEW.beacontype, TRUE);
+    end if;
+    return null;
+  END; $$ language plpgsql;
+
+create trigger ibeacons_record_change
+  after insert or delete or update of uuid, major, minor, beacontype on ibeacons
+  for each row execute procedure record_ibeacons_change();
+
+create trigger ibeacons_record_truncate
+  after truncate on ibeacons
+  for each statement execute procedure record_ibeacons_change();
@@ -0,0 +1,43 @@
+-- Sites group beacons and edges, for example the buildings of a
+-- deployment. Edges are sent the beacons that share a site with them,
+-- beacons or edges without a site are not filtered.
+create table sites (
+  id serial primary key,
+  name varchar(60) not null unique,
+  description text
+);
+
+create table beacon_sites (
+  beaconid integer not null references ibeacons on delete cascade,
+  siteid integer not null references sites on delete cascade,
+  primary key (beaconid, siteid)
+);
+create index beacon_sites_siteid on beacon_sites(siteid);
+
+create table edge_sites (
+  edgenodeid integer not null references edge_node on delete cascade,
+  siteid integer not null references sites on delete cascade,
+  primary key (edgenodeid, siteid)
+);
+create index edge_sites_siteid on edge_sites(siteid);
+
+-- Assignments change the sets of many edges, they are sent in full again
+create or replace function reset_ibeacons_changes() returns trigger as $$
+  BEGIN
+    insert into ibeacons_changes (added) values (null);
+    return null;
+  END; $$ language plpgsql;
+
+create trigger beacon_sites_changed
+  after insert or update or delete or truncate on beacon_sites
+  for each statement execute procedure reset_ibeacons_changes();
+create trigger edge_sites_changed
+  after insert or update or delete or truncate on edge_sites
+  for each statement execute procedure reset_ibeacons_changes();
+
+create trigger beacon_sites_notify
+  after insert or update or delete or truncate on beacon_sites
+  for each statement execute procedure notify_ibeacons_changed();
+create trigger edge_sites_notify
+  after insert or update or delete or truncate on edge_sites
+  for each statement execute procedure notify_ibeacons_changed();
@@ -0,0 +1,24 @@
+alter table edge_node add column discovery boolean not null default FALSE;
+comment on column edge_node.discovery is 'The edge reports beacons that are not registered to discovered_beacons';
+
+create table discovered_beacons (
+  uuid uuid not null,
+  major integer not null,
+  minor integer not null,
+  beacontype integer not null default 0,
+  edgenodeid integer not null references edge_node on delete cascade,
+  first_seen timestamp with time zone not null,
+  last_seen timestamp with time zone not null,
+  best_rssi integer not null,
+  count bigint not null,
+  primary key (uuid, major, minor, beacontype, edgenodeid)
+);
+create index discovered_beacons_last_seen on discovered_beacons(last_seen);
+
+comment on table discovered_beacons is 'Beacons seen by edges in discovery mode, per edge';
+comment on column discovered_beacons.count is 'Advertisements received';
+
+-- The beacon server caches which edges are in discovery mode with ibeacons
+create trigger edge_node_discovery_notify
+  after update of discovery on edge_node
+  for each statement execute procedure notify_ibeacons_changed();
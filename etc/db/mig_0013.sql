@@ -0,0 +1,22 @@
+-- Edges that aggregate send a summary of each beacon per window instead of
+-- every advertisement. Each window is also written to beacon_log with the
+-- filtered or mean rssi at its middle.
+create table beacon_log_agg (
+  id bigserial primary key,
+  datetime timestamp with time zone not null,
+  window_ms integer not null,
+  beaconid integer not null references ibeacons,
+  edgenodeid integer not null references edge_node,
+  count integer not null,
+  rssi_mean real not null,
+  rssi_median real not null,
+  rssi_min smallint not null,
+  rssi_max smallint not null,
+  rssi_kalman real
+);
+create unique index beacon_log_agg_window on beacon_log_agg(edgenodeid, beaconid, datetime);
+create index beacon_log_agg_datetime on beacon_log_agg(datetime);
+create index beacon_log_agg_beaconid on beacon_log_agg(beaconid);
+
+comment on column beacon_log_agg.datetime is 'Start of the window';
+comment on column beacon_log_agg.rssi_kalman is 'Kalman filtered rssi at the end of the window, null if the edge does not filter';
@@ -0,0 +1,30 @@
+-- Beacons advertise the rssi they are measured to have at 1m, it is kept
+-- with each log, null for frames without it
+alter table beacon_log add column txpower smallint;
+alter table beacon_log_agg add column txpower smallint;
+comment on column ibeacons.txpower is 'The rssi at 1m used for distances when the beacon does not advertise one';
+
+-- The reference rssi at 1m of the path loss model depends on mode:
+--   bias     the bias of the edge, as before
+--   txpower  the tx power advertised by the beacon, or the txpower of the
+--            beacon if it advertises none
+--   both     the tx power of the beacon corrected by how far the bias of
+--            the edge is from the default of -50, so an edge with the
+--            default bias uses the tx power as is
+drop function average_stamp_and_prev(timestamptz, interval);
+create or replace function average_stamp_and_prev(moment timestamptz,
+    lastx interval default '00:00:00.5'::interval, mode text default 'bias')
+  returns table(beacon int, edge int, rssi numeric, distance real)
+  as $$
+  select beaconid, edgenodeid, avg(rssi) as arssi,
+      cast (power(10, ((case $3
+        when 'txpower' then coalesce(avg(l.txpower), b.txpower)
+        when 'both' then coalesce(avg(l.txpower), b.txpower) + e.bias + 50
+        else e.bias end) - avg(rssi))/(10 * e.gamma)) as real) as distance
+  -- 10 ^ (reference - rssi / 10 * gamma)
+  from beacon_log as l, edge_node as e, ibeacons as b
+  where datetime < $1 and datetime > $1 - $2
+  and l.edgenodeid = e.id and l.beaconid = b.id
+  group by beaconid, edgenodeid, gamma, bias, b.txpower
+  order by beaconid, edgenodeid; $$
+language SQL;
@@ -0,0 +1,17 @@
+-- Where a beacon really was, recorded during labelled walk-throughs or by
+-- the simulator, to measure the accuracy of the locations on a map.
+-- Positions are in the coordinates of the edges, room is the room the
+-- beacon was in if it was noted.
+create table ground_truth (
+  id bigserial primary key,
+  beaconid integer not null references ibeacons on delete cascade,
+  mapid integer references webmap_configs on delete cascade,
+  walkthrough text not null default '',
+  datetime timestamp with time zone not null,
+  x real not null,
+  y real not null,
+  z real not null default 0,
+  room text
+);
+create index ground_truth_beacon_datetime on ground_truth(beaconid, datetime);
+create index ground_truth_walkthrough on ground_truth(walkthrough);
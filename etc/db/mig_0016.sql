@@ -0,0 +1,24 @@
+-- The spread of the rssi behind each average is returned as well so
+-- distances can be weighted by how certain they are, variance is 0 when
+-- there is a single sample and gamma is the path loss exponent of the edge
+drop function average_stamp_and_prev(timestamptz, interval, text);
+create or replace function average_stamp_and_prev(moment timestamptz,
+    lastx interval default '00:00:00.5'::interval, mode text default 'bias')
+  returns table(beacon int, edge int, rssi numeric, distance real,
+    variance real, samples int, gamma real)
+  as $$
+  select beaconid, edgenodeid, avg(rssi) as arssi,
+      cast (power(10, ((case $3
+        when 'txpower' then coalesce(avg(l.txpower), b.txpower)
+        when 'both' then coalesce(avg(l.txpower), b.txpower) + e.bias + 50
+        else e.bias end) - avg(rssi))/(10 * e.gamma)) as real) as distance,
+      cast (coalesce(var_samp(rssi), 0) as real) as variance,
+      cast (count(*) as int) as samples,
+      cast (e.gamma as real) as gamma
+  -- 10 ^ (reference - rssi / 10 * gamma)
+  from beacon_log as l, edge_node as e, ibeacons as b
+  where datetime < $1 and datetime > $1 - $2
+  and l.edgenodeid = e.id and l.beaconid = b.id
+  group by beaconid, edgenodeid, e.gamma, e.bias, b.txpower
+  order by beaconid, edgenodeid; $$
+language SQL;
@@ -0,0 +1,25 @@
+-- Radio map of a map for fingerprinting. Each point is where a survey
+-- beacon was held while the edges of the map listened to it, the rssi of
+-- each edge is summarised over the window the beacon was there.
+create table fingerprints (
+  id serial primary key,
+  mapid integer not null references webmap_configs on delete cascade,
+  label text not null default '',
+  x real not null,
+  y real not null,
+  z real not null default 0,
+  beaconid integer references ibeacons on delete set null,
+  datetime_from timestamp with time zone not null,
+  datetime_to timestamp with time zone not null,
+  created timestamp with time zone not null default now()
+);
+create index fingerprints_mapid on fingerprints(mapid);
+
+create table fingerprint_rssi (
+  fingerprintid integer not null references fingerprints on delete cascade,
+  edgenodeid integer not null references edge_node on delete cascade,
+  rssi real not null,
+  stddev real not null,
+  samples integer not null,
+  primary key (fingerprintid, edgenodeid)
+);
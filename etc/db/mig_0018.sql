@@ -0,0 +1,15 @@
+-- Beacons entering and leaving zones as decided by the presence engine of
+-- the server. Zones are the rooms of the edges or the polygons of the
+-- zones of a map, a beacon is in the zone its last event entered until it
+-- has an exit event.
+create table presence_events (
+  id bigserial primary key,
+  beaconid integer not null references ibeacons on delete cascade,
+  zone text not null,
+  event text not null check (event in ('enter', 'exit')),
+  datetime timestamp with time zone not null,
+  -- The strongest edge when the beacon entered
+  edgenodeid integer references edge_node on delete set null
+);
+create index presence_events_beacon_datetime on presence_events(beaconid, datetime);
+create index presence_events_zone_datetime on presence_events(zone, datetime);
@@ -0,0 +1,42 @@
+-- Beacons the metrics server locates continuously on a map with one of
+-- the localization algorithms, parameters are its tunables as JSON
+create table tracking_sessions (
+  id serial primary key,
+  title text not null default '',
+  mapid integer not null references webmap_configs on delete cascade,
+  beacons integer[] not null,
+  algorithm text not null default 'weighted-least-squares',
+  parameters text not null default '{}',
+  interval_ms integer not null default 1000,
+  enabled boolean not null default true,
+  created timestamp with time zone not null default now()
+);
+
+-- Checkpoint of the motion filter of each beacon of a session so tracking
+-- picks up where it was after a restart, state is JSON
+create table tracker_filters (
+  sessionid integer not null references tracking_sessions on delete cascade,
+  beaconid integer not null references ibeacons on delete cascade,
+  state text not null,
+  updated timestamp with time zone not null,
+  primary key (sessionid, beaconid)
+);
+
+-- Locations of the beacons of the sessions after filtering, velocity is
+-- in metres per second and error_radius is the radius in metres of the 95%
+-- confidence circle
+create table beacon_positions (
+  id bigserial primary key,
+  sessionid integer not null references tracking_sessions on delete cascade,
+  mapid integer not null references webmap_configs on delete cascade,
+  beaconid integer not null references ibeacons on delete cascade,
+  datetime timestamp with time zone not null,
+  x real not null,
+  y real not null,
+  z real not null default 0,
+  vx real not null default 0,
+  vy real not null default 0,
+  error_radius real
+);
+create index beacon_positions_beacon_datetime on beacon_positions(beaconid, datetime);
+create index beacon_positions_session_datetime on beacon_positions(sessionid, datetime);
@@ -0,0 +1,3 @@
+-- MIME type of the floor plan of a map, maps added before it was kept are
+-- PNG
+alter table webmap_configs add column image_type text not null default 'image/png';
@@ -0,0 +1,53 @@
+-- Positions of edges in metres. An edge without a map_id is at that
+-- position on every map, edges on several floors are placed on the map of
+-- each floor. The location text of edge_node is left as a description.
+create table edge_placements (
+  id serial primary key,
+  edgenodeid integer not null references edge_node on delete cascade,
+  map_id integer references webmap_configs on delete cascade,
+  x double precision not null,
+  y double precision not null,
+  z double precision not null
+);
+create unique index edge_placements_default on edge_placements(edgenodeid)
+  where map_id is null;
+create unique index edge_placements_map on edge_placements(edgenodeid, map_id)
+  where map_id is not null;
+
+-- Every location the old edge_locations view found "(x, y, z)" in is kept,
+-- with its pattern. Those it matched with something other than a number,
+-- like "(1,5, 2, 3)", are reported in system_errors and need placing.
+create temporary table old_locations as
+  select id, location, a
+  from (select id, location, regexp_matches(location,
+      '\s*\((-?\d+(?:.\d+)?),\s*(-?\d+(?:.\d+)?),\s*(-?\d+(?:.\d+)?)\)\s*') as a
+    from edge_node) as l;
+alter table old_locations add column valid boolean;
+update old_locations set valid = a[1] ~ '^-?\d+(\.\d+)?$'
+  and a[2] ~ '^-?\d+(\.\d+)?$' and a[3] ~ '^-?\d+(\.\d+)?$';
+insert into edge_placements (edgenodeid, x, y, z)
+  select id, a[1]::double precision, a[2]::double precision, a[3]::double precision
+  from old_locations
+  where valid;
+insert into system_errors (error_level, error_text, edgenodeid)
+  select 3, 'Location "' || location || '" could not be migrated, the edge needs placing', id
+  from old_locations
+  where not valid;
+drop table old_locations;
+
+-- Position of each edge on a map, its placement on the map if it has one
+create or replace function edge_positions(map integer)
+  returns table(id integer, x double precision, y double precision, z double precision)
+  as $$
+  select distinct on (edgenodeid) edgenodeid, x, y, z
+  from edge_placements
+  where map_id = $1 or map_id is null
+  order by edgenodeid, map_id nulls last; $$
+language SQL stable;
+
+drop view edge_locations;
+create view edge_locations as
+  select edgenodeid as id, x, y, z
+  from edge_placements
+  where map_id is null
+  order by edgenodeid;
@@ -0,0 +1,3 @@
+-- Signatures cover the version and platform of an update as well as the
+-- binary, updates signed before need to be signed again
+comment on column edge_updates.signature is 'ed25519 signature of version, newline, platform, newline and data, verified by the edge before installing';
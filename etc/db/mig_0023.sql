@@ -0,0 +1,18 @@
+-- Eddystone-TLM frames of beacons as seen by each edge. Beacons without a
+-- battery or thermometer leave battery_mv or temperature null.
+create table beacon_telemetry (
+  id bigserial primary key,
+  datetime timestamp with time zone not null,
+  beaconid integer not null references ibeacons,
+  edgenodeid integer not null references edge_node,
+  battery_mv integer,
+  temperature real,
+  adv_count bigint not null,
+  uptime_ms bigint not null
+);
+create unique index beacon_telemetry_frame on beacon_telemetry(edgenodeid, beaconid, datetime);
+create index beacon_telemetry_beaconid on beacon_telemetry(beaconid, datetime);
+
+comment on column beacon_telemetry.temperature is 'Degrees Celsius';
+comment on column beacon_telemetry.adv_count is 'Advertisements sent by the beacon since it booted';
+comment on column beacon_telemetry.uptime_ms is 'Time since the beacon booted';
@@ -0,0 +1,121 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Percentiles of the location error reported by evaluations
+var EVALUATION_PERCENTILES = []float64{50, 75, 90, 95}
+
+// locationError compares one estimated location to the ground truth
+type locationError struct {
+	// Failed is set if the algorithm gave no location
+	Failed bool
+	// Distance in metres between the estimate and the truth
+	Error float64
+	// Rooms are empty if unknown
+	Room     string
+	TrueRoom string
+}
+
+// EvaluationResult is the accuracy of an algorithm on a map
+type EvaluationResult struct {
+	Algorithm string
+	Map       int
+	// Ground truth points replayed and those without an estimate
+	Points int
+	Failed int
+	// Errors in metres
+	MeanError   float64
+	MedianError float64
+	// Error below which each of EVALUATION_PERCENTILES of the estimates
+	// fall, keyed by percentile
+	Percentiles map[string]float64
+	// Points with both rooms known and the fraction in the right room
+	RoomPoints   int
+	RoomAccuracy float64
+}
+
+// summariseErrors returns the accuracy of an algorithm from its errors
+func summariseErrors(algorithm string, mapid int, errs []locationError) EvaluationResult {
+	res := EvaluationResult{
+		Algorithm:   algorithm,
+		Map:         mapid,
+		Points:      len(errs),
+		Percentiles: make(map[string]float64),
+	}
+	var dists []float64
+	var sum float64
+	correct := 0
+	for _, e := range errs {
+		if e.Failed {
+			res.Failed++
+			continue
+		}
+		dists = append(dists, e.Error)
+		sum += e.Error
+		if e.Room != "" && e.TrueRoom != "" {
+			res.RoomPoints++
+			if e.Room == e.TrueRoom {
+				correct++
+			}
+		}
+	}
+	if len(dists) == 0 {
+		return res
+	}
+	sort.Float64s(dists)
+	res.MeanError = sum / float64(len(dists))
+	res.MedianError = percentile(dists, 50)
+	for _, p := range EVALUATION_PERCENTILES {
+		res.Percentiles[strconv.FormatFloat(p, 'f', -1, 64)] = percentile(dists, p)
+	}
+	if res.RoomPoints > 0 {
+		res.RoomAccuracy = float64(correct) / float64(res.RoomPoints)
+	}
+	return res
+}
+
+// percentile returns the p-th percentile of sorted, interpolating between
+// the closest values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	pos := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(pos))
+	if lo >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[lo] + (pos-float64(lo))*(sorted[lo+1]-sorted[lo])
+}
+
+// nearestRoom returns the room of the edge closest to p in x and y, edge
+// locations and rooms are by index
+func nearestRoom(p []float64, locs [][]float64, rooms []string) string {
+	best, room := math.Inf(1), ""
+	for i, l := range locs {
+		if d := math.Hypot(p[0]-l[0], p[1]-l[1]); d < best {
+			best, room = d, rooms[i]
+		}
+	}
+	return room
+}
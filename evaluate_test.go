@@ -0,0 +1,60 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSummariseErrors(t *testing.T) {
+	errs := []locationError{
+		{Error: 1, Room: "a", TrueRoom: "a"},
+		{Error: 2, Room: "a", TrueRoom: "b"},
+		{Error: 3, Room: "b", TrueRoom: "b"},
+		{Error: 4, Room: "b"},
+		{Failed: true, TrueRoom: "a"},
+	}
+	res := summariseErrors("test", 1, errs)
+	if res.Points != 5 || res.Failed != 1 {
+		t.Fatalf("Counted %d points %d failed", res.Points, res.Failed)
+	}
+	if res.MeanError != 2.5 || res.MedianError != 2.5 {
+		t.Fatalf("Mean %f median %f", res.MeanError, res.MedianError)
+	}
+	if p := res.Percentiles["90"]; math.Abs(p-3.7) > 1e-9 {
+		t.Fatalf("90th percentile was %f", p)
+	}
+	if res.RoomPoints != 3 || math.Abs(res.RoomAccuracy-2.0/3) > 1e-9 {
+		t.Fatalf("Room accuracy was %f of %d", res.RoomAccuracy, res.RoomPoints)
+	}
+
+	if res = summariseErrors("test", 1, errs[4:]); res.Failed != 1 || res.MeanError != 0 {
+		t.Fatalf("Only failures gave %+v", res)
+	}
+}
+
+func TestNearestRoom(t *testing.T) {
+	locs := [][]float64{{0, 0, 2}, {10, 0, 2}}
+	rooms := []string{"a", "b"}
+	if r := nearestRoom([]float64{4, 3}, locs, rooms); r != "a" {
+		t.Fatalf("Nearest room was %s", r)
+	}
+	if r := nearestRoom([]float64{6, -3}, locs, rooms); r != "b" {
+		t.Fatalf("Nearest room was %s", r)
+	}
+}
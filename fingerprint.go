@@ -0,0 +1,169 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"github.com/pkg/errors"
+	"math"
+	"sort"
+)
+
+const (
+	// Rssi of an edge that did not hear a beacon
+	FINGERPRINT_MISSING_RSSI = -100
+	// Smallest standard deviation in dB of the rssi of a fingerprint so
+	// points surveyed with few samples don't match too sharply
+	FINGERPRINT_MIN_STDDEV = 2
+	// Signal distance in dB added before inverting it to a weight so an
+	// exact match doesn't take all of the weight
+	FINGERPRINT_EPSILON = 0.1
+)
+
+// fingerprint is the rssi the edges heard from a beacon held at Location
+type fingerprint struct {
+	Id    int
+	Label string
+	// x, y and z
+	Location []float64
+	// Mean and standard deviation of the rssi and the samples by edge id
+	Rssi    map[int]float64
+	Stddev  map[int]float64
+	Samples map[int]int
+}
+
+// signalEdges returns the edges heard at either fp or in observed
+func signalEdges(fp *fingerprint, observed map[int]float64) []int {
+	edges := make([]int, 0, len(fp.Rssi)+len(observed))
+	for e := range fp.Rssi {
+		edges = append(edges, e)
+	}
+	for e := range observed {
+		if _, ok := fp.Rssi[e]; !ok {
+			edges = append(edges, e)
+		}
+	}
+	return edges
+}
+
+// rssiOr returns the rssi of edge or missing if it was not heard
+func rssiOr(rssi map[int]float64, edge int, missing float64) float64 {
+	if v, ok := rssi[edge]; ok {
+		return v
+	}
+	return missing
+}
+
+// signalDistance is the euclidean distance in dB between the rssi of fp
+// and observed, edges that only one heard count as hearing missing
+func signalDistance(fp *fingerprint, observed map[int]float64, missing float64) float64 {
+	var sum float64
+	for _, e := range signalEdges(fp, observed) {
+		d := rssiOr(fp.Rssi, e, missing) - rssiOr(observed, e, missing)
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
+
+// weightedLocation returns the mean of the locations of fps and their
+// covariance in x and y by weight
+func weightedLocation(fps []*fingerprint, weights []float64) locationEstimate {
+	var total float64
+	mean := make([]float64, 3)
+	for i, fp := range fps {
+		total += weights[i]
+		for j := range mean {
+			mean[j] += weights[i] * fp.Location[j]
+		}
+	}
+	for j := range mean {
+		mean[j] /= total
+	}
+	cov := make([]float64, 4)
+	for i, fp := range fps {
+		w := weights[i] / total
+		dx, dy := fp.Location[0]-mean[0], fp.Location[1]-mean[1]
+		cov[0] += w * dx * dx
+		cov[1] += w * dx * dy
+		cov[3] += w * dy * dy
+	}
+	cov[2] = cov[1]
+	return locationEstimate{
+		Location:    mean,
+		Covariance:  cov,
+		ErrorRadius: errorRadius(cov),
+	}
+}
+
+// matchKNN returns the location of observed, the rssi by edge id, as the
+// mean of its k nearest fingerprints in signal space weighted by the
+// inverse of their distance
+func matchKNN(fps []fingerprint, observed map[int]float64, k int,
+	missing float64) (locationEstimate, error) {
+	if len(fps) == 0 || len(observed) == 0 {
+		return locationEstimate{}, errors.New("No fingerprints or rssi to match")
+	}
+	type match struct {
+		fp   *fingerprint
+		dist float64
+	}
+	matches := make([]match, len(fps))
+	for i := range fps {
+		matches[i] = match{&fps[i], signalDistance(&fps[i], observed, missing)}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].dist < matches[j].dist
+	})
+	if k > len(matches) {
+		k = len(matches)
+	}
+	near := make([]*fingerprint, k)
+	weights := make([]float64, k)
+	for i := 0; i < k; i++ {
+		near[i] = matches[i].fp
+		weights[i] = 1 / (matches[i].dist + FINGERPRINT_EPSILON)
+	}
+	return weightedLocation(near, weights), nil
+}
+
+// matchProbabilistic returns the location of observed, the rssi by edge
+// id, as the mean of all fingerprints weighted by how likely observed is at
+// each when the rssi of every edge is normal around the survey
+func matchProbabilistic(fps []fingerprint, observed map[int]float64,
+	missing float64) (locationEstimate, error) {
+	if len(fps) == 0 || len(observed) == 0 {
+		return locationEstimate{}, errors.New("No fingerprints or rssi to match")
+	}
+	all := make([]*fingerprint, len(fps))
+	loglike := make([]float64, len(fps))
+	best := math.Inf(-1)
+	for i := range fps {
+		fp := &fps[i]
+		all[i] = fp
+		for _, e := range signalEdges(fp, observed) {
+			sd := math.Max(fp.Stddev[e], FINGERPRINT_MIN_STDDEV)
+			z := (rssiOr(observed, e, missing) - rssiOr(fp.Rssi, e, missing)) / sd
+			loglike[i] -= z*z/2 + math.Log(sd)
+		}
+		best = math.Max(best, loglike[i])
+	}
+	// Relative to the best so the weights don't underflow
+	weights := make([]float64, len(fps))
+	for i := range loglike {
+		weights[i] = math.Exp(loglike[i] - best)
+	}
+	return weightedLocation(all, weights), nil
+}
@@ -0,0 +1,77 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"math"
+	"testing"
+)
+
+// testSurvey is a corridor surveyed every 2m along x with edges 1 and 2 at
+// either end
+func testSurvey() []fingerprint {
+	var fps []fingerprint
+	for x := 0.0; x <= 10; x += 2 {
+		fps = append(fps, fingerprint{
+			Location: []float64{x, 0, 0},
+			Rssi:     map[int]float64{1: -50 - 4*x, 2: -90 + 4*x},
+			Stddev:   map[int]float64{1: 3, 2: 3},
+		})
+	}
+	return fps
+}
+
+func TestMatchKNN(t *testing.T) {
+	fps := testSurvey()
+	est, err := matchKNN(fps, map[int]float64{1: -66, 2: -74}, 1, FINGERPRINT_MISSING_RSSI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.Location[0] != 4 || est.ErrorRadius != 0 {
+		t.Fatalf("Nearest point was %v with radius %f", est.Location, est.ErrorRadius)
+	}
+	// Between two points
+	if est, err = matchKNN(fps, map[int]float64{1: -70, 2: -70}, 2,
+		FINGERPRINT_MISSING_RSSI); err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(est.Location[0]-5) > 1e-9 || est.ErrorRadius <= 0 {
+		t.Fatalf("Between points was %v with radius %f", est.Location, est.ErrorRadius)
+	}
+	// Only edge 1 heard it, close to it
+	if est, err = matchKNN(fps, map[int]float64{1: -50}, 1,
+		FINGERPRINT_MISSING_RSSI); err != nil {
+		t.Fatal(err)
+	}
+	if est.Location[0] != 0 {
+		t.Fatalf("Beacon heard by one edge was at %v", est.Location)
+	}
+	if _, err = matchKNN(nil, map[int]float64{1: -50}, 1, FINGERPRINT_MISSING_RSSI); err == nil {
+		t.Fatal("Matched without a survey")
+	}
+}
+
+func TestMatchProbabilistic(t *testing.T) {
+	est, err := matchProbabilistic(testSurvey(), map[int]float64{1: -83, 2: -57},
+		FINGERPRINT_MISSING_RSSI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(est.Location[0]-8.25) > 0.5 {
+		t.Fatalf("Beacon at 8.25m was at %v", est.Location)
+	}
+}
@@ -0,0 +1,395 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// metricsserv builds cause problems with other binaries due to inclusion
+// of packages that require python3
+// +build metrics
+
+package beaconpi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	// Most ground truth points added, listed or evaluated at once
+	GROUND_TRUTH_MAX = 10000
+)
+
+// groundTruthPoint is where a beacon really was at a time
+type groundTruthPoint struct {
+	Id          int64
+	Beacon      int
+	Map         *int
+	Walkthrough string
+	Time        time.Time
+	X           float64
+	Y           float64
+	Z           float64
+	Room        *string
+}
+
+// groundTruthFilter selects ground truth points, the zero value selects
+// every point
+type groundTruthFilter struct {
+	Beacons     []int
+	Map         int
+	Walkthrough string
+	Since       *time.Time
+	Before      *time.Time
+}
+
+// dbGetGroundTruth returns the points selected by f ordered by beacon and
+// time, points without a map match every map
+func dbGetGroundTruth(f groundTruthFilter, limit int, db *sql.DB) ([]groundTruthPoint, error) {
+	rows, err := db.Query(`
+		select id, beaconid, mapid, walkthrough, datetime, x, y, z, room
+		from ground_truth
+		where (coalesce(cardinality($1::int[]), 0) = 0 or beaconid = any($1::int[]))
+		and ($2 = 0 or mapid = $2 or mapid is null)
+		and ($3 = '' or walkthrough = $3)
+		and ($4::timestamptz is null or datetime >= $4)
+		and ($5::timestamptz is null or datetime < $5)
+		order by beaconid, datetime
+		limit $6`, pq.Array(f.Beacons), f.Map, f.Walkthrough, f.Since, f.Before, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query ground truth")
+	}
+	defer rows.Close()
+	points := []groundTruthPoint{}
+	for rows.Next() {
+		var p groundTruthPoint
+		var mapid sql.NullInt64
+		var room sql.NullString
+		if err = rows.Scan(&p.Id, &p.Beacon, &mapid, &p.Walkthrough, &p.Time,
+			&p.X, &p.Y, &p.Z, &room); err != nil {
+			return nil, errors.Wrap(err, "Failed to scan ground truth")
+		}
+		if mapid.Valid {
+			m := int(mapid.Int64)
+			p.Map = &m
+		}
+		if room.Valid {
+			p.Room = &room.String
+		}
+		points = append(points, p)
+	}
+	return points, errors.Wrap(rows.Err(), "Failed to query ground truth")
+}
+
+// addGroundTruth records where a beacon was during a walk-through
+func addGroundTruth() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Beacon int
+			// Optional, points without a map are used for every map
+			Map         int
+			Walkthrough string
+			Points      []struct {
+				Time time.Time
+				X    float64
+				Y    float64
+				Z    float64
+				Room string
+			}
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in AddGroundTruth %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if len(input.Points) == 0 || len(input.Points) > GROUND_TRUTH_MAX {
+			log.Infof("Ground truth needs 1 to %d points", GROUND_TRUTH_MAX)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		var mapid *int
+		if input.Map != 0 {
+			mapid = &input.Map
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		tx, err := db.Begin()
+		if err != nil {
+			log.Errorf("Failed to begin transaction %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer tx.Rollback()
+		stmt, err := tx.Prepare(`
+			insert into ground_truth
+			(beaconid, mapid, walkthrough, datetime, x, y, z, room) values
+			($1, $2, $3, $4, $5, $6, $7, nullif($8, ''))`)
+		if err != nil {
+			log.Errorf("Failed to prepare ground truth insert %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer stmt.Close()
+		for _, p := range input.Points {
+			if _, err = stmt.Exec(input.Beacon, mapid, input.Walkthrough, p.Time,
+				p.X, p.Y, p.Z, p.Room); err != nil {
+				log.Infof("Failed to insert ground truth %s", err)
+				http.Error(w, "Invalid Request", 400)
+				return
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			log.Errorf("Failed to commit ground truth %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Success": true,
+			"Points":  len(input.Points),
+		})
+	})
+}
+
+// getGroundTruth lists ground truth points
+func getGroundTruth() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var input struct {
+			groundTruthFilter
+			Limit int
+		}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in GetGroundTruth %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if input.Limit <= 0 || input.Limit > GROUND_TRUTH_MAX {
+			input.Limit = GROUND_TRUTH_MAX
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		points, err := dbGetGroundTruth(input.groundTruthFilter, input.Limit, db)
+		if err != nil {
+			log.Errorf("Failed to get ground truth %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Points": points,
+		})
+	})
+}
+
+// remGroundTruth removes ground truth points by id or whole walk-throughs
+func remGroundTruth() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Ids         []int64
+			Walkthrough string
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in RemGroundTruth %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if len(input.Ids) == 0 && input.Walkthrough == "" {
+			log.Infof("Removing ground truth needs Ids or a Walkthrough")
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		res, err := db.Exec(`delete from ground_truth
+			where id = any($1::bigint[]) or ($2 != '' and walkthrough = $2)`,
+			pq.Array(input.Ids), input.Walkthrough)
+		if err != nil {
+			log.Errorf("Failed to remove ground truth %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		removed, _ := res.RowsAffected()
+		jsonResponse(w, map[string]interface{}{
+			"Success": true,
+			"Removed": removed,
+		})
+	})
+}
+
+// fetchEdgeRooms returns the locations on a map and rooms of edges ordered
+// by id
+func fetchEdgeRooms(db *sql.DB, mapid int, edges []int) (locs [][]float64, rooms []string, err error) {
+	rows, err := db.Query(`select l.x, l.y, l.z, e.room
+		from edge_positions($1) as l, edge_node as e
+		where l.id = e.id and e.id = any ($2::int[])
+		order by e.id`, mapid, pq.Array(edges))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to fetch edge rooms")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		l := make([]float64, 3)
+		var room string
+		if err = rows.Scan(&l[0], &l[1], &l[2], &room); err != nil {
+			return nil, nil, errors.Wrap(err, "Failed to scan edge rooms")
+		}
+		locs = append(locs, l)
+		rooms = append(rooms, room)
+	}
+	return locs, rooms, errors.Wrap(rows.Err(), "Failed to fetch edge rooms")
+}
+
+// evaluateAlgorithm replays the ground truth points through algo in order
+// and compares each location to the truth, rooms are those of the
+// nearest edge unless the truth noted one
+func evaluateAlgorithm(db *sql.DB, mc *MapConfig, algo *LocalizationAlgorithm,
+	params map[string]float64, points []groundTruthPoint, locs [][]float64, rooms []string) []locationError {
+	errs := make([]locationError, 0, len(points))
+	filterid, beacon := "", 0
+	for _, p := range points {
+		if p.Beacon != beacon {
+			// Filters follow one beacon through time
+			filterid, beacon = "", p.Beacon
+		}
+		truth := []float64{p.X, p.Y}
+		e := locationError{TrueRoom: nearestRoom(truth, locs, rooms)}
+		if p.Room != nil {
+			e.TrueRoom = *p.Room
+		}
+		mlr := FilteredMapLocationRequest{
+			FilterID:    filterid,
+			Beacons:     []int{p.Beacon},
+			Edges:       mc.Edges,
+			MapID:       mc.Id,
+			RequestTime: p.Time,
+			Algorithm:   algo.Name,
+			Parameters:  params,
+		}
+		td, err := algo.run(db, mc, &mlr)
+		if err != nil || len(td.Series) == 0 {
+			log.Debugf("No location of beacon %d at %s: %v", p.Beacon, p.Time, err)
+			e.Failed = true
+			errs = append(errs, e)
+			continue
+		}
+		filterid = td.FilterID
+		loc := td.Series[0].Location
+		e.Error = math.Hypot(loc[0]-p.X, loc[1]-p.Y)
+		e.Room = nearestRoom(loc, locs, rooms)
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// evaluateLocalization replays beacon_log through localization algorithms
+// at the times of the ground truth of a map and reports their accuracy
+func evaluateLocalization() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var input struct {
+			groundTruthFilter
+			Algorithms []string
+			// Tunables by algorithm then parameter name
+			Parameters map[string]map[string]float64
+		}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in EvaluateLocalization %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if input.Map == 0 || len(input.Algorithms) == 0 {
+			log.Infof("Evaluation needs a Map and Algorithms")
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		algos := make([]*LocalizationAlgorithm, len(input.Algorithms))
+		params := make([]map[string]float64, len(input.Algorithms))
+		for i, name := range input.Algorithms {
+			if algos[i] = localizationAlgorithm(name); algos[i] == nil {
+				log.Infof("Unknown algorithm \"%s\"", name)
+				http.Error(w, "Invalid Request", 400)
+				return
+			}
+			var err error
+			if params[i], err = algos[i].resolveParameters(input.Parameters[name]); err != nil {
+				log.Infof("Invalid algorithm parameters %s", err)
+				http.Error(w, "Invalid Request", 400)
+				return
+			}
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		mc, err := fetchMapConfig(db, input.Map)
+		if err != nil {
+			log.Infof("Failed to fetch map for given Id %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		points, err := dbGetGroundTruth(input.groundTruthFilter, GROUND_TRUTH_MAX, db)
+		if err != nil {
+			log.Errorf("Failed to get ground truth %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		locs, rooms, err := fetchEdgeRooms(db, mc.Id, mc.Edges)
+		if err != nil {
+			log.Errorf("Failed to get edges of map %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+
+		results := make([]EvaluationResult, len(algos))
+		for i, algo := range algos {
+			errs := evaluateAlgorithm(db, mc, algo, params[i], points, locs, rooms)
+			results[i] = summariseErrors(input.Algorithms[i], mc.Id, errs)
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Results": results,
+		})
+	})
+}
@@ -0,0 +1,192 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"log"
+	"sync"
+)
+
+const (
+	// setsockopt option for the HCI socket filter
+	HCI_FILTER = 2
+	// ioctl to bring an HCI device up, _IOW('H', 201, int)
+	HCIDEVUP = 0x400448c9
+
+	// LE controller commands, OGF 0x08
+	OCF_LE_SET_SCAN_PARAMETERS = 0x200B
+	OCF_LE_SET_SCAN_ENABLE     = 0x200C
+
+	// Scan parameters matching those used by "hcitool lescan", intervals
+	// are in units of 0.625ms
+	LE_SCAN_ACTIVE   = 0x01
+	LE_SCAN_INTERVAL = 0x0010
+	LE_SCAN_WINDOW   = 0x0010
+)
+
+// hciSocketScanner reads HCI events directly from a raw HCI socket, it
+// requires cap_net_raw and cap_net_admin
+type hciSocketScanner struct {
+	sync.Mutex
+	fd     int
+	device int
+	closed bool
+}
+
+// newHCISocketScanner opens a raw socket on hci<device> and enables LE
+// scanning with duplicate reports
+func newHCISocketScanner(device int) (bleScanner, error) {
+	fd, err := unix.Socket(unix.AF_BLUETOOTH, unix.SOCK_RAW|unix.SOCK_CLOEXEC,
+		unix.BTPROTO_HCI)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open HCI socket")
+	}
+	s := &hciSocketScanner{fd: fd, device: device}
+
+	// Bring the device up, it is fine if it already is
+	if err = unix.IoctlSetInt(fd, HCIDEVUP, device); err != nil && err != unix.EALREADY {
+		unix.Close(fd)
+		return nil, errors.Wrapf(err, "Failed to bring up hci%d", device)
+	}
+	if err = unix.Bind(fd, &unix.SockaddrHCI{Dev: uint16(device),
+		Channel: unix.HCI_CHANNEL_RAW}); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrapf(err, "Failed to bind hci%d", device)
+	}
+	if err = s.setFilter(); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// A timeout on reads lets Scan notice when the scanner is closed
+	if err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO,
+		&unix.Timeval{Sec: 1}); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(err, "Failed to set HCI socket timeout")
+	}
+
+	// Disable scanning first as the parameters can't change while enabled
+	s.setScanEnable(false)
+	params := new(bytes.Buffer)
+	binary.Write(params, binary.LittleEndian, struct {
+		Type         uint8
+		Interval     uint16
+		Window       uint16
+		OwnAddrType  uint8
+		FilterPolicy uint8
+	}{LE_SCAN_ACTIVE, LE_SCAN_INTERVAL, LE_SCAN_WINDOW, 0, 0})
+	if err = s.command(OCF_LE_SET_SCAN_PARAMETERS, params.Bytes()); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if err = s.setScanEnable(true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	log.Printf("Scanning on hci%d", device)
+	return s, nil
+}
+
+// setFilter limits the socket to the events the scanner needs
+func (s *hciSocketScanner) setFilter() error {
+	var filter struct {
+		TypeMask  uint32
+		EventMask [2]uint32
+		Opcode    uint16
+	}
+	filter.TypeMask = 1 << HCI_EVENT_PKT
+	for _, evt := range []uint{EVT_CMD_COMPLETE, EVT_CMD_STATUS, EVT_LE_META} {
+		filter.EventMask[evt/32] |= 1 << (evt % 32)
+	}
+	buff := new(bytes.Buffer)
+	binary.Write(buff, binary.LittleEndian, &filter)
+	if err := unix.SetsockoptString(s.fd, unix.SOL_HCI, HCI_FILTER,
+		buff.String()); err != nil {
+		return errors.Wrap(err, "Failed to set HCI filter")
+	}
+	return nil
+}
+
+// setScanEnable enables or disables LE scanning, duplicates are never
+// filtered as every advertisement is a sighting
+func (s *hciSocketScanner) setScanEnable(enable bool) error {
+	var e uint8
+	if enable {
+		e = 1
+	}
+	return s.command(OCF_LE_SET_SCAN_ENABLE, []byte{e, 0})
+}
+
+// command writes an HCI command, completion is reported in Scan
+func (s *hciSocketScanner) command(opcode uint16, params []byte) error {
+	pkt := make([]byte, 4, 4+len(params))
+	pkt[0] = HCI_COMMAND_PKT
+	binary.LittleEndian.PutUint16(pkt[1:3], opcode)
+	pkt[3] = uint8(len(params))
+	pkt = append(pkt, params...)
+	if _, err := unix.Write(s.fd, pkt); err != nil {
+		return errors.Wrapf(err, "Failed to write HCI command 0x%04x", opcode)
+	}
+	return nil
+}
+
+// Scan implements bleScanner
+func (s *hciSocketScanner) Scan(events chan<- []byte) error {
+	buff := make([]byte, 260)
+	for {
+		n, err := unix.Read(s.fd, buff)
+		s.Lock()
+		closed := s.closed
+		s.Unlock()
+		if closed {
+			return errors.New("Scanner closed")
+		}
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return errors.Wrap(err, "Failed to read HCI socket")
+		}
+		pkt := buff[:n]
+		// Report failed commands, the status follows the opcode
+		if n >= 7 && pkt[1] == EVT_CMD_COMPLETE && pkt[6] != 0 {
+			log.Printf("HCI command 0x%04x failed with status 0x%02x",
+				binary.LittleEndian.Uint16(pkt[4:6]), pkt[6])
+			continue
+		}
+		if n < 2 || pkt[1] != EVT_LE_META {
+			continue
+		}
+		out := make([]byte, n)
+		copy(out, pkt)
+		events <- out
+	}
+}
+
+// Close implements bleScanner
+func (s *hciSocketScanner) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.setScanEnable(false)
+	return unix.Close(s.fd)
+}
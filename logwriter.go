@@ -0,0 +1,258 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	LOG_WRITER_STATS_INTERVAL = time.Minute
+	// Requests waiting for the writer before connections block
+	LOG_WRITER_QUEUE = 1024
+)
+
+// beaconLogRow is one row of beacon_log
+type beaconLogRow struct {
+	Datetime time.Time
+	Beaconid int
+	Edgeid   int
+	Rssi     int
+	// TxPower advertised by the beacon, 0 if unknown
+	TxPower int8
+}
+
+// logWriteRequest is the rows, aggregates and telemetry of one packet, done
+// is sent the result once they are committed or rolled back
+type logWriteRequest struct {
+	rows []beaconLogRow
+	aggs []beaconAggregateRow
+	tlms []beaconTelemetryRow
+	// Server clock less the clock of the edge
+	skew time.Duration
+	// Rows copied into beacon_log, rows and those of the new aggregates
+	written []beaconLogRow
+	done    chan error
+}
+
+// logStore is where a logWriter commits packets
+type logStore interface {
+	// Insert commits reqs in one transaction, nothing of them is kept if
+	// it fails. The written rows of each request are set.
+	Insert(reqs []*logWriteRequest) error
+}
+
+// logWriter inserts beacon logs with COPY, each packet is inserted with its
+// aggregates and telemetry in a transaction so it is all or nothing. If
+// batchSize is more than zero packets from all connections are buffered and
+// committed together when batchSize rows are waiting or after interval.
+type logWriter struct {
+	store     logStore
+	batchSize int
+	interval  time.Duration
+	requests  chan *logWriteRequest
+	// Told of rows once they are committed if set
+	presence *presenceEngine
+
+	// Throughput since the last report
+	statsLock  sync.Mutex
+	rows       int
+	packets    int
+	flushes    int
+	flushTime  time.Duration
+	statsStart time.Time
+}
+
+// newLogWriter starts a writer to store, batching is disabled if batchSize
+// or interval is zero
+func newLogWriter(store logStore, batchSize int, interval time.Duration) *logWriter {
+	w := &logWriter{
+		store:      store,
+		batchSize:  batchSize,
+		interval:   interval,
+		statsStart: time.Now(),
+	}
+	if batchSize > 0 && interval > 0 {
+		w.requests = make(chan *logWriteRequest, LOG_WRITER_QUEUE)
+		go w.run()
+	}
+	go w.reportStats()
+	return w
+}
+
+// Write inserts rows, aggs and tlms and returns once they are committed,
+// skew is the server clock less the clock of the edge that sent them
+func (w *logWriter) Write(rows []beaconLogRow, aggs []beaconAggregateRow,
+	tlms []beaconTelemetryRow, skew time.Duration) error {
+	if len(rows) == 0 && len(aggs) == 0 && len(tlms) == 0 {
+		return nil
+	}
+	req := &logWriteRequest{rows: rows, aggs: aggs, tlms: tlms, skew: skew,
+		done: make(chan error, 1)}
+	var err error
+	if w.requests == nil {
+		start := time.Now()
+		if err = w.store.Insert([]*logWriteRequest{req}); err == nil {
+			w.record(len(req.written), 1, time.Since(start))
+		}
+	} else {
+		w.requests <- req
+		err = <-req.done
+	}
+	if err == nil && w.presence != nil {
+		w.presence.Record(req.written, req.skew)
+	}
+	return err
+}
+
+// run buffers requests until the batch is full or interval has passed
+// since the first one arrived
+func (w *logWriter) run() {
+	var batch []*logWriteRequest
+	var nrows int
+	var timer <-chan time.Time
+	for {
+		select {
+		case req := <-w.requests:
+			if len(batch) == 0 {
+				timer = time.After(w.interval)
+			}
+			batch = append(batch, req)
+			nrows += len(req.rows) + len(req.aggs) + len(req.tlms)
+			if nrows < w.batchSize {
+				continue
+			}
+		case _ = <-timer:
+		}
+		w.flush(batch)
+		batch = nil
+		nrows = 0
+		timer = nil
+	}
+}
+
+// flush commits a batch in one transaction, if that fails each packet is
+// retried in its own transaction so one bad packet fails alone
+func (w *logWriter) flush(batch []*logWriteRequest) {
+	start := time.Now()
+	err := w.store.Insert(batch)
+	if err == nil {
+		var nrows int
+		for _, req := range batch {
+			nrows += len(req.written)
+		}
+		w.record(nrows, len(batch), time.Since(start))
+		for _, req := range batch {
+			req.done <- nil
+		}
+		return
+	}
+	if len(batch) > 1 {
+		log.Warnf("Batch insert of %d packets failed, retrying separately: %s",
+			len(batch), err)
+	}
+	for _, req := range batch {
+		start = time.Now()
+		err = w.store.Insert([]*logWriteRequest{req})
+		if err == nil {
+			w.record(len(req.written), 1, time.Since(start))
+		}
+		req.done <- err
+	}
+}
+
+// dbLogStore commits packets to the database
+type dbLogStore struct {
+	db *sql.DB
+}
+
+// Insert implements logStore, the aggregates of reqs are added to
+// beacon_log_agg and their telemetry to beacon_telemetry and their rows are
+// copied into beacon_log
+func (s dbLogStore) Insert(reqs []*logWriteRequest) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin transaction")
+	}
+	defer tx.Rollback()
+	var rows []beaconLogRow
+	for _, req := range reqs {
+		aggrows, err := dbInsertAggregates(tx, req.aggs)
+		if err != nil {
+			return err
+		}
+		if err = dbInsertTelemetry(tx, req.tlms); err != nil {
+			return err
+		}
+		req.written = append(req.rows[:len(req.rows):len(req.rows)], aggrows...)
+		rows = append(rows, req.written...)
+	}
+	stmt, err := tx.Prepare(pq.CopyIn("beacon_log",
+		"datetime", "beaconid", "edgenodeid", "rssi", "txpower"))
+	if err != nil {
+		return errors.Wrap(err, "Failed to prepare copy")
+	}
+	for _, row := range rows {
+		if _, err = stmt.Exec(row.Datetime.UTC(), row.Beaconid, row.Edgeid,
+			row.Rssi, nullTxPower(row.TxPower)); err != nil {
+			stmt.Close()
+			return errors.Wrap(err, "Failed to copy row")
+		}
+	}
+	if _, err = stmt.Exec(); err != nil {
+		stmt.Close()
+		return errors.Wrap(err, "Failed to flush copy")
+	}
+	if err = stmt.Close(); err != nil {
+		return errors.Wrap(err, "Failed to close copy")
+	}
+	if err = tx.Commit(); err != nil {
+		return errors.Wrap(err, "Failed to commit logs")
+	}
+	return nil
+}
+
+func (w *logWriter) record(rows, packets int, d time.Duration) {
+	w.statsLock.Lock()
+	defer w.statsLock.Unlock()
+	w.rows += rows
+	w.packets += packets
+	w.flushes++
+	w.flushTime += d
+}
+
+// reportStats logs the throughput of the writer periodically
+func (w *logWriter) reportStats() {
+	for _ = range time.Tick(LOG_WRITER_STATS_INTERVAL) {
+		w.statsLock.Lock()
+		elapsed := time.Since(w.statsStart)
+		if w.flushes > 0 {
+			log.Infof("Log writer: %d rows in %d packets, %d commits, "+
+				"%.1f rows/s, %s average commit", w.rows, w.packets, w.flushes,
+				float64(w.rows)/elapsed.Seconds(),
+				w.flushTime/time.Duration(w.flushes))
+		}
+		w.rows, w.packets, w.flushes, w.flushTime = 0, 0, 0, 0
+		w.statsStart = time.Now()
+		w.statsLock.Unlock()
+	}
+}
@@ -0,0 +1,177 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"github.com/pkg/errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryLogStore commits packets to memory, batches with a row of a
+// negative rssi fail as a whole
+type memoryLogStore struct {
+	sync.Mutex
+	rows    []beaconLogRow
+	batches [][]*logWriteRequest
+}
+
+// Insert implements logStore
+func (s *memoryLogStore) Insert(reqs []*logWriteRequest) error {
+	s.Lock()
+	defer s.Unlock()
+	s.batches = append(s.batches, reqs)
+	var rows []beaconLogRow
+	for _, req := range reqs {
+		for _, row := range req.rows {
+			if row.Rssi < 0 {
+				return errors.New("Invalid rssi")
+			}
+		}
+		req.written = append(req.rows[:len(req.rows):len(req.rows)], aggregateLogRows(req.aggs)...)
+		rows = append(rows, req.written...)
+	}
+	s.rows = append(s.rows, rows...)
+	return nil
+}
+
+func aggregateLogRows(aggs []beaconAggregateRow) []beaconLogRow {
+	var rows []beaconLogRow
+	for i := range aggs {
+		rows = append(rows, aggs[i].logRow())
+	}
+	return rows
+}
+
+// writeConcurrently writes a packet of each row from its own connection
+// and returns the error of each
+func writeConcurrently(w *logWriter, rows []beaconLogRow) []error {
+	errs := make([]error, len(rows))
+	var wg sync.WaitGroup
+	for i := range rows {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = w.Write(rows[i:i+1], nil, nil, 0)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestLogWriterBatchSize(t *testing.T) {
+	store := new(memoryLogStore)
+	// The interval is never reached, only a full batch is committed
+	w := newLogWriter(store, 4, time.Hour)
+	rows := []beaconLogRow{{Rssi: 1}, {Rssi: 2}, {Rssi: 3}, {Rssi: 4}}
+	for i, err := range writeConcurrently(w, rows) {
+		if err != nil {
+			t.Errorf("Packet %d failed: %s", i, err)
+		}
+	}
+	if len(store.batches) != 1 || len(store.batches[0]) != 4 || len(store.rows) != 4 {
+		t.Fatalf("Packets were committed in %d batches with %d rows",
+			len(store.batches), len(store.rows))
+	}
+
+	// Aggregates count towards the batch and are written as rows
+	aggs := []beaconAggregateRow{{BeaconAggregate{Count: 1}, 1, 1},
+		{BeaconAggregate{Count: 1}, 2, 1}}
+	done := make(chan error)
+	go func() { done <- w.Write([]beaconLogRow{{Rssi: 5}}, aggs, nil, 0) }()
+	go func() { done <- w.Write([]beaconLogRow{{Rssi: 6}}, nil, nil, 0) }()
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(store.batches) != 2 || len(store.rows) != 8 {
+		t.Fatalf("Packets were committed in %d batches with %d rows",
+			len(store.batches), len(store.rows))
+	}
+}
+
+func TestLogWriterInterval(t *testing.T) {
+	store := new(memoryLogStore)
+	w := newLogWriter(store, 1000, 50*time.Millisecond)
+	start := time.Now()
+	if err := w.Write([]beaconLogRow{{Rssi: 1}}, nil, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Batch was committed after %s", elapsed)
+	}
+	if len(store.rows) != 1 {
+		t.Fatalf("%d rows were committed", len(store.rows))
+	}
+
+	// Nothing is queued for empty packets
+	if err := w.Write(nil, nil, nil, 0); err != nil || len(store.batches) != 1 {
+		t.Fatalf("Empty packet was committed: %v", err)
+	}
+}
+
+func TestLogWriterRetry(t *testing.T) {
+	store := new(memoryLogStore)
+	w := newLogWriter(store, 3, time.Hour)
+	rows := []beaconLogRow{{Rssi: 1}, {Rssi: -1}, {Rssi: 2}}
+	errs := writeConcurrently(w, rows)
+	if errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Fatalf("Packets returned %v", errs)
+	}
+	// The failed batch and each packet on its own
+	if len(store.batches) != 4 {
+		t.Fatalf("%d batches were inserted", len(store.batches))
+	}
+	if len(store.rows) != 2 {
+		t.Fatalf("Rows %+v were committed", store.rows)
+	}
+	for _, row := range store.rows {
+		if row.Rssi < 0 {
+			t.Fatalf("The failed packet was committed %+v", store.rows)
+		}
+	}
+
+	w.statsLock.Lock()
+	defer w.statsLock.Unlock()
+	if w.rows != 2 || w.packets != 2 || w.flushes != 2 {
+		t.Errorf("Stats were %d rows, %d packets, %d flushes", w.rows, w.packets, w.flushes)
+	}
+}
+
+func TestLogWriterUnbatched(t *testing.T) {
+	store := new(memoryLogStore)
+	w := newLogWriter(store, 0, 0)
+	for i := 1; i <= 3; i++ {
+		if err := w.Write([]beaconLogRow{{Rssi: i}, {Rssi: i}}, nil, nil, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Write([]beaconLogRow{{Rssi: -1}}, nil, nil, 0); err == nil {
+		t.Fatal("Failed packet returned no error")
+	}
+	if len(store.batches) != 4 || len(store.rows) != 6 {
+		t.Fatalf("Packets were committed in %d batches with %d rows",
+			len(store.batches), len(store.rows))
+	}
+	w.statsLock.Lock()
+	defer w.statsLock.Unlock()
+	if w.rows != 6 || w.packets != 3 || w.flushes != 3 {
+		t.Errorf("Stats were %d rows, %d packets, %d flushes", w.rows, w.packets, w.flushes)
+	}
+}
@@ -0,0 +1,238 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// metricsserv builds cause problems with other binaries due to inclusion
+// of packages that require python3
+// +build metrics
+
+package beaconpi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+)
+
+// validateMapConfig returns an error if mc can't be used to locate
+// beacons, the edges must be placed in db
+func validateMapConfig(mc *MapConfig, db *sql.DB) error {
+	err := validateLen(nil, mc.Title, "Title", 1)
+	if err != nil {
+		return err
+	}
+	if len(mc.Limits) != 4 || mc.Limits[0] >= mc.Limits[1] || mc.Limits[2] >= mc.Limits[3] {
+		return errors.New("Limits must be x1, x2, y1, y2 with x1 < x2 and y1 < y2")
+	}
+	if mc.CoordScaleX == 0 || mc.CoordScaleY == 0 {
+		return errors.New("CoordScaleX and CoordScaleY can't be zero")
+	}
+	if mc.DistanceMode != "" {
+		if err = validateDistanceMode(mc.DistanceMode); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	for _, z := range mc.Zones {
+		if z.Name == "" || names[z.Name] || len(z.Polygon) < 3 {
+			return errors.Errorf("Zone \"%s\" needs a unique name and 3 or more vertices", z.Name)
+		}
+		names[z.Name] = true
+	}
+	if len(mc.Edges) == 0 {
+		return errors.New("Maps need Edges")
+	}
+	unique := make(map[int]bool)
+	for _, e := range mc.Edges {
+		if unique[e] {
+			return errors.Errorf("Edge %d is on the map twice", e)
+		}
+		unique[e] = true
+	}
+	var found int
+	if err = db.QueryRow(`select count(*) from edge_positions($1)
+		where id = any($2::int[])`, mc.Id, pq.Array(mc.Edges)).Scan(&found); err != nil {
+		return errors.Wrap(err, "Failed to check edges")
+	}
+	if found != len(mc.Edges) {
+		return errors.Errorf("%d of the Edges don't exist or aren't placed",
+			len(mc.Edges)-found)
+	}
+	return nil
+}
+
+// modMap adds, changes or removes a map. ImageData is the floor plan,
+// required for new maps and replacing the old one if given otherwise.
+func modMap() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			MapConfig
+			Option    string
+			ImageData []byte
+		}{}
+		req.Body = http.MaxBytesReader(w, req.Body, 2*MAP_IMAGE_MAX)
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in ModMap %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		var imagetype string
+		if input.Option == "new" || len(input.ImageData) > 0 {
+			var err error
+			if imagetype, err = mapImageType(input.ImageData); err != nil ||
+				len(input.ImageData) > MAP_IMAGE_MAX {
+				log.Infof("Invalid floor plan of %d bytes %v", len(input.ImageData), err)
+				http.Error(w, "Invalid Request", 400)
+				return
+			}
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		mc := &input.MapConfig
+		if input.Option != "rem" {
+			if err = validateMapConfig(mc, db); err != nil {
+				log.Infof("Failed validation %s", err)
+				http.Error(w, "Invalid Request", 400)
+				return
+			}
+		}
+		// Id, title and image are columns of their own
+		config := *mc
+		config.Id, config.Title, config.Image = 0, "", 0
+		configjson, err := json.Marshal(&config)
+		if err != nil {
+			log.Errorf("Failed to encode map config %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Errorf("Failed to begin transaction %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer tx.Rollback()
+		switch input.Option {
+		case "new":
+			err = tx.QueryRow(`insert into webmap_configs
+				(title, image, image_type, config) values
+				($1, lo_from_bytea(0, $2), $3, $4) returning id`,
+				mc.Title, input.ImageData, imagetype, string(configjson)).Scan(&mc.Id)
+		case "mod":
+			var res sql.Result
+			res, err = tx.Exec(`update webmap_configs
+				set (title, config) = ($1, $2) where id = $3`,
+				mc.Title, string(configjson), mc.Id)
+			if err == nil {
+				if n, _ := res.RowsAffected(); n == 0 {
+					err = errors.Errorf("Map %d does not exist", mc.Id)
+				}
+			}
+			if err == nil && len(input.ImageData) > 0 {
+				_, err = tx.Exec(`with old as (
+						select image from webmap_configs where id = $1)
+					update webmap_configs
+					set (image, image_type) = (lo_from_bytea(0, $2), $3)
+					where id = $1 and lo_unlink((select image from old)) = 1`,
+					mc.Id, input.ImageData, imagetype)
+			}
+		case "rem":
+			_, err = tx.Exec(`select lo_unlink(image) from webmap_configs
+				where id = $1`, mc.Id)
+			if err == nil {
+				_, err = tx.Exec(`delete from webmap_configs where id = $1`, mc.Id)
+			}
+		default:
+			log.Infof("Option invalid given \"%s\"", input.Option)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if err != nil {
+			log.Infof("Failed operation on DB %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if err = tx.Commit(); err != nil {
+			log.Errorf("Failed to commit map %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Success": true,
+			"Id":      mc.Id,
+		})
+	})
+}
+
+// calibrateMap returns the CoordBias and CoordScale of a map from two or
+// more reference points at known pixels of the floor plan and world
+// coordinates, and the error of the fit in pixels
+func calibrateMap() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Points []struct {
+				PixelX float64
+				PixelY float64
+				X      float64
+				Y      float64
+			}
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in CalibrateMap %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		var px, py, x, y []float64
+		for _, p := range input.Points {
+			px, py = append(px, p.PixelX), append(py, p.PixelY)
+			x, y = append(x, p.X), append(y, p.Y)
+		}
+		biasx, scalex, rmsx, err := calibrateAxis(px, x)
+		if err != nil {
+			log.Infof("Failed to calibrate x %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		biasy, scaley, rmsy, err := calibrateAxis(py, y)
+		if err != nil {
+			log.Infof("Failed to calibrate y %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			// Biases are whole pixels in MapConfig
+			"CoordBiasX":  int(math.Round(biasx)),
+			"CoordBiasY":  int(math.Round(biasy)),
+			"CoordScaleX": scalex,
+			"CoordScaleY": scaley,
+			"ErrorX":      rmsx,
+			"ErrorY":      rmsy,
+		})
+	})
+}
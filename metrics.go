@@ -42,6 +42,10 @@ type MetricsParameters struct {
 	SMTPUser       string
 	SMTPPassphrase string
 	MonitorEmail   string
+	// DistanceMode is the DISTANCE_* used by maps that don't set one
+	DistanceMode string
+	// Don't locate the beacons of tracking sessions in the background
+	NoTracker bool
 }
 
 var mp MetricsParameters
@@ -124,6 +128,9 @@ func beaconShortHistory() http.Handler {
 // MetricStart is the main entry point of the metrics server
 func MetricStart(metrics *MetricsParameters) {
 	mp = *metrics
+	if mp.DistanceMode == "" {
+		mp.DistanceMode = DISTANCE_BIAS
+	}
 
 	mux := http.NewServeMux()
 
@@ -134,6 +141,10 @@ func MetricStart(metrics *MetricsParameters) {
 	customFormatter.FullTimestamp = true
 	log.SetFormatter(customFormatter)
 
+	if err := validateDistanceMode(mp.DistanceMode); err != nil {
+		log.Fatalf("Invalid distance mode %s", err)
+	}
+
 	wa, err := webauth.OpenAuthDB(mp.DriverName, mp.DataSourceName)
 	if err != nil {
 		log.Fatalf("Failed to open DB for auth %s", err)
@@ -155,6 +166,19 @@ func MetricStart(metrics *MetricsParameters) {
 	mux.Handle("/config/modedge", wc.CheckCookie(cookieAction)(modEdge()))
 	mux.Handle("/config/allbeacons", wc.CheckCookie(cookieAction)(getBeacons()))
 	mux.Handle("/config/alledges", wc.CheckCookie(cookieAction)(getEdges()))
+	mux.Handle("/config/allsites", wc.CheckCookie(cookieAction)(getSites()))
+	mux.Handle("/config/modsite", wc.CheckCookie(cookieAction)(modSite()))
+	mux.Handle("/config/assignsite", wc.CheckCookie(cookieAction)(assignSite()))
+	mux.Handle("/config/discovered", wc.CheckCookie(cookieAction)(getDiscovered()))
+	mux.Handle("/config/promotebeacon", wc.CheckCookie(cookieAction)(promoteBeacon()))
+	mux.Handle("/control/edgeaction", wc.CheckCookie(cookieAction)(edgeAction()))
+	mux.Handle("/control/discovery", wc.CheckCookie(cookieAction)(edgeDiscovery()))
+	mux.Handle("/control/uploadupdate", wc.CheckCookie(cookieAction)(uploadUpdate()))
+	mux.Handle("/control/tail", wc.CheckCookie(cookieAction)(tailControl()))
+	mux.Handle("/control/enqueue", wc.CheckCookie(cookieAction)(enqueueControl()))
+	mux.Handle("/control/list", wc.CheckCookie(cookieAction)(listControl()))
+	mux.Handle("/control/cancel", wc.CheckCookie(cookieAction)(cancelControl()))
+	mux.Handle("/control/expire", wc.CheckCookie(cookieAction)(expireControl()))
 	// Home screen can be unauthenticated
 	//	mux.Handle("/stats/quick", wc.CheckCookie(cookieAction)(quickStats()))
 	mux.Handle("/stats/quick", quickStats())
@@ -162,10 +186,26 @@ func MetricStart(metrics *MetricsParameters) {
 	mux.Handle("/history/short", wc.CheckCookie(cookieAction)(beaconShortHistory()))
 	//TODO(mae) restore cookie
 	mux.Handle("/history/maptracking", wc.CheckCookie(cookieAction)(filteredMapLocation(mp)))
+	mux.Handle("/history/algorithms", wc.CheckCookie(cookieAction)(allAlgorithms()))
+	mux.Handle("/history/replay", wc.CheckCookie(cookieAction)(replayTrajectory()))
 	mux.Handle("/maps/allmaps", wc.CheckCookie(cookieAction)(allMaps(mp)))
 	mux.Handle("/maps/mapimage", wc.CheckCookie(cookieAction)(fetchImage(mp)))
+	mux.Handle("/maps/modmap", wc.CheckCookie(cookieAction)(modMap()))
+	mux.Handle("/maps/calibrate", wc.CheckCookie(cookieAction)(calibrateMap()))
+	mux.Handle("/maps/addfingerprint", wc.CheckCookie(cookieAction)(addFingerprint()))
+	mux.Handle("/maps/fingerprints", wc.CheckCookie(cookieAction)(getFingerprints()))
+	mux.Handle("/maps/remfingerprint", wc.CheckCookie(cookieAction)(remFingerprint()))
 
 	mux.Handle("/history/export", wc.CheckCookie(cookieAction)(getCSV()))
+	mux.Handle("/history/addgroundtruth", wc.CheckCookie(cookieAction)(addGroundTruth()))
+	mux.Handle("/history/groundtruth", wc.CheckCookie(cookieAction)(getGroundTruth()))
+	mux.Handle("/history/remgroundtruth", wc.CheckCookie(cookieAction)(remGroundTruth()))
+	mux.Handle("/history/evaluate", wc.CheckCookie(cookieAction)(evaluateLocalization()))
+	mux.Handle("/presence/occupancy", wc.CheckCookie(cookieAction)(getOccupancy()))
+	mux.Handle("/presence/visits", wc.CheckCookie(cookieAction)(getVisits()))
+	mux.Handle("/tracking/sessions", wc.CheckCookie(cookieAction)(getTrackingSessions()))
+	mux.Handle("/tracking/modsession", wc.CheckCookie(cookieAction)(modTrackingSession()))
+	mux.Handle("/tracking/positions", wc.CheckCookie(cookieAction)(getPositions()))
 
 	origins := strings.Split(mp.AllowedOrigin, ",")
 	log.Infof("Allowed domains: %#v", origins)
@@ -178,6 +218,9 @@ func MetricStart(metrics *MetricsParameters) {
 	// Start
 	log.Infof("Starting background tasks")
 	go metricsBackgroundTasks()
+	if !mp.NoTracker {
+		go runTracker()
+	}
 	log.Infof("Starting metrics server on %v", metrics.Port)
 	log.Fatal(http.ListenAndServe(":"+metrics.Port, handler))
 }
@@ -0,0 +1,134 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"time"
+)
+
+const (
+	// Spectral density of the acceleration in m²/s³ the motion filter
+	// expects, about what someone walking around a ward does
+	MOTION_ACCELERATION = 0.25
+	// Standard deviation in metres of a location that came without a
+	// covariance
+	MOTION_MEASUREMENT_SD = 2.0
+	// Standard deviation in m/s of the velocity of a new filter
+	MOTION_VELOCITY_SD = 1.0
+	// Filters not updated for this long start again from the next location
+	MOTION_RESET = time.Minute
+)
+
+// motionFilter is a constant velocity Kalman filter of a location in x and
+// y, unlike the particle filters all of its state is exported so it can be
+// checkpointed as JSON
+type motionFilter struct {
+	// Time of the last location, zero before the first
+	Time time.Time
+	// x, y, vx, vy and their covariance
+	State      [4]float64
+	Covariance [4][4]float64
+}
+
+// predict moves the state dt seconds forward
+func (f *motionFilter) predict(dt float64) {
+	p := &f.Covariance
+	// F P F' where F adds dt times the velocity to the location
+	for i := 0; i < 2; i++ {
+		f.State[i] += dt * f.State[i+2]
+		for j := 0; j < 4; j++ {
+			p[i][j] += dt * p[i+2][j]
+		}
+	}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 2; j++ {
+			p[i][j] += dt * p[i][j+2]
+		}
+	}
+	// Q of white noise acceleration for each axis
+	q := MOTION_ACCELERATION
+	for i := 0; i < 2; i++ {
+		p[i][i] += q * dt * dt * dt / 3
+		p[i][i+2] += q * dt * dt / 2
+		p[i+2][i] += q * dt * dt / 2
+		p[i+2][i+2] += q * dt
+	}
+}
+
+// Update advances the filter to t and corrects it with a location with
+// covariance cov as xx, xy, yx, yy. Locations older than the filter are
+// ignored and false is returned.
+func (f *motionFilter) Update(t time.Time, loc []float64, cov []float64) bool {
+	if cov == nil {
+		v := MOTION_MEASUREMENT_SD * MOTION_MEASUREMENT_SD
+		cov = []float64{v, 0, 0, v}
+	}
+	if f.Time.IsZero() || t.Sub(f.Time) > MOTION_RESET {
+		v := MOTION_VELOCITY_SD * MOTION_VELOCITY_SD
+		*f = motionFilter{
+			Time:  t,
+			State: [4]float64{loc[0], loc[1], 0, 0},
+			Covariance: [4][4]float64{
+				{cov[0], cov[1], 0, 0},
+				{cov[2], cov[3], 0, 0},
+				{0, 0, v, 0},
+				{0, 0, 0, v},
+			},
+		}
+		return true
+	}
+	if !t.After(f.Time) {
+		return false
+	}
+	f.predict(t.Sub(f.Time).Seconds())
+	f.Time = t
+
+	p := &f.Covariance
+	// S = H P H' + R, H picks the location
+	s := [2][2]float64{{p[0][0] + cov[0], p[0][1] + cov[1]},
+		{p[1][0] + cov[2], p[1][1] + cov[3]}}
+	det := s[0][0]*s[1][1] - s[0][1]*s[1][0]
+	sinv := [2][2]float64{{s[1][1] / det, -s[0][1] / det},
+		{-s[1][0] / det, s[0][0] / det}}
+	// K = P H' S^-1
+	var k [4][2]float64
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 2; j++ {
+			k[i][j] = p[i][0]*sinv[0][j] + p[i][1]*sinv[1][j]
+		}
+	}
+	y := [2]float64{loc[0] - f.State[0], loc[1] - f.State[1]}
+	for i := 0; i < 4; i++ {
+		f.State[i] += k[i][0]*y[0] + k[i][1]*y[1]
+	}
+	// P = (I - K H) P
+	var hp [2][4]float64
+	hp[0], hp[1] = p[0], p[1]
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			p[i][j] -= k[i][0]*hp[0][j] + k[i][1]*hp[1][j]
+		}
+	}
+	return true
+}
+
+// Location returns the location and its covariance as xx, xy, yx, yy
+func (f *motionFilter) Location() ([]float64, []float64) {
+	p := f.Covariance
+	return []float64{f.State[0], f.State[1]},
+		[]float64{p[0][0], p[0][1], p[1][0], p[1][1]}
+}
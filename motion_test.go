@@ -0,0 +1,73 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestMotionFilter(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	start := time.Now()
+	var f motionFilter
+	var before float64
+	// Walking along x at 1m/s with 2m of noise
+	for s := 0; s <= 60; s++ {
+		noisy := []float64{float64(s) + rng.NormFloat64()*2, 5 + rng.NormFloat64()*2}
+		if !f.Update(start.Add(time.Duration(s)*time.Second), noisy, nil) {
+			t.Fatalf("Location at %ds was ignored", s)
+		}
+		if s == 1 {
+			_, cov := f.Location()
+			before = errorRadius(cov)
+		}
+	}
+	loc, cov := f.Location()
+	if math.Hypot(loc[0]-60, loc[1]-5) > 2 || math.Abs(f.State[2]-1) > 0.3 {
+		t.Fatalf("Filter was at %v moving %v", loc, f.State[2:])
+	}
+	if errorRadius(cov) >= before {
+		t.Fatalf("Error radius grew from %f to %f", before, errorRadius(cov))
+	}
+	if f.Update(start.Add(30*time.Second), []float64{0, 0}, nil) {
+		t.Fatal("Old location was used")
+	}
+
+	// Checkpoints restore to the same filter
+	state, err := json.Marshal(&f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored motionFilter
+	if err = json.Unmarshal(state, &restored); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.Time.Equal(f.Time) || restored.State != f.State ||
+		restored.Covariance != f.Covariance {
+		t.Fatalf("Restored %+v from %+v", restored, f)
+	}
+
+	// A long gap starts again
+	f.Update(start.Add(60*time.Second+MOTION_RESET+time.Second), []float64{1, 1}, nil)
+	if f.State != [4]float64{1, 1, 0, 0} {
+		t.Fatalf("Filter after a gap was %v", f.State)
+	}
+}
@@ -0,0 +1,171 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"github.com/pkg/errors"
+	"math"
+)
+
+const (
+	// Levenberg-Marquardt stops after this many steps or once a step is
+	// shorter than WLS_TOLERANCE metres
+	WLS_MAX_ITERATIONS = 100
+	WLS_TOLERANCE      = 1e-6
+	// Smallest standard deviation of a distance in metres so edges next to
+	// a beacon don't get all of the weight
+	WLS_MIN_SIGMA = 0.1
+	// Radius of the 95% confidence circle in standard deviations of the
+	// major axis, the square root of the chi-square quantile for 2 degrees
+	WLS_CONFIDENCE_SCALE = 2.4477
+)
+
+// rangeMeasurement is the distance of a beacon from an edge at Loc
+type rangeMeasurement struct {
+	Loc []float64
+	// Dist and its standard deviation in metres
+	Dist  float64
+	Sigma float64
+}
+
+// locationEstimate is the location of a beacon and how certain it is
+type locationEstimate struct {
+	// x, y and the height the beacon was assumed to be at
+	Location []float64
+	// Covariance of x and y as xx, xy, yx, yy
+	Covariance []float64
+	// Radius in metres of the 95% confidence circle
+	ErrorRadius float64
+}
+
+// rangeSigma returns the standard deviation in metres of a distance from
+// the path loss model with exponent gamma. The rssi behind it is an average
+// of samples with the given variance, shadowing is the standard deviation
+// in dB that averaging can't remove. Distances are exponential in rssi so
+// their error grows with them.
+func rangeSigma(dist, gamma, variance float64, samples int, shadowing float64) float64 {
+	rssivar := shadowing * shadowing
+	if samples > 1 {
+		rssivar += variance / float64(samples)
+	}
+	sigma := dist * math.Ln10 / (10 * gamma) * math.Sqrt(rssivar)
+	if sigma < WLS_MIN_SIGMA || math.IsNaN(sigma) {
+		return WLS_MIN_SIGMA
+	}
+	return sigma
+}
+
+// solveWLS finds the x and y of a beacon at height which best fits the
+// ranges weighted by their certainty with Levenberg-Marquardt. A weak prior
+// at the weighted centre of the edges keeps it solvable with two edges, with
+// one edge the beacon is somewhere on a circle around it. The location is
+// clamped to limits, x1, x2, y1, y2, if they are given.
+func solveWLS(ms []rangeMeasurement, height float64, limits []float64) (locationEstimate, error) {
+	if len(ms) == 0 {
+		return locationEstimate{}, errors.New("No ranges to solve location with")
+	}
+	var p [2]float64
+	var wsum, spread float64
+	for _, m := range ms {
+		w := 1 / (m.Sigma * m.Sigma)
+		p[0] += w * m.Loc[0]
+		p[1] += w * m.Loc[1]
+		wsum += w
+		spread = math.Max(spread, m.Dist+2*m.Sigma)
+	}
+	p[0], p[1] = p[0]/wsum, p[1]/wsum
+
+	var res locationEstimate
+	if len(ms) == 1 {
+		// Anywhere on the circle, so the variance of each axis is that of a
+		// point on it
+		v := ms[0].Dist*ms[0].Dist/2 + ms[0].Sigma*ms[0].Sigma
+		res.Covariance = []float64{v, 0, 0, v}
+	} else {
+		prior := p
+		// normal returns J'J and J'r at q and the cost r'r
+		normal := func(q [2]float64) (a [3]float64, g [2]float64, cost float64) {
+			for _, m := range ms {
+				dx, dy, dz := q[0]-m.Loc[0], q[1]-m.Loc[1], height-m.Loc[2]
+				d := math.Sqrt(dx*dx + dy*dy + dz*dz)
+				r := (d - m.Dist) / m.Sigma
+				cost += r * r
+				if d < WLS_TOLERANCE {
+					continue
+				}
+				jx, jy := dx/(d*m.Sigma), dy/(d*m.Sigma)
+				a[0] += jx * jx
+				a[1] += jx * jy
+				a[2] += jy * jy
+				g[0] += jx * r
+				g[1] += jy * r
+			}
+			for i := range q {
+				r := (q[i] - prior[i]) / spread
+				cost += r * r
+				g[i] += r / spread
+			}
+			a[0] += 1 / (spread * spread)
+			a[2] += 1 / (spread * spread)
+			return
+		}
+
+		lambda := 1e-3
+		a, g, cost := normal(p)
+		for i := 0; i < WLS_MAX_ITERATIONS && lambda < 1e10; i++ {
+			// (J'J + lambda diag(J'J)) step = -J'r
+			m0, m2 := a[0]*(1+lambda), a[2]*(1+lambda)
+			det := m0*m2 - a[1]*a[1]
+			step := [2]float64{(-g[0]*m2 + g[1]*a[1]) / det,
+				(-g[1]*m0 + g[0]*a[1]) / det}
+			next := [2]float64{p[0] + step[0], p[1] + step[1]}
+			na, ng, ncost := normal(next)
+			if ncost >= cost {
+				lambda *= 10
+				continue
+			}
+			p, a, g, cost = next, na, ng, ncost
+			lambda /= 10
+			if math.Hypot(step[0], step[1]) < WLS_TOLERANCE {
+				break
+			}
+		}
+		det := a[0]*a[2] - a[1]*a[1]
+		res.Covariance = []float64{a[2] / det, -a[1] / det, -a[1] / det, a[0] / det}
+	}
+
+	res.ErrorRadius = errorRadius(res.Covariance)
+	if len(limits) == 4 {
+		p[0] = clamp(p[0], limits[0], limits[1])
+		p[1] = clamp(p[1], limits[2], limits[3])
+	}
+	res.Location = []float64{p[0], p[1], height}
+	return res, nil
+}
+
+// errorRadius returns the radius of the 95% confidence circle of a
+// covariance of x and y
+func errorRadius(c []float64) float64 {
+	// Largest eigenvalue is the variance along the major axis
+	major := (c[0]+c[3])/2 + math.Hypot((c[0]-c[3])/2, c[1])
+	return WLS_CONFIDENCE_SCALE * math.Sqrt(major)
+}
+
+// clamp returns v within the range of a and b in either order
+func clamp(v, a, b float64) float64 {
+	return math.Max(math.Min(a, b), math.Min(math.Max(a, b), v))
+}
@@ -0,0 +1,94 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"math"
+	"testing"
+)
+
+// testRanges returns exact ranges to a beacon at x, y, 1 from edges at a
+// height of 2
+func testRanges(x, y float64, sigma float64, edges ...[2]float64) []rangeMeasurement {
+	var ms []rangeMeasurement
+	for _, e := range edges {
+		loc := []float64{e[0], e[1], 2}
+		ms = append(ms, rangeMeasurement{Loc: loc,
+			Dist:  math.Sqrt((x-e[0])*(x-e[0]) + (y-e[1])*(y-e[1]) + 1),
+			Sigma: sigma})
+	}
+	return ms
+}
+
+func TestSolveWLS(t *testing.T) {
+	square := [][2]float64{{0, 0}, {10, 0}, {0, 10}, {10, 10}}
+	sol, err := solveWLS(testRanges(3, 7, 0.5, square...), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Hypot(sol.Location[0]-3, sol.Location[1]-7) > 0.01 {
+		t.Fatalf("Exact ranges gave %v", sol.Location)
+	}
+	if sol.ErrorRadius <= 0 || sol.ErrorRadius > 2 {
+		t.Fatalf("Four edges had an error radius of %f", sol.ErrorRadius)
+	}
+
+	// A far edge that is wrong has little weight
+	ms := testRanges(3, 7, 0.5, square...)
+	ms[3].Dist, ms[3].Sigma = 3, 5
+	if sol, err = solveWLS(ms, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if math.Hypot(sol.Location[0]-3, sol.Location[1]-7) > 0.5 {
+		t.Fatalf("Uncertain range pulled the location to %v", sol.Location)
+	}
+
+	// Two edges find the line between them but can't tell the side
+	two, err := solveWLS(testRanges(5, 0, 0.5, square[0], square[1]), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(two.Location[0]-5) > 0.1 || two.ErrorRadius <= sol.ErrorRadius {
+		t.Fatalf("Two edges gave %v with radius %f", two.Location, two.ErrorRadius)
+	}
+
+	one, err := solveWLS(testRanges(3, 4, 0.5, square[0]), 1, []float64{1, 10, 1, 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if one.Location[0] != 1 || one.Location[1] != 1 || one.ErrorRadius < 5 {
+		t.Fatalf("One edge gave %v with radius %f", one.Location, one.ErrorRadius)
+	}
+
+	if _, err = solveWLS(nil, 1, nil); err == nil {
+		t.Fatal("No ranges were solved")
+	}
+}
+
+func TestRangeSigma(t *testing.T) {
+	near := rangeSigma(2, 2, 16, 4, 4)
+	far := rangeSigma(8, 2, 16, 4, 4)
+	if near >= far || math.Abs(far/near-4) > 1e-9 {
+		t.Fatalf("Sigma at 2m was %f and at 8m %f", near, far)
+	}
+	if rangeSigma(8, 2, 16, 16, 4) >= far {
+		t.Fatal("More samples did not lower the sigma")
+	}
+	if rangeSigma(0.01, 2, 0, 1, 4) != WLS_MIN_SIGMA {
+		t.Fatal("Sigma was not floored")
+	}
+}
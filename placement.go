@@ -0,0 +1,83 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// Largest coordinate of an edge in metres
+const EDGE_COORD_MAX = 100000
+
+// Locations of edges as they were entered before placements, "(x, y, z)"
+// anywhere in the text as the old edge_locations view found it
+var edgeLocationRe = regexp.MustCompile(
+	`\(\s*(-?\d+(?:\.\d+)?)\s*,\s*(-?\d+(?:\.\d+)?)\s*,\s*(-?\d+(?:\.\d+)?)\s*\)`)
+
+// EdgePlacement is the position of an edge in metres on a map, or on every
+// map that doesn't place the edge itself if Map is 0
+type EdgePlacement struct {
+	Map int
+	X   float64
+	Y   float64
+	Z   float64
+}
+
+// parseEdgeLocation returns the placement on every map of a location in the
+// "(x, y, z)" form
+func parseEdgeLocation(location string) (EdgePlacement, error) {
+	m := edgeLocationRe.FindStringSubmatch(location)
+	if m == nil {
+		return EdgePlacement{}, errors.Errorf("Location \"%s\" is not (x, y, z)", location)
+	}
+	var c [3]float64
+	for i := range c {
+		// The expression only matches numbers
+		c[i], _ = strconv.ParseFloat(m[i+1], 64)
+	}
+	return EdgePlacement{X: c[0], Y: c[1], Z: c[2]}, nil
+}
+
+// String formats the position as a location of edge_node
+func (p EdgePlacement) String() string {
+	return fmt.Sprintf("(%g, %g, %g)", p.X, p.Y, p.Z)
+}
+
+// validatePlacements returns an error if a coordinate is not finite or
+// beyond EDGE_COORD_MAX or a map is given more than once
+func validatePlacements(ps []EdgePlacement) error {
+	maps := make(map[int]bool)
+	for _, p := range ps {
+		if maps[p.Map] {
+			return errors.Errorf("Edge is placed on map %d twice", p.Map)
+		}
+		maps[p.Map] = true
+		if p.Map < 0 {
+			return errors.Errorf("Map %d is invalid", p.Map)
+		}
+		for _, c := range []float64{p.X, p.Y, p.Z} {
+			if math.IsNaN(c) || math.Abs(c) > EDGE_COORD_MAX {
+				return errors.Errorf("Coordinate %g on map %d is out of range", c, p.Map)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseEdgeLocation(t *testing.T) {
+	for s, want := range map[string]EdgePlacement{
+		"(1, 2, 3)":           {X: 1, Y: 2, Z: 3},
+		" ( -1.5,2.25 , 0 ) ": {X: -1.5, Y: 2.25, Z: 0},
+		"Ward 3 (1.5, 2, 0)":  {X: 1.5, Y: 2, Z: 0},
+		"(1,2,3) ":            {X: 1, Y: 2, Z: 3},
+	} {
+		p, err := parseEdgeLocation(s)
+		if err != nil || p != want {
+			t.Errorf("%q was %+v: %v", s, p, err)
+		}
+		if back, _ := parseEdgeLocation(p.String()); back != p {
+			t.Errorf("%+v formatted as %q", p, p.String())
+		}
+	}
+	for _, s := range []string{"", "by the door", "(1, 2)", "(1,5, 2, 3)", "(1a5, 2, 3)"} {
+		if p, err := parseEdgeLocation(s); err == nil {
+			t.Errorf("%q was parsed as %+v", s, p)
+		}
+	}
+}
+
+func TestValidatePlacements(t *testing.T) {
+	if err := validatePlacements([]EdgePlacement{{X: 1}, {Map: 2, X: 1, Z: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, ps := range [][]EdgePlacement{
+		{{Map: 1}, {Map: 1, X: 2}},
+		{{X: math.NaN()}},
+		{{Y: math.Inf(1)}},
+		{{Z: -EDGE_COORD_MAX - 1}},
+		{{Map: -1}},
+	} {
+		if err := validatePlacements(ps); err == nil {
+			t.Errorf("%+v was valid", ps)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// Weight of a new rssi in the moving average of an edge
+	PRESENCE_SMOOTHING = 0.3
+	// dB another zone must be stronger than the current one by to move a
+	// beacon, and for how long
+	PRESENCE_MARGIN = 5.0
+	PRESENCE_DWELL  = 5 * time.Second
+	// An edge that has not heard a beacon for this long no longer counts
+	PRESENCE_EDGE_TIMEOUT = 10 * time.Second
+	// A beacon leaves its zone when it has not been heard there for this long
+	PRESENCE_EXIT_TIMEOUT = 30 * time.Second
+	// How often exits are checked and zones are reloaded
+	PRESENCE_TICK         = time.Second
+	PRESENCE_ZONE_REFRESH = time.Minute
+
+	// Events of presence_events
+	PRESENCE_ENTER = "enter"
+	PRESENCE_EXIT  = "exit"
+)
+
+// Zone is a named area of a map, beacons near edges inside Polygon are in
+// the zone rather than the room of the edge
+type Zone struct {
+	Name string
+	// x, y vertices in the coordinates of the edges
+	Polygon [][2]float64
+}
+
+// presenceEvent is a beacon entering or leaving a zone
+type presenceEvent struct {
+	Beacon int
+	Zone   string
+	Event  string
+	Time   time.Time
+	// Strongest edge when entering, 0 when leaving
+	Edge int
+}
+
+// edgeSignal is the moving average of the rssi of a beacon at an edge
+type edgeSignal struct {
+	rssi float64
+	seen time.Time
+}
+
+// beaconPresence is the zone of a beacon and what the edges hear of it
+type beaconPresence struct {
+	// Empty if the beacon is in no zone
+	zone string
+	// Last time the zone of the beacon heard it
+	lastSeen time.Time
+	// Stronger zone the beacon is moving to and since when
+	candidate      string
+	candidateSince time.Time
+	edges          map[int]*edgeSignal
+}
+
+// presenceEngine assigns beacons to the zone of their strongest edge, a
+// beacon only moves when another zone is stronger by PRESENCE_MARGIN for
+// PRESENCE_DWELL so it doesn't flicker between neighbouring rooms
+type presenceEngine struct {
+	sync.Mutex
+	db *sql.DB
+	// Zone of each edge, edges without one are ignored
+	zones   map[int]string
+	beacons map[int]*beaconPresence
+}
+
+// newPresenceEngine returns an engine with no zones and no beacons
+func newPresenceEngine(db *sql.DB) *presenceEngine {
+	return &presenceEngine{
+		db:      db,
+		zones:   make(map[int]string),
+		beacons: make(map[int]*beaconPresence),
+	}
+}
+
+// current returns rows in the time of the server at now, skew is added to
+// their times. Rows older than PRESENCE_EDGE_TIMEOUT were replayed from the
+// spool of an edge and are left out, they would otherwise expire at once.
+func (p *presenceEngine) current(rows []beaconLogRow, skew time.Duration,
+	now time.Time) []beaconLogRow {
+	res := make([]beaconLogRow, 0, len(rows))
+	for _, row := range rows {
+		row.Datetime = row.Datetime.Add(skew)
+		if now.Sub(row.Datetime) > PRESENCE_EDGE_TIMEOUT {
+			continue
+		}
+		if row.Datetime.After(now) {
+			row.Datetime = now
+		}
+		res = append(res, row)
+	}
+	return res
+}
+
+// observe updates the presence of beacons with rows and returns the events
+// they cause
+func (p *presenceEngine) observe(rows []beaconLogRow) []presenceEvent {
+	p.Lock()
+	defer p.Unlock()
+	var events []presenceEvent
+	for _, row := range rows {
+		if _, ok := p.zones[row.Edgeid]; !ok {
+			continue
+		}
+		bp, ok := p.beacons[row.Beaconid]
+		if !ok {
+			bp = &beaconPresence{edges: make(map[int]*edgeSignal)}
+			p.beacons[row.Beaconid] = bp
+		}
+		sig, ok := bp.edges[row.Edgeid]
+		switch {
+		case !ok || row.Datetime.Sub(sig.seen) > PRESENCE_EDGE_TIMEOUT:
+			bp.edges[row.Edgeid] = &edgeSignal{float64(row.Rssi), row.Datetime}
+		case row.Datetime.After(sig.seen):
+			sig.rssi += PRESENCE_SMOOTHING * (float64(row.Rssi) - sig.rssi)
+			sig.seen = row.Datetime
+		}
+		events = p.update(row.Beaconid, bp, row.Datetime, events)
+	}
+	return events
+}
+
+// update moves a beacon to the strongest zone at t if it should, events
+// are appended to events
+func (p *presenceEngine) update(beacon int, bp *beaconPresence, t time.Time,
+	events []presenceEvent) []presenceEvent {
+	// Edges report out of order, events of a beacon must not go back
+	if t.Before(bp.lastSeen) {
+		t = bp.lastSeen
+	}
+	strength := make(map[string]float64)
+	best, bestzone, bestedge := math.Inf(-1), "", 0
+	for edge, sig := range bp.edges {
+		if t.Sub(sig.seen) > PRESENCE_EDGE_TIMEOUT {
+			continue
+		}
+		zone := p.zones[edge]
+		if s, ok := strength[zone]; !ok || sig.rssi > s {
+			strength[zone] = sig.rssi
+		}
+		if sig.rssi > best {
+			best, bestzone, bestedge = sig.rssi, zone, edge
+		}
+	}
+	if bestzone == "" {
+		return events
+	}
+	current, heard := strength[bp.zone]
+	if heard {
+		bp.lastSeen = t
+	}
+	stronger := !heard || best >= current+PRESENCE_MARGIN
+	switch {
+	case bp.zone == "":
+		// First heard, nothing to be sticky about
+	case bestzone == bp.zone || !stronger:
+		bp.candidate = ""
+		return events
+	case bp.candidate != bestzone:
+		bp.candidate, bp.candidateSince = bestzone, t
+		return events
+	case t.Sub(bp.candidateSince) < PRESENCE_DWELL:
+		return events
+	default:
+		events = append(events, presenceEvent{Beacon: beacon, Zone: bp.zone,
+			Event: PRESENCE_EXIT, Time: t})
+	}
+	events = append(events, presenceEvent{Beacon: beacon, Zone: bestzone,
+		Event: PRESENCE_ENTER, Time: t, Edge: bestedge})
+	bp.zone, bp.lastSeen, bp.candidate = bestzone, t, ""
+	return events
+}
+
+// expire returns exits for beacons their zone has not heard since before
+// now less PRESENCE_EXIT_TIMEOUT and forgets beacons no edge has heard
+func (p *presenceEngine) expire(now time.Time) []presenceEvent {
+	p.Lock()
+	defer p.Unlock()
+	var events []presenceEvent
+	for beacon, bp := range p.beacons {
+		if bp.zone != "" && now.Sub(bp.lastSeen) > PRESENCE_EXIT_TIMEOUT {
+			events = append(events, presenceEvent{Beacon: beacon, Zone: bp.zone,
+				Event: PRESENCE_EXIT, Time: bp.lastSeen})
+			bp.zone, bp.candidate = "", ""
+		}
+		for edge, sig := range bp.edges {
+			if now.Sub(sig.seen) > PRESENCE_EDGE_TIMEOUT {
+				delete(bp.edges, edge)
+			}
+		}
+		if bp.zone == "" && len(bp.edges) == 0 {
+			delete(p.beacons, beacon)
+		}
+	}
+	return events
+}
+
+// setZones replaces the zones of the edges
+func (p *presenceEngine) setZones(zones map[int]string) {
+	p.Lock()
+	defer p.Unlock()
+	p.zones = zones
+}
+
+// pointInPolygon returns true if x, y is inside poly
+func pointInPolygon(x, y float64, poly [][2]float64) bool {
+	in := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		a, b := poly[i], poly[j]
+		if (a[1] > y) != (b[1] > y) &&
+			x < (b[0]-a[0])*(y-a[1])/(b[1]-a[1])+a[0] {
+			in = !in
+		}
+	}
+	return in
+}
+
+// dbGetPresenceZones returns the zone of each edge, the zone of a map
+// whose polygon contains its placement on the map or otherwise its room
+func dbGetPresenceZones(db *sql.DB) (map[int]string, error) {
+	zones := make(map[int]string)
+	rows, err := db.Query(`select id, room from edge_node`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query edge rooms")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var room string
+		if err = rows.Scan(&id, &room); err != nil {
+			return nil, errors.Wrap(err, "Failed to scan edge room")
+		}
+		if room != "" {
+			zones[id] = room
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to query edge rooms")
+	}
+
+	// Placements of each edge by map, 0 for every map
+	locs := make(map[int]map[int][2]float64)
+	places, err := db.Query(`select edgenodeid, coalesce(map_id, 0), x, y
+		from edge_placements`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query edge placements")
+	}
+	defer places.Close()
+	for places.Next() {
+		var id, mapid int
+		var l [2]float64
+		if err = places.Scan(&id, &mapid, &l[0], &l[1]); err != nil {
+			return nil, errors.Wrap(err, "Failed to scan edge placement")
+		}
+		if locs[id] == nil {
+			locs[id] = make(map[int][2]float64)
+		}
+		locs[id][mapid] = l
+	}
+	if err = places.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to query edge placements")
+	}
+
+	maps, err := db.Query(`select id, config from webmap_configs`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query map zones")
+	}
+	defer maps.Close()
+	for maps.Next() {
+		var mapid int
+		var config string
+		if err = maps.Scan(&mapid, &config); err != nil {
+			return nil, errors.Wrap(err, "Failed to scan map zones")
+		}
+		var mc struct {
+			Edges []int
+			Zones []Zone
+		}
+		if err = json.Unmarshal([]byte(config), &mc); err != nil {
+			log.Warnf("Zones of a map were skipped: %s", err)
+			continue
+		}
+		for _, e := range mc.Edges {
+			l, ok := locs[e][mapid]
+			if !ok {
+				if l, ok = locs[e][0]; !ok {
+					continue
+				}
+			}
+			for _, z := range mc.Zones {
+				if pointInPolygon(l[0], l[1], z.Polygon) {
+					zones[e] = z.Name
+					break
+				}
+			}
+		}
+	}
+	return zones, errors.Wrap(maps.Err(), "Failed to query map zones")
+}
+
+// dbGetOpenVisits returns the zone of each beacon whose last event entered
+// one
+func dbGetOpenVisits(db *sql.DB) (map[int]string, error) {
+	rows, err := db.Query(`select beaconid, zone from (
+			select distinct on (beaconid) beaconid, zone, event
+			from presence_events
+			order by beaconid, datetime desc, id desc) as last
+		where event = $1`, PRESENCE_ENTER)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query open visits")
+	}
+	defer rows.Close()
+	open := make(map[int]string)
+	for rows.Next() {
+		var beacon int
+		var zone string
+		if err = rows.Scan(&beacon, &zone); err != nil {
+			return nil, errors.Wrap(err, "Failed to scan open visit")
+		}
+		open[beacon] = zone
+	}
+	return open, errors.Wrap(rows.Err(), "Failed to query open visits")
+}
+
+// dbInsertPresenceEvents stores events in presence_events
+func dbInsertPresenceEvents(events []presenceEvent, db *sql.DB) error {
+	if len(events) == 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin transaction")
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`insert into presence_events
+		(beaconid, zone, event, datetime, edgenodeid) values
+		($1, $2, $3, $4, nullif($5, 0))`)
+	if err != nil {
+		return errors.Wrap(err, "Failed to prepare presence insert")
+	}
+	defer stmt.Close()
+	for _, e := range events {
+		if _, err = stmt.Exec(e.Beacon, e.Zone, e.Event, e.Time.UTC(), e.Edge); err != nil {
+			return errors.Wrap(err, "Failed to insert presence event")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "Failed to commit presence events")
+}
+
+// Record updates presence with rows that were written to beacon_log, skew
+// is the server clock less the clock of the edge that sent them
+func (p *presenceEngine) Record(rows []beaconLogRow, skew time.Duration) {
+	if err := dbInsertPresenceEvents(p.observe(p.current(rows, skew, time.Now())), p.db); err != nil {
+		log.Errorf("Failed to store presence: %s", err)
+	}
+}
+
+// run loads the zones and the beacons that were in one when the server
+// stopped, then expires visits and reloads zones until end is closed
+func (p *presenceEngine) run(end chan struct{}) {
+	zones, err := dbGetPresenceZones(p.db)
+	if err != nil {
+		log.Errorf("Failed to load presence zones: %s", err)
+	} else {
+		p.setZones(zones)
+	}
+	open, err := dbGetOpenVisits(p.db)
+	if err != nil {
+		log.Errorf("Failed to load presence: %s", err)
+	}
+	now := time.Now()
+	p.Lock()
+	for beacon, zone := range open {
+		// Still there until they are not heard for PRESENCE_EXIT_TIMEOUT
+		p.beacons[beacon] = &beaconPresence{zone: zone, lastSeen: now,
+			edges: make(map[int]*edgeSignal)}
+	}
+	p.Unlock()
+
+	tick := time.NewTicker(PRESENCE_TICK)
+	defer tick.Stop()
+	reload := now.Add(PRESENCE_ZONE_REFRESH)
+	for {
+		select {
+		case <-end:
+			return
+		case now = <-tick.C:
+		}
+		if err = dbInsertPresenceEvents(p.expire(now), p.db); err != nil {
+			log.Errorf("Failed to store presence: %s", err)
+		}
+		if now.After(reload) {
+			reload = now.Add(PRESENCE_ZONE_REFRESH)
+			if zones, err = dbGetPresenceZones(p.db); err != nil {
+				log.Errorf("Failed to load presence zones: %s", err)
+				continue
+			}
+			p.setZones(zones)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresenceEngine(t *testing.T) {
+	p := newPresenceEngine(nil)
+	p.setZones(map[int]string{1: "ward", 2: "ward", 3: "hall"})
+	start := time.Now()
+	at := func(s float64) time.Time {
+		return start.Add(time.Duration(s * float64(time.Second)))
+	}
+	// heard returns the events of the beacon heard by edges 1 and 3 at s
+	heard := func(s float64, ward, hall int) []presenceEvent {
+		return p.observe([]beaconLogRow{
+			{Datetime: at(s), Beaconid: 7, Edgeid: 1, Rssi: ward},
+			{Datetime: at(s), Beaconid: 7, Edgeid: 3, Rssi: hall},
+		})
+	}
+
+	events := heard(0, -60, -80)
+	if len(events) != 1 || events[0].Event != PRESENCE_ENTER ||
+		events[0].Zone != "ward" || events[0].Edge != 1 {
+		t.Fatalf("First sighting gave %+v", events)
+	}
+	// Edges not in a zone are ignored
+	if events = p.observe([]beaconLogRow{{Datetime: at(0.5), Beaconid: 7,
+		Edgeid: 4, Rssi: -30}}); len(events) != 0 {
+		t.Fatalf("Edge without a zone gave %+v", events)
+	}
+	// A slightly stronger hall doesn't move it
+	for s := 1.0; s < 10; s++ {
+		if events = heard(s, -70, -68); len(events) != 0 {
+			t.Fatalf("Hall within the margin gave %+v at %fs", events, s)
+		}
+	}
+	// A much stronger hall moves it once it has lasted the dwell
+	var moved []presenceEvent
+	for s := 10.0; s < 20; s++ {
+		if events = heard(s, -85, -55); len(events) != 0 {
+			if moved != nil {
+				t.Fatalf("Moved twice %+v", events)
+			}
+			moved = events
+			if at(s).Sub(at(10)) < PRESENCE_DWELL {
+				t.Fatalf("Moved after %fs", s-10)
+			}
+		}
+	}
+	if len(moved) != 2 || moved[0].Event != PRESENCE_EXIT || moved[0].Zone != "ward" ||
+		moved[1].Event != PRESENCE_ENTER || moved[1].Zone != "hall" {
+		t.Fatalf("Moving gave %+v", moved)
+	}
+
+	if events = p.expire(at(19)); len(events) != 0 {
+		t.Fatalf("Expired while heard %+v", events)
+	}
+	events = p.expire(at(19).Add(PRESENCE_EXIT_TIMEOUT + time.Second))
+	if len(events) != 1 || events[0].Event != PRESENCE_EXIT || !events[0].Time.Equal(at(19)) {
+		t.Fatalf("Expiring gave %+v", events)
+	}
+	if len(p.beacons) != 0 {
+		t.Fatal("Beacon that left was not forgotten")
+	}
+}
+
+func TestPresenceReplayedAndSkewed(t *testing.T) {
+	p := newPresenceEngine(nil)
+	p.setZones(map[int]string{1: "ward", 3: "hall"})
+	now := time.Now()
+	if events := p.observe(p.current([]beaconLogRow{
+		{Datetime: now, Beaconid: 7, Edgeid: 1, Rssi: -60},
+	}, 0, now)); len(events) != 1 || events[0].Zone != "ward" {
+		t.Fatalf("First sighting gave %+v", events)
+	}
+
+	// A batch replayed from the spool of the hall edge is ignored rather
+	// than moving the beacon and exiting it at once
+	var replayed []beaconLogRow
+	for s := 0; s < 20; s++ {
+		replayed = append(replayed, beaconLogRow{Datetime: now.Add(-10*time.Minute +
+			time.Duration(s)*time.Second), Beaconid: 7, Edgeid: 3, Rssi: -40})
+	}
+	if events := p.observe(p.current(replayed, 0, now)); len(events) != 0 {
+		t.Fatalf("Replayed batch gave %+v", events)
+	}
+	if events := p.expire(now.Add(time.Second)); len(events) != 0 {
+		t.Fatalf("Replayed batch expired %+v", events)
+	}
+
+	// An edge 25 seconds behind is corrected to the server clock
+	behind := 25 * time.Second
+	var events []presenceEvent
+	for s := 1; s <= 10; s++ {
+		at := now.Add(time.Duration(s) * time.Second)
+		events = append(events, p.observe(p.current([]beaconLogRow{
+			{Datetime: at.Add(-behind), Beaconid: 7, Edgeid: 3, Rssi: -40},
+			{Datetime: at, Beaconid: 7, Edgeid: 1, Rssi: -80},
+		}, behind, at))...)
+	}
+	if len(events) != 2 || events[1].Zone != "hall" || events[1].Time.Before(now) {
+		t.Fatalf("Skewed edge gave %+v", events)
+	}
+	if exits := p.expire(now.Add(11 * time.Second)); len(exits) != 0 {
+		t.Fatalf("Skewed edge expired %+v", exits)
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].Time.Before(events[i-1].Time) {
+			t.Fatalf("Events out of order %+v", events)
+		}
+	}
+}
+
+func TestPointInPolygon(t *testing.T) {
+	l := [][2]float64{{0, 0}, {10, 0}, {10, 4}, {4, 4}, {4, 10}, {0, 10}}
+	for _, c := range [][2]float64{{2, 2}, {8, 2}, {2, 8}} {
+		if !pointInPolygon(c[0], c[1], l) {
+			t.Errorf("%v was not in the polygon", c)
+		}
+	}
+	if pointInPolygon(8, 8, l) || pointInPolygon(-1, 2, l) || pointInPolygon(1, 1, nil) {
+		t.Error("Point outside was in the polygon")
+	}
+}
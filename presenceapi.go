@@ -0,0 +1,188 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// metricsserv builds cause problems with other binaries due to inclusion
+// of packages that require python3
+// +build metrics
+
+package beaconpi
+
+import (
+	"encoding/json"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+const (
+	// Most visits returned at once
+	PRESENCE_VISITS_MAX = 10000
+)
+
+// occupant is a beacon in a zone
+type occupant struct {
+	Beacon int
+	Label  string
+	Since  time.Time
+}
+
+// visit is a stay of a beacon in a zone, Left is nil if it is still there
+type visit struct {
+	Beacon  int
+	Zone    string
+	Entered time.Time
+	Left    *time.Time
+	// Seconds in the zone so far
+	Duration float64
+}
+
+// getOccupancy returns the beacons in each zone, optionally only Zones
+func getOccupancy() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Zones []string
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in GetOccupancy %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		rows, err := db.Query(`
+			select l.zone, l.beaconid, b.label, l.datetime from (
+				select distinct on (beaconid) beaconid, zone, event, datetime
+				from presence_events
+				order by beaconid, datetime desc, id desc) as l, ibeacons as b
+			where l.beaconid = b.id and l.event = $1
+			and (coalesce(cardinality($2::text[]), 0) = 0 or l.zone = any($2::text[]))
+			order by l.zone, l.datetime`, PRESENCE_ENTER, pq.Array(input.Zones))
+		if err != nil {
+			log.Errorf("Failed to query occupancy %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer rows.Close()
+		zones := make(map[string][]occupant)
+		for _, z := range input.Zones {
+			zones[z] = []occupant{}
+		}
+		for rows.Next() {
+			var o occupant
+			var zone string
+			if err = rows.Scan(&zone, &o.Beacon, &o.Label, &o.Since); err != nil {
+				log.Errorf("Failed to scan occupancy %s", err)
+				http.Error(w, "Server failure", 500)
+				return
+			}
+			zones[zone] = append(zones[zone], o)
+		}
+		if err = rows.Err(); err != nil {
+			log.Errorf("Failed to query occupancy %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Zones": zones,
+		})
+	})
+}
+
+// getVisits returns the stays of beacons in zones overlapping a time range
+// ordered by beacon and time entered
+func getVisits() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Beacons []int
+			Zones   []string
+			Since   *time.Time
+			Before  *time.Time
+			Limit   int
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in GetVisits %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if input.Limit <= 0 || input.Limit > PRESENCE_VISITS_MAX {
+			input.Limit = PRESENCE_VISITS_MAX
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		// Each enter lasts until the next event of the beacon
+		rows, err := db.Query(`
+			select beaconid, zone, entered, exited from (
+				select beaconid, zone, event, datetime as entered,
+					lead(datetime) over w as exited
+				from presence_events
+				where (coalesce(cardinality($1::int[]), 0) = 0 or beaconid = any($1::int[]))
+				window w as (partition by beaconid order by datetime, id)) as v
+			where event = $2
+			and (coalesce(cardinality($3::text[]), 0) = 0 or zone = any($3::text[]))
+			and ($4::timestamptz is null or exited is null or exited >= $4)
+			and ($5::timestamptz is null or entered < $5)
+			order by beaconid, entered
+			limit $6`, pq.Array(input.Beacons), PRESENCE_ENTER, pq.Array(input.Zones),
+			input.Since, input.Before, input.Limit)
+		if err != nil {
+			log.Errorf("Failed to query visits %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer rows.Close()
+		now := time.Now()
+		visits := []visit{}
+		for rows.Next() {
+			var v visit
+			if err = rows.Scan(&v.Beacon, &v.Zone, &v.Entered, &v.Left); err != nil {
+				log.Errorf("Failed to scan visit %s", err)
+				http.Error(w, "Server failure", 500)
+				return
+			}
+			end := now
+			if v.Left != nil {
+				end = *v.Left
+			}
+			v.Duration = end.Sub(v.Entered).Seconds()
+			visits = append(visits, v)
+		}
+		if err = rows.Err(); err != nil {
+			log.Errorf("Failed to query visits %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Visits": visits,
+		})
+	})
+}
@@ -35,8 +35,8 @@ const (
 	// Based on the size of the encompassing types this is the max size
 	// of a packet, all others should be dropped
 	// 16 is for UUID, 1 is for Flags
-	MAX_SIZE        = MAX_CTRL + MAX_LOGS*12 + MAX_BEACONS*20 + 16 + 1
-	CURRENT_VERSION = 1
+	MAX_SIZE        = MAX_CTRL + MAX_LOGS*12 + MAX_BEACONS*21 + 16 + 1
+	CURRENT_VERSION = 2
 )
 
 type Uuid [16]byte
@@ -68,16 +68,28 @@ type BeaconLog struct {
 	Rssi     int16
 	// Index of value within a packet
 	BeaconIndex uint16
+	// TxPower advertised by the beacon, 0 if unknown. Only sent on the
+	// wire by version 2 packets with EXT_TX_POWER
+	TxPower int8
 }
 
-// 20 Bytes corresponding to the iBeacon profile
+// 20 Bytes corresponding to the iBeacon profile, other beacon types map
+// their identity onto the same fields, see decoders.go
 type BeaconData struct {
 	Uuid  Uuid `json:"string"`
 	Major uint16
 	Minor uint16
+	// Type is one of the BEACON_* types, it is only sent on the wire
+	// when a packet has REQUEST_TYPED_BEACONS
+	Type uint8
 }
 
+// String returns "uuid,major,minor" for iBeacons and
+// "uuid,major,minor,type" for other types
 func (b *BeaconData) String() string {
+	if b.Type != BEACON_IBEACON {
+		return fmt.Sprintf("%s,%d,%d,%d", b.Uuid, b.Major, b.Minor, b.Type)
+	}
 	return fmt.Sprintf("%s,%d,%d", b.Uuid, b.Major, b.Minor)
 }
 
@@ -101,6 +113,11 @@ const (
 	// the server is notifying the client there is a problem on its side that
 	// it cannot recover from
 	RESPONSE_INTERNAL_FAILURE = 0x800
+	// the client should report beacons it does not watch, sent on every
+	// response while discovery is on for the edge
+	RESPONSE_DISCOVERY = 0x1000
+	// the response starts with a BeaconDiff for the client to apply
+	RESPONSE_BEACON_DIFF = 0x2000
 	// the client should run the command in its shell
 	RESPONSE_SYSTEM = 0x8000
 	// Requests have only 0xF0 to work with for flags
@@ -113,6 +130,8 @@ const (
 	// the client is signalling that it has completed the control and the
 	// server can stop sending it
 	REQUEST_CONTROL_COMPLETE = 0x40
+	// the beacons in the packet are 21 bytes, the last byte is the type
+	REQUEST_TYPED_BEACONS = 0x80
 )
 
 // BeaconLogPacket should be sent by clients to the server
@@ -126,6 +145,63 @@ type BeaconLogPacket struct {
 	Beacons []BeaconData
 	// Extra unstructed data
 	ControlData string
+	// Extension flags of version 2 packets, EXT_*
+	Ext uint64
+	// Version of the beacon set the client holds, sent if Ext has
+	// EXT_BEACON_VERSION
+	BeaconVersion uint64
+	// Sent in place of logs if Ext has EXT_AGGREGATE
+	Aggregates []BeaconAggregate
+	// Eddystone-TLM frames seen by the edge, sent if Ext has EXT_TELEMETRY
+	Telemetry []BeaconTelemetry
+}
+
+// BeaconAggregate summarises the rssi of a beacon over a window
+type BeaconAggregate struct {
+	Start  time.Time
+	Window time.Duration
+	// Index of the beacon within a packet
+	BeaconIndex uint16
+	Count       uint32
+	Min         int16
+	Max         int16
+	Mean        float64
+	Median      float64
+	// Kalman filtered rssi at the end of the window, only if Filtered
+	Filtered bool
+	Kalman   float64
+	// TxPower advertised by the beacon in the window, 0 if unknown
+	TxPower int8
+}
+
+// BeaconTelemetry is an Eddystone-TLM frame advertised by a beacon
+type BeaconTelemetry struct {
+	Datetime time.Time
+	// Index of the beacon within a packet
+	BeaconIndex uint16
+	EddystoneTelemetry
+}
+
+// Log packets carry the time the client sent them in ControlData, the
+// server measures clock skew from it so spooled logs are not rejected
+const SENT_TIME_PREFIX = "sent:"
+
+// SetSentTime records t as the time the packet was sent
+func (b *BeaconLogPacket) SetSentTime(t time.Time) {
+	b.ControlData = SENT_TIME_PREFIX + strconv.FormatInt(t.UnixNano()/1000, 10)
+}
+
+// SentTime returns the time set by SetSentTime, ok is false for clients
+// that don't send it
+func (b *BeaconLogPacket) SentTime() (t time.Time, ok bool) {
+	if !strings.HasPrefix(b.ControlData, SENT_TIME_PREFIX) {
+		return time.Time{}, false
+	}
+	micros, err := strconv.ParseInt(b.ControlData[len(SENT_TIME_PREFIX):], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, micros*1000), true
 }
 
 // BeaconResponsePacket is the response to the client from the server
@@ -135,6 +211,8 @@ type BeaconResponsePacket struct {
 	//LengthData uint32
 	// Unstructered data
 	Data string
+	// Sent if Flags has RESPONSE_BEACON_DIFF
+	Diff *BeaconDiff
 }
 
 // MarshalBinary implements the encoding.BinaryMarshaler interface.
@@ -166,6 +244,9 @@ func (b *BeaconData) MarshalBinary() ([]byte, error) {
 
 // MarshalBinary implements the encoding.BinaryMarshaler interface.
 func (b *BeaconLogPacket) MarshalBinary() ([]byte, error) {
+	if b.Flags&VERSION_MASK >= 2 {
+		return b.marshalV2()
+	}
 	buff := new(bytes.Buffer)
 	if len(b.Logs) > MAX_LOGS {
 		return nil, errors.New("Protocol limits logs to 256")
@@ -173,18 +254,34 @@ func (b *BeaconLogPacket) MarshalBinary() ([]byte, error) {
 	if len(b.Beacons) > MAX_BEACONS {
 		return nil, errors.New("Protocol limits beacons to 256")
 	}
+	if len(b.Aggregates) > 0 {
+		return nil, errors.New("Protocol version 1 has no aggregates")
+	}
+	if len(b.Telemetry) > 0 {
+		return nil, errors.New("Protocol version 1 has no telemetry")
+	}
 	if len(b.ControlData) > MAX_CTRL {
 		return nil, errors.New("Protocol limits control data to 65535")
 	}
+	// Beacons other than iBeacons need their type sent
+	flags := b.Flags &^ REQUEST_TYPED_BEACONS
+	for i := range b.Beacons {
+		if b.Beacons[i].Type != BEACON_IBEACON {
+			flags |= REQUEST_TYPED_BEACONS
+			break
+		}
+	}
+	beaconsize := beaconDataSize(flags)
+
 	logsb := 12 * len(b.Logs)
-	beacb := 20 * len(b.Beacons)
+	beacb := beaconsize * len(b.Beacons)
 	controldata := len(b.ControlData)
 
 	outbuff := make([]byte, 23+logsb+beacb+controldata)
 	pointer := 0
 
 	// 1 byte
-	littleEndianEncode(buff, b.Flags)
+	littleEndianEncode(buff, flags)
 	copy(outbuff, buff.Bytes()[:1])
 	pointer += 1
 
@@ -206,10 +303,13 @@ func (b *BeaconLogPacket) MarshalBinary() ([]byte, error) {
 
 	// Beacons
 	for i := range b.Beacons {
-		// 20 bytes each
+		// 20 bytes each, plus the type if typed
 		bdata, _ := b.Beacons[i].MarshalBinary()
 		copy(outbuff[pointer:pointer+20], bdata)
-		pointer += 20
+		if beaconsize == 21 {
+			outbuff[pointer+20] = b.Beacons[i].Type
+		}
+		pointer += beaconsize
 	}
 	// Logs
 	for i := range b.Logs {
@@ -260,6 +360,9 @@ func (b *BeaconData) UnmarshalBinary(data []byte) error {
 }
 
 func (b *BeaconLogPacket) UnmarshalBinary(data []byte) error {
+	if len(data) > 0 && data[0]&VERSION_MASK == 2 {
+		return b.unmarshalV2(data)
+	}
 	if len(data) < 23 {
 		return errors.New("Packet header too small")
 	}
@@ -299,7 +402,8 @@ func (b *BeaconLogPacket) UnmarshalBinary(data []byte) error {
 	if ncontrol > MAX_CTRL {
 		return errors.New("Protocol limits control messages to 65535, sender sent invalid packet")
 	}
-	requiredlen := 20*int(nbeacons) + 12*int(nlogs) + int(ncontrol) + 23
+	beaconsize := beaconDataSize(b.Flags)
+	requiredlen := beaconsize*int(nbeacons) + 12*int(nlogs) + int(ncontrol) + 23
 	if len(data) < requiredlen {
 		// Data is too small
 		return errors.New("Input data buffer is too small to support number of beacons and logs")
@@ -310,7 +414,10 @@ func (b *BeaconLogPacket) UnmarshalBinary(data []byte) error {
 	b.Logs = make([]BeaconLog, nlogs)
 	for i := 0; i < int(nbeacons); i++ {
 		err := b.Beacons[i].UnmarshalBinary(data[pointer : pointer+20])
-		pointer += 20
+		if beaconsize == 21 {
+			b.Beacons[i].Type = data[pointer+20]
+		}
+		pointer += beaconsize
 		if err != nil {
 			return fmt.Errorf("Error occured while parsing beacon data: %s", err)
 		}
@@ -330,16 +437,25 @@ func (b *BeaconLogPacket) UnmarshalBinary(data []byte) error {
 // MarshalBinary implements the encoding.BinaryMarshaler interface.
 func (b *BeaconResponsePacket) MarshalBinary() ([]byte, error) {
 	bb := new(bytes.Buffer)
-	if len(b.Data) > (1 << 30) {
-		return []byte{}, errors.New("Data field is too long " + strconv.Itoa(len(b.Data)))
+	data := []byte(b.Data)
+	if b.Flags&RESPONSE_BEACON_DIFF != 0 {
+		if b.Diff == nil {
+			return []byte{}, errors.New("Response has a beacon diff flag without a diff")
+		}
+		diff := new(bytes.Buffer)
+		b.Diff.marshalBinary(diff)
+		data = append(diff.Bytes(), data...)
 	}
-	reqlen := len(b.Data) + 2 + 4
+	if len(data) > (1 << 30) {
+		return []byte{}, errors.New("Data field is too long " + strconv.Itoa(len(data)))
+	}
+	reqlen := len(data) + 2 + 4
 	resp := make([]byte, reqlen)
 	littleEndianEncode(bb, b.Flags)
 	copy(resp[0:2], bb.Bytes()[0:2])
-	littleEndianEncode(bb, uint32(len(b.Data)))
+	littleEndianEncode(bb, uint32(len(data)))
 	copy(resp[2:6], bb.Bytes()[0:4])
-	copy(resp[6:], []byte(b.Data))
+	copy(resp[6:], data)
 
 	return resp, nil
 }
@@ -363,10 +479,27 @@ func (b *BeaconResponsePacket) UnmarshalBinary(d []byte) error {
 	if len(d) < int(dl)+6 {
 		return errors.New("Response packet is too short given data")
 	}
+	if b.Flags&RESPONSE_BEACON_DIFF != 0 {
+		r := bytes.NewReader(d[6 : 6+int(dl)])
+		b.Diff = new(BeaconDiff)
+		if err := b.Diff.unmarshalBinary(r); err != nil {
+			return err
+		}
+		b.Data = string(d[6+int(dl)-r.Len():])
+		return nil
+	}
 	b.Data = string(d[6:])
 	return nil
 }
 
+// beaconDataSize returns the size of each beacon in a packet with flags
+func beaconDataSize(flags uint8) int {
+	if flags&REQUEST_TYPED_BEACONS != 0 {
+		return 21
+	}
+	return 20
+}
+
 // Helper function to little endian encode some data i to buffer b or panic
 func littleEndianEncode(b *bytes.Buffer, i interface{}) {
 	b.Reset()
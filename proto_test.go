@@ -18,7 +18,9 @@ package beaconpi
 
 import (
 	"bytes"
+	"math"
 	"math/rand"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -98,6 +100,163 @@ func TestDecodePacket(t *testing.T) {
 	t.Log("Time: ", tar.Logs[0].Datetime)
 }
 
+func TestTypedBeaconsPacket(t *testing.T) {
+	blp := genRandomPacket(2, 4)
+	blp.Beacons[1].Type = BEACON_EDDYSTONE_UID
+	binblp, err := blp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binblp[0]&REQUEST_TYPED_BEACONS == 0 {
+		t.Fatal("Typed beacons flag not set")
+	}
+	var tar BeaconLogPacket
+	if err = tar.UnmarshalBinary(binblp); err != nil {
+		t.Fatal(err)
+	}
+	for i := range blp.Beacons {
+		if tar.Beacons[i] != blp.Beacons[i] {
+			t.Fatalf("Beacon %d was %#v expected %#v", i, tar.Beacons[i], blp.Beacons[i])
+		}
+	}
+	if len(tar.Logs) != 4 {
+		t.Fatalf("Expected 4 logs got %d", len(tar.Logs))
+	}
+}
+
+func TestPacketV2(t *testing.T) {
+	blp := genRandomPacket(8, 200)
+	blp.Beacons[3].Type = BEACON_ALTBEACON
+	blp.ControlData = "control"
+	for i := range blp.Logs {
+		blp.Logs[i].TxPower = int8(-50 - i%20)
+	}
+	v1 := *blp
+	v1.Flags = 1
+	binv1, err := v1.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []uint64{0, EXT_DEFLATE, EXT_TX_POWER} {
+		blp.Flags = 2
+		blp.Ext = ext
+		binblp, err := blp.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(binblp) >= len(binv1) {
+			t.Errorf("Version 2 packet is %d bytes, version 1 is %d", len(binblp), len(binv1))
+		}
+		var tar BeaconLogPacket
+		if err = tar.UnmarshalBinary(binblp); err != nil {
+			t.Fatal(err)
+		}
+		if tar.Ext != ext || tar.ControlData != blp.ControlData || tar.Uuid != blp.Uuid {
+			t.Fatalf("Header was %#v", tar)
+		}
+		for i := range blp.Beacons {
+			if tar.Beacons[i] != blp.Beacons[i] {
+				t.Fatalf("Beacon %d was %#v expected %#v", i, tar.Beacons[i], blp.Beacons[i])
+			}
+		}
+		for i, l := range blp.Logs {
+			g := tar.Logs[i]
+			if ext&EXT_TX_POWER == 0 {
+				l.TxPower = 0
+			}
+			if g.Datetime.UnixNano()/1000 != l.Datetime.UnixNano()/1000 ||
+				g.Rssi != l.Rssi || g.BeaconIndex != l.BeaconIndex ||
+				g.TxPower != l.TxPower {
+				t.Fatalf("Log %d was %#v expected %#v", i, g, l)
+			}
+		}
+	}
+}
+
+func TestEmptyPacketV2(t *testing.T) {
+	blp := BeaconLogPacket{Flags: 2 | REQUEST_BEACON_UPDATES}
+	binblp, err := blp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tar BeaconLogPacket
+	if err = tar.UnmarshalBinary(binblp); err != nil {
+		t.Fatal(err)
+	}
+	if tar.Flags != blp.Flags || len(tar.Logs) != 0 {
+		t.Fatalf("Packet was %#v", tar)
+	}
+}
+
+func TestTelemetryPacket(t *testing.T) {
+	start := time.Unix(1500000000, 123000)
+	blp := BeaconLogPacket{
+		Flags:   2,
+		Ext:     EXT_TELEMETRY | EXT_DEFLATE,
+		Beacons: []BeaconData{{Major: 1, Type: BEACON_EDDYSTONE_UID}},
+		Telemetry: []BeaconTelemetry{
+			{start, 0, EddystoneTelemetry{3000, 21.5, 12345, 3600 * time.Second}},
+			{start.Add(-time.Second), 0, EddystoneTelemetry{0, math.NaN(), 1, 0}},
+			{start.Add(time.Minute), 0, EddystoneTelemetry{65535, -127.99609375,
+				math.MaxUint32, math.MaxUint32 * TELEMETRY_UPTIME_UNIT}},
+		},
+	}
+	bin, err := blp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tar BeaconLogPacket
+	if err = tar.UnmarshalBinary(bin); err != nil {
+		t.Fatal(err)
+	}
+	if len(tar.Telemetry) != len(blp.Telemetry) {
+		t.Fatalf("Telemetry was %+v", tar.Telemetry)
+	}
+	for i, want := range blp.Telemetry {
+		got := tar.Telemetry[i]
+		if !got.Datetime.Equal(want.Datetime) || got.BeaconIndex != want.BeaconIndex ||
+			got.Battery != want.Battery || got.AdvCount != want.AdvCount ||
+			got.Uptime != want.Uptime ||
+			math.IsNaN(got.Temperature) != math.IsNaN(want.Temperature) ||
+			(!math.IsNaN(want.Temperature) && got.Temperature != want.Temperature) {
+			t.Errorf("Telemetry %d was %+v expected %+v", i, got, want)
+		}
+	}
+
+	blp.Ext = 0
+	if _, err = blp.MarshalBinary(); err == nil {
+		t.Error("Telemetry was sent without EXT_TELEMETRY")
+	}
+	blp.Flags = 1
+	if _, err = blp.MarshalBinary(); err == nil {
+		t.Error("Telemetry was sent with version 1")
+	}
+}
+
+func TestSplitPacket(t *testing.T) {
+	blp := genRandomPacket(300, 1000)
+	parts := blp.Split(1)
+	var nlogs int
+	for _, p := range parts {
+		if len(p.Beacons) > MAX_BEACONS || len(p.Logs) > MAX_LOGS {
+			t.Fatalf("Part has %d beacons and %d logs", len(p.Beacons), len(p.Logs))
+		}
+		for _, l := range p.Logs {
+			if p.Beacons[l.BeaconIndex] != blp.Beacons[blp.Logs[nlogs].BeaconIndex] {
+				t.Fatalf("Log %d references the wrong beacon", nlogs)
+			}
+			nlogs++
+		}
+		p.Flags = 1
+		if _, err := p.MarshalBinary(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if nlogs != len(blp.Logs) {
+		t.Fatalf("Split kept %d of %d logs", nlogs, len(blp.Logs))
+	}
+}
+
 func TestEncodeResponse(t *testing.T) {
 	var packet BeaconResponsePacket
 
@@ -121,3 +280,71 @@ func TestEncodeResponse(t *testing.T) {
 		t.Fatal("Data not correct")
 	}
 }
+
+func TestResponseDiff(t *testing.T) {
+	blp := BeaconLogPacket{Flags: 2, Ext: EXT_BEACON_VERSION, BeaconVersion: 300}
+	binblp, err := blp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tarblp BeaconLogPacket
+	if err = tarblp.UnmarshalBinary(binblp); err != nil {
+		t.Fatal(err)
+	}
+	if tarblp.BeaconVersion != 300 {
+		t.Fatalf("Beacon version was %d", tarblp.BeaconVersion)
+	}
+
+	packet := BeaconResponsePacket{
+		Flags: 2 | RESPONSE_OK | RESPONSE_BEACON_DIFF,
+		Data:  "12\ncommand",
+		Diff: &BeaconDiff{
+			From:    300,
+			Version: 302,
+			Added:   []BeaconData{{Uuid: Uuid{1, 2, 3}, Major: 7, Minor: 8, Type: BEACON_ALTBEACON}},
+			Removed: []BeaconData{{Uuid: Uuid{4}, Major: 1, Minor: 2}},
+		},
+	}
+	res, err := packet.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tar BeaconResponsePacket
+	if err = tar.UnmarshalBinary(res); err != nil {
+		t.Fatal(err)
+	}
+	if tar.Data != packet.Data || !reflect.DeepEqual(tar.Diff, packet.Diff) {
+		t.Fatalf("Response was %#v %#v", tar, tar.Diff)
+	}
+
+	client := clientinfo{nodes: map[string]struct{}{"stale": {}}, beaconVersion: 300}
+	applyBeaconDiff(&client, &BeaconDiff{From: 299, Version: 301, Full: false})
+	if client.beaconVersion != 300 {
+		t.Fatal("Diff from another version was applied")
+	}
+	applyBeaconDiff(&client, tar.Diff)
+	if _, ok := client.nodes[packet.Diff.Added[0].String()]; !ok || client.beaconVersion != 302 {
+		t.Fatalf("Diff not applied %v", client.nodes)
+	}
+	applyBeaconDiff(&client, &BeaconDiff{From: 0, Version: 303, Full: true})
+	if len(client.nodes) != 0 {
+		t.Fatalf("Full diff kept %v", client.nodes)
+	}
+}
+
+func TestResponseDiffCounts(t *testing.T) {
+	// Counts whose sum overflows to what would fit must be rejected
+	for _, counts := range [][2]uint64{{1 << 63, 1 << 63}, {1, math.MaxUint64}, {2, 0}} {
+		buff := new(bytes.Buffer)
+		putUvarint(buff, 1)
+		putUvarint(buff, 2)
+		buff.WriteByte(0)
+		putUvarint(buff, counts[0])
+		putUvarint(buff, counts[1])
+		buff.Write(make([]byte, 21))
+		var d BeaconDiff
+		if err := d.unmarshalBinary(bytes.NewReader(buff.Bytes())); err == nil {
+			t.Errorf("Diff of %d added and %d removed was read", counts[0], counts[1])
+		}
+	}
+}
@@ -0,0 +1,636 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+// Version 2 of the packet protocol, after the flags byte:
+//   uvarint extension flags, EXT_*
+//   uvarint beacon set version if EXT_BEACON_VERSION is set
+//   16 bytes sender uuid
+//   varint base time, microseconds since the unix epoch
+//   uvarint number of beacons, logs and bytes of control data
+//   uvarint number of aggregates if EXT_AGGREGATE is set
+//   uvarint number of telemetry frames if EXT_TELEMETRY is set
+//   21 bytes per beacon, the iBeacon fields followed by the type
+//   per log a varint time delta in microseconds from the previous log (the
+//     first from the base time), the rssi as an int8 and a uvarint index
+//   per aggregate a varint time delta of its start like logs, uvarint
+//     window in milliseconds, uvarint index and count, int8 min and max,
+//     varint mean and median in 1/16 dBm, a byte set to 1 if a varint
+//     kalman filtered rssi in 1/16 dBm follows
+//   if EXT_TX_POWER is set every log and aggregate is followed by the
+//     advertised tx power as an int8
+//   per telemetry frame a varint time delta like logs, uvarint index and
+//     battery in mV, a byte set to 1 if a varint temperature in 1/256
+//     degrees Celsius follows, uvarint advertisement count and uptime in
+//     100ms
+//   control data
+// If EXT_DEFLATE is set everything after the extension flags is compressed.
+const (
+	MAX_BEACONS_V2    = 4096
+	MAX_LOGS_V2       = 16384
+	MAX_CTRL_V2       = 1 << 20
+	MAX_AGGREGATES_V2 = 4096
+	MAX_TELEMETRY_V2  = 1024
+	// Logs are at most 10 bytes of delta, 1 of rssi, 3 of index and 1 of
+	// tx power, aggregates at most 41 bytes and telemetry frames 30
+	MAX_SIZE_V2 = MAX_CTRL_V2 + MAX_LOGS_V2*15 + MAX_BEACONS_V2*21 +
+		MAX_AGGREGATES_V2*41 + MAX_TELEMETRY_V2*30 + 64
+
+	// the body of the packet is compressed with deflate
+	EXT_DEFLATE = 0x01
+	// the client is requesting the newest update for the platform in the
+	// control data, the server answers with RESPONSE_UPDATE
+	EXT_REQUEST_UPDATE = 0x02
+	// the packet carries the version of the beacon set the client holds,
+	// the server answers with RESPONSE_BEACON_DIFF once the set changes
+	EXT_BEACON_VERSION = 0x04
+	// the beacons of the packet were discovered, the control data is what
+	// was seen of each of them
+	EXT_DISCOVERY = 0x08
+	// the packet carries aggregates of the rssi of beacons over windows
+	EXT_AGGREGATE = 0x10
+	// the logs and aggregates carry the tx power advertised by the beacon
+	EXT_TX_POWER = 0x20
+	// the packet carries Eddystone-TLM frames of beacons
+	EXT_TELEMETRY = 0x40
+
+	// Fixed point scale of aggregated rssi
+	AGGREGATE_RSSI_SCALE = 16
+	// Fixed point scale of telemetry temperature, that of Eddystone-TLM
+	TELEMETRY_TEMP_SCALE = 256
+	// Resolution of telemetry uptime, that of Eddystone-TLM
+	TELEMETRY_UPTIME_UNIT = 100 * time.Millisecond
+)
+
+// maxPacketSize returns the largest packet accepted for version
+func maxPacketSize(version uint8) int {
+	if version >= 2 {
+		return MAX_SIZE_V2
+	}
+	return MAX_SIZE
+}
+
+// packetLimits returns the most beacons and logs in a packet of version
+func packetLimits(version uint8) (beacons, logs int) {
+	if version >= 2 {
+		return MAX_BEACONS_V2, MAX_LOGS_V2
+	}
+	return MAX_BEACONS, MAX_LOGS
+}
+
+// hasTxPower returns true if any log or aggregate of the packet has a tx
+// power, only then is it worth sending EXT_TX_POWER
+func (b *BeaconLogPacket) hasTxPower() bool {
+	for i := range b.Logs {
+		if b.Logs[i].TxPower != 0 {
+			return true
+		}
+	}
+	for i := range b.Aggregates {
+		if b.Aggregates[i].TxPower != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// marshalV2 encodes the packet as version 2
+func (b *BeaconLogPacket) marshalV2() ([]byte, error) {
+	if len(b.Logs) > MAX_LOGS_V2 {
+		return nil, errors.Errorf("Protocol limits logs to %d", MAX_LOGS_V2)
+	}
+	if len(b.Beacons) > MAX_BEACONS_V2 {
+		return nil, errors.Errorf("Protocol limits beacons to %d", MAX_BEACONS_V2)
+	}
+	if len(b.ControlData) > MAX_CTRL_V2 {
+		return nil, errors.Errorf("Protocol limits control data to %d", MAX_CTRL_V2)
+	}
+	if len(b.Aggregates) > MAX_AGGREGATES_V2 {
+		return nil, errors.Errorf("Protocol limits aggregates to %d", MAX_AGGREGATES_V2)
+	}
+	if len(b.Aggregates) > 0 && b.Ext&EXT_AGGREGATE == 0 {
+		return nil, errors.New("Aggregates need EXT_AGGREGATE")
+	}
+	if len(b.Telemetry) > MAX_TELEMETRY_V2 {
+		return nil, errors.Errorf("Protocol limits telemetry to %d", MAX_TELEMETRY_V2)
+	}
+	if len(b.Telemetry) > 0 && b.Ext&EXT_TELEMETRY == 0 {
+		return nil, errors.New("Telemetry needs EXT_TELEMETRY")
+	}
+	out := new(bytes.Buffer)
+	out.WriteByte(b.Flags &^ REQUEST_TYPED_BEACONS)
+	putUvarint(out, b.Ext)
+	if b.Ext&EXT_BEACON_VERSION != 0 {
+		putUvarint(out, b.BeaconVersion)
+	}
+
+	body := new(bytes.Buffer)
+	body.Write(b.Uuid[:])
+	var base int64
+	if len(b.Logs) > 0 {
+		base = b.Logs[0].Datetime.UnixNano() / 1000
+	} else if len(b.Aggregates) > 0 {
+		base = b.Aggregates[0].Start.UnixNano() / 1000
+	} else if len(b.Telemetry) > 0 {
+		base = b.Telemetry[0].Datetime.UnixNano() / 1000
+	}
+	putVarint(body, base)
+	putUvarint(body, uint64(len(b.Beacons)))
+	putUvarint(body, uint64(len(b.Logs)))
+	putUvarint(body, uint64(len(b.ControlData)))
+	if b.Ext&EXT_AGGREGATE != 0 {
+		putUvarint(body, uint64(len(b.Aggregates)))
+	}
+	if b.Ext&EXT_TELEMETRY != 0 {
+		putUvarint(body, uint64(len(b.Telemetry)))
+	}
+
+	for i := range b.Beacons {
+		bdata, _ := b.Beacons[i].MarshalBinary()
+		body.Write(bdata)
+		body.WriteByte(b.Beacons[i].Type)
+	}
+	last := base
+	for i := range b.Logs {
+		if int(b.Logs[i].BeaconIndex) >= len(b.Beacons) {
+			return nil, errors.New("Log references a beacon not in the packet")
+		}
+		t := b.Logs[i].Datetime.UnixNano() / 1000
+		putVarint(body, t-last)
+		last = t
+		body.WriteByte(byte(clampRssi(b.Logs[i].Rssi)))
+		putUvarint(body, uint64(b.Logs[i].BeaconIndex))
+		if b.Ext&EXT_TX_POWER != 0 {
+			body.WriteByte(byte(b.Logs[i].TxPower))
+		}
+	}
+	last = base
+	for i := range b.Aggregates {
+		a := &b.Aggregates[i]
+		if int(a.BeaconIndex) >= len(b.Beacons) {
+			return nil, errors.New("Aggregate references a beacon not in the packet")
+		}
+		t := a.Start.UnixNano() / 1000
+		putVarint(body, t-last)
+		last = t
+		putUvarint(body, uint64(a.Window/time.Millisecond))
+		putUvarint(body, uint64(a.BeaconIndex))
+		putUvarint(body, uint64(a.Count))
+		body.WriteByte(byte(clampRssi(a.Min)))
+		body.WriteByte(byte(clampRssi(a.Max)))
+		putVarint(body, scaleRssi(a.Mean))
+		putVarint(body, scaleRssi(a.Median))
+		if a.Filtered {
+			body.WriteByte(1)
+			putVarint(body, scaleRssi(a.Kalman))
+		} else {
+			body.WriteByte(0)
+		}
+		if b.Ext&EXT_TX_POWER != 0 {
+			body.WriteByte(byte(a.TxPower))
+		}
+	}
+	last = base
+	for i := range b.Telemetry {
+		tlm := &b.Telemetry[i]
+		if int(tlm.BeaconIndex) >= len(b.Beacons) {
+			return nil, errors.New("Telemetry references a beacon not in the packet")
+		}
+		t := tlm.Datetime.UnixNano() / 1000
+		putVarint(body, t-last)
+		last = t
+		tlm.marshalV2(body)
+	}
+	body.WriteString(b.ControlData)
+
+	if b.Ext&EXT_DEFLATE != 0 {
+		w, err := flate.NewWriter(out, flate.BestCompression)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to create compressor")
+		}
+		if _, err = body.WriteTo(w); err != nil {
+			return nil, errors.Wrap(err, "Failed to compress packet")
+		}
+		if err = w.Close(); err != nil {
+			return nil, errors.Wrap(err, "Failed to compress packet")
+		}
+	} else {
+		body.WriteTo(out)
+	}
+	return out.Bytes(), nil
+}
+
+// unmarshalV2 decodes a version 2 packet
+func (b *BeaconLogPacket) unmarshalV2(data []byte) error {
+	if len(data) > MAX_SIZE_V2 {
+		return errors.New("Packet is larger than the protocol allows")
+	}
+	r := bytes.NewReader(data)
+	var err error
+	if b.Flags, err = r.ReadByte(); err != nil {
+		return errors.New("Packet header too small")
+	}
+	if b.Ext, err = binary.ReadUvarint(r); err != nil {
+		return errors.Wrap(err, "Failed to read extension flags")
+	}
+	if b.Ext&EXT_BEACON_VERSION != 0 {
+		if b.BeaconVersion, err = binary.ReadUvarint(r); err != nil {
+			return errors.Wrap(err, "Failed to read beacon set version")
+		}
+	}
+	br := r
+	if b.Ext&EXT_DEFLATE != 0 {
+		inflated, err := ioutil.ReadAll(io.LimitReader(flate.NewReader(r), MAX_SIZE_V2+1))
+		if err != nil {
+			return errors.Wrap(err, "Failed to decompress packet")
+		}
+		if len(inflated) > MAX_SIZE_V2 {
+			return errors.New("Decompressed packet is larger than the protocol allows")
+		}
+		br = bytes.NewReader(inflated)
+	}
+
+	if _, err = io.ReadFull(br, b.Uuid[:]); err != nil {
+		return errors.New("Packet header too small")
+	}
+	base, err := binary.ReadVarint(br)
+	if err != nil {
+		return errors.Wrap(err, "Failed to read base time")
+	}
+	var nbeacons, nlogs, ncontrol, naggregates, ntelemetry uint64
+	counts := []*uint64{&nbeacons, &nlogs, &ncontrol}
+	if b.Ext&EXT_AGGREGATE != 0 {
+		counts = append(counts, &naggregates)
+	}
+	if b.Ext&EXT_TELEMETRY != 0 {
+		counts = append(counts, &ntelemetry)
+	}
+	for _, n := range counts {
+		if *n, err = binary.ReadUvarint(br); err != nil {
+			return errors.Wrap(err, "Failed to read packet counts")
+		}
+	}
+	if nlogs > MAX_LOGS_V2 {
+		return errors.Errorf("Protocol limits logs to %d, sender sent invalid packet", MAX_LOGS_V2)
+	}
+	if nbeacons > MAX_BEACONS_V2 {
+		return errors.Errorf("Protocol limits beacons to %d, sender sent invalid packet", MAX_BEACONS_V2)
+	}
+	if ncontrol > MAX_CTRL_V2 {
+		return errors.Errorf("Protocol limits control data to %d, sender sent invalid packet", MAX_CTRL_V2)
+	}
+	if naggregates > MAX_AGGREGATES_V2 {
+		return errors.Errorf("Protocol limits aggregates to %d, sender sent invalid packet", MAX_AGGREGATES_V2)
+	}
+	if ntelemetry > MAX_TELEMETRY_V2 {
+		return errors.Errorf("Protocol limits telemetry to %d, sender sent invalid packet", MAX_TELEMETRY_V2)
+	}
+	// Every beacon is 21 bytes, every log at least 3, every aggregate 9 and
+	// every telemetry frame 6
+	if uint64(br.Len()) < nbeacons*21+nlogs*3+naggregates*9+ntelemetry*6+ncontrol {
+		return errors.New("Input data buffer is too small to support number of beacons and logs")
+	}
+
+	b.Beacons = make([]BeaconData, nbeacons)
+	bdata := make([]byte, 21)
+	for i := range b.Beacons {
+		if _, err = io.ReadFull(br, bdata); err != nil {
+			return errors.Wrap(err, "Error occured while parsing beacon data")
+		}
+		b.Beacons[i].UnmarshalBinary(bdata[:20])
+		b.Beacons[i].Type = bdata[20]
+	}
+
+	b.Logs = make([]BeaconLog, nlogs)
+	last := base
+	for i := range b.Logs {
+		delta, err := binary.ReadVarint(br)
+		if err != nil {
+			return errors.Wrap(err, "Error occured while parsing log time")
+		}
+		rssi, err := br.ReadByte()
+		if err != nil {
+			return errors.Wrap(err, "Error occured while parsing log rssi")
+		}
+		index, err := binary.ReadUvarint(br)
+		if err != nil {
+			return errors.Wrap(err, "Error occured while parsing log index")
+		}
+		if index >= nbeacons {
+			return errors.New("Log references a beacon not in the packet")
+		}
+		var txpower byte
+		if b.Ext&EXT_TX_POWER != 0 {
+			if txpower, err = br.ReadByte(); err != nil {
+				return errors.Wrap(err, "Error occured while parsing log tx power")
+			}
+		}
+		last += delta
+		b.Logs[i] = BeaconLog{
+			Datetime:    time.Unix(last/1000000, (last%1000000)*1000),
+			Rssi:        int16(int8(rssi)),
+			BeaconIndex: uint16(index),
+			TxPower:     int8(txpower),
+		}
+	}
+
+	b.Aggregates = nil
+	if naggregates > 0 {
+		b.Aggregates = make([]BeaconAggregate, naggregates)
+	}
+	last = base
+	for i := range b.Aggregates {
+		if err = b.Aggregates[i].unmarshalV2(br, &last, nbeacons); err != nil {
+			return err
+		}
+		if b.Ext&EXT_TX_POWER != 0 {
+			txpower, err := br.ReadByte()
+			if err != nil {
+				return errors.Wrap(err, "Error occured while parsing aggregate tx power")
+			}
+			b.Aggregates[i].TxPower = int8(txpower)
+		}
+	}
+
+	b.Telemetry = nil
+	if ntelemetry > 0 {
+		b.Telemetry = make([]BeaconTelemetry, ntelemetry)
+	}
+	last = base
+	for i := range b.Telemetry {
+		if err = b.Telemetry[i].unmarshalV2(br, &last, nbeacons); err != nil {
+			return err
+		}
+	}
+
+	control := make([]byte, ncontrol)
+	if _, err = io.ReadFull(br, control); err != nil {
+		return errors.New("Input data buffer is too small to support control data")
+	}
+	if br.Len() != 0 {
+		return errors.New("Input data buffer is too long to support number of beacons and logs")
+	}
+	b.ControlData = string(control)
+	return nil
+}
+
+// Split divides the logs of the packet into packets that fit in the limits
+// of version, each with only the beacons its logs reference
+func (b *BeaconLogPacket) Split(version uint8) []*BeaconLogPacket {
+	maxbeacons, maxlogs := packetLimits(version)
+	if len(b.Beacons) <= maxbeacons && len(b.Logs) <= maxlogs {
+		return []*BeaconLogPacket{b}
+	}
+	var rval []*BeaconLogPacket
+	var cur *BeaconLogPacket
+	var indexes map[uint16]uint16
+	for _, l := range b.Logs {
+		_, seen := indexes[l.BeaconIndex]
+		if cur == nil || len(cur.Logs) == maxlogs ||
+			(!seen && len(cur.Beacons) == maxbeacons) {
+			cur = &BeaconLogPacket{Flags: b.Flags, Ext: b.Ext, Uuid: b.Uuid}
+			indexes = make(map[uint16]uint16)
+			rval = append(rval, cur)
+		}
+		i, ok := indexes[l.BeaconIndex]
+		if !ok {
+			i = uint16(len(cur.Beacons))
+			indexes[l.BeaconIndex] = i
+			cur.Beacons = append(cur.Beacons, b.Beacons[l.BeaconIndex])
+		}
+		l.BeaconIndex = i
+		cur.Logs = append(cur.Logs, l)
+	}
+	return rval
+}
+
+// BeaconDiff changes the beacon set of a client from version From to
+// Version. It is sent before the data of a response with
+// RESPONSE_BEACON_DIFF as:
+//   uvarint from, uvarint version, 1 byte set to 1 if the diff is full
+//   uvarint number of added and removed beacons
+//   21 bytes per beacon, the iBeacon fields followed by the type
+type BeaconDiff struct {
+	From    uint64
+	Version uint64
+	// Full diffs replace the set with Added whatever version it was
+	Full    bool
+	Added   []BeaconData
+	Removed []BeaconData
+}
+
+// marshalBinary appends the encoded diff to out
+func (d *BeaconDiff) marshalBinary(out *bytes.Buffer) {
+	putUvarint(out, d.From)
+	putUvarint(out, d.Version)
+	if d.Full {
+		out.WriteByte(1)
+	} else {
+		out.WriteByte(0)
+	}
+	putUvarint(out, uint64(len(d.Added)))
+	putUvarint(out, uint64(len(d.Removed)))
+	for _, list := range [][]BeaconData{d.Added, d.Removed} {
+		for i := range list {
+			bdata, _ := list[i].MarshalBinary()
+			out.Write(bdata)
+			out.WriteByte(list[i].Type)
+		}
+	}
+}
+
+// unmarshalBinary reads a diff from the start of r
+func (d *BeaconDiff) unmarshalBinary(r *bytes.Reader) error {
+	var err error
+	if d.From, err = binary.ReadUvarint(r); err != nil {
+		return errors.Wrap(err, "Failed to read diff base version")
+	}
+	if d.Version, err = binary.ReadUvarint(r); err != nil {
+		return errors.Wrap(err, "Failed to read diff version")
+	}
+	full, err := r.ReadByte()
+	if err != nil {
+		return errors.Wrap(err, "Failed to read diff")
+	}
+	d.Full = full != 0
+	var nadded, nremoved uint64
+	for _, n := range []*uint64{&nadded, &nremoved} {
+		if *n, err = binary.ReadUvarint(r); err != nil {
+			return errors.Wrap(err, "Failed to read diff counts")
+		}
+	}
+	// Each count is checked alone so their sum can't overflow
+	fits := uint64(r.Len()) / 21
+	if nadded > fits || nremoved > fits-nadded {
+		return errors.New("Response is too small for the beacons in the diff")
+	}
+	d.Added = make([]BeaconData, nadded)
+	d.Removed = make([]BeaconData, nremoved)
+	bdata := make([]byte, 21)
+	for _, list := range [][]BeaconData{d.Added, d.Removed} {
+		for i := range list {
+			if _, err = io.ReadFull(r, bdata); err != nil {
+				return errors.Wrap(err, "Error occured while parsing diff")
+			}
+			list[i].UnmarshalBinary(bdata[:20])
+			list[i].Type = bdata[20]
+		}
+	}
+	return nil
+}
+
+// unmarshalV2 reads an aggregate from br, last is the start of the one
+// before it
+func (a *BeaconAggregate) unmarshalV2(br *bytes.Reader, last *int64, nbeacons uint64) error {
+	delta, err := binary.ReadVarint(br)
+	if err != nil {
+		return errors.Wrap(err, "Error occured while parsing aggregate time")
+	}
+	*last += delta
+	a.Start = time.Unix(*last/1000000, (*last%1000000)*1000)
+	var fields [3]uint64
+	for i := range fields {
+		if fields[i], err = binary.ReadUvarint(br); err != nil {
+			return errors.Wrap(err, "Error occured while parsing aggregate")
+		}
+	}
+	if fields[1] >= nbeacons {
+		return errors.New("Aggregate references a beacon not in the packet")
+	}
+	a.Window = time.Duration(fields[0]) * time.Millisecond
+	a.BeaconIndex = uint16(fields[1])
+	a.Count = uint32(fields[2])
+	var minmax [2]byte
+	if _, err = io.ReadFull(br, minmax[:]); err != nil {
+		return errors.Wrap(err, "Error occured while parsing aggregate rssi")
+	}
+	a.Min, a.Max = int16(int8(minmax[0])), int16(int8(minmax[1]))
+	var scaled [2]int64
+	for i := range scaled {
+		if scaled[i], err = binary.ReadVarint(br); err != nil {
+			return errors.Wrap(err, "Error occured while parsing aggregate rssi")
+		}
+	}
+	a.Mean = float64(scaled[0]) / AGGREGATE_RSSI_SCALE
+	a.Median = float64(scaled[1]) / AGGREGATE_RSSI_SCALE
+	filtered, err := br.ReadByte()
+	if err != nil {
+		return errors.Wrap(err, "Error occured while parsing aggregate")
+	}
+	a.Filtered = filtered != 0
+	if a.Filtered {
+		kalman, err := binary.ReadVarint(br)
+		if err != nil {
+			return errors.Wrap(err, "Error occured while parsing aggregate kalman")
+		}
+		a.Kalman = float64(kalman) / AGGREGATE_RSSI_SCALE
+	}
+	return nil
+}
+
+// marshalV2 appends the frame after its time delta to body
+func (tlm *BeaconTelemetry) marshalV2(body *bytes.Buffer) {
+	putUvarint(body, uint64(tlm.BeaconIndex))
+	putUvarint(body, uint64(tlm.Battery))
+	if math.IsNaN(tlm.Temperature) {
+		body.WriteByte(0)
+	} else {
+		body.WriteByte(1)
+		putVarint(body, int64(math.Round(tlm.Temperature*TELEMETRY_TEMP_SCALE)))
+	}
+	putUvarint(body, uint64(tlm.AdvCount))
+	putUvarint(body, uint64(tlm.Uptime/TELEMETRY_UPTIME_UNIT))
+}
+
+// unmarshalV2 reads a telemetry frame from br, last is the time of the one
+// before it
+func (tlm *BeaconTelemetry) unmarshalV2(br *bytes.Reader, last *int64, nbeacons uint64) error {
+	delta, err := binary.ReadVarint(br)
+	if err != nil {
+		return errors.Wrap(err, "Error occured while parsing telemetry time")
+	}
+	*last += delta
+	tlm.Datetime = time.Unix(*last/1000000, (*last%1000000)*1000)
+	var fields [2]uint64
+	for i := range fields {
+		if fields[i], err = binary.ReadUvarint(br); err != nil {
+			return errors.Wrap(err, "Error occured while parsing telemetry")
+		}
+	}
+	if fields[0] >= nbeacons {
+		return errors.New("Telemetry references a beacon not in the packet")
+	}
+	tlm.BeaconIndex = uint16(fields[0])
+	tlm.Battery = uint16(fields[1])
+	hastemp, err := br.ReadByte()
+	if err != nil {
+		return errors.Wrap(err, "Error occured while parsing telemetry")
+	}
+	tlm.Temperature = math.NaN()
+	if hastemp != 0 {
+		temp, err := binary.ReadVarint(br)
+		if err != nil {
+			return errors.Wrap(err, "Error occured while parsing telemetry temperature")
+		}
+		tlm.Temperature = float64(temp) / TELEMETRY_TEMP_SCALE
+	}
+	var counts [2]uint64
+	for i := range counts {
+		if counts[i], err = binary.ReadUvarint(br); err != nil {
+			return errors.Wrap(err, "Error occured while parsing telemetry")
+		}
+	}
+	tlm.AdvCount = uint32(counts[0])
+	tlm.Uptime = time.Duration(counts[1]) * TELEMETRY_UPTIME_UNIT
+	return nil
+}
+
+// scaleRssi returns rssi in the fixed point of aggregates
+func scaleRssi(rssi float64) int64 {
+	return int64(math.Round(rssi * AGGREGATE_RSSI_SCALE))
+}
+
+// clampRssi limits rssi to the int8 sent by version 2
+func clampRssi(rssi int16) int8 {
+	if rssi < -128 {
+		return -128
+	} else if rssi > 127 {
+		return 127
+	}
+	return int8(rssi)
+}
+
+func putUvarint(b *bytes.Buffer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func putVarint(b *bytes.Buffer, v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutVarint(buf[:], v)])
+}
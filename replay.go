@@ -0,0 +1,201 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// metricsserv builds cause problems with other binaries due to inclusion
+// of packages that require python3
+// +build metrics
+
+package beaconpi
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+const (
+	// Most steps replayed by one request
+	REPLAY_MAX_STEPS = 86400
+	// Shortest step in milliseconds
+	REPLAY_MIN_STEP = 100
+	// Steps in each object of a streamed replay
+	REPLAY_CHUNK = 60
+)
+
+// replayChunk is a part of a replay, the series is ordered by beacon and
+// time
+type replayChunk struct {
+	Series []TimeSeriesPoint
+	// Steps replayed so far and those without a location of any beacon
+	Steps  int
+	Failed int
+	Done   bool
+}
+
+// simplifySeries drops points of each beacon that are within tolerance of
+// the path of the rest, series must be ordered by beacon and time
+func simplifySeries(series []TimeSeriesPoint, tolerance float64) []TimeSeriesPoint {
+	res := make([]TimeSeriesPoint, 0, len(series))
+	for start := 0; start < len(series); {
+		end := start
+		var path [][2]float64
+		for ; end < len(series) && series[end].Beacon == series[start].Beacon; end++ {
+			l := series[end].Location
+			path = append(path, [2]float64{l[0], l[1]})
+		}
+		for _, i := range simplifyPath(path, tolerance) {
+			res = append(res, series[start+i])
+		}
+		start = end
+	}
+	return res
+}
+
+// replayTrajectory runs a localization algorithm over a time range in one
+// pass and returns the location of the beacons at every step. If Stream is
+// set the response is one JSON object per line for every REPLAY_CHUNK
+// steps, the last has Done set. Simplify is a tolerance in metres to drop
+// points within of the path of the beacon.
+func replayTrajectory() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Beacons    []int
+			Map        int
+			Since      time.Time
+			Before     time.Time
+			Step       int
+			Algorithm  string
+			Parameters map[string]float64
+			Stream     bool
+			Simplify   float64
+		}{Step: 1000}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in ReplayTrajectory %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		step := time.Duration(input.Step) * time.Millisecond
+		if len(input.Beacons) == 0 || input.Step < REPLAY_MIN_STEP ||
+			!input.Before.After(input.Since) || input.Simplify < 0 ||
+			input.Before.Sub(input.Since)/step > REPLAY_MAX_STEPS {
+			log.Infof("Replay needs Beacons and up to %d steps of at least %dms",
+				REPLAY_MAX_STEPS, REPLAY_MIN_STEP)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		algo := localizationAlgorithm(input.Algorithm)
+		if algo == nil {
+			log.Infof("Unknown algorithm \"%s\"", input.Algorithm)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		params, err := algo.resolveParameters(input.Parameters)
+		if err != nil {
+			log.Infof("Invalid algorithm parameters %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		mc, err := fetchMapConfig(db, input.Map)
+		if err != nil {
+			log.Infof("Failed to fetch map for given Id %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
+		var enc *json.Encoder
+		var flusher http.Flusher
+		if input.Stream {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			flusher, _ = w.(http.Flusher)
+			enc = json.NewEncoder(w)
+		}
+		// Series of each beacon until they are sent
+		pending := make(map[int][]TimeSeriesPoint)
+		var chunk replayChunk
+		flush := func() error {
+			chunk.Series = nil
+			for _, b := range input.Beacons {
+				chunk.Series = append(chunk.Series, pending[b]...)
+				delete(pending, b)
+			}
+			if input.Simplify > 0 {
+				chunk.Series = simplifySeries(chunk.Series, input.Simplify)
+			}
+			if !input.Stream {
+				return nil
+			}
+			if err := enc.Encode(chunk); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}
+
+		mlr := FilteredMapLocationRequest{
+			Beacons:    input.Beacons,
+			Edges:      mc.Edges,
+			MapID:      mc.Id,
+			Algorithm:  algo.Name,
+			Parameters: params,
+		}
+		for t := input.Since; t.Before(input.Before); t = t.Add(step) {
+			if req.Context().Err() != nil {
+				return
+			}
+			mlr.RequestTime = t
+			td, err := algo.run(db, mc, &mlr)
+			chunk.Steps++
+			if err != nil || len(td.Series) == 0 {
+				log.Debugf("No locations at %s: %v", t, err)
+				chunk.Failed++
+			} else {
+				// Filters follow the beacons through the range
+				mlr.FilterID = td.FilterID
+				for _, p := range td.Series {
+					pending[p.Beacon] = append(pending[p.Beacon], p)
+				}
+			}
+			if input.Stream && chunk.Steps%REPLAY_CHUNK == 0 {
+				if err = flush(); err != nil {
+					return
+				}
+			}
+		}
+		chunk.Done = true
+		if err = flush(); err != nil || input.Stream {
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Series":    chunk.Series,
+			"Steps":     chunk.Steps,
+			"Failed":    chunk.Failed,
+			"MapConfig": mc,
+		})
+	})
+}
@@ -17,21 +17,35 @@
 package beaconpi
 
 import (
+	"bytes"
 	"crypto/tls"
+	"database/sql"
+	"encoding/binary"
 	"flag"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net"
 	"os"
-	//"database/sql"
-	"bytes"
-	"encoding/binary"
 	"time"
 )
 
+// Responses are written in chunks of this many bytes, each must be written
+// within RESPONSE_WRITE_TIMEOUT so large updates are not cut off on slow
+// links while stalled clients still are
+const (
+	RESPONSE_WRITE_CHUNK   = 64 << 10
+	RESPONSE_WRITE_TIMEOUT = 2 * time.Second
+)
+
 var db *dbHandler
 
+// serverdb is the pool shared by all connections
+var serverdb *sql.DB
+
+// logs inserts all beacon logs received by the server
+var logs *logWriter
+
 // Required BeaconServer config
 type ServerConfig struct {
 	X509cert string
@@ -40,6 +54,13 @@ type ServerConfig struct {
 	Drivername string
 	// Database data source name
 	DSN string
+	// Rows of beacon logs to buffer across connections before committing,
+	// zero commits each packet as it arrives
+	BatchSize int
+	// Longest a buffered row waits to be committed
+	BatchInterval time.Duration
+	// Don't track which zone beacons are in
+	NoPresence bool
 }
 
 func GetFlags() (out ServerConfig) {
@@ -52,6 +73,12 @@ func GetFlags() (out ServerConfig) {
 		"Required: The database driver name")
 	flag.StringVar(&out.DSN, "db-datasource-name", "",
 		"Required: The database datasource name, may be multiple tokes")
+	flag.IntVar(&out.BatchSize, "batch-size", 0,
+		"Rows of beacon logs to buffer before committing them together, 0 disables buffering")
+	flag.DurationVar(&out.BatchInterval, "batch-interval", 100*time.Millisecond,
+		"Longest time a buffered beacon log waits before being committed")
+	flag.BoolVar(&out.NoPresence, "no-presence", false,
+		"Don't record beacons entering and leaving rooms and zones in presence_events")
 	debug := flag.Bool("debug", false, "extra logging")
 	flag.Parse()
 	if *debug {
@@ -67,6 +94,17 @@ func GetFlags() (out ServerConfig) {
 
 // StartServer is the main interface for the BeaconServer
 func StartServer(x509cert, x509key, drivername, dsn string, end chan struct{}) {
+	StartServerConfig(ServerConfig{
+		X509cert:   x509cert,
+		X509key:    x509key,
+		Drivername: drivername,
+		DSN:        dsn,
+	}, end)
+}
+
+// StartServerConfig starts the BeaconServer with all options of config
+func StartServerConfig(config ServerConfig, end chan struct{}) {
+	x509cert, x509key := config.X509cert, config.X509key
 	// Logging
 	customFormatter := new(log.TextFormatter)
 	customFormatter.TimestampFormat = "2006-01-02 15:04:05"
@@ -74,8 +112,19 @@ func StartServer(x509cert, x509key, drivername, dsn string, end chan struct{}) {
 	log.SetFormatter(customFormatter)
 
 	db = new(dbHandler)
-	db.Drivername = drivername
-	db.DataSourceName = dsn
+	db.Drivername = config.Drivername
+	db.DataSourceName = config.DSN
+	var err error
+	serverdb, err = db.openDB()
+	if err != nil {
+		log.Fatal(err)
+	}
+	logs = newLogWriter(dbLogStore{serverdb}, config.BatchSize, config.BatchInterval)
+	if !config.NoPresence {
+		logs.presence = newPresenceEngine(serverdb)
+		go logs.presence.run(end)
+	}
+	go beacons.listen(config.Drivername, config.DSN)
 
 	cerpoolrootca := LoadFileToCert(x509cert)
 
@@ -84,21 +133,23 @@ func StartServer(x509cert, x509key, drivername, dsn string, end chan struct{}) {
 		log.Fatal(err)
 	}
 	port := DEFAULT_PORT
-	config := &tls.Config{
+	tlsconfig := &tls.Config{
 		Certificates: []tls.Certificate{cer},
 		ClientCAs:    cerpoolrootca,
 		ClientAuth:   tls.RequireAndVerifyClientCert,
 	}
-	ln, err := tls.Listen("tcp", ":"+port, config)
+	ln, err := tls.Listen("tcp", ":"+port, tlsconfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Println("Now listening on tcp \":\"" + port)
 	defer ln.Close()
+	stopped := make(chan struct{})
 	go func() {
 		// Passes when closed
 		_, _ = <-end
 		log.Println("Recieved end message, stopping...")
+		close(stopped)
 		ln.Close()
 	}()
 
@@ -106,6 +157,11 @@ func StartServer(x509cert, x509key, drivername, dsn string, end chan struct{}) {
 		conn, err := ln.Accept()
 
 		if err != nil {
+			select {
+			case <-stopped:
+				return
+			default:
+			}
 			log.Println(err)
 			continue
 		}
@@ -133,18 +189,28 @@ func writeResponseAndClose(conn net.Conn, resp *BeaconResponsePacket, close bool
 		return
 	}
 
-	conn.SetWriteDeadline(time.Now().Add(time.Second * 2))
+	conn.SetWriteDeadline(time.Now().Add(RESPONSE_WRITE_TIMEOUT))
 	_, err = buff.WriteTo(conn)
 	if err != nil {
 		log.Printf("Failed to write len of response %+v", errors.WithStack(err))
 		return
 	}
 
-	conn.SetWriteDeadline(time.Now().Add(time.Second * 2))
-	n, err := conn.Write(respbytes)
-	if n != len(respbytes) || err != nil {
-		log.Printf("Failed to write response. Len written: %d of %d"+
-			". Error was %+v", n, len(respbytes), err)
+	var n int
+	for n < len(respbytes) {
+		end := n + RESPONSE_WRITE_CHUNK
+		if end > len(respbytes) {
+			end = len(respbytes)
+		}
+		conn.SetWriteDeadline(time.Now().Add(RESPONSE_WRITE_TIMEOUT))
+		var written int
+		written, err = conn.Write(respbytes[n:end])
+		n += written
+		if err != nil {
+			log.Printf("Failed to write response. Len written: %d of %d"+
+				". Error was %+v", n, len(respbytes), err)
+			break
+		}
 	}
 	conn.SetWriteDeadline(time.Time{})
 }
@@ -167,7 +233,11 @@ func handleConnection(conn net.Conn, end chan struct{}) {
 		raiseErr(RESPONSE_INVALID, err)
 		return
 	}
+	// Answer with the highest version both of us support
 	version = uint8(buff.Bytes()[0] & VERSION_MASK)
+	if version > CURRENT_VERSION {
+		version = CURRENT_VERSION
+	}
 	resp.Flags |= uint16(version)
 
 	// Write the version back
@@ -195,6 +265,10 @@ func handleConnection(conn net.Conn, end chan struct{}) {
 			raiseErr(RESPONSE_INVALID, err)
 			return
 		}
+		if int64(length) > int64(maxPacketSize(version)) {
+			raiseErr(RESPONSE_INVALID, errors.Errorf("Packet length %d is too long", length))
+			return
+		}
 
 		buff, err = readBytesOrCancel(conn, int64(length), &resp, version, end)
 		if err != nil {
@@ -236,17 +310,35 @@ func handlePacket(conn net.Conn, resp *BeaconResponsePacket,
 		writeResponseAndClose(conn, resp, successClose, version)
 	}
 
-	db, err := db.openDB()
-	if err != nil {
-		responseHandle(RESPONSE_INTERNAL_FAILURE, errors.Wrap(err, "Failed to open DB"))
-		return
+	db := serverdb
+	var err error
+
+	// Discovery reports need version 2
+	if version >= 2 {
+		if set, err := beacons.get(db); err != nil {
+			log.Warnf("Failed to get beacons: %s", err)
+		} else if set.discovery[pack.Uuid] {
+			resp.Flags |= RESPONSE_DISCOVERY
+		}
+	}
+	// Clients holding an older beacon set get the changes with any response
+	if pack.Ext&EXT_BEACON_VERSION != 0 {
+		if diff, err := beacons.diff(pack.Uuid, pack.BeaconVersion, db); err != nil {
+			log.Warnf("Failed to get beacon diff: %s", err)
+		} else if diff != nil {
+			resp.Diff = diff
+			resp.Flags |= RESPONSE_BEACON_DIFF
+		}
 	}
-	defer db.Close()
 
 	// Client request beacon updates
-	if pack.Flags&REQUEST_BEACON_UPDATES != 0 {
+	if pack.Flags&REQUEST_BEACON_UPDATES != 0 && pack.Ext&EXT_BEACON_VERSION != 0 {
+		// The diff is the update
+		responseHandle(RESPONSE_OK, nil)
+		return
+	} else if pack.Flags&REQUEST_BEACON_UPDATES != 0 {
 		log.Info("Client requested beacon updates")
-		beacons, err := dbGetBeacons(db)
+		beacons, err := dbGetBeaconsForEdge(pack.Uuid, db)
 		if err != nil {
 			responseHandle(RESPONSE_INTERNAL_FAILURE, errors.Wrap(err, "Failed to get beacons"))
 			return
@@ -261,6 +353,50 @@ func handlePacket(conn net.Conn, resp *BeaconResponsePacket,
 		return
 	}
 
+	// Client is reporting beacons it does not watch
+	if pack.Ext&EXT_DISCOVERY != 0 {
+		edgeid, err := dbCheckUuid(pack.Uuid, db)
+		if err != nil {
+			err = errors.Wrapf(err, "Error occured edgeid \"%s\" was not found in db", pack.Uuid)
+			responseHandle(RESPONSE_INVALID, err)
+			return
+		}
+		seen, err := parseDiscovery(pack)
+		if err != nil {
+			responseHandle(RESPONSE_INVALID, err)
+			return
+		}
+		if err = dbAddDiscovered(edgeid, pack.Beacons, seen, db); err != nil {
+			responseHandle(RESPONSE_INTERNAL_FAILURE, err)
+			return
+		}
+		responseHandle(RESPONSE_OK, nil)
+		return
+	}
+
+	// Client is downloading an update
+	if pack.Ext&EXT_REQUEST_UPDATE != 0 {
+		edgeid, err := dbCheckUuid(pack.Uuid, db)
+		if err != nil {
+			err = errors.Wrapf(err, "Error occured edgeid \"%s\" was not found in db", pack.Uuid)
+			responseHandle(RESPONSE_INVALID, err)
+			return
+		}
+		updateversion, data, err := dbGetUpdate(pack.ControlData, db)
+		if err == sql.ErrNoRows {
+			dbInsertServerControlLog(edgeid, "no update for "+pack.ControlData, db)
+			responseHandle(RESPONSE_OK, nil)
+			return
+		} else if err != nil {
+			responseHandle(RESPONSE_INTERNAL_FAILURE, errors.Wrap(err, "Failed to get update"))
+			return
+		}
+		dbInsertServerControlLog(edgeid, "sent update "+updateversion+" for "+pack.ControlData, db)
+		resp.Data = data
+		responseHandle(RESPONSE_UPDATE, nil)
+		return
+	}
+
 	// Client requested command and control
 	if pack.Flags&REQUEST_CONTROL_LOG != 0 {
 		edgeid, err := dbCheckUuid(pack.Uuid, db)
@@ -275,24 +411,28 @@ func handlePacket(conn net.Conn, resp *BeaconResponsePacket,
 			responseHandle(RESPONSE_OK, nil)
 		}
 		return
+	}
 
-		// Client is phoning home to give the results of the command and control
-	} else if pack.Flags&REQUEST_CONTROL_COMPLETE != 0 {
+	// Client is phoning home to give the results of the command and control
+	if pack.Flags&REQUEST_CONTROL_COMPLETE != 0 {
 		err = dbCompleteControl(pack, db)
 		if err != nil {
 			responseHandle(RESPONSE_INTERNAL_FAILURE, errors.Wrap(err, "Failed to update control"))
 			return
 		}
 		responseHandle(RESPONSE_OK, nil)
+		return
+	}
+
+	// Only data packets are sent commands and actions, the responses to
+	// the requests above are read by the client for their own purpose
+	control, err := dbGetControl(pack, db)
+	if err != nil {
+		// log.Printf("DEBUG: Failed to get control, passing: %s", err)
 	} else {
-		control, err := dbGetControl(pack, db)
-		if err != nil {
-			// log.Printf("DEBUG: Failed to get control, passing: %s", err)
-		} else {
-			log.Infof("Sending control %s", control)
-			resp.Data = control
-			resp.Flags |= RESPONSE_SYSTEM
-		}
+		log.Infof("Sending control %s", control)
+		resp.Data = control
+		resp.Flags |= RESPONSE_SYSTEM
 	}
 
 	var edgeid int
@@ -307,11 +447,19 @@ func handlePacket(conn net.Conn, resp *BeaconResponsePacket,
 	// Update the time of the given edge that we have confirmed
 	updateEdgeLastUpdate(pack.Uuid, db)
 	log.Debug("Packet from ", pack.Uuid, edgeid)
-	if err = dbAddLogsForBeacons(pack, edgeid, db); err != nil {
+	if err = dbAddLogsForBeacons(pack, edgeid, db, logs); err != nil {
 		err = errors.Wrap(err, "Error when checking in logs for beacon")
 		responseHandle(RESPONSE_INTERNAL_FAILURE, err)
 		return
 	}
+	// Actions are only taken with a successful response so they aren't lost
+	if action, err := dbTakePendingAction(edgeid, db); err != nil {
+		log.Warn(err)
+	} else if action != ACTION_NONE {
+		log.Infof("Sending action %d to edge %d", action, edgeid)
+		dbInsertServerControlLog(edgeid, "sent "+actionNames[action], db)
+		resp.Flags |= actionResponses[action]
+	}
 	responseHandle(RESPONSE_OK, nil)
 }
 
@@ -17,87 +17,394 @@
 package beaconpi
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
 	"io/ioutil"
-	"log"
+	"math/big"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
 
-func TestDB(t *testing.T) {
-	// Always skip this
-	t.Skip()
-
-	logfname := "test.log"
-	logf, err := os.Create(logfname)
+// writeTestCert writes a certificate and key for localhost to dir, signed
+// by parent or self signed as a CA if parent is nil
+func writeTestCert(t *testing.T, dir, name string, parent *x509.Certificate,
+	parentkey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		t.Fatal(err)
 	}
-	log.SetOutput(logf)
-	channelend := make(chan struct{}, 1)
-	prog := "/mnt/storage/Source_Code/Projects/beacons"
-	config := ServerConfig{X509cert: prog + "/x509/server.crt",
-		X509key: prog + "/x509/server.key", Drivername: "postgres",
-		DSN: "user=postgres password=notapassword dbname=beacons sslmode=disable"}
-	t.Log("Starting server")
-	go StartServer(config.X509cert, config.X509key,
-		config.Drivername, config.DSN, channelend)
-	time.Sleep(1 * time.Second)
-	channelend <- struct{}{} // End after one request
-
-	t.Log("Server started")
-	packet := BeaconLogPacket{Flags: REQUEST_BEACON_UPDATES}
-	encpacket, _ := packet.MarshalBinary()
-	resbytes := sendBytes(encpacket)
-	t.Logf("%#v\n", resbytes)
-	var rp BeaconResponsePacket
-	err = rp.UnmarshalBinary(resbytes)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		template.IsCA = true
+		parent, parentkey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certpem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keypem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder})
+	if err = ioutil.WriteFile(filepath.Join(dir, name+".crt"), certpem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, name+".key"), keypem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("%#v\n", rp)
-	time.Sleep(1 * time.Second)
+	return cert, key
 }
 
-func sendBytes(b []byte) []byte {
-	var servcertfile, clientcertfile, clientkeyfile string
-	prog := "/mnt/storage/Source_Code/Projects/beacons"
-	servcertfile = prog + "/x509/server.crt"
-	clientcertfile = prog + "/x509/client.crt"
-	clientkeyfile = prog + "/x509/client.key"
-
-	certpool := LoadFileToCert(servcertfile)
-	if certpool == nil {
-		log.Fatal("Something happened while loading the certfile")
+// openTestDB opens the migrated database given by BEACONPI_TEST_DSN, the
+// postgres datasource name, the test is skipped if it is not set
+func openTestDB(t *testing.T) (*sql.DB, string) {
+	dsn := os.Getenv("BEACONPI_TEST_DSN")
+	if dsn == "" {
+		t.Skip("BEACONPI_TEST_DSN is not set")
 	}
+	dbconfig := dbHandler{"postgres", dsn}
+	testdb, err := dbconfig.openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testdb, dsn
+}
 
-	clientcert, err := tls.LoadX509KeyPair(clientcertfile, clientkeyfile)
+// TestDB runs simulated edges against a server on a migrated database
+func TestDB(t *testing.T) {
+	testdb, dsn := openTestDB(t)
+	defer testdb.Close()
+	dir, err := ioutil.TempDir("", "beaconpi-test-")
 	if err != nil {
-		log.Fatal("Failed to open x509 keypair", err)
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(dir)
+	servcert, servkey := writeTestCert(t, dir, "server", nil, nil)
+	writeTestCert(t, dir, "client", servcert, servkey)
 
-	conf := &tls.Config{
-		RootCAs:      certpool,
-		Certificates: []tls.Certificate{clientcert},
+	// Fresh identities so runs don't see each other's logs
+	id := randBase64(getRand(), 8)
+	edgeuuid := func(n byte) string {
+		var u Uuid
+		rand.Read(u[:15])
+		u[15] = n
+		return u.String()
 	}
-	port := DEFAULT_PORT
-	log.Println("Dialing localhost")
-	conn, err := tls.Dial("tcp", "localhost:"+port, conf)
+	scenario, err := readScenario(strings.NewReader(`{
+		"Rooms": [{"Name": "a", "Min": [0, 0], "Max": [5, 5]},
+			{"Name": "b", "Min": [5, 0], "Max": [10, 5]}],
+		"Edges": [{"Uuid": "` + edgeuuid(1) + `", "Position": [1, 1, 2]},
+			{"Uuid": "` + edgeuuid(2) + `", "Position": [9, 4, 2]}],
+		"Beacons": [{"Label": "` + id + `", "Uuid": "` + edgeuuid(3) + `",
+			"Trajectory": [{"Time": 0, "Position": [2, 2, 1]},
+				{"Time": 2, "Position": [8, 3, 1]}]}],
+		"Model": {"Noise": 2, "WallLoss": 5}
+	}`))
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
-	defer conn.Close()
+	if err = registerScenario(scenario, testdb); err != nil {
+		t.Fatal(err)
+	}
+
+	end := make(chan struct{})
+	defer close(end)
+	go StartServerConfig(ServerConfig{
+		X509cert:   filepath.Join(dir, "server.crt"),
+		X509key:    filepath.Join(dir, "server.key"),
+		Drivername: "postgres",
+		DSN:        dsn,
+	}, end)
+	time.Sleep(time.Second)
 
-	_, err = conn.Write(b)
+	clientcert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"),
+		filepath.Join(dir, "client.key"))
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err = storeGroundTruth(scenario, testdb, id, 0, start,
+		start.Add(3*time.Second), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	var points int
+	if err = testdb.QueryRow(`select count(*) from ground_truth
+		where walkthrough = $1`, id).Scan(&points); err != nil || points != 4 {
+		t.Fatalf("Stored %d ground truth points: %v", points, err)
+	}
+	if err = simulate(scenario, simConfig{
+		tlsconf: &tls.Config{
+			RootCAs:      LoadFileToCert(filepath.Join(dir, "server.crt")),
+			Certificates: []tls.Certificate{clientcert},
+		},
+		host:          "localhost:" + DEFAULT_PORT,
+		maxVersion:    CURRENT_VERSION,
+		timeoutBeacon: TIMEOUT_BEACON * time.Millisecond,
+		seed:          1,
+		duration:      3 * time.Second,
+	}, start); err != nil {
+		t.Fatal(err)
 	}
-	conn.CloseWrite()
 
-	data, err := ioutil.ReadAll(conn)
+	// Every edge saw the beacon as it walked past
+	deadline := start.Add(3*time.Second + SIM_FLUSH + 5*time.Second)
+	for {
+		var edges int
+		if err = testdb.QueryRow(`
+			select count(distinct l.edgenodeid)
+			from beacon_log as l, ibeacons as b
+			where l.beaconid = b.id and b.label = $1`, id).Scan(&edges); err != nil {
+			t.Fatal(err)
+		}
+		if edges == len(scenario.Edges) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Logs from %d of %d edges were stored", edges, len(scenario.Edges))
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// testExchange writes pack to a connection of handleConnection and returns
+// the response, it fails if a second response follows
+func testExchange(t *testing.T, conn net.Conn, pack *BeaconLogPacket) *BeaconResponsePacket {
+	data, err := pack.MarshalBinary()
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err = binary.Write(conn, binary.LittleEndian, uint32(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	var length uint32
+	if err = binary.Read(conn, binary.LittleEndian, &length); err != nil {
+		t.Fatal(err)
+	}
+	buff := new(bytes.Buffer)
+	if _, err = io.CopyN(buff, conn, int64(length)); err != nil {
+		t.Fatal(err)
+	}
+	var resp BeaconResponsePacket
+	if err = resp.UnmarshalBinary(buff.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if n, _ := conn.Read(make([]byte, 1)); n != 0 {
+		t.Fatalf("Second response followed %+v", resp)
+	}
+	return &resp
+}
+
+// TestControlCompleteResponse sends the result of a command and then logs
+// on one connection, each gets one response and the pending action is sent
+// with the second
+func TestControlCompleteResponse(t *testing.T) {
+	testdb, _ := openTestDB(t)
+	defer testdb.Close()
+	olddb, oldlogs := serverdb, logs
+	serverdb, logs = testdb, newLogWriter(dbLogStore{testdb}, 0, 0)
+	defer func() { serverdb, logs = olddb, oldlogs }()
+
+	var edge Uuid
+	rand.Read(edge[:])
+	var edgeid, controlid int
+	// The action is only sent with the response to logs
+	if err := testdb.QueryRow(`insert into edge_node (uuid, title, room, location,
+		pending_action) values ($1, 'control test', 'test', '(0, 0, 0)', $2)
+		returning id`, edge.String(), ACTION_RESTART).Scan(&edgeid); err != nil {
+		t.Fatal(err)
+	}
+	if err := testdb.QueryRow(`insert into control_commands (edgenodeid, data, status)
+		values ($1, '{"Op": "report-disk"}', $2) returning id`,
+		edgeid, CONTROL_STATUS_SENT).Scan(&controlid); err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	end := make(chan struct{})
+	defer close(end)
+	go handleConnection(server, end)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	version := []byte{CURRENT_VERSION}
+	if _, err := client.Write(version); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, version); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := testExchange(t, client, &BeaconLogPacket{
+		Flags:       CURRENT_VERSION | REQUEST_CONTROL_COMPLETE,
+		Uuid:        edge,
+		ControlData: strconv.Itoa(controlid) + "\n" + `{"Op": "report-disk", "Exit": 0}`,
+	})
+	if resp.Flags&(RESPONSE_INVALID|RESPONSE_INTERNAL_FAILURE|RESPONSE_RESTART) != 0 {
+		t.Fatalf("Completion was answered with flags %x", resp.Flags)
+	}
+	resp = testExchange(t, client, &BeaconLogPacket{
+		Flags: CURRENT_VERSION,
+		Uuid:  edge,
+	})
+	if resp.Flags&(RESPONSE_INVALID|RESPONSE_INTERNAL_FAILURE) != 0 ||
+		resp.Flags&RESPONSE_RESTART == 0 {
+		t.Fatalf("Logs were answered with flags %x", resp.Flags)
+	}
+	var status string
+	if err := testdb.QueryRow(`select status from control_commands where id = $1`,
+		controlid).Scan(&status); err != nil || status != CONTROL_STATUS_COMPLETED {
+		t.Fatalf("Command was %s: %v", status, err)
+	}
+}
+
+// TestControlStatus takes commands of an edge through sending, resending,
+// expiry, cancellation and completion
+func TestControlStatus(t *testing.T) {
+	testdb, _ := openTestDB(t)
+	defer testdb.Close()
+
+	var edge Uuid
+	rand.Read(edge[:])
+	var edgeid int
+	if err := testdb.QueryRow(`insert into edge_node (uuid, title, room, location)
+		values ($1, 'control status test', 'test', '(0, 0, 0)') returning id`,
+		edge.String()).Scan(&edgeid); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	lost := now.Add(-CONTROL_RESEND_AFTER - time.Minute)
+	expired := now.Add(-time.Minute)
+	insert := func(age time.Duration, status string, sent, expires *time.Time) int {
+		var id int
+		if err := testdb.QueryRow(`insert into control_commands
+			(edgenodeid, datetime, data, status, sent_at, expires_at)
+			values ($1, $2, '{"Op": "report-disk"}', $3, $4, $5) returning id`,
+			edgeid, now.Add(-age), status, sent, expires).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	// From oldest to newest, the oldest that can be sent goes first
+	running := insert(8*time.Minute, CONTROL_STATUS_SENT, &now, &expired)
+	lostexpired := insert(7*time.Minute, CONTROL_STATUS_SENT, &lost, &expired)
+	pendingexpired := insert(6*time.Minute, CONTROL_STATUS_PENDING, nil, &expired)
+	pending := insert(5*time.Minute, CONTROL_STATUS_PENDING, nil, nil)
+	resent := insert(4*time.Minute, CONTROL_STATUS_SENT, &lost, nil)
+	cancelled := insert(3*time.Minute, CONTROL_STATUS_PENDING, nil, nil)
+
+	packet := &BeaconLogPacket{Uuid: edge}
+	next := func(want int) {
+		data, err := dbGetControl(packet, testdb)
+		if err != nil || !strings.HasPrefix(data, strconv.Itoa(want)+"\n") {
+			t.Fatalf("Expected command %d to be sent, got %q: %v", want, data, err)
+		}
+	}
+	next(pending)
+	ids, err := dbCancelControls([]int{cancelled, pending}, testdb)
+	if err != nil || len(ids) != 1 || ids[0] != cancelled {
+		t.Fatalf("Cancelled %v: %v", ids, err)
+	}
+	next(resent)
+	if data, err := dbGetControl(packet, testdb); err == nil {
+		t.Fatalf("Command %q was sent again", data)
+	}
+
+	for id, result := range map[int]string{
+		pending: `{"Op": "report-disk", "Exit": 0}`,
+		resent:  `{"Op": "report-disk", "Exit": 1}`,
+	} {
+		packet.ControlData = strconv.Itoa(id) + "\n" + result
+		if err = dbCompleteControl(packet, testdb); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for id, want := range map[int]string{
+		running:        CONTROL_STATUS_SENT,
+		lostexpired:    CONTROL_STATUS_EXPIRED,
+		pendingexpired: CONTROL_STATUS_EXPIRED,
+		pending:        CONTROL_STATUS_COMPLETED,
+		resent:         CONTROL_STATUS_FAILED,
+		cancelled:      CONTROL_STATUS_CANCELLED,
+	} {
+		var status string
+		if err = testdb.QueryRow(`select status from control_commands where id = $1`,
+			id).Scan(&status); err != nil || status != want {
+			t.Errorf("Command %d was %s expected %s: %v", id, status, want, err)
+		}
+	}
+}
+
+// TestWriteLargeResponse writes an update to a client reading slower than
+// the whole response could be written within one write timeout
+func TestWriteLargeResponse(t *testing.T) {
+	data := make([]byte, 4<<20)
+	rand.Read(data)
+	server, client := net.Pipe()
+	defer client.Close()
+	go writeResponseAndClose(server, &BeaconResponsePacket{
+		Flags: CURRENT_VERSION | RESPONSE_UPDATE,
+		Data:  string(data),
+	}, true, CURRENT_VERSION)
+
+	start := time.Now()
+	var length uint32
+	if err := binary.Read(client, binary.LittleEndian, &length); err != nil {
+		t.Fatal(err)
+	}
+	buff := new(bytes.Buffer)
+	for buff.Len() < int(length) {
+		time.Sleep(20 * time.Millisecond)
+		if _, err := io.CopyN(buff, client, 32<<10); err != nil && err != io.EOF {
+			t.Fatalf("Read %d of %d bytes: %s", buff.Len(), length, err)
+		} else if err == io.EOF {
+			break
+		}
+	}
+	if time.Since(start) < RESPONSE_WRITE_TIMEOUT {
+		t.Fatalf("Response was read in %s", time.Since(start))
+	}
+	var resp BeaconResponsePacket
+	if err := resp.UnmarshalBinary(buff.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Flags&RESPONSE_UPDATE == 0 || resp.Data != string(data) {
+		t.Fatalf("Update of %d bytes was received as %d bytes with flags %x",
+			len(data), len(resp.Data), resp.Flags)
 	}
-	return data
 }
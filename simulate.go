@@ -0,0 +1,681 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Defaults of the scenario model
+	SIM_ADVERTISE_INTERVAL = 100 * time.Millisecond
+	SIM_TXPOWER            = -59
+	SIM_GAMMA              = 2.0
+	SIM_SENSITIVITY        = -100
+	// BLE adds up to 10ms of random delay to each advertisement
+	SIM_ADVERTISE_JITTER = 10 * time.Millisecond
+	// Distances are never shorter than this, in metres
+	SIM_MIN_DISTANCE = 0.1
+	// Time given to edges to send their last packets once the simulation
+	// ends
+	SIM_FLUSH = 2 * time.Second
+)
+
+// Scenario describes a simulated deployment, it is read from JSON.
+// Positions are x, y, z in metres.
+type Scenario struct {
+	Rooms   []SimRoom
+	Edges   []SimEdge
+	Beacons []SimBeacon
+	Model   SimModel
+}
+
+// SimRoom is a rectangular room
+type SimRoom struct {
+	Name string
+	// Opposite corners of the room, x and y
+	Min [2]float64
+	Max [2]float64
+}
+
+// SimEdge is a virtual edge node
+type SimEdge struct {
+	// Uuid of the edge, as given to -client-uuid
+	Uuid     string
+	Title    string
+	Position [3]float64
+	// Room of the edge, the room its position is in if empty
+	Room string
+	// Offset in dB added to every rssi the edge measures, the difference
+	// of its receiver to the others
+	Offset float64
+}
+
+// SimBeacon is a virtual beacon moving along a trajectory
+type SimBeacon struct {
+	Label string
+	Uuid  string
+	Major uint16
+	Minor uint16
+	// Frames advertised, ibeacon or altbeacon, ibeacon if empty
+	Type string
+	// Rssi at 1m advertised by the beacon, the model's if 0
+	TxPower int8
+	// Milliseconds between advertisements, 100 if 0
+	Interval int
+	// Positions over time, the beacon moves in a straight line between
+	// them and stays at the last one unless Loop is set
+	Trajectory []SimWaypoint
+	Loop       bool
+}
+
+// SimWaypoint is the position of a beacon at a time
+type SimWaypoint struct {
+	// Seconds since the start of the simulation
+	Time     float64
+	Position [3]float64
+}
+
+// SimModel is the log-distance path loss model of the rssi, the rssi at
+// distance d is TxPower - 10 * Gamma * log10(d) plus gaussian noise
+type SimModel struct {
+	// Rssi at 1m of beacons that don't set one
+	TxPower int8
+	Gamma   float64
+	// Standard deviation of the noise in dB
+	Noise float64
+	// Loss in dB between a beacon and an edge in different rooms
+	WallLoss float64
+	// Weakest rssi edges receive
+	Sensitivity float64
+	// Fraction of advertisements that are lost
+	DropRate float64
+}
+
+// LoadScenario reads and validates a scenario file
+func LoadScenario(fname string) (*Scenario, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open scenario")
+	}
+	defer f.Close()
+	return readScenario(f)
+}
+
+// readScenario decodes a scenario, filling in defaults
+func readScenario(r io.Reader) (*Scenario, error) {
+	var s Scenario
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, errors.Wrap(err, "Failed to decode scenario")
+	}
+	if s.Model.TxPower == 0 {
+		s.Model.TxPower = SIM_TXPOWER
+	}
+	if s.Model.Gamma == 0 {
+		s.Model.Gamma = SIM_GAMMA
+	}
+	if s.Model.Sensitivity == 0 {
+		s.Model.Sensitivity = SIM_SENSITIVITY
+	}
+	if s.Model.DropRate < 0 || s.Model.DropRate >= 1 {
+		return nil, errors.New("DropRate must be at least 0 and less than 1")
+	}
+	rooms := make(map[string]bool)
+	for _, r := range s.Rooms {
+		if r.Name == "" || rooms[r.Name] {
+			return nil, errors.Errorf("Room \"%s\" needs a unique name", r.Name)
+		}
+		rooms[r.Name] = true
+	}
+	if len(s.Edges) == 0 || len(s.Beacons) == 0 {
+		return nil, errors.New("Scenario needs edges and beacons")
+	}
+	for i := range s.Edges {
+		e := &s.Edges[i]
+		if _, err := UuidFromString(e.Uuid); err != nil {
+			return nil, errors.Wrapf(err, "Edge %d has an invalid uuid", i)
+		}
+		if e.Room == "" {
+			e.Room = s.roomAt(e.Position)
+		} else if !rooms[e.Room] {
+			return nil, errors.Errorf("Edge %d is in unknown room \"%s\"", i, e.Room)
+		}
+		if e.Title == "" {
+			e.Title = fmt.Sprintf("sim-edge-%d", i)
+		}
+	}
+	for i := range s.Beacons {
+		b := &s.Beacons[i]
+		if _, err := UuidFromString(b.Uuid); err != nil {
+			return nil, errors.Wrapf(err, "Beacon %d has an invalid uuid", i)
+		}
+		if b.Type != "" && b.Type != "ibeacon" && b.Type != "altbeacon" {
+			return nil, errors.Errorf("Beacon %d has unknown type \"%s\"", i, b.Type)
+		}
+		if len(b.Trajectory) == 0 {
+			return nil, errors.Errorf("Beacon %d has no trajectory", i)
+		}
+		for j := 1; j < len(b.Trajectory); j++ {
+			if b.Trajectory[j].Time <= b.Trajectory[j-1].Time {
+				return nil, errors.Errorf("Trajectory of beacon %d must go forward in time", i)
+			}
+		}
+		if b.TxPower == 0 {
+			b.TxPower = s.Model.TxPower
+		}
+		if b.Label == "" {
+			b.Label = fmt.Sprintf("sim-beacon-%d", i)
+		}
+	}
+	return &s, nil
+}
+
+// roomAt returns the name of the first room that contains p, empty if it
+// is in none
+func (s *Scenario) roomAt(p [3]float64) string {
+	for _, r := range s.Rooms {
+		if p[0] >= math.Min(r.Min[0], r.Max[0]) && p[0] <= math.Max(r.Min[0], r.Max[0]) &&
+			p[1] >= math.Min(r.Min[1], r.Max[1]) && p[1] <= math.Max(r.Min[1], r.Max[1]) {
+			return r.Name
+		}
+	}
+	return ""
+}
+
+// identity returns the beacon as it is registered and sent by edges
+func (b *SimBeacon) identity() BeaconData {
+	id := BeaconData{Major: b.Major, Minor: b.Minor}
+	id.Uuid, _ = UuidFromString(b.Uuid)
+	if b.Type == "altbeacon" {
+		id.Type = BEACON_ALTBEACON
+	}
+	return id
+}
+
+// interval returns the time between advertisements of the beacon
+func (b *SimBeacon) interval() time.Duration {
+	if b.Interval <= 0 {
+		return SIM_ADVERTISE_INTERVAL
+	}
+	return time.Duration(b.Interval) * time.Millisecond
+}
+
+// positionAt returns where the beacon is at elapsed since the start
+func (b *SimBeacon) positionAt(elapsed time.Duration) [3]float64 {
+	t := elapsed.Seconds()
+	path := b.Trajectory
+	first, last := path[0].Time, path[len(path)-1].Time
+	if b.Loop && last > first && t > last {
+		t = first + math.Mod(t-first, last-first)
+	}
+	if t <= first {
+		return path[0].Position
+	}
+	for i := 1; i < len(path); i++ {
+		if t > path[i].Time {
+			continue
+		}
+		f := (t - path[i-1].Time) / (path[i].Time - path[i-1].Time)
+		var p [3]float64
+		for k := range p {
+			p[k] = path[i-1].Position[k] + f*(path[i].Position[k]-path[i-1].Position[k])
+		}
+		return p
+	}
+	return path[len(path)-1].Position
+}
+
+// rssi returns the rssi edge measures from a beacon of txpower at p, ok is
+// false if the advertisement is lost
+func (m *SimModel) rssi(rng *rand.Rand, s *Scenario, edge *SimEdge,
+	txpower int8, p [3]float64) (rssi int16, ok bool) {
+	if m.DropRate > 0 && rng.Float64() < m.DropRate {
+		return 0, false
+	}
+	var d float64
+	for k := range p {
+		d += (p[k] - edge.Position[k]) * (p[k] - edge.Position[k])
+	}
+	d = math.Max(math.Sqrt(d), SIM_MIN_DISTANCE)
+	r := float64(txpower) - 10*m.Gamma*math.Log10(d) + edge.Offset +
+		rng.NormFloat64()*m.Noise
+	if s.roomAt(p) != edge.Room {
+		r -= m.WallLoss
+	}
+	if r < m.Sensitivity {
+		return 0, false
+	}
+	return int16(math.Round(math.Max(r, math.MinInt8))), true
+}
+
+// simAdvertisingData returns the advertising data the beacon sends
+func simAdvertisingData(b BeaconData, txpower int8) []byte {
+	ad := []byte{0x02, 0x01, 0x06}
+	if b.Type == BEACON_ALTBEACON {
+		ad = append(ad, 0x1B, AD_MANUFACTURER, 0x18, 0x01, 0xBE, 0xAC)
+	} else {
+		ad = append(ad, 0x1A, AD_MANUFACTURER, 0x4C, 0x00, 0x02, 0x15)
+	}
+	ad = append(ad, b.Uuid[:]...)
+	ad = append(ad, byte(b.Major>>8), byte(b.Major), byte(b.Minor>>8),
+		byte(b.Minor), byte(txpower))
+	if b.Type == BEACON_ALTBEACON {
+		// Reserved for the manufacturer
+		ad = append(ad, 0x00)
+	}
+	return ad
+}
+
+// simAdvertisingReport returns the HCI event of an LE advertising report
+// of a single advertisement
+func simAdvertisingReport(address [6]byte, data []byte, rssi int16) []byte {
+	params := []byte{EVT_LE_ADVERTISING_REPORT, 1,
+		// Non connectable undirected advertising from a random address
+		0x03, 0x01}
+	params = append(params, address[:]...)
+	params = append(params, byte(len(data)))
+	params = append(params, data...)
+	params = append(params, byte(int8(rssi)))
+	return append([]byte{HCI_EVENT_PKT, EVT_LE_META, byte(len(params))}, params...)
+}
+
+// simScanner is a bleScanner producing the advertisements an edge of a
+// scenario receives in real time
+type simScanner struct {
+	scenario *Scenario
+	edge     *SimEdge
+	rng      *rand.Rand
+	start    time.Time
+	// The scanner is exhausted at end, never if it is zero
+	end  time.Time
+	done chan struct{}
+	once sync.Once
+}
+
+// Scan implements bleScanner
+func (s *simScanner) Scan(events chan<- []byte) error {
+	next := make([]time.Time, len(s.scenario.Beacons))
+	data := make([][]byte, len(s.scenario.Beacons))
+	for i := range s.scenario.Beacons {
+		b := &s.scenario.Beacons[i]
+		next[i] = s.start.Add(time.Duration(s.rng.Int63n(int64(b.interval()))))
+		data[i] = simAdvertisingData(b.identity(), b.TxPower)
+	}
+	timer := time.NewTimer(0)
+	<-timer.C
+	defer timer.Stop()
+	for {
+		// Advertisements are sent in the order they are due
+		i := 0
+		for j := range next {
+			if next[j].Before(next[i]) {
+				i = j
+			}
+		}
+		if !s.end.IsZero() && next[i].After(s.end) {
+			return nil
+		}
+		timer.Reset(time.Until(next[i]))
+		select {
+		case <-s.done:
+			return nil
+		case <-timer.C:
+		}
+		b := &s.scenario.Beacons[i]
+		p := b.positionAt(next[i].Sub(s.start))
+		if rssi, ok := s.scenario.Model.rssi(s.rng, s.scenario, s.edge, b.TxPower, p); ok {
+			var address [6]byte
+			binary.LittleEndian.PutUint32(address[:], uint32(i))
+			address[5] = 0xC0
+			select {
+			case events <- simAdvertisingReport(address, data[i], rssi):
+			case <-s.done:
+				return nil
+			}
+		}
+		next[i] = next[i].Add(b.interval() +
+			time.Duration(s.rng.Int63n(int64(SIM_ADVERTISE_JITTER))))
+	}
+}
+
+// Close implements bleScanner
+func (s *simScanner) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+// simConfig is how the edges of a simulation connect to the server
+type simConfig struct {
+	tlsconf         *tls.Config
+	host            string
+	maxVersion      uint8
+	timeoutBeacon   time.Duration
+	aggregateWindow time.Duration
+	aggregateKalman bool
+	// Random numbers are repeatable if seed is not 0
+	seed int64
+	// The simulation ends after duration, never if it is 0
+	duration time.Duration
+}
+
+// simulate runs a clientLoop for every edge of the scenario fed by
+// simScanners, the edges keep running once their scanners are exhausted
+func simulate(s *Scenario, config simConfig, start time.Time) error {
+	var end time.Time
+	if config.duration > 0 {
+		end = start.Add(config.duration)
+	}
+	for i := range s.Edges {
+		e := &s.Edges[i]
+		uuid, _ := UuidFromString(e.Uuid)
+		rng := getRand()
+		if config.seed != 0 {
+			rng = rand.New(rand.NewSource(config.seed + int64(i)))
+		}
+		scanner := &simScanner{scenario: s, edge: e, rng: rng, start: start,
+			end: end, done: make(chan struct{})}
+		spool, err := openSpool("", SPOOL_MAX_SIZE, SPOOL_MAX_AGE)
+		if err != nil {
+			return err
+		}
+		client := &clientinfo{
+			tlsconf:              config.tlsconf,
+			host:                 config.host,
+			nodes:                make(map[string]struct{}),
+			uuid:                 uuid,
+			timeoutBeaconRefresh: TIMEOUT_BEACON_REFRESH * time.Millisecond,
+			timeoutBeacon:        config.timeoutBeacon,
+			newScanner:           func() (bleScanner, error) { return scanner, nil },
+			spool:                spool,
+			spoolMaxAge:          SPOOL_MAX_AGE,
+			maxVersion:           config.maxVersion,
+			allowRaw:             make(map[string]struct{}),
+			running:              make(map[int]struct{}),
+			control:              make(chan *BeaconLogPacket, PENDING_PACKETS),
+			aggregateWindow:      config.aggregateWindow,
+			aggregateKalman:      config.aggregateKalman,
+		}
+		go clientLoop(client)
+	}
+	return nil
+}
+
+// groundTruth calls fn with the position of every beacon of the scenario
+// each interval from start until end
+func (s *Scenario) groundTruth(start, end time.Time, interval time.Duration,
+	fn func(t time.Time, b *SimBeacon, p [3]float64) error) error {
+	for t := start; !t.After(end); t = t.Add(interval) {
+		for i := range s.Beacons {
+			b := &s.Beacons[i]
+			if err := fn(t, b, b.positionAt(t.Sub(start))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeGroundTruth writes the position and room of every beacon of the
+// scenario to w each interval from start until end as tab separated values
+func writeGroundTruth(s *Scenario, w io.Writer, start, end time.Time,
+	interval time.Duration) error {
+	if _, err := fmt.Fprintf(w, "\"datetime\"\t\"beacon\"\t\"x\"\t\"y\"\t\"z\"\t\"room\"\n"); err != nil {
+		return errors.Wrap(err, "Failed to write ground truth")
+	}
+	return s.groundTruth(start, end, interval,
+		func(t time.Time, b *SimBeacon, p [3]float64) error {
+			_, err := fmt.Fprintf(w, "\"%s\"\t\"%s\"\t%f\t%f\t%f\t\"%s\"\n",
+				t.Format(time.RFC3339Nano), b.Label, p[0], p[1], p[2], s.roomAt(p))
+			return errors.Wrap(err, "Failed to write ground truth")
+		})
+}
+
+// storeGroundTruth inserts the position and room of every beacon of the
+// scenario each interval from start until end into ground_truth as the
+// walkthrough, for the map with id mapid if it is not 0
+func storeGroundTruth(s *Scenario, db *sql.DB, walkthrough string, mapid int,
+	start, end time.Time, interval time.Duration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin transaction")
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`
+		insert into ground_truth
+		(beaconid, mapid, walkthrough, datetime, x, y, z, room)
+		select id, nullif($5, 0), $6, $7, $8, $9, $10, nullif($11, '')
+		from ibeacons
+		where uuid = $1 and major = $2 and minor = $3 and beacontype = $4`)
+	if err != nil {
+		return errors.Wrap(err, "Failed to prepare ground truth insert")
+	}
+	defer stmt.Close()
+	err = s.groundTruth(start, end, interval,
+		func(t time.Time, b *SimBeacon, p [3]float64) error {
+			id := b.identity()
+			_, err := stmt.Exec(id.Uuid.String(), id.Major, id.Minor, id.Type,
+				mapid, walkthrough, t, p[0], p[1], p[2], s.roomAt(p))
+			return errors.Wrapf(err, "Failed to insert ground truth of %s", b.Label)
+		})
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "Failed to commit ground truth")
+}
+
+// registerScenario adds the edges and beacons of the scenario to the
+// database, edges that exist are moved to their positions in the scenario
+func registerScenario(s *Scenario, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin transaction")
+	}
+	defer tx.Rollback()
+	for i := range s.Edges {
+		e := &s.Edges[i]
+		uuid, _ := UuidFromString(e.Uuid)
+		// The bias is the rssi the edge measures at 1m from a beacon with
+		// the model's tx power
+		if _, err = tx.Exec(`
+			insert into edge_node
+			(uuid, title, room, location, description, bias, gamma) values
+			($1, $2, $3, $4, 'Simulated edge', $5, $6)
+			on conflict (uuid) do update set
+			(title, room, location, bias, gamma) =
+			(excluded.title, excluded.room, excluded.location, excluded.bias,
+				excluded.gamma)`, uuid.String(), e.Title, e.Room,
+			fmt.Sprintf("(%g, %g, %g)", e.Position[0], e.Position[1], e.Position[2]),
+			float64(s.Model.TxPower)+e.Offset, s.Model.Gamma); err != nil {
+			return errors.Wrapf(err, "Failed to register edge %s", e.Title)
+		}
+		if _, err = tx.Exec(`
+			insert into edge_placements (edgenodeid, x, y, z)
+			select id, $2, $3, $4 from edge_node where uuid = $1
+			on conflict (edgenodeid) where map_id is null do update set
+			(x, y, z) = (excluded.x, excluded.y, excluded.z)`, uuid.String(),
+			e.Position[0], e.Position[1], e.Position[2]); err != nil {
+			return errors.Wrapf(err, "Failed to place edge %s", e.Title)
+		}
+	}
+	for i := range s.Beacons {
+		b := &s.Beacons[i]
+		id := b.identity()
+		if _, err = tx.Exec(`
+			insert into ibeacons
+			(label, uuid, major, minor, beacontype, txpower) values
+			($1, $2, $3, $4, $5, $6)
+			on conflict (uuid, major, minor, beacontype) do update set
+			(label, txpower) = (excluded.label, excluded.txpower)`,
+			b.Label, id.Uuid.String(), id.Major, id.Minor, id.Type,
+			b.TxPower); err != nil {
+			return errors.Wrapf(err, "Failed to register beacon %s", b.Label)
+		}
+	}
+	return errors.Wrap(tx.Commit(), "Failed to commit scenario")
+}
+
+// StartSimulator is the main entry point of the simulator, it runs the
+// virtual edges of a scenario against a server
+func StartSimulator() {
+	var (
+		scenariofile    string
+		servcertfile    string
+		clientcertfile  string
+		clientkeyfile   string
+		servhost        string
+		servport        string
+		duration        time.Duration
+		seed            int64
+		protocolVersion int
+		timeoutBeacon   int
+		aggregateWindow time.Duration
+		aggregateKalman bool
+		truthfile       string
+		truthInterval   time.Duration
+		walkthrough     string
+		truthMap        int
+		register        bool
+		drivername      string
+		dsn             string
+		logDebug        bool
+	)
+	flag.StringVar(&scenariofile, "scenario", "", "Required: JSON file describing the rooms, edges, beacons and path loss model")
+	flag.StringVar(&servcertfile, "serv-cert-file", "", "Has trusted keys")
+	flag.StringVar(&clientcertfile, "client-cert-file", "", "certificate all virtual edges use")
+	flag.StringVar(&clientkeyfile, "client-key-file", "", "")
+	flag.StringVar(&servhost, "serv-host", "localhost", "")
+	flag.StringVar(&servport, "serv-port", DEFAULT_PORT, "")
+	flag.DurationVar(&duration, "duration", time.Minute, "time to simulate, 0 runs until killed")
+	flag.Int64Var(&seed, "seed", 0, "seed of the noise, 0 picks a random one")
+	flag.IntVar(&protocolVersion, "protocol-version", CURRENT_VERSION, "highest protocol version the edges use")
+	flag.IntVar(&timeoutBeacon, "timeout-beacon", TIMEOUT_BEACON, "timeout for beacon sightings before pushing to the server")
+	flag.DurationVar(&aggregateWindow, "aggregate-window", 0, "window the edges aggregate the rssi of each beacon over, 0 sends every sighting")
+	flag.BoolVar(&aggregateKalman, "aggregate-kalman", false, "also send the Kalman filtered rssi of aggregated beacons")
+	flag.StringVar(&truthfile, "truth-file", "", "file to write the true positions of the beacons to")
+	flag.DurationVar(&truthInterval, "truth-interval", time.Second, "time between true positions in -truth-file")
+	flag.StringVar(&walkthrough, "walkthrough", "", "store the true positions of the beacons every -truth-interval in ground_truth as this walk-through")
+	flag.IntVar(&truthMap, "truth-map", 0, "id of the map the ground truth of -walkthrough is for, 0 for every map")
+	flag.BoolVar(&register, "register", false, "add the edges and beacons of the scenario to the database first")
+	flag.StringVar(&drivername, "db-driver-name", "postgres", "database driver name used by -register and -walkthrough")
+	flag.StringVar(&dsn, "db-datasource-name", "", "database datasource name used by -register and -walkthrough")
+	flag.BoolVar(&logDebug, "debug", false, "enable more logging")
+	flag.Parse()
+
+	if logDebug {
+		log.SetLevel(log.DebugLevel)
+	}
+	if scenariofile == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if protocolVersion < 1 || protocolVersion > CURRENT_VERSION {
+		log.Fatalf("Protocol version must be between 1 and %d", CURRENT_VERSION)
+	}
+	if (truthfile != "" || walkthrough != "") && duration == 0 {
+		log.Fatal("Ground truth needs a duration")
+	}
+	scenario, err := LoadScenario(scenariofile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if register {
+		dbconfig := dbHandler{drivername, dsn}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Fatal("Failed to open database: ", err)
+		}
+		err = registerScenario(scenario, db)
+		db.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Registered %d edges and %d beacons", len(scenario.Edges),
+			len(scenario.Beacons))
+	}
+
+	certpool := LoadFileToCert(servcertfile)
+	if certpool == nil {
+		log.Fatal("Something happened while loading the certfile")
+	}
+	clientcert, err := tls.LoadX509KeyPair(clientcertfile, clientkeyfile)
+	if err != nil {
+		log.Fatal("Failed to open x509 keypair", err)
+	}
+
+	start := time.Now()
+	config := simConfig{
+		tlsconf: &tls.Config{
+			RootCAs:      certpool,
+			Certificates: []tls.Certificate{clientcert},
+		},
+		host:            servhost + ":" + servport,
+		maxVersion:      uint8(protocolVersion),
+		timeoutBeacon:   time.Duration(timeoutBeacon) * time.Millisecond,
+		aggregateWindow: aggregateWindow,
+		aggregateKalman: aggregateKalman,
+		seed:            seed,
+		duration:        duration,
+	}
+	if err = simulate(scenario, config, start); err != nil {
+		log.Fatal(err)
+	}
+	if truthfile != "" {
+		f, err := os.Create(truthfile)
+		if err != nil {
+			log.Fatal("Failed to create ground truth file: ", err)
+		}
+		err = writeGroundTruth(scenario, f, start, start.Add(duration), truthInterval)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if walkthrough != "" {
+		dbconfig := dbHandler{drivername, dsn}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Fatal("Failed to open database: ", err)
+		}
+		err = storeGroundTruth(scenario, db, walkthrough, truthMap, start,
+			start.Add(duration), truthInterval)
+		db.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if duration == 0 {
+		select {}
+	}
+	time.Sleep(time.Until(start.Add(duration + SIM_FLUSH)))
+	log.Info("Simulation finished")
+}
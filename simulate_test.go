@@ -0,0 +1,103 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testScenario = `{
+	"Rooms": [{"Name": "ward", "Min": [0, 0], "Max": [10, 10]}],
+	"Edges": [{"Uuid": "00112233445566778899aabbccddeeff", "Position": [0, 0, 0]}],
+	"Beacons": [
+		{"Uuid": "9566c74d-1003-7c4d-7bbb-0407d1e2c649", "Major": 6, "Minor": 25,
+			"Interval": 20, "Loop": true,
+			"Trajectory": [{"Time": 0, "Position": [1, 0, 0]},
+				{"Time": 10, "Position": [11, 0, 0]}]},
+		{"Uuid": "9566c74d-1003-7c4d-7bbb-0407d1e2c649", "Major": 7, "Minor": 1,
+			"Type": "altbeacon", "TxPower": -65, "Interval": 20,
+			"Trajectory": [{"Time": 0, "Position": [0, 10, 0]}]}
+	]
+}`
+
+func TestScenarioTrajectory(t *testing.T) {
+	s, err := readScenario(strings.NewReader(testScenario))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &s.Beacons[0]
+	for _, c := range []struct {
+		elapsed time.Duration
+		x       float64
+	}{{0, 1}, {5 * time.Second, 6}, {10 * time.Second, 11}, {15 * time.Second, 6}} {
+		if p := b.positionAt(c.elapsed); p[0] != c.x {
+			t.Errorf("Beacon at %s was at %v expected x of %f", c.elapsed, p, c.x)
+		}
+	}
+	if s.roomAt(b.positionAt(10*time.Second)) != "" || s.Edges[0].Room != "ward" {
+		t.Fatal("Rooms were not found")
+	}
+	if s.Beacons[0].TxPower != SIM_TXPOWER || s.Beacons[1].TxPower != -65 {
+		t.Fatal("Tx power defaults were not applied")
+	}
+}
+
+func TestSimScanner(t *testing.T) {
+	s, err := readScenario(strings.NewReader(testScenario))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	scanner := &simScanner{scenario: s, edge: &s.Edges[0],
+		rng: rand.New(rand.NewSource(1)), start: start,
+		end: start.Add(200 * time.Millisecond), done: make(chan struct{})}
+	events := make(chan []byte, 1024)
+	if err = scanner.Scan(events); err != nil {
+		t.Fatal(err)
+	}
+	close(events)
+
+	state := newAdvDecoderState(nil)
+	seen := make(map[uint16]int)
+	for pkt := range events {
+		advs, err := decodeLEAdvertisingReports(pkt)
+		if err != nil || len(advs) != 1 {
+			t.Fatalf("Event %x was not an advertising report", pkt)
+		}
+		rec, ok := state.decode(advs[0])
+		if !ok {
+			t.Fatalf("Advertisement %x was not decoded", advs[0].Data)
+		}
+		seen[rec.Major]++
+		// Without noise the rssi follows the path loss model exactly, the
+		// first beacon moves from 1m to 1.2m
+		switch {
+		case rec.Major == 6 && (advs[0].Rssi > SIM_TXPOWER || advs[0].Rssi < SIM_TXPOWER-2 ||
+			rec.TxPower != SIM_TXPOWER):
+			t.Fatalf("Beacon near 1m had rssi %d and tx power %d", advs[0].Rssi, rec.TxPower)
+		case rec.Major == 7 && (advs[0].Rssi != -85 || rec.Type != BEACON_ALTBEACON):
+			t.Fatalf("Beacon at 10m had rssi %d and type %d", advs[0].Rssi, rec.Type)
+		}
+	}
+	// Every 20ms with up to 10ms of jitter over 200ms
+	if seen[6] < 6 || seen[7] < 6 {
+		t.Fatalf("Advertisements seen were %v", seen)
+	}
+}
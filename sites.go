@@ -0,0 +1,220 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// metricsserv builds cause problems with other binaries due to inclusion
+// of packages that require python3
+// +build metrics
+
+package beaconpi
+
+import (
+	"encoding/json"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// getSites returns every site with the ids of its beacons and edges
+func getSites() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+
+		rows, err := db.Query(`
+			select s.id, s.name, coalesce(s.description, ''),
+				array(select beaconid from beacon_sites where siteid = s.id order by beaconid),
+				array(select edgenodeid from edge_sites where siteid = s.id order by edgenodeid)
+			from sites as s
+			order by s.name`)
+		if err != nil {
+			log.Errorf("Failed while quering sites %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer rows.Close()
+		type site struct {
+			Id          int
+			Name        string
+			Description string
+			Beacons     []int64
+			Edges       []int64
+		}
+		outdata := []site{}
+		for rows.Next() {
+			var s site
+			if err = rows.Scan(&s.Id, &s.Name, &s.Description,
+				(*pq.Int64Array)(&s.Beacons), (*pq.Int64Array)(&s.Edges)); err != nil {
+				log.Errorf("Failed to scan sites in GetSites %s", err)
+				http.Error(w, "Server failure", 500)
+				return
+			}
+			outdata = append(outdata, s)
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Sites": outdata,
+		})
+	})
+}
+
+// modSite creates, changes or removes a site, removing a site removes its
+// assignments
+func modSite() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Id          int
+			Name        string
+			Description string
+			Option      string
+		}{}
+		dec := json.NewDecoder(req.Body)
+		err := dec.Decode(&input)
+		if err != nil {
+			log.Infof("Failed to decode json request in ModSite %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if input.Option != "rem" {
+			if err = validateLen(nil, input.Name, "Name", 1); err != nil {
+				log.Infof("Failed validation %s", err)
+				http.Error(w, "Invalid Request", 400)
+				return
+			}
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		switch input.Option {
+		case "new":
+			err = db.QueryRow(`insert into sites (name, description) values ($1, $2)
+					returning id`, input.Name, input.Description).Scan(&input.Id)
+		case "mod":
+			_, err = db.Exec(`update sites set (name, description) = ($1, $2)
+					where id = $3`, input.Name, input.Description, input.Id)
+		case "rem":
+			_, err = db.Exec(`delete from sites where id = $1`, input.Id)
+		default:
+			log.Infof("Option invalid given \"%s\"", input.Option)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if err != nil {
+			log.Infof("Failed operation on DB %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Success": true,
+			"Id":      input.Id,
+		})
+	})
+}
+
+// assignSite adds beacons and edges to a site, removes them from it or
+// replaces its assignments with them
+func assignSite() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Site    int
+			Beacons []int
+			Edges   []int
+			// add, rem or set
+			Option string
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in AssignSite %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
+		beacons, edges := pq.Array(input.Beacons), pq.Array(input.Edges)
+		type statement struct {
+			query string
+			args  []interface{}
+		}
+		var statements []statement
+		switch input.Option {
+		case "set":
+			statements = []statement{
+				{`delete from beacon_sites where siteid = $1`, []interface{}{input.Site}},
+				{`delete from edge_sites where siteid = $1`, []interface{}{input.Site}},
+			}
+			fallthrough
+		case "add":
+			statements = append(statements,
+				statement{`insert into beacon_sites (siteid, beaconid)
+					select $1, unnest($2::int[]) on conflict do nothing`,
+					[]interface{}{input.Site, beacons}},
+				statement{`insert into edge_sites (siteid, edgenodeid)
+					select $1, unnest($2::int[]) on conflict do nothing`,
+					[]interface{}{input.Site, edges}})
+		case "rem":
+			statements = []statement{
+				{`delete from beacon_sites where siteid = $1 and beaconid = any($2::int[])`,
+					[]interface{}{input.Site, beacons}},
+				{`delete from edge_sites where siteid = $1 and edgenodeid = any($2::int[])`,
+					[]interface{}{input.Site, edges}},
+			}
+		default:
+			log.Infof("Option invalid given \"%s\"", input.Option)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		tx, err := db.Begin()
+		if err != nil {
+			log.Errorf("Failed to begin transaction %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer tx.Rollback()
+		for _, st := range statements {
+			if _, err = tx.Exec(st.query, st.args...); err != nil {
+				log.Infof("Failed operation on DB %s", err)
+				http.Error(w, "Invalid Request", 400)
+				return
+			}
+		}
+		if err = tx.Commit(); err != nil {
+			log.Errorf("Failed to commit site assignment %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Success": true,
+		})
+	})
+}
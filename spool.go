@@ -0,0 +1,595 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	SPOOL_MAX_SIZE = 64 << 20
+	SPOOL_MAX_AGE  = 24 * time.Hour
+	// Segments are a fraction of the spool size so the oldest can be
+	// dropped when the spool is full
+	SPOOL_SEGMENTS         = 16
+	SPOOL_SEGMENT_MIN      = 64 << 10
+	SPOOL_SEGMENT_MAX      = 4 << 20
+	SPOOL_RECORD_HEADER    = 16
+	SPOOL_ACK_FILE         = "ack"
+	SPOOL_ACK_SAVE_RECORDS = 32
+	SPOOL_ACK_SAVE_TIME    = time.Second
+)
+
+// spoolStats counts records moving through a spool
+type spoolStats struct {
+	// Records written to the spool
+	Spooled uint64
+	// Records acknowledged by the server after being spooled
+	Replayed uint64
+	// Records dropped because they were too old, the spool was full or
+	// the server rejected them
+	DroppedAge      uint64
+	DroppedSize     uint64
+	DroppedRejected uint64
+	// Records and bytes currently spooled
+	Pending int
+	Bytes   int64
+}
+
+func (s spoolStats) String() string {
+	return fmt.Sprintf("%d pending (%d bytes), %d spooled, %d replayed, "+
+		"%d dropped (age %d, size %d, rejected %d)", s.Pending, s.Bytes,
+		s.Spooled, s.Replayed, s.DroppedAge+s.DroppedSize+s.DroppedRejected,
+		s.DroppedAge, s.DroppedSize, s.DroppedRejected)
+}
+
+// packetSpool is a bounded FIFO of marshalled packets that could not be
+// sent to the server yet
+type packetSpool interface {
+	// Append adds a record to the end of the spool
+	Append(data []byte) error
+	// Peek returns the oldest record and the time it was spooled, io.EOF
+	// is returned if the spool is empty
+	Peek() ([]byte, time.Time, error)
+	// Ack removes the oldest record once the server acknowledged it
+	Ack() error
+	// Drop removes the oldest record without sending it, rejected counts it
+	// as rejected by the server rather than too old
+	Drop(rejected bool) error
+	Len() int
+	Stats() spoolStats
+	Close() error
+}
+
+// openSpool returns a spool in dir or in memory if dir is empty
+func openSpool(dir string, maxSize int64, maxAge time.Duration) (packetSpool, error) {
+	if dir == "" {
+		return &memorySpool{maxSize: maxSize, maxAge: maxAge}, nil
+	}
+	return openDiskSpool(dir, maxSize, maxAge)
+}
+
+// memorySpool keeps records in memory, they are lost if the client exits
+type memorySpool struct {
+	sync.Mutex
+	stats   spoolStats
+	maxSize int64
+	maxAge  time.Duration
+	records []spoolRecord
+}
+
+type spoolRecord struct {
+	data    []byte
+	spooled time.Time
+}
+
+// Append implements packetSpool
+func (s *memorySpool) Append(data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if int64(len(data)) > s.maxSize {
+		s.stats.DroppedSize++
+		return errors.New("Record is larger than the spool")
+	}
+	now := time.Now()
+	for len(s.records) > 0 && (s.stats.Bytes+int64(len(data)) > s.maxSize ||
+		now.Sub(s.records[0].spooled) > s.maxAge) {
+		if now.Sub(s.records[0].spooled) > s.maxAge {
+			s.stats.DroppedAge++
+		} else {
+			s.stats.DroppedSize++
+		}
+		s.pop()
+	}
+	s.records = append(s.records, spoolRecord{data, now})
+	s.stats.Bytes += int64(len(data))
+	s.stats.Spooled++
+	return nil
+}
+
+func (s *memorySpool) pop() {
+	s.stats.Bytes -= int64(len(s.records[0].data))
+	s.records[0] = spoolRecord{}
+	s.records = s.records[1:]
+}
+
+// Peek implements packetSpool
+func (s *memorySpool) Peek() ([]byte, time.Time, error) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.records) == 0 {
+		return nil, time.Time{}, io.EOF
+	}
+	return s.records[0].data, s.records[0].spooled, nil
+}
+
+// Ack implements packetSpool
+func (s *memorySpool) Ack() error {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.records) == 0 {
+		return io.EOF
+	}
+	s.pop()
+	s.stats.Replayed++
+	return nil
+}
+
+// Drop implements packetSpool
+func (s *memorySpool) Drop(rejected bool) error {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.records) == 0 {
+		return io.EOF
+	}
+	s.pop()
+	if rejected {
+		s.stats.DroppedRejected++
+	} else {
+		s.stats.DroppedAge++
+	}
+	return nil
+}
+
+// Len implements packetSpool
+func (s *memorySpool) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.records)
+}
+
+// Stats implements packetSpool
+func (s *memorySpool) Stats() spoolStats {
+	s.Lock()
+	defer s.Unlock()
+	st := s.stats
+	st.Pending = len(s.records)
+	return st
+}
+
+// Close implements packetSpool
+func (s *memorySpool) Close() error {
+	return nil
+}
+
+// spoolSegment is one append only file of a diskSpool
+type spoolSegment struct {
+	id   uint64
+	size int64
+	// Records in the segment which have not been read
+	records int
+	// Time the newest record was spooled
+	last time.Time
+}
+
+func (seg *spoolSegment) name() string {
+	return fmt.Sprintf("%016x.seg", seg.id)
+}
+
+// diskSpool is an append only log of segments in a directory. Each record
+// is framed by its length, CRC-32 and the time it was spooled so a record
+// torn by a crash is detected and discarded. The read position is saved
+// to an ack file, records acknowledged after the last save may be sent
+// twice after a crash.
+type diskSpool struct {
+	sync.Mutex
+	stats       spoolStats
+	dir         string
+	maxSize     int64
+	maxAge      time.Duration
+	segmentSize int64
+	// Oldest first, the last segment is the one written to
+	segments   []*spoolSegment
+	writer     *os.File
+	reader     *os.File
+	readOffset int64
+	// Size of the record returned by Peek
+	peekSize    int64
+	unsavedAcks int
+	lastSave    time.Time
+}
+
+func openDiskSpool(dir string, maxSize int64, maxAge time.Duration) (*diskSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "Failed to create spool directory")
+	}
+	s := &diskSpool{
+		dir:         dir,
+		maxSize:     maxSize,
+		maxAge:      maxAge,
+		segmentSize: maxSize / SPOOL_SEGMENTS,
+		lastSave:    time.Now(),
+	}
+	if s.segmentSize < SPOOL_SEGMENT_MIN {
+		s.segmentSize = SPOOL_SEGMENT_MIN
+	} else if s.segmentSize > SPOOL_SEGMENT_MAX {
+		s.segmentSize = SPOOL_SEGMENT_MAX
+	}
+
+	var ackid uint64
+	var ackoffset int64
+	if b, err := ioutil.ReadFile(filepath.Join(dir, SPOOL_ACK_FILE)); err == nil {
+		if _, err = fmt.Sscanf(string(b), "%x %d", &ackid, &ackoffset); err != nil {
+			return nil, errors.Wrap(err, "Spool ack file is corrupt")
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "Failed to read spool ack file")
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list spool segments")
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		seg := new(spoolSegment)
+		if _, err := fmt.Sscanf(filepath.Base(name), "%016x.seg", &seg.id); err != nil {
+			continue
+		}
+		if seg.id < ackid {
+			os.Remove(name)
+			continue
+		}
+		var start int64
+		if seg.id == ackid {
+			start = ackoffset
+		}
+		if err := s.recoverSegment(seg, start); err != nil {
+			return nil, err
+		}
+		if seg.id == ackid {
+			s.readOffset = start
+		}
+		s.segments = append(s.segments, seg)
+		s.stats.Bytes += seg.size
+		s.stats.Pending += seg.records
+	}
+	return s, nil
+}
+
+// recoverSegment counts the records after start in seg and truncates the
+// segment after the last complete record
+func (s *diskSpool) recoverSegment(seg *spoolSegment, start int64) error {
+	f, err := os.OpenFile(filepath.Join(s.dir, seg.name()), os.O_RDWR, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Failed to open spool segment")
+	}
+	defer f.Close()
+	var offset int64
+	for {
+		n, spooled, err := readSpoolRecord(f, offset, nil)
+		if err != nil {
+			break
+		}
+		if offset >= start {
+			seg.records++
+		}
+		seg.last = spooled
+		offset += n
+	}
+	seg.size = offset
+	if err = f.Truncate(offset); err != nil {
+		return errors.Wrap(err, "Failed to truncate spool segment")
+	}
+	return nil
+}
+
+// readSpoolRecord reads the record at offset of f into data if it is not
+// nil, returning the size of the record including its header
+func readSpoolRecord(f *os.File, offset int64, data *[]byte) (int64, time.Time, error) {
+	header := make([]byte, SPOOL_RECORD_HEADER)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return 0, time.Time{}, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	sum := binary.LittleEndian.Uint32(header[4:8])
+	spooled := time.Unix(0, int64(binary.LittleEndian.Uint64(header[8:16])))
+	if length > MAX_SIZE_V2 {
+		return 0, time.Time{}, errors.New("Spool record length is corrupt")
+	}
+	buff := make([]byte, length)
+	if _, err := f.ReadAt(buff, offset+SPOOL_RECORD_HEADER); err != nil {
+		return 0, time.Time{}, err
+	}
+	if crc32.ChecksumIEEE(buff) != sum {
+		return 0, time.Time{}, errors.New("Spool record checksum failed")
+	}
+	if data != nil {
+		*data = buff
+	}
+	return SPOOL_RECORD_HEADER + int64(length), spooled, nil
+}
+
+// Append implements packetSpool
+func (s *diskSpool) Append(data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	recsize := int64(SPOOL_RECORD_HEADER + len(data))
+	if recsize > s.maxSize {
+		s.stats.DroppedSize++
+		return errors.New("Record is larger than the spool")
+	}
+	now := time.Now()
+	for len(s.segments) > 0 {
+		oldest := s.segments[0]
+		if now.Sub(oldest.last) > s.maxAge {
+			s.stats.DroppedAge += uint64(oldest.records)
+		} else if s.stats.Bytes+recsize > s.maxSize {
+			s.stats.DroppedSize += uint64(oldest.records)
+		} else {
+			break
+		}
+		if err := s.removeOldest(); err != nil {
+			return err
+		}
+	}
+
+	if s.writer == nil || s.segments[len(s.segments)-1].size+recsize > s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	seg := s.segments[len(s.segments)-1]
+	buff := make([]byte, recsize)
+	binary.LittleEndian.PutUint32(buff[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(buff[4:8], crc32.ChecksumIEEE(data))
+	binary.LittleEndian.PutUint64(buff[8:16], uint64(now.UnixNano()))
+	copy(buff[SPOOL_RECORD_HEADER:], data)
+	if _, err := s.writer.Write(buff); err != nil {
+		// Drop anything partially written so the next append is framed
+		s.writer.Truncate(seg.size)
+		return errors.Wrap(err, "Failed to write spool record")
+	}
+	if err := s.writer.Sync(); err != nil {
+		return errors.Wrap(err, "Failed to sync spool segment")
+	}
+	seg.size += recsize
+	seg.records++
+	seg.last = now
+	s.stats.Bytes += recsize
+	s.stats.Pending++
+	s.stats.Spooled++
+	return nil
+}
+
+// rotate starts a new segment for writing
+func (s *diskSpool) rotate() error {
+	var id uint64 = 1
+	if len(s.segments) > 0 {
+		last := s.segments[len(s.segments)-1]
+		id = last.id + 1
+		if s.writer != nil {
+			s.writer.Close()
+			s.writer = nil
+		}
+		// A fully read segment is no longer needed once it is not written
+		if len(s.segments) == 1 && s.readOffset >= last.size {
+			if err := s.removeOldest(); err != nil {
+				return err
+			}
+		}
+	}
+	seg := &spoolSegment{id: id}
+	f, err := os.OpenFile(filepath.Join(s.dir, seg.name()),
+		os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create spool segment")
+	}
+	s.writer = f
+	s.segments = append(s.segments, seg)
+	s.syncDir()
+	return nil
+}
+
+// removeOldest deletes the oldest segment and saves the read position
+func (s *diskSpool) removeOldest() error {
+	seg := s.segments[0]
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	if len(s.segments) == 1 && s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+	if err := os.Remove(filepath.Join(s.dir, seg.name())); err != nil {
+		return errors.Wrap(err, "Failed to remove spool segment")
+	}
+	s.stats.Bytes -= seg.size
+	s.stats.Pending -= seg.records
+	s.segments = s.segments[1:]
+	s.readOffset = 0
+	s.peekSize = 0
+	return s.saveAck()
+}
+
+// saveAck atomically records the read position
+func (s *diskSpool) saveAck() error {
+	id := uint64(0)
+	if len(s.segments) > 0 {
+		id = s.segments[0].id
+	}
+	tmp := filepath.Join(s.dir, SPOOL_ACK_FILE+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create spool ack file")
+	}
+	fmt.Fprintf(f, "%x %d\n", id, s.readOffset)
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "Failed to sync spool ack file")
+	}
+	f.Close()
+	if err = os.Rename(tmp, filepath.Join(s.dir, SPOOL_ACK_FILE)); err != nil {
+		return errors.Wrap(err, "Failed to save spool ack file")
+	}
+	s.syncDir()
+	s.unsavedAcks = 0
+	s.lastSave = time.Now()
+	return nil
+}
+
+// syncDir makes created and removed files durable
+func (s *diskSpool) syncDir() {
+	if d, err := os.Open(s.dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Peek implements packetSpool
+func (s *diskSpool) Peek() ([]byte, time.Time, error) {
+	s.Lock()
+	defer s.Unlock()
+	for len(s.segments) > 0 {
+		seg := s.segments[0]
+		if seg.records == 0 {
+			// Fully read, only the segment being written is kept
+			if len(s.segments) == 1 {
+				break
+			}
+			if err := s.removeOldest(); err != nil {
+				return nil, time.Time{}, err
+			}
+			continue
+		}
+		if s.reader == nil {
+			f, err := os.Open(filepath.Join(s.dir, seg.name()))
+			if err != nil {
+				return nil, time.Time{}, errors.Wrap(err, "Failed to open spool segment")
+			}
+			s.reader = f
+		}
+		var data []byte
+		n, spooled, err := readSpoolRecord(s.reader, s.readOffset, &data)
+		if err != nil {
+			// The rest of the segment can't be framed
+			s.stats.DroppedSize += uint64(seg.records)
+			s.stats.Pending -= seg.records
+			seg.records = 0
+			s.readOffset = seg.size
+			continue
+		}
+		s.peekSize = n
+		return data, spooled, nil
+	}
+	return nil, time.Time{}, io.EOF
+}
+
+// advance moves past the record returned by Peek
+func (s *diskSpool) advance() error {
+	if s.peekSize == 0 {
+		return errors.New("Spool record was not peeked")
+	}
+	seg := s.segments[0]
+	s.readOffset += s.peekSize
+	s.peekSize = 0
+	seg.records--
+	s.stats.Pending--
+	if seg.records == 0 && len(s.segments) > 1 {
+		return s.removeOldest()
+	}
+	s.unsavedAcks++
+	if s.unsavedAcks >= SPOOL_ACK_SAVE_RECORDS ||
+		time.Since(s.lastSave) > SPOOL_ACK_SAVE_TIME {
+		return s.saveAck()
+	}
+	return nil
+}
+
+// Ack implements packetSpool
+func (s *diskSpool) Ack() error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.advance(); err != nil {
+		return err
+	}
+	s.stats.Replayed++
+	return nil
+}
+
+// Drop implements packetSpool
+func (s *diskSpool) Drop(rejected bool) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.advance(); err != nil {
+		return err
+	}
+	if rejected {
+		s.stats.DroppedRejected++
+	} else {
+		s.stats.DroppedAge++
+	}
+	return nil
+}
+
+// Len implements packetSpool
+func (s *diskSpool) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.stats.Pending
+}
+
+// Stats implements packetSpool
+func (s *diskSpool) Stats() spoolStats {
+	s.Lock()
+	defer s.Unlock()
+	return s.stats
+}
+
+// Close implements packetSpool
+func (s *diskSpool) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.reader != nil {
+		s.reader.Close()
+	}
+	if s.writer != nil {
+		s.writer.Close()
+	}
+	return s.saveAck()
+}
@@ -0,0 +1,195 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskSpoolReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openDiskSpool(dir, SPOOL_MAX_SIZE, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+	for _, r := range records {
+		if err = s.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _, err := s.Peek()
+	if err != nil || !bytes.Equal(data, records[0]) {
+		t.Fatalf("Peek returned %q, %v", data, err)
+	}
+	if err = s.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Simulate a record torn by a crash
+	f, err := os.OpenFile(filepath.Join(dir, "0000000000000001.seg"),
+		os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0xff, 0, 0, 0, 1, 2})
+	f.Close()
+
+	s, err = openDiskSpool(dir, SPOOL_MAX_SIZE, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Len() != 2 {
+		t.Fatalf("Expected 2 records after reopening, got %d", s.Len())
+	}
+	for _, r := range records[1:] {
+		data, _, err = s.Peek()
+		if err != nil || !bytes.Equal(data, r) {
+			t.Fatalf("Peek returned %q, %v expected %q", data, err, r)
+		}
+		s.Ack()
+	}
+	if _, _, err = s.Peek(); err != io.EOF {
+		t.Fatalf("Expected empty spool, got %v", err)
+	}
+	if err = s.Append([]byte("four")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _, _ = s.Peek(); string(data) != "four" {
+		t.Fatalf("Append after torn record returned %q", data)
+	}
+}
+
+func TestDiskSpoolLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openDiskSpool(dir, 4*SPOOL_SEGMENT_MIN, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	record := make([]byte, 1000)
+	for i := 0; i < 1000; i++ {
+		record[0] = byte(i)
+		if err = s.Append(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := s.Stats()
+	if stats.Bytes > 4*SPOOL_SEGMENT_MIN {
+		t.Errorf("Spool grew to %d bytes", stats.Bytes)
+	}
+	if stats.DroppedSize == 0 || uint64(stats.Pending)+stats.DroppedSize != 1000 {
+		t.Errorf("Unexpected stats %s", stats)
+	}
+	// The newest records are kept
+	for s.Len() > 1 {
+		s.Peek()
+		s.Ack()
+	}
+	if data, _, _ := s.Peek(); data[0] != byte(999%256) {
+		t.Errorf("Expected newest record to be kept, got %d", data[0])
+	}
+}
+
+func TestMemorySpoolAge(t *testing.T) {
+	s, _ := openSpool("", SPOOL_MAX_SIZE, time.Millisecond)
+	s.Append([]byte("old"))
+	time.Sleep(5 * time.Millisecond)
+	s.Append([]byte("new"))
+	if data, _, _ := s.Peek(); string(data) != "new" {
+		t.Errorf("Expected old record to be dropped, got %q", data)
+	}
+	if s.Stats().DroppedAge != 1 {
+		t.Errorf("Unexpected stats %s", s.Stats())
+	}
+}
+
+func TestSpoolReplayErrors(t *testing.T) {
+	s, _ := openSpool("", SPOOL_MAX_SIZE, time.Hour)
+	s.Append([]byte("one"))
+	s.Append([]byte("two"))
+	s.Append([]byte("three"))
+
+	// The server never saw the packet, it is kept however often it fails
+	var attempts int
+	for i := 0; i < 10*SPOOL_MAX_ATTEMPTS; i++ {
+		for _, err := range []error{
+			errors.New("dial tcp: connect: network is unreachable"),
+			errors.Wrap(io.ErrUnexpectedEOF, "Failed to read response to sendData"),
+			errors.Wrap(errors.New("i/o timeout"), "Failed to write to socket"),
+		} {
+			attempts = spoolReplayFailed(s, err, attempts)
+		}
+	}
+	if data, _, _ := s.Peek(); s.Len() != 3 || string(data) != "one" || attempts != 0 {
+		t.Fatalf("Connection errors dropped packets, %d left, %d attempts", s.Len(), attempts)
+	}
+
+	// Connection errors don't count towards the attempts of server failures
+	failure := errors.Wrap(errServerFailure, "Server responded with an error")
+	for i := 1; i < SPOOL_MAX_ATTEMPTS; i++ {
+		attempts = spoolReplayFailed(s, failure, attempts)
+		attempts = spoolReplayFailed(s, io.EOF, attempts)
+	}
+	if s.Len() != 3 || attempts != SPOOL_MAX_ATTEMPTS-1 {
+		t.Fatalf("%d left after %d attempts", s.Len(), attempts)
+	}
+	if attempts = spoolReplayFailed(s, failure, attempts); s.Len() != 2 || attempts != 0 {
+		t.Fatalf("%d left after %d attempts", s.Len(), attempts)
+	}
+
+	// Rejected packets are dropped at once
+	rejected := errors.Wrap(errPacketRejected, "Server responded with an error")
+	if attempts = spoolReplayFailed(s, rejected, 0); s.Len() != 1 || attempts != 0 {
+		t.Fatalf("%d left after rejection", s.Len())
+	}
+	if data, _, _ := s.Peek(); string(data) != "three" {
+		t.Fatalf("Expected the newest packet to be left, got %q", data)
+	}
+}
+
+func TestSentTime(t *testing.T) {
+	blp := genRandomPacket(1, 1)
+	if _, ok := blp.SentTime(); ok {
+		t.Fatal("Packet without sent time reported one")
+	}
+	now := time.Now()
+	blp.SetSentTime(now)
+	sent, ok := blp.SentTime()
+	if !ok || sent.Sub(now) > time.Microsecond || now.Sub(sent) > time.Microsecond {
+		t.Errorf("Sent time %s does not match %s", sent, now)
+	}
+}
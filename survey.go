@@ -0,0 +1,335 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// metricsserv builds cause problems with other binaries due to inclusion
+// of packages that require python3
+// +build metrics
+
+package beaconpi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+const (
+	// Longest window of beacon_log a survey point is recorded from
+	SURVEY_MAX_WINDOW = 10 * time.Minute
+)
+
+func init() {
+	missing := AlgorithmParameter{
+		Name:        "Missing",
+		Description: "Rssi in dB of an edge that did not hear the beacon",
+		Default:     FINGERPRINT_MISSING_RSSI, Min: -150, Max: -30,
+	}
+	registerAlgorithm("fingerprint-knn",
+		"Mean of the survey points of the map nearest to the rssi of the beacon",
+		fingerprintKNN,
+		AlgorithmParameter{
+			Name:        "K",
+			Description: "Survey points the location is the mean of",
+			Default:     3, Min: 1, Max: 50, Integer: true,
+		},
+		missing)
+	registerAlgorithm("fingerprint-probabilistic",
+		"Mean of the survey points of the map weighted by how likely the rssi "+
+			"of the beacon is at each",
+		fingerprintProbabilistic,
+		missing)
+}
+
+// dbGetFingerprints returns the survey points of a map ordered by id
+func dbGetFingerprints(mapid int, db *sql.DB) ([]fingerprint, error) {
+	rows, err := db.Query(`
+		select f.id, f.label, f.x, f.y, f.z, r.edgenodeid, r.rssi, r.stddev, r.samples
+		from fingerprints as f, fingerprint_rssi as r
+		where f.id = r.fingerprintid and f.mapid = $1
+		order by f.id`, mapid)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query fingerprints")
+	}
+	defer rows.Close()
+	fps := []fingerprint{}
+	for rows.Next() {
+		var fp fingerprint
+		var edge, samples int
+		var rssi, stddev float64
+		fp.Location = make([]float64, 3)
+		if err = rows.Scan(&fp.Id, &fp.Label, &fp.Location[0], &fp.Location[1],
+			&fp.Location[2], &edge, &rssi, &stddev, &samples); err != nil {
+			return nil, errors.Wrap(err, "Failed to scan fingerprint")
+		}
+		if len(fps) == 0 || fps[len(fps)-1].Id != fp.Id {
+			fp.Rssi = make(map[int]float64)
+			fp.Stddev = make(map[int]float64)
+			fp.Samples = make(map[int]int)
+			fps = append(fps, fp)
+		}
+		last := &fps[len(fps)-1]
+		last.Rssi[edge] = rssi
+		last.Stddev[edge] = stddev
+		last.Samples[edge] = samples
+	}
+	return fps, errors.Wrap(rows.Err(), "Failed to query fingerprints")
+}
+
+// addFingerprint records a survey point of a map from the rssi the edges
+// of the map heard from a beacon held there
+func addFingerprint() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Map    int
+			Label  string
+			X      float64
+			Y      float64
+			Z      float64
+			Beacon int
+			// Window of beacon_log the beacon was at the point
+			Since  time.Time
+			Before time.Time
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in AddFingerprint %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if window := input.Before.Sub(input.Since); input.Map == 0 || input.Beacon == 0 ||
+			window <= 0 || window > SURVEY_MAX_WINDOW {
+			log.Infof("Survey points need a Map, Beacon and a window up to %s",
+				SURVEY_MAX_WINDOW)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		mc, err := fetchMapConfig(db, input.Map)
+		if err != nil {
+			log.Infof("Failed to fetch map for given Id %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			log.Errorf("Failed to begin transaction %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer tx.Rollback()
+		var id int
+		if err = tx.QueryRow(`
+			insert into fingerprints
+			(mapid, label, x, y, z, beaconid, datetime_from, datetime_to) values
+			($1, $2, $3, $4, $5, $6, $7, $8) returning id`,
+			input.Map, input.Label, input.X, input.Y, input.Z, input.Beacon,
+			input.Since, input.Before).Scan(&id); err != nil {
+			log.Infof("Failed to insert fingerprint %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		res, err := tx.Exec(`
+			insert into fingerprint_rssi
+			(fingerprintid, edgenodeid, rssi, stddev, samples)
+			select $1, edgenodeid, avg(rssi), coalesce(stddev_samp(rssi), 0), count(*)
+			from beacon_log
+			where beaconid = $2 and datetime >= $3 and datetime < $4
+			and edgenodeid = any($5::int[])
+			group by edgenodeid`,
+			id, input.Beacon, input.Since, input.Before, pq.Array(mc.Edges))
+		if err != nil {
+			log.Errorf("Failed to summarise rssi of fingerprint %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		if edges, _ := res.RowsAffected(); edges == 0 {
+			log.Infof("No edge of map %d heard beacon %d", input.Map, input.Beacon)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if err = tx.Commit(); err != nil {
+			log.Errorf("Failed to commit fingerprint %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Success": true,
+			"Id":      id,
+		})
+	})
+}
+
+// getFingerprints lists the survey points of a map and their rssi
+func getFingerprints() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Map int
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in GetFingerprints %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		fps, err := dbGetFingerprints(input.Map, db)
+		if err != nil {
+			log.Errorf("Failed to get fingerprints %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Fingerprints": fps,
+		})
+	})
+}
+
+// remFingerprint removes survey points by id or every point of a map
+func remFingerprint() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Ids []int
+			Map int
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in RemFingerprint %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if len(input.Ids) == 0 && input.Map == 0 {
+			log.Infof("Removing fingerprints needs Ids or a Map")
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		res, err := db.Exec(`delete from fingerprints
+			where id = any($1::int[]) or mapid = $2`,
+			pq.Array(input.Ids), input.Map)
+		if err != nil {
+			log.Errorf("Failed to remove fingerprints %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		removed, _ := res.RowsAffected()
+		jsonResponse(w, map[string]interface{}{
+			"Success": true,
+			"Removed": removed,
+		})
+	})
+}
+
+// matchFunction locates the rssi of a beacon by edge id on the survey
+type matchFunction func(fps []fingerprint, observed map[int]float64) (locationEstimate, error)
+
+// matchFingerprints locates the beacons of mlr with match on the survey of
+// the map, beacons no edge heard are left out
+func matchFingerprints(db *sql.DB, mp *MapConfig, mlr *FilteredMapLocationRequest,
+	match matchFunction) (TrackingData, error) {
+	fps, err := dbGetFingerprints(mp.Id, db)
+	if err != nil {
+		return TrackingData{}, errors.Wrap(err, "Failed to fetch fingerprints")
+	}
+	if len(fps) == 0 {
+		return TrackingData{}, errors.Errorf("Map %d has no survey points", mp.Id)
+	}
+	rssi, err := fetchAverageRSSI(db, mlr.Beacons, mlr.Edges, mlr.RequestTime,
+		mp.DistanceMode)
+	if err != nil {
+		return TrackingData{}, errors.Wrap(err, "Failed to fetch RSSI")
+	}
+	observed := make(map[int]map[int]float64)
+	for _, v := range rssi {
+		if observed[v.Beacon] == nil {
+			observed[v.Beacon] = make(map[int]float64)
+		}
+		observed[v.Beacon][v.Edge] = v.Rssi
+	}
+	var series []TimeSeriesPoint
+	for _, b := range mlr.Beacons {
+		if len(observed[b]) == 0 {
+			continue
+		}
+		est, err := match(fps, observed[b])
+		if err != nil {
+			return TrackingData{}, errors.Wrapf(err, "Failed to locate beacon %d", b)
+		}
+		series = append(series, TimeSeriesPoint{
+			Beacon:      b,
+			Time:        mlr.RequestTime,
+			Location:    est.Location,
+			Covariance:  est.Covariance,
+			ErrorRadius: est.ErrorRadius,
+		})
+	}
+	return TrackingData{
+		Series:      series,
+		Beacons:     mlr.Beacons,
+		Edges:       mlr.Edges,
+		RequestTime: mlr.RequestTime,
+		MapConfig:   mp,
+	}, nil
+}
+
+// fingerprintKNN handles requests for indoor location by k nearest survey
+// points
+func fingerprintKNN(db *sql.DB, mp *MapConfig,
+	mlr *FilteredMapLocationRequest) (TrackingData, error) {
+	k, missing := int(mlr.Parameters["K"]), mlr.Parameters["Missing"]
+	return matchFingerprints(db, mp, mlr,
+		func(fps []fingerprint, observed map[int]float64) (locationEstimate, error) {
+			return matchKNN(fps, observed, k, missing)
+		})
+}
+
+// fingerprintProbabilistic handles requests for indoor location by the
+// likelihood of the survey points
+func fingerprintProbabilistic(db *sql.DB, mp *MapConfig,
+	mlr *FilteredMapLocationRequest) (TrackingData, error) {
+	missing := mlr.Parameters["Missing"]
+	return matchFingerprints(db, mp, mlr,
+		func(fps []fingerprint, observed map[int]float64) (locationEstimate, error) {
+			return matchProbabilistic(fps, observed, missing)
+		})
+}
@@ -29,6 +29,11 @@ import (
 	"net/http"
 )
 
+const (
+	// Tx power of beacons added without one, the default of ibeacons
+	BEACON_TXPOWER_DEFAULT = -70
+)
+
 // jsonResponse helper for sending simple JSON objects
 func jsonResponse(w http.ResponseWriter, results map[string]interface{}) {
 	encoder := json.NewEncoder(w)
@@ -153,7 +158,7 @@ func getBeacons() http.Handler {
 		defer db.Close()
 
 		rows, err := db.Query(`
-			select id, label, uuid, major, minor
+			select id, label, uuid, major, minor, beacontype, url, txpower
 			from ibeacons
 			order by label`)
 		if err != nil {
@@ -162,23 +167,30 @@ func getBeacons() http.Handler {
 			return
 		}
 		type ibeacon struct {
-			Id    int
-			Label string
-			Uuid  string
-			Major int
-			Minor int
+			Id         int
+			Label      string
+			Uuid       string
+			Major      int
+			Minor      int
+			BeaconType int
+			TypeName   string
+			Url        string
+			TxPower    int
 		}
 
 		var outdata []ibeacon
 
 		for rows.Next() {
 			var b ibeacon
+			var url sql.NullString
 			if err = rows.Scan(&b.Id, &b.Label, &b.Uuid, &b.Major,
-				&b.Minor); err != nil {
+				&b.Minor, &b.BeaconType, &url, &b.TxPower); err != nil {
 				log.Errorf("Failed to scan beacons in GetBeacons %s", err)
 				http.Error(w, "Server failure", 500)
 				return
 			}
+			b.TypeName = BeaconTypeName(uint8(b.BeaconType))
+			b.Url = url.String
 			outdata = append(outdata, b)
 		}
 		jsonResponse(w, map[string]interface{}{
@@ -201,7 +213,8 @@ func getEdges() http.Handler {
 		defer db.Close()
 
 		rows, err := db.Query(`
-			select id, uuid, title, room, location, description, bias, gamma
+			select id, uuid, title, room, location, description, bias, gamma,
+				pending_action, discovery
 			from edge_node
 			order by title`)
 		if err != nil {
@@ -218,20 +231,35 @@ func getEdges() http.Handler {
 			Description string
 			Bias        float64
 			Gamma       float64
+			// Name of the action sent on the next packet from the edge
+			PendingAction string
+			// Reporting beacons that are not registered
+			Discovery bool
+			// Positions of the edge on maps
+			Placements []EdgePlacement
 		}
 		var outdata []edge
+		placements, err := dbGetEdgePlacements(db)
+		if err != nil {
+			log.Errorf("Failed while quering placements %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
 
 		for rows.Next() {
 			var edge edge
 			var description sql.NullString
+			var action int
 			if err = rows.Scan(&edge.Id, &edge.Uuid, &edge.Title,
 				&edge.Room, &edge.Location, &description,
-				&edge.Bias, &edge.Gamma); err != nil {
+				&edge.Bias, &edge.Gamma, &action, &edge.Discovery); err != nil {
 				log.Errorf("Failed to scan edges in GetEdges %s", err)
 				http.Error(w, "Server failure", 500)
 				return
 			}
 			edge.Description = description.String
+			edge.PendingAction = actionNames[action]
+			edge.Placements = placements[edge.Id]
 			outdata = append(outdata, edge)
 		}
 		jsonResponse(w, map[string]interface{}{
@@ -267,7 +295,9 @@ func validateLen(pass error, field interface{}, fieldn string, minlen int) error
 	return errors.New(fmt.Sprintf("Field %s is unknown type, (value %v)", fieldn, field))
 }
 
-// modEdge allows the caller to modify edges through the administrative panel
+// modEdge allows the caller to modify edges through the administrative panel.
+// Placements replace those of the edge, if omitted Location must be an
+// "(x, y, z)" position on every map.
 func modEdge() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		input := struct {
@@ -280,6 +310,7 @@ func modEdge() http.Handler {
 			Bias        float64
 			Gamma       float64
 			Option      string
+			Placements  []EdgePlacement
 		}{}
 		dec := json.NewDecoder(req.Body)
 		err := dec.Decode(&input)
@@ -292,13 +323,25 @@ func modEdge() http.Handler {
 			err = validateLen(nil, input.Uuid, "Uuid", 16)
 			err = validateLen(err, input.Title, "Title", 1)
 			err = validateLen(err, input.Room, "Room", 1)
-			err = validateLen(err, input.Location, "Location", 1)
 			err = validateLen(err, input.Option, "Option", 3)
+			if err == nil && input.Placements == nil {
+				var p EdgePlacement
+				p, err = parseEdgeLocation(input.Location)
+				input.Placements = []EdgePlacement{p}
+			}
+			if err == nil {
+				err = validatePlacements(input.Placements)
+			}
 			if err != nil {
 				log.Infof("Failed validation %s", err)
 				http.Error(w, "Invalid Request", 400)
 				return
 			}
+			for _, p := range input.Placements {
+				if p.Map == 0 && input.Location == "" {
+					input.Location = p.String()
+				}
+			}
 		}
 
 		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
@@ -309,20 +352,28 @@ func modEdge() http.Handler {
 			return
 		}
 		defer db.Close()
+		tx, err := db.Begin()
+		if err != nil {
+			log.Errorf("Failed to begin transaction %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer tx.Rollback()
 		switch input.Option {
 		case "new":
-			_, err = db.Exec(`insert into edge_node (uuid, title, room, location,
-					description, bias, gamma) values ($1, $2, $3, $4, $5, $6, $7)`,
+			err = tx.QueryRow(`insert into edge_node (uuid, title, room, location,
+					description, bias, gamma) values ($1, $2, $3, $4, $5, $6, $7)
+					returning id`,
 				input.Uuid, input.Title, input.Room, input.Location,
-				input.Description, input.Bias, input.Gamma)
+				input.Description, input.Bias, input.Gamma).Scan(&input.Id)
 		case "mod":
-			_, err = db.Exec(`update edge_node set 
+			_, err = tx.Exec(`update edge_node set 
 					(uuid, title, room, location, description, bias, gamma) = 
 					($1, $2, $3, $4, $5, $6, $7) where id = $8`, input.Uuid, input.Title,
 				input.Room, input.Location, input.Description, input.Bias,
 				input.Gamma, input.Id)
 		case "rem":
-			_, err = db.Exec(`delete from edge_node
+			_, err = tx.Exec(`delete from edge_node
 					where id = $1`, input.Id)
 		default:
 			log.Infof("Option invalid given \"%s\"", input.Option)
@@ -330,18 +381,66 @@ func modEdge() http.Handler {
 			return
 			// Mod
 		}
+		if err == nil && input.Option != "rem" {
+			err = dbSetEdgePlacements(tx, input.Id, input.Placements)
+		}
 		if err != nil {
 			log.Infof("Failed operation on DB %s", err)
 			http.Error(w, "Invalid Request", 400)
 			return
 		}
+		if err = tx.Commit(); err != nil {
+			log.Errorf("Failed to commit edge %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
 		jsonResponse(w, map[string]interface{}{
 			"Success": true,
+			"Id":      input.Id,
 		})
 		return
 	})
 }
 
+// dbSetEdgePlacements replaces the placements of an edge, placements on
+// every map are stored with a null map_id
+func dbSetEdgePlacements(tx *sql.Tx, edge int, ps []EdgePlacement) error {
+	if _, err := tx.Exec(`delete from edge_placements where edgenodeid = $1`,
+		edge); err != nil {
+		return errors.Wrap(err, "Failed to remove placements")
+	}
+	for _, p := range ps {
+		mapid := sql.NullInt64{Int64: int64(p.Map), Valid: p.Map != 0}
+		if _, err := tx.Exec(`insert into edge_placements
+			(edgenodeid, map_id, x, y, z) values ($1, $2, $3, $4, $5)`,
+			edge, mapid, p.X, p.Y, p.Z); err != nil {
+			return errors.Wrapf(err, "Failed to place edge on map %d", p.Map)
+		}
+	}
+	return nil
+}
+
+// dbGetEdgePlacements returns the placements of every edge by id
+func dbGetEdgePlacements(db *sql.DB) (map[int][]EdgePlacement, error) {
+	rows, err := db.Query(`select edgenodeid, coalesce(map_id, 0), x, y, z
+		from edge_placements
+		order by edgenodeid, map_id nulls first`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query placements")
+	}
+	defer rows.Close()
+	res := make(map[int][]EdgePlacement)
+	for rows.Next() {
+		var id int
+		var p EdgePlacement
+		if err = rows.Scan(&id, &p.Map, &p.X, &p.Y, &p.Z); err != nil {
+			return nil, errors.Wrap(err, "Failed to scan placements")
+		}
+		res[id] = append(res[id], p)
+	}
+	return res, errors.Wrap(rows.Err(), "Failed to query placements")
+}
+
 // modBeacon allows users to modify beacons through the admin interface
 func modBeacon() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -352,6 +451,13 @@ func modBeacon() http.Handler {
 			Major  int
 			Minor  int
 			Option string
+			// One of the BEACON_* types, iBeacon if omitted
+			BeaconType int
+			// Required for Eddystone-URL, the Uuid is derived from it
+			Url string
+			// Rssi at 1m used when the beacon doesn't advertise it, left
+			// as is if omitted
+			TxPower *int
 		}{}
 		dec := json.NewDecoder(req.Body)
 		err := dec.Decode(&input)
@@ -370,12 +476,28 @@ func modBeacon() http.Handler {
 		if input.Option != "rem" {
 			err = validateLen(nil, input.Label, "Label", 1)
 			err = validateLen(err, input.Option, "Option", 3)
+			if err == nil && (input.BeaconType < 0 || input.BeaconType > BEACON_TYPE_MAX) {
+				err = errors.Errorf("BeaconType %d is unknown", input.BeaconType)
+			}
+			if err == nil && input.BeaconType == BEACON_EDDYSTONE_URL {
+				err = validateLen(err, input.Url, "Url", 1)
+				input.Uuid = EddystoneURLUuid(input.Url).String()
+				input.Major, input.Minor = 0, 0
+			}
 			if err != nil {
 				log.Infof("Failed validation %s", err)
 				http.Error(w, "Invalid Request", 400)
 				return
 			}
 		}
+		var url *string
+		if input.Url != "" {
+			url = &input.Url
+		}
+		if input.TxPower == nil && input.Option == "new" {
+			txpower := BEACON_TXPOWER_DEFAULT
+			input.TxPower = &txpower
+		}
 		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
 		db, err := dbconfig.openDB()
 		if err != nil {
@@ -387,14 +509,15 @@ func modBeacon() http.Handler {
 		switch input.Option {
 		case "new":
 			_, err = db.Exec(`insert into ibeacons
-				(label, uuid, major, minor) values
-				($1, $2, $3, $4)`, input.Label, input.Uuid,
-				input.Major, input.Minor)
+				(label, uuid, major, minor, beacontype, url, txpower) values
+				($1, $2, $3, $4, $5, $6, $7)`, input.Label, input.Uuid,
+				input.Major, input.Minor, input.BeaconType, url, input.TxPower)
 		case "mod":
 			_, err = db.Exec(`update ibeacons
-				set (label, uuid, major, minor) =
-				($1, $2, $3, $4) where id = $5`, input.Label, input.Uuid,
-				input.Major, input.Minor, input.Id)
+				set (label, uuid, major, minor, beacontype, url, txpower) =
+				($1, $2, $3, $4, $5, $6, coalesce($8, txpower)) where id = $7`,
+				input.Label, input.Uuid, input.Major, input.Minor,
+				input.BeaconType, url, input.Id, input.TxPower)
 		case "rem":
 			_, err = db.Exec(`delete from ibeacons
 				where id = $1`, input.Id)
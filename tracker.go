@@ -0,0 +1,567 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// metricsserv builds cause problems with other binaries due to inclusion
+// of packages that require python3
+// +build metrics
+
+package beaconpi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+const (
+	// How often the tracker checks for sessions that are due
+	TRACKER_TICK = 200 * time.Millisecond
+	// Shortest interval between locations of a session
+	TRACKER_MIN_INTERVAL = 200
+	// How often sessions are reloaded and filters are checkpointed
+	TRACKER_RELOAD     = 30 * time.Second
+	TRACKER_CHECKPOINT = 10 * time.Second
+	// Beacons are located this far in the past so late logs are included
+	TRACKER_LAG = time.Second
+	// The tracked algorithm ignores locations older than this
+	TRACKER_STALE = 10 * time.Second
+	// Most positions returned at once
+	TRACKER_POSITIONS_MAX = 10000
+	// Algorithm that reads the positions of the tracker
+	TRACKER_ALGORITHM = "tracked"
+)
+
+func init() {
+	registerAlgorithm(TRACKER_ALGORITHM,
+		"Latest location of each beacon from the tracking sessions of the map",
+		trackedLocations)
+}
+
+// trackingSession is a set of beacons located continuously on a map
+type trackingSession struct {
+	Id         int
+	Title      string
+	Map        int
+	Beacons    []int
+	Algorithm  string
+	Parameters map[string]float64
+	// Milliseconds between locations
+	Interval int
+	Enabled  bool
+}
+
+// runningSession is a session and the filters of its beacons
+type runningSession struct {
+	trackingSession
+	mc      *MapConfig
+	algo    *LocalizationAlgorithm
+	params  map[string]float64
+	filters map[int]*motionFilter
+	// Filter ID given by the algorithm, if it keeps filters of its own
+	filterid string
+	next     time.Time
+}
+
+// trackerPosition is a filtered location of a beacon
+type trackerPosition struct {
+	Session     int
+	Map         int
+	Beacon      int
+	Time        time.Time
+	X           float64
+	Y           float64
+	Z           float64
+	VX          float64
+	VY          float64
+	ErrorRadius float64
+}
+
+// dbGetTrackingSessions returns the sessions ordered by id
+func dbGetTrackingSessions(db *sql.DB) ([]trackingSession, error) {
+	rows, err := db.Query(`select id, title, mapid, beacons, algorithm,
+		parameters, interval_ms, enabled
+		from tracking_sessions order by id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query tracking sessions")
+	}
+	defer rows.Close()
+	sessions := []trackingSession{}
+	for rows.Next() {
+		var s trackingSession
+		var beacons pq.Int64Array
+		var params string
+		if err = rows.Scan(&s.Id, &s.Title, &s.Map, &beacons, &s.Algorithm,
+			&params, &s.Interval, &s.Enabled); err != nil {
+			return nil, errors.Wrap(err, "Failed to scan tracking session")
+		}
+		for _, b := range beacons {
+			s.Beacons = append(s.Beacons, int(b))
+		}
+		if err = json.Unmarshal([]byte(params), &s.Parameters); err != nil {
+			return nil, errors.Wrapf(err, "Parameters of session %d are invalid", s.Id)
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, errors.Wrap(rows.Err(), "Failed to query tracking sessions")
+}
+
+// validateSession returns the algorithm of s and its parameters, an error
+// is returned if s can't be tracked
+func validateSession(s *trackingSession) (*LocalizationAlgorithm, map[string]float64, error) {
+	if len(s.Beacons) == 0 {
+		return nil, nil, errors.New("Tracking needs Beacons")
+	}
+	if s.Interval < TRACKER_MIN_INTERVAL {
+		return nil, nil, errors.Errorf("Interval must be at least %dms", TRACKER_MIN_INTERVAL)
+	}
+	algo := localizationAlgorithm(s.Algorithm)
+	if algo == nil || algo.Name == TRACKER_ALGORITHM {
+		return nil, nil, errors.Errorf("Algorithm \"%s\" can't be tracked", s.Algorithm)
+	}
+	params, err := algo.resolveParameters(s.Parameters)
+	return algo, params, err
+}
+
+// dbGetTrackerFilters returns the checkpointed filters of a session by
+// beacon
+func dbGetTrackerFilters(session int, db *sql.DB) (map[int]*motionFilter, error) {
+	rows, err := db.Query(`select beaconid, state from tracker_filters
+		where sessionid = $1`, session)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to query tracker filters")
+	}
+	defer rows.Close()
+	filters := make(map[int]*motionFilter)
+	for rows.Next() {
+		var beacon int
+		var state string
+		if err = rows.Scan(&beacon, &state); err != nil {
+			return nil, errors.Wrap(err, "Failed to scan tracker filter")
+		}
+		f := new(motionFilter)
+		if err = json.Unmarshal([]byte(state), f); err != nil {
+			log.Warnf("Filter of beacon %d in session %d was reset: %s", beacon, session, err)
+			continue
+		}
+		filters[beacon] = f
+	}
+	return filters, errors.Wrap(rows.Err(), "Failed to query tracker filters")
+}
+
+// dbCheckpointFilters stores the filters of a session
+func dbCheckpointFilters(s *runningSession, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin transaction")
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`insert into tracker_filters
+		(sessionid, beaconid, state, updated) values ($1, $2, $3, $4)
+		on conflict (sessionid, beaconid) do update
+		set state = excluded.state, updated = excluded.updated`)
+	if err != nil {
+		return errors.Wrap(err, "Failed to prepare filter checkpoint")
+	}
+	defer stmt.Close()
+	for beacon, f := range s.filters {
+		state, err := json.Marshal(f)
+		if err != nil {
+			return errors.Wrap(err, "Failed to encode filter")
+		}
+		if _, err = stmt.Exec(s.Id, beacon, string(state), f.Time); err != nil {
+			return errors.Wrap(err, "Failed to checkpoint filter")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "Failed to commit filter checkpoint")
+}
+
+// dbInsertPositions stores positions in beacon_positions
+func dbInsertPositions(positions []trackerPosition, db *sql.DB) error {
+	if len(positions) == 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "Failed to begin transaction")
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(pq.CopyIn("beacon_positions", "sessionid", "mapid",
+		"beaconid", "datetime", "x", "y", "z", "vx", "vy", "error_radius"))
+	if err != nil {
+		return errors.Wrap(err, "Failed to prepare copy")
+	}
+	for _, p := range positions {
+		if _, err = stmt.Exec(p.Session, p.Map, p.Beacon, p.Time.UTC(), p.X, p.Y,
+			p.Z, p.VX, p.VY, p.ErrorRadius); err != nil {
+			stmt.Close()
+			return errors.Wrap(err, "Failed to copy position")
+		}
+	}
+	if _, err = stmt.Exec(); err != nil {
+		stmt.Close()
+		return errors.Wrap(err, "Failed to flush copy")
+	}
+	if err = stmt.Close(); err != nil {
+		return errors.Wrap(err, "Failed to close copy")
+	}
+	return errors.Wrap(tx.Commit(), "Failed to commit positions")
+}
+
+// step locates the beacons of s at t and advances their filters
+func (s *runningSession) step(db *sql.DB, t time.Time) ([]trackerPosition, error) {
+	mlr := FilteredMapLocationRequest{
+		FilterID:    s.filterid,
+		Beacons:     s.Beacons,
+		Edges:       s.mc.Edges,
+		MapID:       s.Map,
+		RequestTime: t,
+		Algorithm:   s.Algorithm,
+		Parameters:  s.params,
+	}
+	td, err := s.algo.run(db, s.mc, &mlr)
+	if err != nil {
+		return nil, err
+	}
+	s.filterid = td.FilterID
+	var positions []trackerPosition
+	for _, p := range td.Series {
+		f, ok := s.filters[p.Beacon]
+		if !ok {
+			f = new(motionFilter)
+			s.filters[p.Beacon] = f
+		}
+		if !f.Update(t, p.Location, p.Covariance) {
+			continue
+		}
+		if l := s.mc.Limits; len(l) == 4 {
+			f.State[0] = clamp(f.State[0], l[0], l[1])
+			f.State[1] = clamp(f.State[1], l[2], l[3])
+		}
+		var z float64
+		if len(p.Location) > 2 {
+			z = p.Location[2]
+		}
+		_, cov := f.Location()
+		positions = append(positions, trackerPosition{
+			Session:     s.Id,
+			Map:         s.Map,
+			Beacon:      p.Beacon,
+			Time:        t,
+			X:           f.State[0],
+			Y:           f.State[1],
+			Z:           z,
+			VX:          f.State[2],
+			VY:          f.State[3],
+			ErrorRadius: errorRadius(cov),
+		})
+	}
+	return positions, nil
+}
+
+// loadSessions returns the enabled sessions, those already running keep
+// their filters and the rest start from their checkpoints
+func loadSessions(db *sql.DB, running map[int]*runningSession) (map[int]*runningSession, error) {
+	sessions, err := dbGetTrackingSessions(db)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[int]*runningSession)
+	for _, ts := range sessions {
+		if !ts.Enabled {
+			continue
+		}
+		algo, params, err := validateSession(&ts)
+		if err != nil {
+			log.Warnf("Session %d is not tracked: %s", ts.Id, err)
+			continue
+		}
+		mc, err := fetchMapConfig(db, ts.Map)
+		if err != nil {
+			log.Warnf("Session %d is not tracked: %s", ts.Id, err)
+			continue
+		}
+		s, ok := running[ts.Id]
+		if !ok {
+			s = &runningSession{}
+			if s.filters, err = dbGetTrackerFilters(ts.Id, db); err != nil {
+				return nil, err
+			}
+		}
+		if s.Algorithm != ts.Algorithm || s.Map != ts.Map {
+			s.filterid = ""
+		}
+		s.trackingSession, s.algo, s.params, s.mc = ts, algo, params, mc
+		res[ts.Id] = s
+	}
+	return res, nil
+}
+
+// runTracker locates the beacons of every enabled session at its interval
+// and stores their positions
+func runTracker() {
+	dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+	db, err := dbconfig.openDB()
+	if err != nil {
+		log.Errorf("Tracker failed to open DB %s", err)
+		return
+	}
+	defer db.Close()
+
+	running := make(map[int]*runningSession)
+	checkpoint := func() {
+		for _, s := range running {
+			if err := dbCheckpointFilters(s, db); err != nil {
+				log.Errorf("Failed to checkpoint session %d: %s", s.Id, err)
+			}
+		}
+	}
+	var reload, nextCheckpoint time.Time
+	for now := range time.Tick(TRACKER_TICK) {
+		if now.After(reload) {
+			reload = now.Add(TRACKER_RELOAD)
+			if sessions, err := loadSessions(db, running); err != nil {
+				log.Errorf("Failed to load tracking sessions: %s", err)
+			} else {
+				// Sessions that stopped keep their last state
+				checkpoint()
+				running = sessions
+			}
+		}
+		for _, s := range running {
+			if now.Before(s.next) {
+				continue
+			}
+			s.next = now.Add(time.Duration(s.Interval) * time.Millisecond)
+			positions, err := s.step(db, now.Add(-TRACKER_LAG))
+			if err != nil {
+				log.Debugf("Session %d found no locations: %s", s.Id, err)
+				continue
+			}
+			if err = dbInsertPositions(positions, db); err != nil {
+				log.Errorf("Failed to store positions of session %d: %s", s.Id, err)
+			}
+		}
+		if now.After(nextCheckpoint) {
+			nextCheckpoint = now.Add(TRACKER_CHECKPOINT)
+			checkpoint()
+		}
+	}
+}
+
+// trackedLocations handles requests for the locations the tracker stored,
+// the latest of each beacon up to TRACKER_STALE before the request time
+func trackedLocations(db *sql.DB, mp *MapConfig,
+	mlr *FilteredMapLocationRequest) (TrackingData, error) {
+	rows, err := db.Query(`
+		select distinct on (beaconid) beaconid, datetime, x, y, z,
+			coalesce(error_radius, 0)
+		from beacon_positions
+		where mapid = $1 and beaconid = any($2::int[])
+		and datetime <= $3 and datetime > $3 - $4 * interval '1 second'
+		order by beaconid, datetime desc`,
+		mp.Id, pq.Array(mlr.Beacons), mlr.RequestTime, TRACKER_STALE.Seconds())
+	if err != nil {
+		return TrackingData{}, errors.Wrap(err, "Failed to query positions")
+	}
+	defer rows.Close()
+	var series []TimeSeriesPoint
+	for rows.Next() {
+		p := TimeSeriesPoint{Location: make([]float64, 3)}
+		if err = rows.Scan(&p.Beacon, &p.Time, &p.Location[0], &p.Location[1],
+			&p.Location[2], &p.ErrorRadius); err != nil {
+			return TrackingData{}, errors.Wrap(err, "Failed to scan position")
+		}
+		series = append(series, p)
+	}
+	if err = rows.Err(); err != nil {
+		return TrackingData{}, errors.Wrap(err, "Failed to query positions")
+	}
+	return TrackingData{
+		Series:      series,
+		Beacons:     mlr.Beacons,
+		Edges:       mlr.Edges,
+		RequestTime: mlr.RequestTime,
+		MapConfig:   mp,
+	}, nil
+}
+
+// getTrackingSessions lists the tracking sessions
+func getTrackingSessions() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		sessions, err := dbGetTrackingSessions(db)
+		if err != nil {
+			log.Errorf("Failed to get tracking sessions %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Sessions": sessions,
+		})
+	})
+}
+
+// modTrackingSession adds, changes or removes a tracking session, changes
+// are picked up by the tracker within TRACKER_RELOAD
+func modTrackingSession() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			trackingSession
+			Option string
+		}{}
+		input.Interval, input.Enabled = 1000, true
+		input.Algorithm = "weighted-least-squares"
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in ModTrackingSession %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		s := &input.trackingSession
+		params := "{}"
+		if input.Option != "rem" {
+			_, _, err := validateSession(s)
+			if err != nil {
+				log.Infof("Failed validation %s", err)
+				http.Error(w, "Invalid Request", 400)
+				return
+			}
+			// Only those given are kept so defaults can change
+			if len(s.Parameters) > 0 {
+				p, _ := json.Marshal(s.Parameters)
+				params = string(p)
+			}
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		switch input.Option {
+		case "new":
+			err = db.QueryRow(`insert into tracking_sessions
+				(title, mapid, beacons, algorithm, parameters, interval_ms, enabled)
+				values ($1, $2, $3, $4, $5, $6, $7) returning id`,
+				s.Title, s.Map, pq.Array(s.Beacons), s.Algorithm, params,
+				s.Interval, s.Enabled).Scan(&s.Id)
+		case "mod":
+			_, err = db.Exec(`update tracking_sessions
+				set (title, mapid, beacons, algorithm, parameters, interval_ms, enabled) =
+				($1, $2, $3, $4, $5, $6, $7) where id = $8`,
+				s.Title, s.Map, pq.Array(s.Beacons), s.Algorithm, params,
+				s.Interval, s.Enabled, s.Id)
+		case "rem":
+			_, err = db.Exec(`delete from tracking_sessions where id = $1`, s.Id)
+		default:
+			log.Infof("Option invalid given \"%s\"", input.Option)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if err != nil {
+			log.Infof("Failed operation on DB %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Success": true,
+			"Id":      s.Id,
+		})
+	})
+}
+
+// getPositions returns the positions the tracker stored ordered by beacon
+// and time
+func getPositions() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		input := struct {
+			Session int
+			Map     int
+			Beacons []int
+			Since   *time.Time
+			Before  *time.Time
+			Limit   int
+		}{}
+		dec := json.NewDecoder(req.Body)
+		if err := dec.Decode(&input); err != nil {
+			log.Infof("Failed to decode json request in GetPositions %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		if input.Limit <= 0 || input.Limit > TRACKER_POSITIONS_MAX {
+			input.Limit = TRACKER_POSITIONS_MAX
+		}
+
+		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
+		db, err := dbconfig.openDB()
+		if err != nil {
+			log.Errorf("Error opening DB %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer db.Close()
+		rows, err := db.Query(`
+			select sessionid, mapid, beaconid, datetime, x, y, z, vx, vy,
+				coalesce(error_radius, 0)
+			from beacon_positions
+			where ($1 = 0 or sessionid = $1) and ($2 = 0 or mapid = $2)
+			and (coalesce(cardinality($3::int[]), 0) = 0 or beaconid = any($3::int[]))
+			and ($4::timestamptz is null or datetime >= $4)
+			and ($5::timestamptz is null or datetime < $5)
+			order by beaconid, datetime
+			limit $6`, input.Session, input.Map, pq.Array(input.Beacons),
+			input.Since, input.Before, input.Limit)
+		if err != nil {
+			log.Errorf("Failed to query positions %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		defer rows.Close()
+		positions := []trackerPosition{}
+		for rows.Next() {
+			var p trackerPosition
+			if err = rows.Scan(&p.Session, &p.Map, &p.Beacon, &p.Time, &p.X, &p.Y,
+				&p.Z, &p.VX, &p.VY, &p.ErrorRadius); err != nil {
+				log.Errorf("Failed to scan position %s", err)
+				http.Error(w, "Server failure", 500)
+				return
+			}
+			positions = append(positions, p)
+		}
+		if err = rows.Err(); err != nil {
+			log.Errorf("Failed to query positions %s", err)
+			http.Error(w, "Server failure", 500)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"Positions": positions,
+		})
+	})
+}
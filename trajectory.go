@@ -0,0 +1,71 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"math"
+)
+
+// simplifyPath returns the indices of the points of path to keep so that
+// no point dropped is further than tolerance from the simplified path,
+// by Douglas-Peucker. The first and last points are always kept.
+func simplifyPath(path [][2]float64, tolerance float64) []int {
+	if len(path) < 3 {
+		keep := make([]int, len(path))
+		for i := range keep {
+			keep[i] = i
+		}
+		return keep
+	}
+	kept := make([]bool, len(path))
+	kept[0], kept[len(path)-1] = true, true
+	spans := [][2]int{{0, len(path) - 1}}
+	for len(spans) > 0 {
+		s := spans[len(spans)-1]
+		spans = spans[:len(spans)-1]
+		far, farthest := -1, tolerance
+		for i := s[0] + 1; i < s[1]; i++ {
+			if d := segmentDistance(path[i], path[s[0]], path[s[1]]); d > farthest {
+				far, farthest = i, d
+			}
+		}
+		if far < 0 {
+			continue
+		}
+		kept[far] = true
+		spans = append(spans, [2]int{s[0], far}, [2]int{far, s[1]})
+	}
+	var keep []int
+	for i, k := range kept {
+		if k {
+			keep = append(keep, i)
+		}
+	}
+	return keep
+}
+
+// segmentDistance returns the distance of p from the segment a to b
+func segmentDistance(p, a, b [2]float64) float64 {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	l := dx*dx + dy*dy
+	if l == 0 {
+		return math.Hypot(p[0]-a[0], p[1]-a[1])
+	}
+	t := ((p[0]-a[0])*dx + (p[1]-a[1])*dy) / l
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(p[0]-a[0]-t*dx, p[1]-a[1]-t*dy)
+}
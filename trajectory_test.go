@@ -0,0 +1,37 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSimplifyPath(t *testing.T) {
+	// Along a corridor with a little wobble then around a corner
+	path := [][2]float64{{0, 0}, {1, 0.1}, {2, -0.1}, {3, 0}, {4, 0.05},
+		{4, 1}, {4.1, 2}, {4, 3}}
+	if keep := simplifyPath(path, 0.5); !reflect.DeepEqual(keep, []int{0, 4, 7}) {
+		t.Fatalf("Kept %v", keep)
+	}
+	if keep := simplifyPath(path, 0); len(keep) != len(path) {
+		t.Fatalf("No tolerance kept %v", keep)
+	}
+	if keep := simplifyPath(path[:2], 10); !reflect.DeepEqual(keep, []int{0, 1}) {
+		t.Fatalf("Short path kept %v", keep)
+	}
+}
@@ -0,0 +1,220 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	// Exit codes for a supervisor, restart is EX_TEMPFAIL so a systemd unit
+	// with Restart=on-failure restarts it while shutdown is not restarted
+	EXIT_RESTART  = 75
+	EXIT_SHUTDOWN = 0
+
+	// The executable an update replaced is kept with this suffix
+	UPDATE_PREVIOUS_SUFFIX = ".prev"
+)
+
+// handleAction processes the restart, shutdown and update flags of a
+// response, the client exits once the response is handled
+func handleAction(client *clientinfo, conn *tls.Conn, brp *BeaconResponsePacket) error {
+	switch {
+	case brp.Flags&RESPONSE_SHUTDOWN != 0:
+		log.Info("Server requested shutdown")
+		client.exiting, client.exitCode = true, EXIT_SHUTDOWN
+		return sendControlLog(client, conn, "shutdown requested, exiting")
+	case brp.Flags&RESPONSE_RESTART != 0:
+		log.Info("Server requested restart")
+		client.exiting, client.exitCode = true, EXIT_RESTART
+		return sendControlLog(client, conn, "restart requested, exiting")
+	case brp.Flags&RESPONSE_UPDATE != 0:
+		log.Info("Server requested update")
+		version, err := updateClient(client, conn)
+		if err != nil {
+			log.Errorf("Update failed: %s", err)
+			return sendControlLog(client, conn, "update failed: "+err.Error())
+		}
+		log.Infof("Installed update %s, restarting", version)
+		client.exiting, client.exitCode = true, EXIT_RESTART
+		return sendControlLog(client, conn, "update "+version+" installed, restarting")
+	}
+	return nil
+}
+
+// sendControlLog records msg in the control log of the server
+func sendControlLog(client *clientinfo, conn *tls.Conn, msg string) error {
+	var datapacket BeaconLogPacket
+	datapacket.Flags = REQUEST_CONTROL_LOG
+	copy(datapacket.Uuid[:], client.uuid[:])
+	datapacket.ControlData = "client: " + msg
+	return sendData(client, conn, &datapacket)
+}
+
+// updateClient downloads the newest binary for this platform from the
+// server, verifies its signature and replaces the running executable
+func updateClient(client *clientinfo, conn *tls.Conn) (string, error) {
+	if client.version < 2 {
+		return "", errors.New("Updates require protocol version 2")
+	}
+	if client.updateKey == nil {
+		return "", errors.New("No update key configured, see -update-key")
+	}
+	var request BeaconLogPacket
+	request.Ext = EXT_REQUEST_UPDATE
+	setPacketVersion(client, &request)
+	copy(request.Uuid[:], client.uuid[:])
+	request.ControlData = runtime.GOOS + "/" + runtime.GOARCH
+	brp, err := exchangePacket(conn, &request)
+	if err != nil {
+		return "", err
+	}
+	if brp.Flags&RESPONSE_UPDATE == 0 {
+		return "", errors.Errorf("Server has no update for %s", request.ControlData)
+	}
+	version, binary, err := verifyUpdate(client.updateKey, request.ControlData, brp.Data)
+	if err != nil {
+		return "", err
+	}
+	if err = installUpdate(binary); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+// updateSignedMessage is what the signature of an update covers, the
+// version and platform are included so a build can't be installed on
+// another platform or as another version
+func updateSignedMessage(version, platform string, binary []byte) []byte {
+	msg := make([]byte, 0, len(version)+len(platform)+2+len(binary))
+	msg = append(msg, version+"\n"+platform+"\n"...)
+	return append(msg, binary...)
+}
+
+// verifyUpdate checks the signature of the data of a RESPONSE_UPDATE and
+// that it was built for platform, it returns the version and the binary
+func verifyUpdate(key ed25519.PublicKey, platform, data string) (string, []byte, error) {
+	parts := strings.SplitN(data, "\n", 3)
+	if len(parts) != 3 || len(parts[2]) < ed25519.SignatureSize {
+		return "", nil, errors.New("Update is malformed")
+	}
+	version := parts[0]
+	signature := []byte(parts[2][:ed25519.SignatureSize])
+	binary := []byte(parts[2][ed25519.SignatureSize:])
+	if !ed25519.Verify(key, updateSignedMessage(version, parts[1], binary), signature) {
+		return "", nil, errors.New("Update signature is invalid")
+	}
+	if parts[1] != platform {
+		return "", nil, errors.Errorf("Update is for %s not %s", parts[1], platform)
+	}
+	return version, binary, nil
+}
+
+// installUpdate atomically replaces the running executable with binary
+func installUpdate(binary []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "Failed to find executable")
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return errors.Wrap(err, "Failed to find executable")
+	}
+	return replaceExecutable(exe, binary)
+}
+
+// replaceExecutable atomically replaces exe with binary, the previous
+// executable is kept as exe.prev so a bad update can be rolled back
+func replaceExecutable(exe string, binary []byte) error {
+	// The temporary file must be on the same filesystem for the rename
+	tmp, err := ioutil.TempFile(filepath.Dir(exe), "."+filepath.Base(exe)+".update")
+	if err != nil {
+		return errors.Wrap(err, "Failed to create update file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(binary); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "Failed to write update")
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "Failed to sync update")
+	}
+	if err = tmp.Close(); err != nil {
+		return errors.Wrap(err, "Failed to write update")
+	}
+	if err = os.Chmod(tmp.Name(), 0755); err != nil {
+		return errors.Wrap(err, "Failed to make update executable")
+	}
+	prev := exe + UPDATE_PREVIOUS_SUFFIX
+	os.Remove(prev)
+	if err = os.Link(exe, prev); err != nil {
+		return errors.Wrap(err, "Failed to keep previous executable")
+	}
+	if err = os.Rename(tmp.Name(), exe); err != nil {
+		return errors.Wrap(err, "Failed to replace executable")
+	}
+	return nil
+}
+
+// loadUpdateKey reads a base64 ed25519 public key from path
+func loadUpdateKey(path string) (ed25519.PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, errors.Wrap(err, "Update key is not base64")
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Update key must be %d bytes", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// exitClient spools anything not yet sent and exits with the code the
+// server asked for
+func exitClient(client *clientinfo, conn *tls.Conn, pending <-chan *BeaconLogPacket) {
+	if conn != nil {
+		conn.Close()
+	}
+	for drained := false; !drained; {
+		select {
+		case datapacket := <-pending:
+			if err := spoolPacket(client, datapacket); err != nil {
+				log.Errorf("Failed to spool packet, dropping it: %s", err)
+			}
+		default:
+			drained = true
+		}
+	}
+	if err := client.spool.Close(); err != nil {
+		log.Errorf("Failed to close spool: %s", err)
+	}
+	log.Infof("Exiting with code %d", client.exitCode)
+	os.Exit(client.exitCode)
+}
@@ -0,0 +1,101 @@
+// Beacon Pi, a edge node system for iBeacons and Edge nodes made of Pi
+// Copyright (C) 2017  Maeve Kennedy
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package beaconpi
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyUpdate(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := []byte("\x7fELF not really a binary")
+	sign := func(version, platform string) string {
+		sig := ed25519.Sign(priv, updateSignedMessage(version, platform, binary))
+		return version + "\n" + platform + "\n" + string(sig) + string(binary)
+	}
+	data := sign("1.2.0", "linux/arm")
+
+	version, got, err := verifyUpdate(pub, "linux/arm", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "1.2.0" || string(got) != string(binary) {
+		t.Fatalf("Got version %q and binary %q", version, got)
+	}
+
+	tampered := data[:len(data)-1] + "!"
+	if _, _, err = verifyUpdate(pub, "linux/arm", tampered); err == nil {
+		t.Fatal("Tampered update was accepted")
+	}
+	if _, _, err = verifyUpdate(pub, "linux/arm", "1.2.0\nlinux/arm\nshort"); err == nil {
+		t.Fatal("Malformed update was accepted")
+	}
+	if _, _, err = verifyUpdate(pub, "linux/arm64", data); err == nil {
+		t.Fatal("Update for another platform was accepted")
+	}
+	// Labels are signed so they can't be changed by the server
+	relabelled := strings.Replace(data, "linux/arm", "linux/arm64", 1)
+	if _, _, err = verifyUpdate(pub, "linux/arm64", relabelled); err == nil {
+		t.Fatal("Relabelled platform was accepted")
+	}
+	relabelled = strings.Replace(data, "1.2.0", "1.3.0", 1)
+	if _, _, err = verifyUpdate(pub, "linux/arm", relabelled); err == nil {
+		t.Fatal("Relabelled version was accepted")
+	}
+	// Signatures of the binary alone are no longer accepted
+	old := "1.2.0\nlinux/arm\n" + string(ed25519.Sign(priv, binary)) + string(binary)
+	if _, _, err = verifyUpdate(pub, "linux/arm", old); err == nil {
+		t.Fatal("Unlabelled signature was accepted")
+	}
+}
+
+func TestReplaceExecutable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "beaconpi-update-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exe := filepath.Join(dir, "beaconclient")
+	if err = ioutil.WriteFile(exe, []byte("old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"new", "newer"} {
+		if err = replaceExecutable(exe, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := ioutil.ReadFile(exe)
+	if err != nil || string(got) != "newer" {
+		t.Fatalf("Executable is %q: %v", got, err)
+	}
+	prev, err := ioutil.ReadFile(exe + UPDATE_PREVIOUS_SUFFIX)
+	if err != nil || string(prev) != "new" {
+		t.Fatalf("Previous executable is %q: %v", prev, err)
+	}
+	if fi, err := os.Stat(exe); err != nil || fi.Mode()&0100 == 0 {
+		t.Fatalf("Executable is not executable: %v", err)
+	}
+}
@@ -37,6 +37,12 @@ import (
 
 const (
 	TIMEOUT_CHECK_FREQUENCY = 30 * time.Second
+
+	// Reference rssi at 1m used by the path loss model for distances, see
+	// average_stamp_and_prev
+	DISTANCE_BIAS    = "bias"
+	DISTANCE_TXPOWER = "txpower"
+	DISTANCE_BOTH    = "both"
 )
 
 // MapConfig is a structure describing how to display the map and limits
@@ -55,6 +61,10 @@ type MapConfig struct {
 	// x1, x2, y1, y2
 	Limits []float64
 	Edges  []int
+	// One of DISTANCE_*, the deployment default if empty
+	DistanceMode string
+	// Areas presence is reported for instead of the rooms of their edges
+	Zones []Zone
 }
 
 // TrackingData is a response struct that contains all details about
@@ -75,6 +85,10 @@ type TimeSeriesPoint struct {
 	Time   time.Time
 	// 2d location
 	Location []float64
+	// Covariance of the location as xx, xy, yx, yy and the radius of its
+	// 95% confidence circle, if the algorithm estimates them
+	Covariance  []float64 `json:",omitempty"`
+	ErrorRadius float64   `json:",omitempty"`
 }
 
 // FilteredMapLocationRequest is a request object from the web
@@ -86,6 +100,9 @@ type FilteredMapLocationRequest struct {
 	MapID       int
 	RequestTime time.Time
 	Algorithm   string
+	// Tunables of the algorithm by name, defaults are filled in for those
+	// not given
+	Parameters map[string]float64
 }
 
 // filterIdSet wraps a filter ID and a timer for cleanup
@@ -139,11 +156,12 @@ func fetchImage(mp MetricsParameters) http.Handler {
 		}
 
 		var image int
+		var imagetype string
 
 		err = db.QueryRow(`
-			select image 
+			select image, image_type
 			from webmap_configs
-      where id = $1`, request.ImageID).Scan(&image)
+      where id = $1`, request.ImageID).Scan(&image, &imagetype)
 		if err != nil {
 			log.Infof("Failed while quering configs %s", err)
 			http.Error(w, "Server failure", 500)
@@ -155,8 +173,12 @@ func fetchImage(mp MetricsParameters) http.Handler {
 			http.Error(w, "Server failure", 500)
 			return
 		}
-		//TODO(mae) more mimetypes?
-		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Type", imagetype)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if imagetype == MAP_IMAGE_SVG {
+			// Uploaded SVGs can carry scripts, they must not run as this origin
+			w.Header().Set("Content-Security-Policy", "sandbox")
+		}
 		buf := bytes.NewBuffer(data)
 		if _, err = io.Copy(w, buf); err != nil {
 			log.Infof("Failed to copy buffer %s", err)
@@ -211,7 +233,7 @@ func allMaps(mp MetricsParameters) http.Handler {
 				http.Error(w, "Server failure", 500)
 				return
 			}
-			res.Id, res.Title = id, title
+			res.Id, res.Title, res.Image = id, title, mapid
 			configs = append(configs, res)
 		}
 		jsonResponse(w, map[string]interface{}{
@@ -236,6 +258,19 @@ func filteredMapLocation(mp MetricsParameters) http.Handler {
 			return
 		}
 
+		algo := localizationAlgorithm(request.Algorithm)
+		if algo == nil {
+			log.Infof("Unknown algorithm \"%s\"", request.Algorithm)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+		var err error
+		if request.Parameters, err = algo.resolveParameters(request.Parameters); err != nil {
+			log.Infof("Invalid algorithm parameters %s", err)
+			http.Error(w, "Invalid Request", 400)
+			return
+		}
+
 		dbconfig := dbHandler{mp.DriverName, mp.DataSourceName}
 		db, err := dbconfig.openDB()
 		if err != nil {
@@ -251,12 +286,7 @@ func filteredMapLocation(mp MetricsParameters) http.Handler {
 			http.Error(w, "Invalid Request", 400)
 			return
 		}
-		var algo filterFunction
-		switch request.Algorithm {
-		case "particle-filter-velocity":
-			algo = particleFilterVelocity
-		}
-		td, err := algo(db, mc, &request)
+		td, err := algo.run(db, mc, &request)
 		if err != nil {
 			log.Infof("Error applying filter", err)
 			http.Error(w, "Server failure", 500)
@@ -271,6 +301,39 @@ func filteredMapLocation(mp MetricsParameters) http.Handler {
 	})
 }
 
+func init() {
+	registerAlgorithm("particle-filter-velocity",
+		"Trilateration smoothed by a particle filter per beacon clamped to the map limits",
+		particleFilterVelocity,
+		AlgorithmParameter{
+			Name:        "Particles",
+			Description: "Particles in the filter of each beacon",
+			Default:     200, Min: 10, Max: 5000, Integer: true,
+		},
+		AlgorithmParameter{
+			Name:        "Timeout",
+			Description: "Seconds a filter is kept between requests",
+			Default:     30, Min: 1, Max: 3600,
+		})
+	registerAlgorithm("weighted-least-squares",
+		"Least squares fit of the distances weighted by the spread of their rssi, "+
+			"works with any number of edges and reports the error of each location",
+		weightedLeastSquares,
+		AlgorithmParameter{
+			Name:        "Height",
+			Description: "Height the beacons are assumed to be carried at in the coordinates of the edges",
+			Default:     1, Min: -1000, Max: 1000,
+		},
+		AlgorithmParameter{
+			Name:        "Shadowing",
+			Description: "Standard deviation in dB of the rssi that averaging does not remove",
+			Default:     4, Min: 0.1, Max: 30,
+		})
+	registerAlgorithm("trilateration",
+		"Trilateration of the average rssi at the request time without filtering",
+		plainTrilateration)
+}
+
 // clearTimeouts clears filters that have hit their timeouts
 func (fm *filterManager) clearTimeouts() {
 	now := time.Now()
@@ -301,6 +364,7 @@ func particleFilterVelocity(db *sql.DB, mp *MapConfig,
 	defer clampedPFs.Unlock()
 
 	rng := getRand()
+	timeout := time.Duration(mlr.Parameters["Timeout"] * float64(time.Second))
 
 	// Initalize filters
 	for {
@@ -315,31 +379,32 @@ func particleFilterVelocity(db *sql.DB, mp *MapConfig,
 			continue
 		}
 		// Create a new set
-		clampedPFs.filters[mlr.FilterID] = &filterIdSet{timeout: time.Now().Add(time.Second * 30)}
+		clampedPFs.filters[mlr.FilterID] = &filterIdSet{timeout: time.Now().Add(timeout)}
 		clampedPFs.filters[mlr.FilterID].pfs = make(map[int]*indoorfilters.PF)
 		for _, v := range mlr.Beacons {
 			clampedPFs.filters[mlr.FilterID].pfs[v] = indoorfilters.NewClampedFilter(
 				mp.Limits[0], mp.Limits[1], mp.Limits[2], mp.Limits[3],
-				200, 0.5, 0.01, 5.0)
+				int(mlr.Parameters["Particles"]), 0.5, 0.01, 5.0)
 		}
 	}
 
 	curfilter := clampedPFs.filters[mlr.FilterID]
 	// Advance timeout
-	curfilter.timeout = time.Now().Add(time.Second * 30)
+	curfilter.timeout = time.Now().Add(timeout)
 
 	// Fetch required locations and edge
-	edgeloc, err := fetchEdgeLocations(db, mlr.Edges)
+	edgeloc, err := fetchEdgeLocations(db, mp.Id, mlr.Edges)
 	if err != nil {
 		return TrackingData{}, errors.Wrap(err, "Failed to fetch edges")
 	}
 	log.Infof("mlr.RequestTime %s", mlr.RequestTime)
-	rssi, err := fetchAverageRSSI(db, mlr.Beacons, mlr.Edges, mlr.RequestTime)
+	rssi, err := fetchAverageRSSI(db, mlr.Beacons, mlr.Edges, mlr.RequestTime,
+		mp.DistanceMode)
 	if err != nil {
 		return TrackingData{}, errors.Wrap(err, "Failed to fetch RSSI")
 	}
 
-	series, err := trilatMultiBeacons(rssi, edgeloc, mlr.Beacons, mlr.Edges, mlr.RequestTime)
+	series, err := trilatMultiBeacons(rssi, edgeloc, mlr.Beacons, mlr.RequestTime)
 	if err != nil {
 		return TrackingData{}, errors.Wrap(err, "Failed in trilat")
 	}
@@ -357,6 +422,79 @@ func particleFilterVelocity(db *sql.DB, mp *MapConfig,
 	return res, nil
 }
 
+// plainTrilateration handles requests for unfiltered indoor location
+func plainTrilateration(db *sql.DB, mp *MapConfig,
+	mlr *FilteredMapLocationRequest) (TrackingData, error) {
+	edgeloc, err := fetchEdgeLocations(db, mp.Id, mlr.Edges)
+	if err != nil {
+		return TrackingData{}, errors.Wrap(err, "Failed to fetch edges")
+	}
+	rssi, err := fetchAverageRSSI(db, mlr.Beacons, mlr.Edges, mlr.RequestTime,
+		mp.DistanceMode)
+	if err != nil {
+		return TrackingData{}, errors.Wrap(err, "Failed to fetch RSSI")
+	}
+	series, err := trilatMultiBeacons(rssi, edgeloc, mlr.Beacons, mlr.RequestTime)
+	if err != nil {
+		return TrackingData{}, errors.Wrap(err, "Failed in trilat")
+	}
+	return TrackingData{
+		Series:      series,
+		Beacons:     mlr.Beacons,
+		Edges:       mlr.Edges,
+		RequestTime: mlr.RequestTime,
+		MapConfig:   mp,
+	}, nil
+}
+
+// weightedLeastSquares handles requests for indoor location by weighted
+// least squares, beacons no edge heard are left out
+func weightedLeastSquares(db *sql.DB, mp *MapConfig,
+	mlr *FilteredMapLocationRequest) (TrackingData, error) {
+	edgeloc, err := fetchEdgeLocations(db, mp.Id, mlr.Edges)
+	if err != nil {
+		return TrackingData{}, errors.Wrap(err, "Failed to fetch edges")
+	}
+	rssi, err := fetchAverageRSSI(db, mlr.Beacons, mlr.Edges, mlr.RequestTime,
+		mp.DistanceMode)
+	if err != nil {
+		return TrackingData{}, errors.Wrap(err, "Failed to fetch RSSI")
+	}
+	ranges := make(map[int][]rangeMeasurement)
+	for _, v := range rssi {
+		ranges[v.Beacon] = append(ranges[v.Beacon], rangeMeasurement{
+			Loc:  edgeloc[v.Edge],
+			Dist: v.Dist,
+			Sigma: rangeSigma(v.Dist, v.Gamma, v.Variance, v.Samples,
+				mlr.Parameters["Shadowing"]),
+		})
+	}
+	var series []TimeSeriesPoint
+	for _, b := range mlr.Beacons {
+		if len(ranges[b]) == 0 {
+			continue
+		}
+		sol, err := solveWLS(ranges[b], mlr.Parameters["Height"], mp.Limits)
+		if err != nil {
+			return TrackingData{}, errors.Wrapf(err, "Failed to locate beacon %d", b)
+		}
+		series = append(series, TimeSeriesPoint{
+			Beacon:      b,
+			Time:        mlr.RequestTime,
+			Location:    sol.Location,
+			Covariance:  sol.Covariance,
+			ErrorRadius: sol.ErrorRadius,
+		})
+	}
+	return TrackingData{
+		Series:      series,
+		Beacons:     mlr.Beacons,
+		Edges:       mlr.Edges,
+		RequestTime: mlr.RequestTime,
+		MapConfig:   mp,
+	}, nil
+}
+
 func filterClampPFsApply(series []TimeSeriesPoint, filters *filterIdSet) ([]TimeSeriesPoint, error) {
 	for i, _ := range series {
 		b := series[i].Beacon
@@ -382,19 +520,19 @@ type rssiTuples struct {
 	Rssi float64
 	// Dist in metres
 	Dist float64
+	// Variance of the rssi samples behind the average and the path loss
+	// exponent of the edge
+	Variance float64
+	Samples  int
+	Gamma    float64
 }
 
 // trilatMultiBeacon does trilateration on multiple beacons given our
 // rssi tuples
-// edges matches loc for id of edge
+// loc is the location of each edge by id
 // rssi must be ordered by beacon, edge (as per the results of fetchAverageRSSI
-func trilatMultiBeacons(rssi []rssiTuples, loc [][]float64, beacons []int,
-	edges []int, time time.Time) (series []TimeSeriesPoint, err error) {
-	edgeToIdx := make(map[int]int)
-	for i, v := range edges {
-		edgeToIdx[v] = i
-	}
-
+func trilatMultiBeacons(rssi []rssiTuples, loc map[int][]float64, beacons []int,
+	time time.Time) (series []TimeSeriesPoint, err error) {
 	bi := 0
 	b := beacons[bi]
 
@@ -428,8 +566,7 @@ func trilatMultiBeacons(rssi []rssiTuples, loc [][]float64, beacons []int,
 		e := v.Edge
 		tdist = append(tdist, v.Dist)
 		var p3 trilateration.Point3
-		// TODO(mae)  is this element 0 and 1
-		copy(p3[0:3], loc[edgeToIdx[e]][0:3])
+		copy(p3[0:3], loc[e][0:3])
 		tloc = append(tloc, p3)
 	}
 
@@ -448,21 +585,33 @@ func trilatMultiBeacons(rssi []rssiTuples, loc [][]float64, beacons []int,
 	return
 }
 
-// fetchAverageRSSI Returns the average RSSI ordered by Beacon, Edge
+// validateDistanceMode returns an error if mode is not one of DISTANCE_*
+func validateDistanceMode(mode string) error {
+	switch mode {
+	case DISTANCE_BIAS, DISTANCE_TXPOWER, DISTANCE_BOTH:
+		return nil
+	}
+	return errors.Errorf("Distance mode \"%s\" is unknown", mode)
+}
+
+// fetchAverageRSSI Returns the average RSSI ordered by Beacon, Edge, the
+// distances are calculated with mode, one of DISTANCE_*
 func fetchAverageRSSI(db *sql.DB, beacons []int, edges []int,
-	ts time.Time) ([]rssiTuples, error) {
-	rows, err := db.Query(`select beacon, edge, rssi, distance
-        from average_stamp_and_prev($1) 
+	ts time.Time, mode string) ([]rssiTuples, error) {
+	rows, err := db.Query(`select beacon, edge, rssi, distance, variance,
+        samples, gamma
+        from average_stamp_and_prev($1, mode => $4) 
         where beacon = any ($2::int[])
         and edge = any ($3::int[])
-    `, ts, pq.Array(beacons), pq.Array(edges))
+    `, ts, pq.Array(beacons), pq.Array(edges), mode)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch RSSI with query")
 	}
 	var result []rssiTuples
 	for rows.Next() {
 		var t rssiTuples
-		if err = rows.Scan(&t.Beacon, &t.Edge, &t.Rssi, &t.Dist); err != nil {
+		if err = rows.Scan(&t.Beacon, &t.Edge, &t.Rssi, &t.Dist, &t.Variance,
+			&t.Samples, &t.Gamma); err != nil {
 			return nil, errors.Wrap(err, "Failed to fetch RSSI when scanning")
 		}
 		result = append(result, t)
@@ -470,32 +619,39 @@ func fetchAverageRSSI(db *sql.DB, beacons []int, edges []int,
 	return result, nil
 }
 
-// fetchEdgeLocations gets the locations of the edges in 3 space and returns
-// them in order by id
-func fetchEdgeLocations(db *sql.DB, edges []int) (loc [][]float64, err error) {
-	rows, err := db.Query(`select x, y, z
-        from edge_locations
-        where id = any ($1::int[])
-        order by id
-    `, pq.Array(edges))
-
+// fetchEdgeLocations gets the locations of the edges in 3 space on a map by
+// edge id, an error is returned if an edge is not placed
+func fetchEdgeLocations(db *sql.DB, mapid int, edges []int) (map[int][]float64, error) {
+	rows, err := db.Query(`select id, x, y, z
+        from edge_positions($1)
+        where id = any ($2::int[])
+    `, mapid, pq.Array(edges))
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch Edges with query")
 	}
+	defer rows.Close()
+	loc := make(map[int][]float64)
 	for rows.Next() {
+		var id int
 		t := make([]float64, 3)
-		if err = rows.Scan(&t[0], &t[1], &t[2]); err != nil {
+		if err = rows.Scan(&id, &t[0], &t[1], &t[2]); err != nil {
 			return nil, errors.Wrap(err, "Failed to fetch Edges when scanning")
 		}
-		loc = append(loc, t)
+		loc[id] = t
 	}
-	if len(loc) != len(edges) {
-		return nil, errors.New("Failed to get enough edges given input")
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch Edges with query")
 	}
-	return
+	for _, e := range edges {
+		if _, ok := loc[e]; !ok {
+			return nil, errors.Errorf("Edge %d is not placed on map %d", e, mapid)
+		}
+	}
+	return loc, nil
 }
 
-// fetchMapConfig gets the MapConfig data from the DB and decodes the JSON
+// fetchMapConfig gets the MapConfig data from the DB and decodes the JSON,
+// maps without a distance mode use the one of the deployment
 func fetchMapConfig(db *sql.DB, id int) (*MapConfig, error) {
 	var (
 		title  string
@@ -514,5 +670,11 @@ func fetchMapConfig(db *sql.DB, id int) (*MapConfig, error) {
 		return nil, err
 	}
 	res.Id, res.Title, res.Image = id, title, image
+	if res.DistanceMode == "" {
+		res.DistanceMode = mp.DistanceMode
+	}
+	if err := validateDistanceMode(res.DistanceMode); err != nil {
+		return nil, errors.Wrapf(err, "Map %d is invalid", id)
+	}
 	return &res, nil
 }